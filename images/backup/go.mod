@@ -0,0 +1,25 @@
+module github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup
+
+go 1.14
+
+require (
+	cloud.google.com/go/storage v1.10.0
+	github.com/Azure/azure-storage-blob-go v0.10.0
+	github.com/aws/aws-sdk-go v1.29.14
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/gogo/protobuf v1.3.1 // indirect
+	github.com/google/gofuzz v1.1.0 // indirect
+	github.com/googleapis/gnostic v0.4.0 // indirect
+	github.com/imdario/mergo v0.3.8 // indirect
+	github.com/prometheus/client_golang v1.7.1
+	github.com/sirupsen/logrus v1.4.2
+	github.com/stretchr/testify v1.4.0
+	golang.org/x/crypto v0.0.0-20200320181102-891825fb96df // indirect
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
+	google.golang.org/api v0.28.0
+	k8s.io/api v0.17.4
+	k8s.io/apimachinery v0.17.4
+	k8s.io/client-go v0.17.0
+	k8s.io/utils v0.0.0-20200322164244-327a8059b905 // indirect
+)
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/catalog"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/client"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/commitlog"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/coordinator"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/incremental"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/manifest"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/metrics"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/purge"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/restore"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/retention"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+func main() {
+	command := "backup"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	namespace := os.Getenv("NAMESPACE")
+	instance := os.Getenv("INSTANCE_NAME")
+	if (command == "backup" || command == "purge" || command == "restore-plan" || command == "restore-stream") && (namespace == "" || instance == "") {
+		log.Fatalf("NAMESPACE and INSTANCE_NAME are required")
+	}
+
+	switch command {
+	case "backup":
+		runBackup(namespace, instance)
+	case "purge":
+		runPurge(namespace, instance)
+	case "list", "describe", "verify":
+		runCatalog(command, namespace, instance)
+	case "restore-plan":
+		runRestorePlan(namespace, instance)
+	case "restore-stream":
+		runRestoreStream(namespace, instance)
+	case "commitlog-archive":
+		runCommitlogArchive()
+	case "commitlog-restore":
+		runCommitlogRestore()
+	case "incremental-ship":
+		runIncrementalShip()
+	default:
+		log.Fatalf("unknown command '%s', expected 'backup', 'purge', 'list', 'describe', 'verify', 'restore-plan', 'restore-stream', 'commitlog-archive', 'commitlog-restore' or 'incremental-ship'", command)
+	}
+}
+
+func runBackup(namespace, instance string) {
+	log.Printf("bootstrapping cassandra backup...")
+
+	name := os.Getenv("BACKUP_NAME")
+	if name == "" {
+		log.Fatalf("BACKUP_NAME is required")
+	}
+
+	options := coordinator.Options{Parallelism: intEnv("PARALLELISM")}
+
+	clientSet, err := client.GetKubeClient()
+	if err != nil {
+		log.Fatalf("failed to get kube client: %v", err)
+	}
+	config, err := client.GetKubeConfig()
+	if err != nil {
+		log.Fatalf("failed to get kube config: %v", err)
+	}
+
+	store := manifest.NewStore(clientSet, namespace, instance)
+	selector := fmt.Sprintf("app = %s, cassandra", instance)
+	c := coordinator.NewCoordinator(clientSet, medusa.NewPodExecutor(config, clientSet), namespace, instance, selector, store, options)
+	if _, err := c.Run(name); err != nil {
+		log.Fatalf("Backup %s of instance %s/%s failed: %v", name, namespace, instance, err)
+	}
+}
+
+func runPurge(namespace, instance string) {
+	log.Printf("bootstrapping cassandra backup purge...")
+
+	policy := retention.Policy{
+		KeepLast:   intEnv("KEEP_LAST"),
+		KeepDaily:  intEnv("KEEP_DAILY"),
+		KeepWeekly: intEnv("KEEP_WEEKLY"),
+	}
+	if err := policy.Validate(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if !policy.Enabled() {
+		log.Infof("No retention policy is configured, all backups are kept")
+		return
+	}
+	storageConfig, index := openIndex()
+
+	clientSet, err := client.GetKubeClient()
+	if err != nil {
+		log.Fatalf("failed to get kube client: %v", err)
+	}
+	config, err := client.GetKubeConfig()
+	if err != nil {
+		log.Fatalf("failed to get kube config: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("failed to get dynamic kube client: %v", err)
+	}
+
+	protection := purge.NewRestoreProtection(clientSet, dynamicClient, purge.Location{
+		Provider:   storageConfig.Provider,
+		Bucket:     storageConfig.Bucket,
+		Prefix:     os.Getenv("PREFIX"),
+		Namespace:  namespace,
+		LocalClaim: os.Getenv("LOCAL_CLAIM"),
+	})
+	store := manifest.NewStore(clientSet, namespace, instance)
+	commitlogs := commitlog.NewStore(index.Storage(), os.Getenv("PREFIX"))
+	incrementals := incremental.NewStore(index.Storage(), os.Getenv("PREFIX"))
+	p := purge.NewPurger(index, store, protection, purge.Options{Policy: policy, Commitlogs: commitlogs, Incremental: incrementals})
+	report, err := p.Run()
+	if report != nil {
+		log.Infof("%s", report)
+	}
+	if err != nil {
+		log.Fatalf("Purge of the backups of instance %s/%s failed: %v", namespace, instance, err)
+	}
+}
+
+// runCatalog lists, describes or verifies backups. It runs in a job as well as locally, the manifests of the backup
+// coordinator are only used if NAMESPACE and INSTANCE_NAME are set and the cluster is reachable.
+func runCatalog(command, namespace, instance string) {
+	name := os.Getenv("BACKUP_NAME")
+	if len(os.Args) > 2 {
+		name = os.Args[2]
+	}
+	if command != "list" && name == "" {
+		log.Fatalf("the name of the backup is required, as argument or in BACKUP_NAME")
+	}
+
+	_, index := openIndex()
+	var store *manifest.Store
+	if namespace != "" && instance != "" {
+		clientSet, err := client.GetKubeClient()
+		if err != nil {
+			log.Warnf("Backup manifests are not available: %v", err)
+		} else {
+			store = manifest.NewStore(clientSet, namespace, instance)
+		}
+	}
+	c := catalog.NewCatalog(index, store)
+
+	switch command {
+	case "list":
+		backups, err := c.List()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := catalog.PrintList(os.Stdout, backups); err != nil {
+			log.Fatalf("%v", err)
+		}
+	case "describe":
+		backup, err := c.Describe(name)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := catalog.PrintBackup(os.Stdout, backup); err != nil {
+			log.Fatalf("%v", err)
+		}
+	case "verify":
+		verification, err := c.Verify(name)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Print(verification)
+		if store != nil {
+			if err := store.SaveReport(manifest.VerificationKey(name), verification.String()); err != nil {
+				log.Warnf("%v", err)
+			}
+		}
+		if !verification.OK() {
+			os.Exit(1)
+		}
+	}
+}
+
+// runRestorePlan creates the restore plan before the nodes start. An existing plan for the same backup is kept, so
+// a restore that was partially streamed continues where it stopped.
+func runRestorePlan(namespace, instance string) {
+	log.Printf("bootstrapping cassandra restore plan...")
+
+	name := os.Getenv("BACKUP_NAME")
+	if name == "" {
+		log.Fatalf("BACKUP_NAME is required")
+	}
+	topology, err := restore.NewTopology(instance, os.Getenv("NODE_TOPOLOGY"), intEnv("NODE_COUNT"), intEnv("NUM_TOKENS"), os.Getenv("BACKUP_RESTORE_ENABLED") == "true")
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	mapping, err := restore.ParseMapping(os.Getenv("DATACENTER_MAPPING"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	clientSet, err := client.GetKubeClient()
+	if err != nil {
+		log.Fatalf("failed to get kube client: %v", err)
+	}
+	plans := restore.NewPlanStore(clientSet, namespace, instance)
+	existing, err := plans.Get()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if existing != nil && existing.Backup == name {
+		log.Infof("Keeping the existing plan\n%s", existing)
+		return
+	}
+
+	_, index := openIndex()
+	plan, err := restore.NewPlanner(index, manifest.NewStore(clientSet, namespace, instance)).Plan(name, topology, mapping)
+	if err != nil {
+		log.Fatalf("Backup %s can not be restored into instance %s/%s: %v", name, namespace, instance, err)
+	}
+	if v := os.Getenv("RESTORE_POINT_IN_TIME"); v != "" {
+		pointInTime, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			log.Fatalf("RESTORE_POINT_IN_TIME is not an RFC 3339 time, e.g. 2020-06-10T14:30:00Z: %v", err)
+		}
+		if err := plan.SetPointInTime(pointInTime); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if err := plans.Save(plan); err != nil {
+		log.Fatalf("%v", err)
+	}
+	log.Infof("%s", plan)
+}
+
+// runRestoreStream streams the backup into the running nodes if the restore plan requires it.
+func runRestoreStream(namespace, instance string) {
+	log.Printf("bootstrapping cassandra restore stream...")
+
+	clientSet, err := client.GetKubeClient()
+	if err != nil {
+		log.Fatalf("failed to get kube client: %v", err)
+	}
+	config, err := client.GetKubeConfig()
+	if err != nil {
+		log.Fatalf("failed to get kube config: %v", err)
+	}
+	_, index := openIndex()
+	plans := restore.NewPlanStore(clientSet, namespace, instance)
+	s := restore.NewStreamer(clientSet, medusa.NewPodExecutor(config, clientSet), namespace, index, plans)
+	if err := s.Run(); err != nil {
+		log.Fatalf("Restore of instance %s/%s failed: %v", namespace, instance, err)
+	}
+}
+
+const (
+	// defaultCommitlogDir and commitlogArchiveDir must match commitlog_directory and the archive_command of the node.
+	defaultCommitlogDir = "/var/lib/cassandra/commitlog"
+	commitlogArchiveDir = "/var/lib/cassandra/commitlog_archive"
+	// commitlogRestoreDir receives the segments of a point-in-time restore, the node applies the properties once.
+	commitlogRestoreDir        = "/var/lib/cassandra/commitlog_restore"
+	commitlogRestoreProperties = "/var/lib/cassandra/commitlog_restore.properties"
+	restorePlanDir             = "/etc/cassandra/restore-plan"
+)
+
+// runCommitlogArchive uploads the commitlogs of the node until the container is stopped.
+func runCommitlogArchive() {
+	log.Printf("bootstrapping cassandra commitlog archiver...")
+
+	fqdn := os.Getenv("FQDN")
+	if fqdn == "" {
+		log.Fatalf("FQDN is required")
+	}
+	interval := time.Duration(intEnv("ARCHIVE_INTERVAL_S")) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	dir := os.Getenv("COMMITLOG_DIR")
+	if dir == "" {
+		dir = defaultCommitlogDir
+	}
+	_, index := openIndex()
+	store := commitlog.NewStore(index.Storage(), os.Getenv("PREFIX"))
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	commitlog.NewArchiver(store, fqdn, dir, commitlogArchiveDir).Run(interval, stop)
+}
+
+// runCommitlogRestore downloads the commitlogs that the node replays after its snapshot was restored, if the
+// restore plan has a point in time.
+func runCommitlogRestore() {
+	log.Printf("bootstrapping cassandra commitlog restore...")
+
+	pod := os.Getenv("POD_NAME")
+	_, index := openIndex()
+	r := commitlog.NewRestore(commitlog.NewStore(index.Storage(), os.Getenv("PREFIX")), commitlogRestoreDir, commitlogRestoreProperties)
+	applied, err := r.Applied()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if applied {
+		log.Infof("The commitlogs were already replayed")
+		return
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(restorePlanDir, "plan.json"))
+	if os.IsNotExist(err) {
+		log.Infof("There is no restore plan")
+		return
+	}
+	if err != nil {
+		log.Fatalf("failed to read the restore plan: %v", err)
+	}
+	plan := &restore.Plan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		log.Fatalf("invalid restore plan: %v", err)
+	}
+	fqdn, ok := plan.Source(pod)
+	if plan.PointInTime == nil || !ok {
+		log.Infof("Pod %s replays no commitlogs", pod)
+		return
+	}
+	n, err := r.Prepare(fqdn, plan.StartedAt, *plan.PointInTime)
+	if err != nil {
+		log.Fatalf("failed to prepare the commitlogs of %s: %v", fqdn, err)
+	}
+	log.Infof("Downloaded %d commitlog segments of %s, they are replayed until %s", n, fqdn, plan.PointInTime.UTC().Format(time.RFC3339))
+}
+
+// defaultDataDir must match data_file_directories of the node.
+const defaultDataDir = "/var/lib/cassandra/data"
+
+// runIncrementalShip ships the incremental backups of the node until the container is stopped.
+func runIncrementalShip() {
+	log.Printf("bootstrapping cassandra incremental backup shipper...")
+
+	fqdn := os.Getenv("FQDN")
+	if fqdn == "" {
+		log.Fatalf("FQDN is required")
+	}
+	interval := time.Duration(intEnv("SCAN_INTERVAL_S")) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		dir = defaultDataDir
+	}
+	_, index := openIndex()
+	store := incremental.NewStore(index.Storage(), os.Getenv("PREFIX"))
+	if address := os.Getenv("METRICS_ADDRESS"); address != "" {
+		go metrics.Serve(address)
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	if err := incremental.NewShipper(index, store, fqdn, dir).Run(interval, stop); err != nil {
+		log.Fatalf("Shipping incremental backups failed: %v", err)
+	}
+}
+
+// openIndex returns the configuration of the backup storage and the backup index in it.
+func openIndex() (storage.Config, *medusa.Index) {
+	config := storage.Config{
+		Provider:    os.Getenv("STORAGE_PROVIDER"),
+		Bucket:      os.Getenv("BUCKET_NAME"),
+		BasePath:    os.Getenv("LOCAL_PATH"),
+		Host:        os.Getenv("STORAGE_HOST"),
+		Port:        os.Getenv("STORAGE_PORT"),
+		Secure:      os.Getenv("STORAGE_SECURE") == "true",
+		Region:      os.Getenv("STORAGE_REGION"),
+		Credentials: []byte(os.Getenv("STORAGE_CREDENTIALS")),
+	}
+	st, err := storage.New(config)
+	if err != nil {
+		log.Fatalf("failed to open backup storage: %v", err)
+	}
+	return config, medusa.NewIndex(st, os.Getenv("PREFIX"))
+}
+
+// intEnv returns the number in the environment variable, 0 if it is not set.
+func intEnv(name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s is not a number: %v", name, err)
+	}
+	return n
+}
@@ -0,0 +1,187 @@
+package catalog
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/manifest"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+)
+
+// Catalog combines the backups in the backup storage with the manifests of the backup coordinator.
+type Catalog struct {
+	index *medusa.Index
+	store *manifest.Store
+}
+
+// NewCatalog returns a catalog of the backups in the index. The store is optional, without it backups are described
+// from the backup storage only.
+func NewCatalog(index *medusa.Index, store *manifest.Store) *Catalog {
+	return &Catalog{index: index, store: store}
+}
+
+// Backup describes a backup in the backup storage.
+type Backup struct {
+	medusa.StoredBackup
+	// Manifest is the manifest of the backup coordinator, nil for backups made without it.
+	Manifest *manifest.Manifest
+	Nodes    []*Node
+	Size     int64
+	Files    int
+}
+
+// Node is the backup of a node.
+type Node struct {
+	FQDN string
+	// Pod is only known from the manifest.
+	Pod        string
+	Datacenter string
+	Rack       string
+	Tokens     int
+	Finished   bool
+	Size       int64
+	Files      int
+}
+
+// Duration returns the time from the start of the backup until the last node finished, zero if the backup is not
+// complete.
+func (b *Backup) Duration() time.Duration {
+	if b.Manifest != nil && b.Manifest.EndedAt != nil {
+		return b.Manifest.EndedAt.Sub(b.Manifest.StartedAt.Time)
+	}
+	if b.FinishedAt.IsZero() {
+		return 0
+	}
+	return b.FinishedAt.Sub(b.StartedAt)
+}
+
+// Status returns the status of the manifest, or whether all nodes finished the backup if there is no manifest.
+func (b *Backup) Status() string {
+	if b.Manifest != nil {
+		return string(b.Manifest.Status)
+	}
+	if b.Complete() {
+		return string(manifest.Complete)
+	}
+	return "Incomplete"
+}
+
+// Datacenters returns the number of nodes per datacenter. Nodes with an unknown datacenter are counted with an
+// empty name.
+func (b *Backup) Datacenters() map[string]int {
+	result := map[string]int{}
+	for _, n := range b.Nodes {
+		result[n.Datacenter]++
+	}
+	return result
+}
+
+// List returns all backups, the oldest first.
+func (c *Catalog) List() ([]*Backup, error) {
+	stored, err := c.index.Backups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %v", err)
+	}
+	manifests, err := c.manifests()
+	if err != nil {
+		return nil, err
+	}
+	backups := []*Backup{}
+	for _, s := range stored {
+		backups = append(backups, c.describe(s, manifests[s.Name]))
+	}
+	return backups, nil
+}
+
+// Describe returns the backup with the name, or an error if there is none.
+func (c *Catalog) Describe(name string) (*Backup, error) {
+	stored, err := c.find(name)
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := c.manifests()
+	if err != nil {
+		return nil, err
+	}
+	return c.describe(stored, manifests[name]), nil
+}
+
+func (c *Catalog) find(name string) (medusa.StoredBackup, error) {
+	backups, err := c.index.Backups()
+	if err != nil {
+		return medusa.StoredBackup{}, fmt.Errorf("failed to list backups: %v", err)
+	}
+	for _, b := range backups {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return medusa.StoredBackup{}, fmt.Errorf("backup %s does not exist", name)
+}
+
+func (c *Catalog) manifests() (map[string]*manifest.Manifest, error) {
+	result := map[string]*manifest.Manifest{}
+	if c.store == nil {
+		return result, nil
+	}
+	manifests, err := c.store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range manifests {
+		result[m.Name] = m
+	}
+	return result, nil
+}
+
+// describe reads the token map and the files of all nodes. Missing information is logged, the backup is described
+// as far as possible.
+func (c *Catalog) describe(stored medusa.StoredBackup, m *manifest.Manifest) *Backup {
+	b := &Backup{StoredBackup: stored, Manifest: m}
+
+	finished := map[string]bool{}
+	for _, fqdn := range stored.Finished {
+		finished[fqdn] = true
+	}
+	tokenMap, err := c.index.TokenMap(stored)
+	if err != nil {
+		log.Warnf("Backup %s has no token map: %v", stored.Name, err)
+	}
+	pods := map[string]*manifest.Node{}
+	if m != nil {
+		for _, n := range m.Nodes {
+			pods[n.FQDN] = n
+		}
+	}
+
+	for _, fqdn := range stored.Nodes {
+		node := &Node{FQDN: fqdn, Finished: finished[fqdn]}
+		if entry, ok := tokenMap[fqdn]; ok {
+			node.Tokens = len(entry.Tokens)
+			node.Datacenter = entry.Datacenter
+			node.Rack = entry.Rack
+		}
+		if n, ok := pods[fqdn]; ok {
+			node.Pod = n.Pod
+			node.Datacenter = n.Datacenter
+		}
+		if node.Finished {
+			tables, err := c.index.NodeManifest(fqdn, stored.Name)
+			if err != nil {
+				log.Warnf("Backup %s of %s has no manifest: %v", stored.Name, fqdn, err)
+			}
+			for _, t := range tables {
+				for _, o := range t.Objects {
+					node.Files++
+					node.Size += o.Size
+				}
+			}
+		}
+		b.Files += node.Files
+		b.Size += node.Size
+		b.Nodes = append(b.Nodes, node)
+	}
+	return b
+}
@@ -0,0 +1,143 @@
+package catalog
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+var started = time.Date(2020, 6, 10, 3, 0, 0, 0, time.UTC)
+
+func write(t *testing.T, dir, key string, content []byte) {
+	path := filepath.Join(dir, filepath.FromSlash(key))
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, ioutil.WriteFile(path, content, 0644))
+}
+
+// writeBackup writes a backup of two nodes in the Medusa storage layout. Each node has two data files.
+func writeBackup(t *testing.T, dir, name string, finished int) {
+	nodes := []string{"node-0.svc", "node-1.svc"}
+	tokenMap := map[string]interface{}{
+		"node-0.svc": map[string]interface{}{"tokens": []int{1, 2}, "is_up": true, "dc": "dc1", "rack": "rack1"},
+		"node-1.svc": map[string]interface{}{"tokens": []int{3, 4}, "is_up": true, "dc": "dc2", "rack": "rack1"},
+	}
+	tm, _ := json.Marshal(tokenMap)
+	for i, fqdn := range nodes {
+		index := fmt.Sprintf("cluster/index/backup_index/%s/", name)
+		write(t, dir, fmt.Sprintf("%sstarted_%s_%d.timestamp", index, fqdn, started.Unix()), nil)
+		write(t, dir, fmt.Sprintf("%stokenmap_%s.json", index, fqdn), tm)
+		if i >= finished {
+			continue
+		}
+		objects := []medusa.ManifestObject{}
+		for _, file := range []string{"Data.db", "Index.db"} {
+			key := fmt.Sprintf("cluster/%s/data/ks/table/%s", fqdn, file)
+			content := []byte(fqdn + file)
+			sum := md5.Sum(content)
+			write(t, dir, key, content)
+			objects = append(objects, medusa.ManifestObject{Path: key, MD5: hex.EncodeToString(sum[:]), Size: int64(len(content))})
+		}
+		m, _ := json.Marshal([]medusa.ManifestTable{{Keyspace: "ks", ColumnFamily: "table", Objects: objects}})
+		meta := fmt.Sprintf("cluster/%s/%s/meta/", fqdn, name)
+		write(t, dir, meta+"manifest.json", m)
+		write(t, dir, meta+"schema.cql", nil)
+		write(t, dir, meta+"tokenmap.json", tm)
+		write(t, dir, fmt.Sprintf("%sfinished_%s_%d.timestamp", index, fqdn, started.Add(90*time.Second).Unix()), nil)
+	}
+}
+
+func testCatalog(t *testing.T) (*Catalog, string) {
+	dir, err := ioutil.TempDir("", "catalog")
+	assert.NoError(t, err)
+	writeBackup(t, dir, "complete", 2)
+	writeBackup(t, dir, "incomplete", 1)
+	return NewCatalog(medusa.NewIndex(storage.NewLocal(dir), "cluster"), nil), dir
+}
+
+func TestList(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	backups, err := c.List()
+	assert.NoError(t, err)
+	out := &bytes.Buffer{}
+	assert.NoError(t, PrintList(out, backups))
+	assert.Equal(t, `NAME        STATUS      STARTED               DURATION  NODES  DATACENTERS       SIZE
+complete    Complete    2020-06-10T03:00:00Z  1m30s     2/2    dc1 (1), dc2 (1)  70 B
+incomplete  Incomplete  2020-06-10T03:00:00Z  -         1/2    dc1 (1), dc2 (1)  35 B
+`, out.String())
+}
+
+func TestDescribe(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	backup, err := c.Describe("complete")
+	assert.NoError(t, err)
+	out := &bytes.Buffer{}
+	assert.NoError(t, PrintBackup(out, backup))
+	assert.Equal(t, `Name:      complete
+Status:    Complete
+Started:   2020-06-10T03:00:00Z
+Finished:  2020-06-10T03:01:30Z
+Duration:  1m30s
+Size:      70 B in 4 files
+Topology:  2 nodes in dc1 (1), dc2 (1)
+Nodes:
+  FQDN        POD  DATACENTER  RACK   TOKENS  FINISHED  FILES  SIZE
+  node-0.svc  -    dc1         rack1  2       true      2      35 B
+  node-1.svc  -    dc2         rack1  2       true      2      35 B
+`, out.String())
+
+	_, err = c.Describe("missing")
+	assert.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	v, err := c.Verify("complete")
+	assert.NoError(t, err)
+	assert.True(t, v.OK(), v.String())
+
+	// Damage the backup: a missing file, a truncated file, a corrupted file and a missing meta file
+	assert.NoError(t, os.Remove(filepath.Join(dir, "cluster/node-0.svc/data/ks/table/Data.db")))
+	write(t, dir, "cluster/node-0.svc/data/ks/table/Index.db", []byte("short"))
+	write(t, dir, "cluster/node-1.svc/data/ks/table/Data.db", []byte("node-1.svcData.dX"))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "cluster/node-1.svc/complete/meta/schema.cql")))
+
+	v, err = c.Verify("complete")
+	assert.NoError(t, err)
+	assert.False(t, v.OK())
+	assert.Equal(t, `Verification of backup complete: FAILED
+  node-0.svc: 2 files verified, 2 problems
+    cluster/node-0.svc/data/ks/table/Data.db is missing
+    cluster/node-0.svc/data/ks/table/Index.db has size 5, expected 18
+  node-1.svc: 2 files verified, 2 problems
+    cluster/node-1.svc/complete/meta/schema.cql is missing
+    cluster/node-1.svc/data/ks/table/Data.db has MD5 037db2847005c23e23502f934b3527f8, expected 37130c390485b91d15cd485ee243e480
+`, v.String())
+
+	v, err = c.Verify("incomplete")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"the node did not finish the backup"}, v.Nodes[1].Problems)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", FormatBytes(512))
+	assert.Equal(t, "1.5 KiB", FormatBytes(1536))
+	assert.Equal(t, "2.0 GiB", FormatBytes(2<<30))
+}
@@ -0,0 +1,100 @@
+package catalog
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// PrintList writes a table of the backups.
+func PrintList(out io.Writer, backups []*Backup) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tSTARTED\tDURATION\tNODES\tDATACENTERS\tSIZE")
+	for _, b := range backups {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d/%d\t%s\t%s\n",
+			b.Name, b.Status(), formatTime(b.StartedAt), formatDuration(b.Duration()),
+			len(b.Finished), len(b.Nodes), formatDatacenters(b.Datacenters()), FormatBytes(b.Size))
+	}
+	return w.Flush()
+}
+
+// PrintBackup writes the details of the backup and of all nodes.
+func PrintBackup(out io.Writer, b *Backup) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", b.Name)
+	fmt.Fprintf(w, "Status:\t%s\n", b.Status())
+	if b.Manifest != nil {
+		fmt.Fprintf(w, "Instance:\t%s/%s\n", b.Manifest.Namespace, b.Manifest.Instance)
+		if b.Manifest.Error != "" {
+			fmt.Fprintf(w, "Error:\t%s\n", b.Manifest.Error)
+		}
+	}
+	fmt.Fprintf(w, "Started:\t%s\n", formatTime(b.StartedAt))
+	fmt.Fprintf(w, "Finished:\t%s\n", formatTime(b.FinishedAt))
+	fmt.Fprintf(w, "Duration:\t%s\n", formatDuration(b.Duration()))
+	fmt.Fprintf(w, "Size:\t%s in %d files\n", FormatBytes(b.Size), b.Files)
+	fmt.Fprintf(w, "Topology:\t%d nodes in %s\n", len(b.Nodes), formatDatacenters(b.Datacenters()))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Nodes:")
+	w = tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "  FQDN\tPOD\tDATACENTER\tRACK\tTOKENS\tFINISHED\tFILES\tSIZE")
+	for _, n := range b.Nodes {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%d\t%t\t%d\t%s\n",
+			n.FQDN, orDash(n.Pod), orDash(n.Datacenter), orDash(n.Rack), n.Tokens, n.Finished, n.Files, FormatBytes(n.Size))
+	}
+	return w.Flush()
+}
+
+// FormatBytes returns the size in binary units, e.g. "1.5 GiB".
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Second).String()
+}
+
+// formatDatacenters returns the datacenters with their number of nodes, e.g. "dc1 (3), dc2 (3)".
+func formatDatacenters(datacenters map[string]int) string {
+	names := []string{}
+	for name, count := range datacenters {
+		if name == "" {
+			name = "unknown"
+		}
+		names = append(names, fmt.Sprintf("%s (%d)", name, count))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
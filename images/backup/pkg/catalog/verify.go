@@ -0,0 +1,170 @@
+package catalog
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+// Verification is the result of the verification of a backup.
+type Verification struct {
+	Backup string
+	Nodes  []*NodeVerification
+}
+
+// NodeVerification is the result of the verification of the backup of a node.
+type NodeVerification struct {
+	FQDN string
+	// Checked is the number of verified files.
+	Checked  int
+	Problems []string
+}
+
+func (n *NodeVerification) problem(format string, args ...interface{}) {
+	n.Problems = append(n.Problems, fmt.Sprintf(format, args...))
+}
+
+// OK returns true if no node has a problem.
+func (v *Verification) OK() bool {
+	for _, n := range v.Nodes {
+		if len(n.Problems) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *Verification) String() string {
+	b := &strings.Builder{}
+	result := "OK"
+	if !v.OK() {
+		result = "FAILED"
+	}
+	fmt.Fprintf(b, "Verification of backup %s: %s\n", v.Backup, result)
+	for _, n := range v.Nodes {
+		fmt.Fprintf(b, "  %s: %d files verified, %d problems\n", n.FQDN, n.Checked, len(n.Problems))
+		for _, p := range n.Problems {
+			fmt.Fprintf(b, "    %s\n", p)
+		}
+	}
+	return b.String()
+}
+
+// Verify checks that every node finished the backup, that its meta files exist, and that every file in its manifest
+// exists with the recorded size and checksum. Checksums are compared with the hash of the storage if possible,
+// otherwise the file is downloaded.
+func (c *Catalog) Verify(name string) (*Verification, error) {
+	stored, err := c.find(name)
+	if err != nil {
+		return nil, err
+	}
+	finished := map[string]bool{}
+	for _, fqdn := range stored.Finished {
+		finished[fqdn] = true
+	}
+
+	v := &Verification{Backup: name}
+	for _, fqdn := range stored.Nodes {
+		n := &NodeVerification{FQDN: fqdn}
+		v.Nodes = append(v.Nodes, n)
+		if !finished[fqdn] {
+			n.problem("the node did not finish the backup")
+			continue
+		}
+		c.verifyNode(stored.Name, n)
+	}
+	return v, nil
+}
+
+func (c *Catalog) verifyNode(name string, n *NodeVerification) {
+	log.Infof("Verifying backup %s of %s", name, n.FQDN)
+	objects, err := c.index.Storage().List(c.index.NodePath(n.FQDN))
+	if err != nil {
+		n.problem("%v", err)
+		return
+	}
+	stored := map[string]storage.Object{}
+	for _, o := range objects {
+		stored[o.Key] = o
+	}
+
+	for _, file := range medusa.MetaFiles {
+		if _, ok := stored[c.index.MetaPath(n.FQDN, name, file)]; !ok {
+			n.problem("%s is missing", c.index.MetaPath(n.FQDN, name, file))
+		}
+	}
+	tables, err := c.index.NodeManifest(n.FQDN, name)
+	if err != nil {
+		n.problem("%v", err)
+		return
+	}
+	for _, t := range tables {
+		for _, expected := range t.Objects {
+			o, ok := stored[expected.Path]
+			switch {
+			case !ok:
+				n.problem("%s is missing", expected.Path)
+			case o.Size != expected.Size:
+				n.problem("%s has size %d, expected %d", expected.Path, o.Size, expected.Size)
+			default:
+				if err := c.verifyChecksum(o, expected.MD5); err != nil {
+					n.problem("%v", err)
+				}
+			}
+			n.Checked++
+		}
+	}
+}
+
+func (c *Catalog) verifyChecksum(o storage.Object, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	// Medusa records the hash of the storage, which is not an MD5 for objects that were uploaded in parts
+	if o.Hash == expected {
+		return nil
+	}
+	want, ok := decodeMD5(expected)
+	if !ok {
+		return fmt.Errorf("%s has checksum %s, expected %s", o.Key, o.Hash, expected)
+	}
+	if got, ok := decodeMD5(o.Hash); ok {
+		if got != want {
+			return fmt.Errorf("%s has MD5 %s, expected %s", o.Key, got, want)
+		}
+		return nil
+	}
+	// The storage has no MD5, e.g. a local storage
+	r, err := c.index.Storage().Open(o.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return fmt.Errorf("failed to read %s: %v", o.Key, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("%s has MD5 %s, expected %s", o.Key, got, want)
+	}
+	return nil
+}
+
+// decodeMD5 returns the hex encoding of an MD5 checksum in hex or base64 encoding.
+func decodeMD5(checksum string) (string, bool) {
+	if b, err := hex.DecodeString(checksum); err == nil && len(b) == md5.Size {
+		return hex.EncodeToString(b), true
+	}
+	if b, err := base64.StdEncoding.DecodeString(checksum); err == nil && len(b) == md5.Size {
+		return hex.EncodeToString(b), true
+	}
+	return "", false
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func buildKubeConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		client, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("error creating kubernetes client from %s: %v", kubeconfig, err)
+		}
+		return client, err
+	}
+	log.Infof("kubeconfig file: using InClusterConfig.")
+	return rest.InClusterConfig()
+}
+
+func GetKubeConfig() (*rest.Config, error) {
+	kubeConfigPath := os.Getenv("KUBECONFIG")
+	return buildKubeConfig(kubeConfigPath)
+}
+
+func GetKubeClient() (*kubernetes.Clientset, error) {
+	config, err := GetKubeConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kube config: %v", err)
+	}
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+	return clientSet, nil
+}
@@ -0,0 +1,118 @@
+package commitlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Archiver uploads the commitlog segments of a node to the store. Cassandra links every segment that it closes into
+// the archive directory with the archive_command of commitlog_archiving.properties. The archiver uploads and removes
+// them, and uploads copies of the segments that Cassandra still writes to, so the archived mutations lag behind at
+// most one interval.
+type Archiver struct {
+	store        *Store
+	fqdn         string
+	commitlogDir string
+	archiveDir   string
+	// uploaded are the modification times of the active segments at their last upload.
+	uploaded map[string]time.Time
+}
+
+// NewArchiver returns an archiver for the node with the FQDN.
+func NewArchiver(store *Store, fqdn, commitlogDir, archiveDir string) *Archiver {
+	return &Archiver{store: store, fqdn: fqdn, commitlogDir: commitlogDir, archiveDir: archiveDir, uploaded: map[string]time.Time{}}
+}
+
+// Run syncs the segments every interval until the stop channel is closed, then syncs a last time. Failed uploads are
+// logged and retried in the next interval.
+func (a *Archiver) Run(interval time.Duration, stop <-chan struct{}) {
+	log.Infof("Archiving the commitlogs of %s every %v", a.fqdn, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.Sync(); err != nil {
+			log.Errorf("Failed to archive commitlogs: %v", err)
+		}
+		select {
+		case <-stop:
+			if err := a.Sync(); err != nil {
+				log.Errorf("Failed to archive commitlogs: %v", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync uploads the closed segments in the archive directory and removes them, then uploads the active segments
+// that changed since their last upload.
+func (a *Archiver) Sync() error {
+	closed, err := segmentFiles(a.archiveDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range closed {
+		if err := a.upload(filepath.Join(a.archiveDir, f.Name()), a.store.ArchivedKey(a.fqdn, f.Name())); err != nil {
+			return err
+		}
+		if err := a.store.storage.Delete(a.store.ActiveKey(a.fqdn, f.Name())); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(a.archiveDir, f.Name())); err != nil {
+			return fmt.Errorf("failed to remove archived segment %s: %v", f.Name(), err)
+		}
+		delete(a.uploaded, f.Name())
+		log.Infof("Archived commitlog segment %s", f.Name())
+	}
+
+	active, err := segmentFiles(a.commitlogDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range active {
+		if last, ok := a.uploaded[f.Name()]; ok && !f.ModTime().After(last) {
+			continue
+		}
+		if err := a.upload(filepath.Join(a.commitlogDir, f.Name()), a.store.ActiveKey(a.fqdn, f.Name())); err != nil {
+			// Cassandra may have closed and removed the segment in the meantime
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		a.uploaded[f.Name()] = f.ModTime()
+	}
+	return nil
+}
+
+func (a *Archiver) upload(path, key string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return a.store.storage.Put(key, f)
+}
+
+// segmentFiles returns the commitlog segments in the directory. A missing directory has none.
+func segmentFiles(dir string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commitlog segments in %s: %v", dir, err)
+	}
+	segments := []os.FileInfo{}
+	for _, f := range files {
+		if _, ok := SegmentID(f.Name()); ok && f.Mode().IsRegular() {
+			segments = append(segments, f)
+		}
+	}
+	return segments, nil
+}
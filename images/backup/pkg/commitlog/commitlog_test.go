@@ -0,0 +1,148 @@
+package commitlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+const fqdn = "cassandra-node-0.cassandra-svc.default.svc.cluster.local"
+
+var started = time.Date(2020, 6, 10, 3, 0, 0, 0, time.UTC)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "commitlog")
+	assert.NoError(t, err)
+	return dir
+}
+
+func write(t *testing.T, path, content string, modified time.Time) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	assert.NoError(t, os.Chtimes(path, modified, modified))
+}
+
+// millis returns the id of a segment created at the time.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func TestSegmentID(t *testing.T) {
+	id, ok := SegmentID("CommitLog-7-1591758000123.log")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1591758000123), id)
+
+	_, ok = SegmentID("CommitLog-7-1591758000123_cdc.idx")
+	assert.False(t, ok)
+}
+
+func TestSelect(t *testing.T) {
+	segment := func(name string, created, uploaded time.Time) Segment {
+		return Segment{Object: storage.Object{Key: name, LastModified: uploaded}, Name: name, ID: millis(created)}
+	}
+	segments := []Segment{
+		// Closed before the backup started, its mutations are in the snapshot
+		segment("before", started.Add(-2*time.Hour), started.Add(-time.Hour)),
+		segment("during", started.Add(-time.Hour), started.Add(time.Hour)),
+		segment("until", started.Add(time.Hour), started.Add(3*time.Hour)),
+		// Created after the point in time
+		segment("after", started.Add(3*time.Hour), started.Add(4*time.Hour)),
+	}
+	selected, covered := Select(segments, started, started.Add(2*time.Hour))
+	names := []string{}
+	for _, s := range selected {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"during", "until"}, names)
+	assert.Equal(t, started.Add(3*time.Hour), covered)
+}
+
+func TestArchiverAndRestore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := NewStore(storage.NewLocal(filepath.Join(dir, "storage")), "cluster")
+	commitlogDir := filepath.Join(dir, "commitlog")
+	archiveDir := filepath.Join(dir, "commitlog_archive")
+
+	first := "CommitLog-7-1591758000000.log"
+	second := "CommitLog-7-1591758000001.log"
+	write(t, filepath.Join(commitlogDir, first), "first", time.Now())
+	a := NewArchiver(store, fqdn, commitlogDir, archiveDir)
+	assert.NoError(t, a.Sync())
+	data, err := store.storage.Get(store.ActiveKey(fqdn, first))
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+
+	// Cassandra closes the first segment and starts the second one
+	assert.NoError(t, os.Remove(filepath.Join(commitlogDir, first)))
+	write(t, filepath.Join(archiveDir, first), "first closed", time.Now())
+	write(t, filepath.Join(commitlogDir, second), "second", time.Now())
+	assert.NoError(t, a.Sync())
+	segments, err := store.Segments(fqdn)
+	assert.NoError(t, err)
+	assert.Len(t, segments, 2)
+	assert.Equal(t, first, segments[0].Name)
+	assert.False(t, segments[0].Active)
+	assert.Equal(t, second, segments[1].Name)
+	assert.True(t, segments[1].Active)
+	_, err = store.storage.Get(store.ActiveKey(fqdn, first))
+	assert.Error(t, err, "the active copy of a closed segment is removed")
+	_, err = os.Stat(filepath.Join(archiveDir, first))
+	assert.True(t, os.IsNotExist(err), "uploaded segments are removed from the archive directory")
+
+	restoreDir := filepath.Join(dir, "commitlog_restore")
+	r := NewRestore(store, restoreDir, restoreDir+".properties")
+	applied, err := r.Applied()
+	assert.NoError(t, err)
+	assert.False(t, applied)
+	pointInTime := time.Date(2020, 6, 10, 14, 30, 0, 0, time.UTC)
+	n, err := r.Prepare(fqdn, time.Now().Add(-time.Hour), pointInTime)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	data, err = ioutil.ReadFile(filepath.Join(restoreDir, first))
+	assert.NoError(t, err)
+	assert.Equal(t, "first closed", string(data))
+	data, err = ioutil.ReadFile(r.Properties)
+	assert.NoError(t, err)
+	assert.Equal(t, `restore_command=cp -f %from %to
+restore_directories=`+restoreDir+`
+restore_point_in_time=2020:06:10 14:30:00
+`, string(data))
+
+	// Cassandra applied the restore
+	assert.NoError(t, os.Rename(r.Properties, r.AppliedProperties()))
+	applied, err = r.Applied()
+	assert.NoError(t, err)
+	assert.True(t, applied)
+	_, err = os.Stat(restoreDir)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = r.Prepare(fqdn, time.Now().Add(time.Hour), pointInTime.Add(time.Hour))
+	assert.Error(t, err, "no segments were archived after the backup")
+}
+
+func TestPrune(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	write(t, filepath.Join(dir, "cluster/commitlogs/node-0/archived/CommitLog-7-1.log"), "old", started.Add(-time.Hour))
+	write(t, filepath.Join(dir, "cluster/commitlogs/node-0/archived/CommitLog-7-2.log"), "new", started.Add(time.Hour))
+	write(t, filepath.Join(dir, "cluster/commitlogs/node-1/active/CommitLog-7-3.log"), "stale", started.Add(-time.Hour))
+	store := NewStore(storage.NewLocal(dir), "cluster")
+
+	nodes, err := store.Nodes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node-0", "node-1"}, nodes)
+	pruned, err := store.Prune(started)
+	assert.NoError(t, err)
+	assert.Len(t, pruned, 2)
+	segments, err := store.Segments("node-0")
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+	assert.Equal(t, int64(2), segments[0].ID)
+}
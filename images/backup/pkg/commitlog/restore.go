@@ -0,0 +1,111 @@
+package commitlog
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pointInTimeFormat is the format of restore_point_in_time in commitlog_archiving.properties, always in GMT.
+const pointInTimeFormat = "2006:01:02 15:04:05"
+
+// Restore downloads the commitlog segments of an old node that Cassandra replays after the snapshot of a backup was
+// restored. The restore is described in a properties file, which is appended to commitlog_archiving.properties
+// when Cassandra starts the next time, and renamed when it was applied.
+type Restore struct {
+	store *Store
+	// Dir receives the segments, it must not contain any other files.
+	Dir string
+	// Properties is the path of the pending restore properties.
+	Properties string
+}
+
+// NewRestore returns a restore that downloads the segments into the directory.
+func NewRestore(store *Store, dir, properties string) *Restore {
+	return &Restore{store: store, Dir: dir, Properties: properties}
+}
+
+// AppliedProperties returns the path of the properties once Cassandra applied them.
+func (r *Restore) AppliedProperties() string {
+	return r.Properties + ".applied"
+}
+
+// Applied returns true if Cassandra already replayed the segments. The downloaded segments are removed then.
+func (r *Restore) Applied() (bool, error) {
+	if _, err := os.Stat(r.AppliedProperties()); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := os.RemoveAll(r.Dir); err != nil {
+		return true, fmt.Errorf("failed to remove restored commitlogs in %s: %v", r.Dir, err)
+	}
+	return true, nil
+}
+
+// Prepare downloads the segments of the node from since, the start of the backup, until the point in time, and
+// writes the properties for Cassandra. It returns the number of segments.
+func (r *Restore) Prepare(fqdn string, since, until time.Time) (int, error) {
+	segments, err := r.store.Segments(fqdn)
+	if err != nil {
+		return 0, err
+	}
+	selected, covered := Select(segments, since, until)
+	if len(selected) == 0 {
+		return 0, fmt.Errorf("no commitlogs of %s were archived after %s", fqdn, since.UTC().Format(time.RFC3339))
+	}
+	if covered.Before(until) {
+		log.Warnf("The commitlogs of %s are archived until %s, mutations until %s are lost", fqdn, covered.UTC().Format(time.RFC3339), until.UTC().Format(time.RFC3339))
+	}
+
+	// Start from scratch if an earlier attempt was interrupted
+	if err := os.RemoveAll(r.Dir); err != nil {
+		return 0, fmt.Errorf("failed to clean %s: %v", r.Dir, err)
+	}
+	if err := os.MkdirAll(r.Dir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create %s: %v", r.Dir, err)
+	}
+	for _, segment := range selected {
+		log.Infof("Downloading commitlog segment %s of %s", segment.Name, fqdn)
+		if err := r.download(segment); err != nil {
+			return 0, err
+		}
+	}
+
+	properties := strings.Join([]string{
+		"restore_command=cp -f %from %to",
+		"restore_directories=" + r.Dir,
+		"restore_point_in_time=" + until.UTC().Format(pointInTimeFormat),
+		"",
+	}, "\n")
+	if err := ioutil.WriteFile(r.Properties, []byte(properties), 0644); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %v", r.Properties, err)
+	}
+	return len(selected), nil
+}
+
+func (r *Restore) download(segment Segment) error {
+	in, err := r.store.storage.Open(segment.Key)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(r.Dir, segment.Name))
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", segment.Name, err)
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", segment.Key, err)
+	}
+	return nil
+}
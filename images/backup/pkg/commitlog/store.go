@@ -0,0 +1,166 @@
+package commitlog
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+var segmentPat = regexp.MustCompile(`^CommitLog-[0-9]+-([0-9]+)\.log$`)
+
+// SegmentID returns the id of a commitlog segment from its file name, e.g. CommitLog-7-1591758000123.log. Cassandra
+// numbers the segments in the order they are created, also across restarts.
+func SegmentID(name string) (int64, bool) {
+	m := segmentPat.FindStringSubmatch(name)
+	if m == nil {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(m[1], 10, 64)
+	return id, err == nil
+}
+
+// Segment is a commitlog segment in the backup storage.
+type Segment struct {
+	storage.Object
+	Name string
+	ID   int64
+	// Active is true for a copy of a segment that Cassandra was still writing to, it contains the mutations up to
+	// the time of the copy.
+	Active bool
+}
+
+// Store keeps the commitlog segments of the nodes in the backup storage, next to the Medusa backups:
+//
+//	<prefix>/commitlogs/<fqdn>/archived/  the segments that Cassandra closed and archived
+//	<prefix>/commitlogs/<fqdn>/active/    the latest copies of the segments that Cassandra still writes to
+type Store struct {
+	storage storage.Storage
+	prefix  string
+}
+
+// NewStore returns the commitlog store with the prefix in the storage.
+func NewStore(s storage.Storage, prefix string) *Store {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &Store{storage: s, prefix: prefix}
+}
+
+func (s *Store) root() string {
+	return s.prefix + "commitlogs/"
+}
+
+// ArchivedKey returns the key of a closed segment of the node.
+func (s *Store) ArchivedKey(fqdn, name string) string {
+	return fmt.Sprintf("%s%s/archived/%s", s.root(), fqdn, name)
+}
+
+// ActiveKey returns the key of the copy of an active segment of the node.
+func (s *Store) ActiveKey(fqdn, name string) string {
+	return fmt.Sprintf("%s%s/active/%s", s.root(), fqdn, name)
+}
+
+// Segments returns the segments of the node, ordered by id. Active copies of segments that were archived since are
+// left out.
+func (s *Store) Segments(fqdn string) ([]Segment, error) {
+	objects, err := s.storage.List(fmt.Sprintf("%s%s/", s.root(), fqdn))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commitlogs of %s: %v", fqdn, err)
+	}
+	archived := map[string]bool{}
+	segments := []Segment{}
+	for _, o := range objects {
+		parts := strings.Split(strings.TrimPrefix(o.Key, s.root()+fqdn+"/"), "/")
+		if len(parts) != 2 {
+			continue
+		}
+		id, ok := SegmentID(parts[1])
+		if !ok {
+			continue
+		}
+		segment := Segment{Object: o, Name: parts[1], ID: id, Active: parts[0] == "active"}
+		if !segment.Active {
+			archived[segment.Name] = true
+		}
+		segments = append(segments, segment)
+	}
+	result := []Segment{}
+	for _, segment := range segments {
+		if segment.Active && archived[segment.Name] {
+			continue
+		}
+		result = append(result, segment)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+// Nodes returns the FQDNs of all nodes with commitlogs in the store.
+func (s *Store) Nodes() ([]string, error) {
+	objects, err := s.storage.List(s.root())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commitlogs: %v", err)
+	}
+	seen := map[string]bool{}
+	nodes := []string{}
+	for _, o := range objects {
+		fqdn := strings.SplitN(strings.TrimPrefix(o.Key, s.root()), "/", 2)[0]
+		if !seen[fqdn] {
+			seen[fqdn] = true
+			nodes = append(nodes, fqdn)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// Select returns the segments that contain the mutations from since until the point in time, and the time up to
+// which the selected segments are complete. A segment was uploaded after its last mutation, and the id of a segment
+// is at most the time it was created in milliseconds. Cassandra skips the mutations outside of the interval.
+func Select(segments []Segment, since, until time.Time) ([]Segment, time.Time) {
+	selected := []Segment{}
+	covered := time.Time{}
+	for _, segment := range segments {
+		if segment.LastModified.Before(since) || time.Unix(0, segment.ID*int64(time.Millisecond)).After(until) {
+			continue
+		}
+		selected = append(selected, segment)
+		if segment.LastModified.After(covered) {
+			covered = segment.LastModified
+		}
+	}
+	return selected, covered
+}
+
+// Prune deletes the segments of all nodes that were uploaded before the time and returns them.
+func (s *Store) Prune(before time.Time) ([]storage.Object, error) {
+	nodes, err := s.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	pruned := []storage.Object{}
+	for _, fqdn := range nodes {
+		segments, err := s.Segments(fqdn)
+		if err != nil {
+			return pruned, err
+		}
+		keys := []string{}
+		objects := []storage.Object{}
+		for _, segment := range segments {
+			if segment.LastModified.Before(before) {
+				keys = append(keys, segment.Key)
+				objects = append(objects, segment.Object)
+			}
+		}
+		if err := s.storage.Delete(keys...); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, objects...)
+	}
+	return pruned, nil
+}
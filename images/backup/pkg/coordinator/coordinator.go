@@ -0,0 +1,247 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/manifest"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+)
+
+// defaultDatacenter is the datacenter of the nodes of an instance without NODE_TOPOLOGY.
+const defaultDatacenter = "datacenter1"
+
+// Options configure a backup.
+type Options struct {
+	// Parallelism is the maximum number of nodes that are backed up at the same time, all nodes if 0.
+	Parallelism int
+}
+
+// Coordinator creates a backup of all nodes of a Cassandra instance. The backup is complete only if every node
+// was backed up, otherwise the backups of all nodes are deleted again.
+type Coordinator struct {
+	client    kubernetes.Interface
+	executor  medusa.Executor
+	namespace string
+	instance  string
+	// selector of the StatefulSets of the instance
+	selector string
+	store    *manifest.Store
+	options  Options
+}
+
+func NewCoordinator(client kubernetes.Interface, executor medusa.Executor, namespace, instance, selector string, store *manifest.Store, options Options) *Coordinator {
+	return &Coordinator{
+		client:    client,
+		executor:  executor,
+		namespace: namespace,
+		instance:  instance,
+		selector:  selector,
+		store:     store,
+		options:   options,
+	}
+}
+
+// target is a node that is backed up.
+type target struct {
+	pod  *corev1.Pod
+	node *manifest.Node
+}
+
+// Run creates the backup and returns its manifest. It returns an error if the backup is not complete.
+func (c *Coordinator) Run(name string) (*manifest.Manifest, error) {
+	if err := manifest.ValidateName(name); err != nil {
+		return nil, err
+	}
+	existing, err := c.store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Status == manifest.Complete {
+		return existing, fmt.Errorf("backup %s already exists", name)
+	}
+
+	targets, err := c.discover()
+	if err != nil {
+		m := manifest.New(name, c.namespace, c.instance, []*manifest.Node{})
+		m.Fail(err)
+		if err := c.store.Save(m); err != nil {
+			log.Errorf("%v", err)
+		}
+		return m, err
+	}
+	nodes := make([]*manifest.Node, 0, len(targets))
+	for _, t := range targets {
+		nodes = append(nodes, t.node)
+	}
+	m := manifest.New(name, c.namespace, c.instance, nodes)
+	if err := c.store.Save(m); err != nil {
+		return m, err
+	}
+	log.Infof("Starting backup %s of %d nodes", name, len(targets))
+
+	c.backup(m, targets)
+
+	m.Finish()
+	if m.Status != manifest.Complete {
+		log.Errorf("Backup %s is incomplete, deleting the backups of all nodes", name)
+		c.cleanup(m, targets)
+	}
+	if err := c.store.Save(m); err != nil {
+		log.Errorf("%v", err)
+	}
+	log.Infof("%s", m.Summary())
+	if m.Status != manifest.Complete {
+		return m, fmt.Errorf("%s", m.Error)
+	}
+	return m, nil
+}
+
+// discover returns all nodes of the StatefulSets of the instance. It fails if a node is not ready, so no backup is
+// started that can not complete.
+func (c *Coordinator) discover() ([]target, error) {
+	list, err := c.client.AppsV1().StatefulSets(c.namespace).List(metav1.ListOptions{LabelSelector: c.selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list StatefulSets: %v", err)
+	}
+	if len(list.Items) == 0 {
+		return nil, fmt.Errorf("no StatefulSets found with selector '%s'", c.selector)
+	}
+	statefulSets := list.Items
+	sort.Slice(statefulSets, func(i, j int) bool { return statefulSets[i].Name < statefulSets[j].Name })
+
+	targets := []target{}
+	for i := range statefulSets {
+		sts := &statefulSets[i]
+		replicas := int32(1)
+		if sts.Spec.Replicas != nil {
+			replicas = *sts.Spec.Replicas
+		}
+		for ordinal := int32(0); ordinal < replicas; ordinal++ {
+			name := fmt.Sprintf("%s-%d", sts.Name, ordinal)
+			pod, err := c.client.CoreV1().Pods(c.namespace).Get(name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get pod %s: %v", name, err)
+			}
+			if !isReady(pod) {
+				return nil, fmt.Errorf("pod %s is not ready", name)
+			}
+			if !hasContainer(pod, medusa.Container) {
+				return nil, fmt.Errorf("pod %s has no %s container, BACKUP_RESTORE_ENABLED must be true", name, medusa.Container)
+			}
+			targets = append(targets, target{
+				pod: pod,
+				node: &manifest.Node{
+					Pod:         name,
+					StatefulSet: sts.Name,
+					Datacenter:  datacenter(sts),
+					FQDN:        fmt.Sprintf("%s.%s.%s.svc.cluster.local", name, sts.Spec.ServiceName, c.namespace),
+					Status:      manifest.Pending,
+				},
+			})
+		}
+	}
+	return targets, nil
+}
+
+// backup backs up the nodes in parallel and saves the manifest after every node.
+func (c *Coordinator) backup(m *manifest.Manifest, targets []target) {
+	parallelism := c.options.Parallelism
+	if parallelism <= 0 || parallelism > len(targets) {
+		parallelism = len(targets)
+	}
+	lock := sync.Mutex{}
+	save := func(update func()) {
+		lock.Lock()
+		defer lock.Unlock()
+		update()
+		if err := c.store.Save(m); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+
+	slots := make(chan struct{}, parallelism)
+	wg := sync.WaitGroup{}
+	for _, t := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(t target) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			save(func() {
+				now := metav1.Now()
+				t.node.Status = manifest.InProgress
+				t.node.StartedAt = &now
+			})
+			log.Infof("Backing up %s", t.pod.Name)
+			_, err := medusa.Backup(c.executor, t.pod, m.Name)
+			save(func() {
+				now := metav1.Now()
+				t.node.EndedAt = &now
+				if err != nil {
+					log.Errorf("Backup of %s failed: %v", t.pod.Name, err)
+					t.node.Status = manifest.Failed
+					t.node.Error = err.Error()
+					return
+				}
+				log.Infof("Backed up %s", t.pod.Name)
+				t.node.Status = manifest.Complete
+			})
+		}(t)
+	}
+	wg.Wait()
+}
+
+// cleanup deletes the backups of all nodes that uploaded files, so no partial backup is left in the storage.
+func (c *Coordinator) cleanup(m *manifest.Manifest, targets []target) {
+	for _, t := range targets {
+		if t.node.Status == manifest.Pending {
+			continue
+		}
+		if _, err := medusa.DeleteBackup(c.executor, t.pod, m.Name); err != nil {
+			log.Errorf("Failed to delete the backup of %s: %v", t.pod.Name, err)
+			continue
+		}
+		t.node.Deleted = true
+	}
+}
+
+// datacenter returns the Cassandra datacenter of the nodes of the StatefulSet.
+func datacenter(sts *appsv1.StatefulSet) string {
+	spec := sts.Spec.Template.Spec
+	for _, container := range append(spec.InitContainers, spec.Containers...) {
+		for _, env := range container.Env {
+			if env.Name == "CASSANDRA_DATACENTER" && env.Value != "" {
+				return env.Value
+			}
+		}
+	}
+	return defaultDatacenter
+}
+
+func hasContainer(pod *corev1.Pod, name string) bool {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package coordinator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/manifest"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+)
+
+type fakeExecutor struct {
+	lock sync.Mutex
+	// fail contains the pods whose backup fails
+	fail    map[string]bool
+	backups []string
+	deletes []string
+}
+
+func (e *fakeExecutor) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if container != medusa.Container {
+		return "", fmt.Errorf("unexpected container %s", container)
+	}
+	switch {
+	case len(command) > 2 && command[2] == "backup":
+		e.backups = append(e.backups, pod.Name)
+		if e.fail[pod.Name] {
+			return "", fmt.Errorf("upload failed")
+		}
+		return "", nil
+	case command[1] == medusa.DeleteScript:
+		e.deletes = append(e.deletes, pod.Name)
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected command %s", strings.Join(command, " "))
+}
+
+// testInstance creates the StatefulSets and pods of a two datacenter instance.
+func testInstance(ready bool) kubernetes.Interface {
+	client := fake.NewSimpleClientset()
+	for _, dc := range []string{"dc1", "dc2"} {
+		replicas := int32(2)
+		sts := &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("cassandra-%s-node", dc),
+				Namespace: "default",
+				Labels:    map[string]string{"app": "cassandra", "cassandra": "cassandra"},
+			},
+			Spec: appsv1.StatefulSetSpec{
+				Replicas:    &replicas,
+				ServiceName: "cassandra-svc",
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						InitContainers: []corev1.Container{{
+							Name: "node-resolver",
+							Env:  []corev1.EnvVar{{Name: "CASSANDRA_DATACENTER", Value: dc}},
+						}},
+					},
+				},
+			},
+		}
+		_, _ = client.AppsV1().StatefulSets("default").Create(sts)
+		for i := 0; i < 2; i++ {
+			status := corev1.ConditionTrue
+			if !ready && dc == "dc2" && i == 1 {
+				status = corev1.ConditionFalse
+			}
+			_, _ = client.CoreV1().Pods("default").Create(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-%d", sts.Name, i), Namespace: "default"},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "cassandra"}, {Name: medusa.Container}}},
+				Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}},
+			})
+		}
+	}
+	return client
+}
+
+func newTestCoordinator(client kubernetes.Interface, executor medusa.Executor) (*Coordinator, *manifest.Store) {
+	store := manifest.NewStore(client, "default", "cassandra")
+	return NewCoordinator(client, executor, "default", "cassandra", "app = cassandra, cassandra", store, Options{Parallelism: 2}), store
+}
+
+func TestRun(t *testing.T) {
+	executor := &fakeExecutor{}
+	coordinator, store := newTestCoordinator(testInstance(true), executor)
+
+	m, err := coordinator.Run("backup1")
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.Complete, m.Status)
+	assert.ElementsMatch(t, []string{"cassandra-dc1-node-0", "cassandra-dc1-node-1", "cassandra-dc2-node-0", "cassandra-dc2-node-1"}, executor.backups)
+	assert.Empty(t, executor.deletes)
+
+	saved, err := store.Get("backup1")
+	assert.NoError(t, err)
+	if assert.NotNil(t, saved) {
+		assert.Equal(t, manifest.Complete, saved.Status)
+		assert.Len(t, saved.Nodes, 4)
+		assert.Equal(t, "dc2", saved.Nodes[2].Datacenter)
+		assert.Equal(t, "cassandra-dc2-node-0.cassandra-svc.default.svc.cluster.local", saved.Nodes[2].FQDN)
+	}
+
+	_, err = coordinator.Run("backup1")
+	assert.Error(t, err, "a complete backup is not overwritten")
+}
+
+func TestRun_partialBackup(t *testing.T) {
+	executor := &fakeExecutor{fail: map[string]bool{"cassandra-dc1-node-1": true}}
+	coordinator, store := newTestCoordinator(testInstance(true), executor)
+
+	m, err := coordinator.Run("backup1")
+	assert.Error(t, err)
+	assert.Equal(t, manifest.Failed, m.Status)
+	assert.Contains(t, m.Error, "cassandra-dc1-node-1")
+	assert.ElementsMatch(t, executor.backups, executor.deletes, "the backups of all nodes are deleted")
+
+	saved, err := store.Get("backup1")
+	assert.NoError(t, err)
+	for _, node := range saved.Nodes {
+		assert.True(t, node.Deleted)
+	}
+	assert.Equal(t, "upload failed", saved.Nodes[1].Error)
+
+	// A failed backup can be retried with the same name
+	executor.fail = nil
+	m, err = coordinator.Run("backup1")
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.Complete, m.Status)
+}
+
+func TestRun_notReady(t *testing.T) {
+	executor := &fakeExecutor{}
+	coordinator, store := newTestCoordinator(testInstance(false), executor)
+
+	_, err := coordinator.Run("backup1")
+	assert.EqualError(t, err, "pod cassandra-dc2-node-1 is not ready")
+	assert.Empty(t, executor.backups, "no node is backed up if the backup can not complete")
+
+	saved, err := store.Get("backup1")
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.Failed, saved.Status)
+}
+
+func TestRun_invalidName(t *testing.T) {
+	coordinator, _ := newTestCoordinator(testInstance(true), &fakeExecutor{})
+	_, err := coordinator.Run("backup/1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,151 @@
+package incremental
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/metrics"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+const (
+	fqdn  = "cassandra-node-0.cassandra-svc.default.svc.cluster.local"
+	table = "shop/orders-0f3c4a2e9b7d11eaa1b2c3d4e5f60708"
+)
+
+var started = time.Date(2020, 6, 10, 3, 0, 0, 0, time.UTC)
+
+func write(t *testing.T, path, content string, modified time.Time) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	assert.NoError(t, os.Chtimes(path, modified, modified))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// setup returns a data directory and a backup storage with a complete backup of the node that contains the files.
+func setup(t *testing.T, files ...string) (string, string, *Shipper) {
+	dir, err := ioutil.TempDir("", "incremental")
+	assert.NoError(t, err)
+	storageDir := filepath.Join(dir, "storage")
+	dataDir := filepath.Join(dir, "data")
+	assert.NoError(t, os.MkdirAll(dataDir, 0755))
+
+	objects := []medusa.ManifestObject{}
+	for _, file := range files {
+		objects = append(objects, medusa.ManifestObject{Path: fmt.Sprintf("cluster/%s/data/%s/%s", fqdn, table, file), Size: int64(len(file))})
+	}
+	m, _ := json.Marshal([]medusa.ManifestTable{{Keyspace: "shop", ColumnFamily: filepath.Base(table), Objects: objects}})
+	write(t, filepath.Join(storageDir, "cluster", fqdn, "full", "meta", "manifest.json"), string(m), started)
+	index := filepath.Join(storageDir, "cluster/index/backup_index/full")
+	write(t, filepath.Join(index, fmt.Sprintf("started_%s_%d.timestamp", fqdn, started.Unix())), "", started)
+	write(t, filepath.Join(index, fmt.Sprintf("finished_%s_%d.timestamp", fqdn, started.Add(time.Minute).Unix())), "", started)
+
+	s := storage.NewLocal(storageDir)
+	return dir, dataDir, NewShipper(medusa.NewIndex(s, "cluster"), NewStore(s, "cluster"), fqdn, dataDir)
+}
+
+func TestScan(t *testing.T) {
+	dir, dataDir, shipper := setup(t, "md-1-big-Data.db")
+	defer os.RemoveAll(dir)
+	backups := filepath.Join(dataDir, table, "backups")
+	// Flushed before the backup, which contains it
+	write(t, filepath.Join(backups, "md-1-big-Data.db"), "md-1-big-Data.db", started.Add(-time.Hour))
+	// Flushed after the backup
+	write(t, filepath.Join(backups, "md-2-big-Data.db"), "new", started.Add(time.Hour))
+	// The live SSTables are not touched
+	write(t, filepath.Join(dataDir, table, "md-2-big-Data.db"), "new", started.Add(time.Hour))
+	uploaded := testutil.ToFloat64(metrics.IncrementalUploadedFiles)
+	deduplicated := testutil.ToFloat64(metrics.IncrementalDeduplicatedFiles)
+
+	assert.NoError(t, shipper.Scan())
+	assert.False(t, exists(filepath.Join(backups, "md-1-big-Data.db")))
+	assert.False(t, exists(filepath.Join(backups, "md-2-big-Data.db")))
+	assert.True(t, exists(filepath.Join(dataDir, table, "md-2-big-Data.db")))
+	files, err := shipper.store.Files(fqdn)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, "cluster/incremental/"+fqdn+"/"+table+"/md-2-big-Data.db", files[0].Key)
+	assert.Equal(t, uploaded+1, testutil.ToFloat64(metrics.IncrementalUploadedFiles))
+	assert.Equal(t, deduplicated+1, testutil.ToFloat64(metrics.IncrementalDeduplicatedFiles))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.IncrementalPendingFiles))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.IncrementalLag))
+
+	// A file that an earlier attempt uploaded is only removed
+	write(t, filepath.Join(backups, "md-2-big-Data.db"), "new", started.Add(time.Hour))
+	assert.NoError(t, shipper.Scan())
+	assert.False(t, exists(filepath.Join(backups, "md-2-big-Data.db")))
+	assert.Equal(t, uploaded+1, testutil.ToFloat64(metrics.IncrementalUploadedFiles))
+}
+
+func TestScan_failed(t *testing.T) {
+	dir, dataDir, shipper := setup(t)
+	defer os.RemoveAll(dir)
+	backups := filepath.Join(dataDir, table, "backups")
+	write(t, filepath.Join(backups, "md-3-big-Data.db"), "data", time.Now().Add(-10*time.Minute))
+	// The storage can not create the table directory
+	write(t, filepath.Join(dir, "storage", "cluster", "incremental", fqdn, "shop"), "", started)
+
+	assert.Error(t, shipper.Scan())
+	assert.True(t, exists(filepath.Join(backups, "md-3-big-Data.db")), "the file is kept for the next scan")
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.IncrementalPendingFiles))
+	assert.Equal(t, 4.0, testutil.ToFloat64(metrics.IncrementalPendingBytes))
+	assert.InDelta(t, 600, testutil.ToFloat64(metrics.IncrementalLag), 60)
+}
+
+func TestRun(t *testing.T) {
+	dir, dataDir, shipper := setup(t)
+	defer os.RemoveAll(dir)
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- shipper.Run(time.Hour, stop)
+	}()
+	// A new table is created and flushed while the shipper runs
+	backups := filepath.Join(dataDir, table, "backups")
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, os.MkdirAll(backups, 0755))
+	time.Sleep(100 * time.Millisecond)
+	// Cassandra links the flushed SSTable into the backups directory
+	write(t, filepath.Join(dataDir, table, "md-4-big-Data.db"), "data", time.Now())
+	assert.NoError(t, os.Link(filepath.Join(dataDir, table, "md-4-big-Data.db"), filepath.Join(backups, "md-4-big-Data.db")))
+
+	assert.Eventually(t, func() bool {
+		return !exists(filepath.Join(backups, "md-4-big-Data.db"))
+	}, 5*time.Second, 50*time.Millisecond)
+	close(stop)
+	assert.NoError(t, <-done)
+	uploaded, err := shipper.store.Uploaded(fqdn, table+"/md-4-big-Data.db", 4)
+	assert.NoError(t, err)
+	assert.True(t, uploaded)
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incremental")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	write(t, filepath.Join(dir, "cluster/incremental", fqdn, table, "md-1-big-Data.db"), "old", started.Add(-time.Hour))
+	write(t, filepath.Join(dir, "cluster/incremental", fqdn, table, "md-2-big-Data.db"), "new", started.Add(time.Hour))
+	store := NewStore(storage.NewLocal(dir), "cluster")
+
+	pruned, err := store.Prune(started)
+	assert.NoError(t, err)
+	assert.Len(t, pruned, 1)
+	files, err := store.Files(fqdn)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, "cluster/incremental/"+fqdn+"/"+table+"/md-2-big-Data.db", files[0].Key)
+}
@@ -0,0 +1,306 @@
+package incremental
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/metrics"
+)
+
+// backupsDir is the directory of a table in which Cassandra links every SSTable that it flushes or streams when
+// incremental_backups is enabled.
+const backupsDir = "backups"
+
+// Shipper ships the incremental backups of a node to the store. It watches the backups directories of all tables in
+// the data directory, uploads every new file and removes it after the upload was confirmed. Files that the last full
+// backup of the node already contains are removed without an upload.
+type Shipper struct {
+	index   *medusa.Index
+	store   *Store
+	fqdn    string
+	dataDir string
+	// backup is the name of the last full backup of the node, and files are its data files with their sizes, by
+	// <keyspace>/<table>/<file>.
+	backup string
+	files  map[string]int64
+}
+
+// NewShipper returns a shipper for the node with the FQDN. The index is used to find the last full backup.
+func NewShipper(index *medusa.Index, store *Store, fqdn, dataDir string) *Shipper {
+	return &Shipper{index: index, store: store, fqdn: fqdn, dataDir: dataDir, files: map[string]int64{}}
+}
+
+// Run ships new files as soon as Cassandra creates them until the stop channel is closed. All files are scanned
+// every interval, which retries failed uploads and picks up the last full backup.
+func (s *Shipper) Run(interval time.Duration, stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %v", err)
+	}
+	defer watcher.Close()
+	if err := s.watch(watcher, s.dataDir); err != nil {
+		return err
+	}
+
+	log.Infof("Shipping the incremental backups of %s, scanning every %v", s.fqdn, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	s.scan()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			s.scan()
+		case err := <-watcher.Errors:
+			// Events may be lost, the next scan catches up
+			log.Warnf("Watching %s failed: %v", s.dataDir, err)
+		case event := <-watcher.Events:
+			if event.Op&(fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			info, err := os.Stat(event.Name)
+			if err != nil {
+				continue
+			}
+			if info.IsDir() {
+				if err := s.watch(watcher, event.Name); err != nil {
+					log.Warnf("%v", err)
+				}
+				// Files created before the directory was watched
+				s.scan()
+				continue
+			}
+			if _, ok := s.relative(event.Name); ok {
+				s.ship(event.Name)
+				s.updatePending()
+			}
+		}
+	}
+}
+
+func (s *Shipper) scan() {
+	if err := s.Scan(); err != nil {
+		log.Errorf("Failed to ship incremental backups: %v", err)
+	}
+}
+
+// watch adds watches for the directory and the directories below it down to the backups directories of the tables.
+func (s *Shipper) watch(watcher *fsnotify.Watcher, dir string) error {
+	rel, err := filepath.Rel(s.dataDir, dir)
+	if err != nil {
+		return err
+	}
+	depth := 0
+	if rel != "." {
+		parts := strings.Split(rel, string(filepath.Separator))
+		depth = len(parts)
+		if depth > 3 || (depth == 3 && parts[2] != backupsDir) {
+			return nil
+		}
+	}
+	if err := watcher.Add(dir); err != nil {
+		return fmt.Errorf("failed to watch %s: %v", dir, err)
+	}
+	if depth == 3 {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %v", dir, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := s.watch(watcher, filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Scan ships all files in the backups directories and updates the metrics. Failed files are kept and shipped by the
+// next scan.
+func (s *Shipper) Scan() error {
+	if err := s.refreshBackup(); err != nil {
+		// Without the last backup every file is uploaded, which is safe
+		log.Warnf("Failed to read the last backup of %s: %v", s.fqdn, err)
+	}
+	paths, err := s.pending()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, path := range paths {
+		if !s.ship(path) {
+			failed++
+		}
+	}
+	s.updatePending()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files were not shipped", failed, len(paths))
+	}
+	return nil
+}
+
+// ship uploads and removes a file, and returns false if it failed.
+func (s *Shipper) ship(path string) bool {
+	if err := s.shipFile(path); err != nil {
+		metrics.IncrementalErrors.Inc()
+		log.Errorf("Failed to ship %s: %v", path, err)
+		return false
+	}
+	metrics.IncrementalLastShipped.SetToCurrentTime()
+	return true
+}
+
+func (s *Shipper) shipFile(path string) error {
+	file, _ := s.relative(path)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// Shipped in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if size, ok := s.files[file]; ok && size == info.Size() {
+		log.Infof("Backup %s contains %s, removing it", s.backup, file)
+		metrics.IncrementalDeduplicatedFiles.Inc()
+		return os.Remove(path)
+	}
+	uploaded, err := s.store.Uploaded(s.fqdn, file, info.Size())
+	if err != nil {
+		return err
+	}
+	if uploaded {
+		// An earlier attempt uploaded the file but did not remove it
+		metrics.IncrementalDeduplicatedFiles.Inc()
+		return os.Remove(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = s.store.storage.Put(s.store.Key(s.fqdn, file), f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if uploaded, err = s.store.Uploaded(s.fqdn, file, info.Size()); err != nil {
+		return err
+	} else if !uploaded {
+		return fmt.Errorf("the upload of %s was not confirmed by the storage", file)
+	}
+	log.Infof("Uploaded %s", file)
+	metrics.IncrementalUploadedFiles.Inc()
+	metrics.IncrementalUploadedBytes.Add(float64(info.Size()))
+	return os.Remove(path)
+}
+
+// relative returns the path of a file in a backups directory as <keyspace>/<table>/<file>, the key of the file in
+// the store and in Medusa backups.
+func (s *Shipper) relative(path string) (string, bool) {
+	rel, err := filepath.Rel(s.dataDir, path)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) != 4 || parts[2] != backupsDir {
+		return "", false
+	}
+	return strings.Join([]string{parts[0], parts[1], parts[3]}, "/"), true
+}
+
+// pending returns the paths of all files in the backups directories.
+func (s *Shipper) pending() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dataDir, "*", "*", backupsDir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// updatePending updates the metrics of the files that are not shipped yet.
+func (s *Shipper) updatePending() {
+	paths, err := s.pending()
+	if err != nil {
+		return
+	}
+	var size int64
+	oldest := time.Now()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		size += info.Size()
+		if info.ModTime().Before(oldest) {
+			oldest = info.ModTime()
+		}
+	}
+	metrics.IncrementalPendingFiles.Set(float64(len(paths)))
+	metrics.IncrementalPendingBytes.Set(float64(size))
+	if len(paths) == 0 {
+		metrics.IncrementalLag.Set(0)
+	} else {
+		metrics.IncrementalLag.Set(time.Since(oldest).Seconds())
+	}
+}
+
+// refreshBackup reads the data files of the last complete backup of the node, if it changed.
+func (s *Shipper) refreshBackup() error {
+	backups, err := s.index.Backups()
+	if err != nil {
+		return err
+	}
+	last := ""
+	for _, b := range backups {
+		if b.Complete() && contains(b.Nodes, s.fqdn) {
+			last = b.Name
+		}
+	}
+	if last == "" || last == s.backup {
+		return nil
+	}
+	tables, err := s.index.NodeManifest(s.fqdn, last)
+	if err != nil {
+		return err
+	}
+	dataPath := s.index.NodePath(s.fqdn) + "data/"
+	files := map[string]int64{}
+	for _, table := range tables {
+		for _, o := range table.Objects {
+			files[strings.TrimPrefix(o.Path, dataPath)] = o.Size
+		}
+	}
+	log.Infof("The last backup of %s is %s", s.fqdn, last)
+	s.backup = last
+	s.files = files
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
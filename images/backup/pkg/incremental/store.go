@@ -0,0 +1,85 @@
+package incremental
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+// Store keeps the incremental backups of the nodes in the backup storage, next to the Medusa backups:
+//
+//	<prefix>/incremental/<fqdn>/<keyspace>/<table>/  the SSTable files that Cassandra flushed after the last backup
+//
+// The table directories keep the id of the table, like the data directories of Cassandra.
+type Store struct {
+	storage storage.Storage
+	prefix  string
+}
+
+// NewStore returns the incremental backup store with the prefix in the storage.
+func NewStore(s storage.Storage, prefix string) *Store {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &Store{storage: s, prefix: prefix}
+}
+
+func (s *Store) root() string {
+	return s.prefix + "incremental/"
+}
+
+// Key returns the key of a file of the node, given as <keyspace>/<table>/<file>.
+func (s *Store) Key(fqdn, file string) string {
+	return fmt.Sprintf("%s%s/%s", s.root(), fqdn, file)
+}
+
+// Files returns the files of the node in the store.
+func (s *Store) Files(fqdn string) ([]storage.Object, error) {
+	objects, err := s.storage.List(s.root() + fqdn + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list incremental backups of %s: %v", fqdn, err)
+	}
+	return objects, nil
+}
+
+// Uploaded returns true if the store contains the file of the node with the size.
+func (s *Store) Uploaded(fqdn, file string, size int64) (bool, error) {
+	key := s.Key(fqdn, file)
+	objects, err := s.storage.List(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up %s: %v", key, err)
+	}
+	for _, o := range objects {
+		if o.Key == key && o.Size == size {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Prune deletes the files of all nodes that were uploaded before the time and returns them. A backup that started
+// after the upload contains the data of the files.
+func (s *Store) Prune(before time.Time) ([]storage.Object, error) {
+	objects, err := s.storage.List(s.root())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list incremental backups: %v", err)
+	}
+	keys := []string{}
+	pruned := []storage.Object{}
+	for _, o := range objects {
+		// Only files of tables, <fqdn>/<keyspace>/<table>/<file>
+		if strings.Count(strings.TrimPrefix(o.Key, s.root()), "/") != 3 {
+			continue
+		}
+		if o.LastModified.Before(before) {
+			keys = append(keys, o.Key)
+			pruned = append(pruned, o)
+		}
+	}
+	if err := s.storage.Delete(keys...); err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
@@ -0,0 +1,277 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Status is the status of a backup or of the backup of a node.
+type Status string
+
+const (
+	Pending    Status = "Pending"
+	InProgress Status = "InProgress"
+	Complete   Status = "Complete"
+	Failed     Status = "Failed"
+)
+
+// Manifest describes a backup of all nodes of a Cassandra instance.
+type Manifest struct {
+	Name      string       `json:"name"`
+	Namespace string       `json:"namespace"`
+	Instance  string       `json:"instance"`
+	Status    Status       `json:"status"`
+	StartedAt metav1.Time  `json:"startedAt"`
+	EndedAt   *metav1.Time `json:"endedAt,omitempty"`
+	// Error is the reason of a failed backup.
+	Error string  `json:"error,omitempty"`
+	Nodes []*Node `json:"nodes"`
+}
+
+// Node is the backup of a Cassandra node.
+type Node struct {
+	Pod         string `json:"pod"`
+	StatefulSet string `json:"statefulSet"`
+	Datacenter  string `json:"datacenter"`
+	// FQDN identifies the backup of the node in the backup storage.
+	FQDN      string       `json:"fqdn"`
+	Status    Status       `json:"status"`
+	StartedAt *metav1.Time `json:"startedAt,omitempty"`
+	EndedAt   *metav1.Time `json:"endedAt,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	// Deleted is true if the files of a failed backup were deleted from the backup storage.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// New returns the manifest of a new backup.
+func New(name, namespace, instance string, nodes []*Node) *Manifest {
+	return &Manifest{
+		Name:      name,
+		Namespace: namespace,
+		Instance:  instance,
+		Status:    InProgress,
+		StartedAt: metav1.Now(),
+		Nodes:     nodes,
+	}
+}
+
+// Finish sets the end time and the status of the backup: complete if all nodes completed, failed otherwise.
+func (m *Manifest) Finish() {
+	now := metav1.Now()
+	m.EndedAt = &now
+	m.Status = Complete
+	failed := []string{}
+	for _, node := range m.Nodes {
+		if node.Status != Complete {
+			m.Status = Failed
+			failed = append(failed, node.Pod)
+		}
+	}
+	if len(failed) > 0 && m.Error == "" {
+		m.Error = fmt.Sprintf("backup of %s failed", strings.Join(failed, ", "))
+	}
+}
+
+// Fail marks the backup as failed before any node was backed up.
+func (m *Manifest) Fail(err error) {
+	now := metav1.Now()
+	m.EndedAt = &now
+	m.Status = Failed
+	m.Error = err.Error()
+}
+
+// Summary returns a human readable summary of the backup and all nodes.
+func (m *Manifest) Summary() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Backup %s of %s/%s: %s", m.Name, m.Namespace, m.Instance, m.Status)
+	if m.EndedAt != nil {
+		fmt.Fprintf(b, " after %v", m.EndedAt.Sub(m.StartedAt.Time).Round(time.Second))
+	}
+	if m.Error != "" {
+		fmt.Fprintf(b, ": %s", m.Error)
+	}
+	fmt.Fprintln(b)
+	for _, node := range m.Nodes {
+		fmt.Fprintf(b, "  %s (%s): %s", node.Pod, node.Datacenter, node.Status)
+		if node.StartedAt != nil && node.EndedAt != nil {
+			fmt.Fprintf(b, " after %v", node.EndedAt.Sub(node.StartedAt.Time).Round(time.Second))
+		}
+		if node.Error != "" {
+			fmt.Fprintf(b, ": %s", node.Error)
+		}
+		if node.Deleted {
+			fmt.Fprint(b, ", deleted from storage")
+		}
+		fmt.Fprintln(b)
+	}
+	return b.String()
+}
+
+var namePat = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+// ValidateName checks that the backup name can be used as a configmap key and a storage path.
+func ValidateName(name string) error {
+	if !namePat.MatchString(name) {
+		return fmt.Errorf("invalid backup name '%s': only letters, digits, '-', '_' and '.' are allowed", name)
+	}
+	return nil
+}
+
+// ConfigMapName returns the name of the configmap with the backup manifests of the instance.
+func ConfigMapName(instance string) string {
+	return fmt.Sprintf("%s-backups", instance)
+}
+
+// Store keeps the manifests of the backups of an instance in a configmap, one key per backup. The configmap has no
+// owner, so the manifests are kept when the instance is removed, like the backups themselves.
+type Store struct {
+	client    kubernetes.Interface
+	namespace string
+	instance  string
+}
+
+// NewStore returns a store for the backup manifests of the instance.
+func NewStore(client kubernetes.Interface, namespace, instance string) *Store {
+	return &Store{client: client, namespace: namespace, instance: instance}
+}
+
+// PurgeReportKey is the key of the report of the last purge in the configmap.
+const PurgeReportKey = "purge-report"
+
+// VerificationKey returns the key of the report of the last verification of the backup in the configmap.
+func VerificationKey(name string) string {
+	return name + ".verification"
+}
+
+func key(name string) string {
+	return name + ".json"
+}
+
+// Get returns the manifest of the backup, or nil if there is none.
+func (s *Store) Get(name string) (*Manifest, error) {
+	manifests, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range manifests {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// List returns all manifests, sorted by start time.
+func (s *Store) List() ([]*Manifest, error) {
+	name := ConfigMapName(s.instance)
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backup manifests %s/%s: %v", s.namespace, name, err)
+	}
+	manifests := []*Manifest{}
+	for k, data := range cm.Data {
+		if !strings.HasSuffix(k, ".json") {
+			continue
+		}
+		m := &Manifest{}
+		if err := json.Unmarshal([]byte(data), m); err != nil {
+			return nil, fmt.Errorf("invalid backup manifest %s in %s/%s: %v", k, s.namespace, name, err)
+		}
+		manifests = append(manifests, m)
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].StartedAt.Before(&manifests[j].StartedAt)
+	})
+	return manifests, nil
+}
+
+// Save persists the manifest.
+func (s *Store) Save(m *Manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to serialize backup manifest: %v", err)
+	}
+	err = s.update(func(d map[string]string) bool {
+		d[key(m.Name)] = string(data)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save backup manifest %s in %s/%s: %v", m.Name, s.namespace, ConfigMapName(s.instance), err)
+	}
+	return nil
+}
+
+// Delete removes the manifests of the backups. Unknown backups are ignored.
+func (s *Store) Delete(names ...string) error {
+	err := s.update(func(d map[string]string) bool {
+		changed := false
+		for _, n := range names {
+			if _, ok := d[key(n)]; ok {
+				delete(d, key(n))
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete backup manifests from %s/%s: %v", s.namespace, ConfigMapName(s.instance), err)
+	}
+	return nil
+}
+
+// SaveReport stores a report next to the manifests, e.g. of the last purge.
+func (s *Store) SaveReport(reportKey, report string) error {
+	err := s.update(func(d map[string]string) bool {
+		d[reportKey] = report
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save report %s in %s/%s: %v", reportKey, s.namespace, ConfigMapName(s.instance), err)
+	}
+	return nil
+}
+
+// update changes the data of the configmap, which is created if necessary. The configmap is only written if the
+// mutation returns true.
+func (s *Store) update(mutate func(data map[string]string) bool) error {
+	name := ConfigMapName(s.instance)
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: s.namespace,
+				Labels:    map[string]string{"app": s.instance},
+			},
+			Data: map[string]string{},
+		}
+		if !mutate(cm.Data) {
+			return nil
+		}
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(cm)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	if !mutate(cm.Data) {
+		return nil
+	}
+	_, err = s.client.CoreV1().ConfigMaps(s.namespace).Update(cm)
+	return err
+}
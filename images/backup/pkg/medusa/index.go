@@ -0,0 +1,262 @@
+package medusa
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+// StoredBackup is a backup in the backup storage, as recorded in the Medusa backup index.
+type StoredBackup struct {
+	Name string
+	// Nodes are the FQDNs of the nodes that started the backup.
+	Nodes []string
+	// Finished are the FQDNs of the nodes that finished the backup.
+	Finished  []string
+	StartedAt time.Time
+	// FinishedAt is the time the last node finished the backup, zero if a node did not finish.
+	FinishedAt time.Time
+}
+
+// Complete returns true if every node that started the backup also finished it.
+func (b StoredBackup) Complete() bool {
+	return len(b.Nodes) > 0 && len(b.Finished) == len(b.Nodes)
+}
+
+// Index reads and modifies the backups in the storage layout of Medusa:
+//
+//	<prefix>/index/backup_index/<backup>/  the index files of all nodes, e.g. started_<fqdn>_<timestamp>.timestamp
+//	<prefix>/<fqdn>/<backup>/meta/         the schema, token map and file manifest of the backup of a node
+//	<prefix>/<fqdn>/data/                  the data files of a node, shared by its differential backups
+type Index struct {
+	storage storage.Storage
+	prefix  string
+}
+
+// NewIndex returns the index of the backups with the prefix in the storage.
+func NewIndex(s storage.Storage, prefix string) *Index {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &Index{storage: s, prefix: prefix}
+}
+
+// Storage returns the storage of the index.
+func (i *Index) Storage() storage.Storage {
+	return i.storage
+}
+
+func (i *Index) backupIndexPath() string {
+	return i.prefix + "index/backup_index/"
+}
+
+func (i *Index) nodeBackupPath(fqdn, name string) string {
+	return fmt.Sprintf("%s%s/%s/", i.prefix, fqdn, name)
+}
+
+func (i *Index) dataPath(fqdn string) string {
+	return fmt.Sprintf("%s%s/data/", i.prefix, fqdn)
+}
+
+var timestampPat = regexp.MustCompile(`^(started|finished)_(.+)_([0-9]+)\.timestamp$`)
+
+// Backups returns all backups in the index, the oldest first.
+func (i *Index) Backups() ([]StoredBackup, error) {
+	objects, err := i.storage.List(i.backupIndexPath())
+	if err != nil {
+		return nil, err
+	}
+	backups := map[string]*StoredBackup{}
+	for _, o := range objects {
+		parts := strings.Split(strings.TrimPrefix(o.Key, i.backupIndexPath()), "/")
+		if len(parts) != 2 {
+			continue
+		}
+		name, file := parts[0], parts[1]
+		b, ok := backups[name]
+		if !ok {
+			b = &StoredBackup{Name: name}
+			backups[name] = b
+		}
+		match := timestampPat.FindStringSubmatch(file)
+		if match == nil {
+			continue
+		}
+		seconds, _ := strconv.ParseInt(match[3], 10, 64)
+		t := time.Unix(seconds, 0).UTC()
+		switch match[1] {
+		case "started":
+			b.Nodes = append(b.Nodes, match[2])
+			if b.StartedAt.IsZero() || t.Before(b.StartedAt) {
+				b.StartedAt = t
+			}
+		case "finished":
+			b.Finished = append(b.Finished, match[2])
+			if t.After(b.FinishedAt) {
+				b.FinishedAt = t
+			}
+		}
+	}
+
+	result := make([]StoredBackup, 0, len(backups))
+	for _, b := range backups {
+		sort.Strings(b.Nodes)
+		sort.Strings(b.Finished)
+		if !b.Complete() {
+			b.FinishedAt = time.Time{}
+		}
+		result = append(result, *b)
+	}
+	sort.Slice(result, func(a, b int) bool {
+		if !result[a].StartedAt.Equal(result[b].StartedAt) {
+			return result[a].StartedAt.Before(result[b].StartedAt)
+		}
+		return result[a].Name < result[b].Name
+	})
+	return result, nil
+}
+
+// Delete removes the backup from the index and deletes the backups of all nodes. The data files of differential
+// backups are kept, see Orphans. It returns the deleted objects.
+func (i *Index) Delete(backup StoredBackup) ([]storage.Object, error) {
+	// The index is deleted first, so the backup is not listed anymore if the deletion fails.
+	prefixes := []string{i.backupIndexPath() + backup.Name + "/"}
+	for _, fqdn := range backup.Nodes {
+		prefixes = append(prefixes, i.nodeBackupPath(fqdn, backup.Name))
+	}
+	deleted := []storage.Object{}
+	for _, prefix := range prefixes {
+		objects, err := i.storage.List(prefix)
+		if err != nil {
+			return deleted, err
+		}
+		if err := i.storage.Delete(keys(objects)...); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, objects...)
+	}
+	return deleted, nil
+}
+
+// ManifestTable is a table in the manifest.json of the backup of a node.
+type ManifestTable struct {
+	Keyspace     string           `json:"keyspace"`
+	ColumnFamily string           `json:"columnfamily"`
+	Objects      []ManifestObject `json:"objects"`
+}
+
+// ManifestObject is a file of a table in the backup of a node.
+type ManifestObject struct {
+	// Path is the key of the file in the storage.
+	Path string `json:"path"`
+	MD5  string `json:"MD5"`
+	Size int64  `json:"size"`
+}
+
+// NodeManifest returns the files of the backup of a node.
+func (i *Index) NodeManifest(fqdn, name string) ([]ManifestTable, error) {
+	return i.readManifest(i.nodeBackupPath(fqdn, name) + "meta/manifest.json")
+}
+
+func (i *Index) readManifest(key string) ([]ManifestTable, error) {
+	content, err := i.storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	tables := []ManifestTable{}
+	if err := json.Unmarshal(content, &tables); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", key, err)
+	}
+	return tables, nil
+}
+
+// MetaFiles are the files that the backup of every node contains in its meta directory.
+var MetaFiles = []string{"manifest.json", "schema.cql", "tokenmap.json"}
+
+// MetaPath returns the key of a file in the meta directory of the backup of a node.
+func (i *Index) MetaPath(fqdn, name, file string) string {
+	return i.nodeBackupPath(fqdn, name) + "meta/" + file
+}
+
+// NodePath returns the prefix of all files of a node.
+func (i *Index) NodePath(fqdn string) string {
+	return i.prefix + fqdn + "/"
+}
+
+// TokenMapEntry is a node in the token map of a backup.
+type TokenMapEntry struct {
+	Tokens []interface{} `json:"tokens"`
+	IsUp   bool          `json:"is_up"`
+	// Datacenter and Rack are only recorded by newer Medusa versions.
+	Datacenter string `json:"dc,omitempty"`
+	Rack       string `json:"rack,omitempty"`
+}
+
+// TokenMap returns the token map of the cluster at the time of the backup, by FQDN.
+func (i *Index) TokenMap(backup StoredBackup) (map[string]TokenMapEntry, error) {
+	if len(backup.Nodes) == 0 {
+		return nil, fmt.Errorf("backup %s has no nodes", backup.Name)
+	}
+	key := fmt.Sprintf("%s%s/tokenmap_%s.json", i.backupIndexPath(), backup.Name, backup.Nodes[0])
+	content, err := i.storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	tokenMap := map[string]TokenMapEntry{}
+	if err := json.Unmarshal(content, &tokenMap); err != nil {
+		return nil, fmt.Errorf("invalid token map %s: %v", key, err)
+	}
+	return tokenMap, nil
+}
+
+// Orphans returns the data files of the node that no backup of the node references and that were modified
+// before the time. Recent files are kept, they can belong to a backup that is in progress.
+func (i *Index) Orphans(fqdn string, before time.Time) ([]storage.Object, error) {
+	objects, err := i.storage.List(i.NodePath(fqdn))
+	if err != nil {
+		return nil, err
+	}
+	referenced := map[string]bool{}
+	data := []storage.Object{}
+	for _, o := range objects {
+		if strings.HasPrefix(o.Key, i.dataPath(fqdn)) {
+			data = append(data, o)
+			continue
+		}
+		if !strings.HasSuffix(o.Key, "/meta/manifest.json") {
+			continue
+		}
+		// Without all references, no file can be considered orphaned
+		tables, err := i.readManifest(o.Key)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range tables {
+			for _, object := range table.Objects {
+				referenced[object.Path] = true
+			}
+		}
+	}
+
+	orphans := []storage.Object{}
+	for _, o := range data {
+		if !referenced[o.Key] && o.LastModified.Before(before) {
+			orphans = append(orphans, o)
+		}
+	}
+	return orphans, nil
+}
+
+func keys(objects []storage.Object) []string {
+	result := make([]string, 0, len(objects))
+	for _, o := range objects {
+		result = append(result, o.Key)
+	}
+	return result
+}
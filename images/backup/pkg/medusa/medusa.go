@@ -0,0 +1,88 @@
+package medusa
+
+import (
+	"bytes"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// Container is the name of the Medusa sidecar in the node pods.
+	Container = "medusa-backup"
+	// Binary is the Medusa command line tool in the sidecar.
+	Binary = "/usr/local/bin/medusa"
+	// DeleteScript deletes the backup of the node from the backup storage.
+	DeleteScript = "/etc/cassandra/medusa-delete-backup.sh"
+)
+
+// Executor runs commands in containers of a pod.
+type Executor interface {
+	Exec(pod *corev1.Pod, container string, command []string) (string, error)
+}
+
+type podExecutor struct {
+	config *rest.Config
+	client kubernetes.Interface
+}
+
+// NewPodExecutor returns an Executor that uses the pods/exec subresource.
+func NewPodExecutor(config *rest.Config, client kubernetes.Interface) Executor {
+	return &podExecutor{config: config, client: client}
+}
+
+func (e *podExecutor) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	req := e.client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod.Name).
+		Namespace(pod.Namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(e.config, "POST", req.URL())
+	if err != nil {
+		return "", fmt.Errorf("failed to create executor for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = exec.Stream(remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		return stdout.String(), fmt.Errorf("command %v in pod %s/%s failed: %v: %s", command, pod.Namespace, pod.Name, err, lastLines(stderr.String(), 10))
+	}
+	return stdout.String(), nil
+}
+
+// Backup creates a backup of the node in the pod with Medusa.
+func Backup(executor Executor, pod *corev1.Pod, name string) (string, error) {
+	return executor.Exec(pod, Container, []string{"python3", Binary, "backup", "--backup-name", name})
+}
+
+// DeleteBackup deletes the files of the backup of the node in the pod from the backup storage. Files that are
+// shared with other backups of the node are kept.
+func DeleteBackup(executor Executor, pod *corev1.Pod, name string) (string, error) {
+	return executor.Exec(pod, Container, []string{"/bin/bash", DeleteScript, name})
+}
+
+// lastLines returns at most the last n lines of the output, Medusa logs a lot before it fails.
+func lastLines(out string, n int) string {
+	lines := bytes.Split(bytes.TrimRight([]byte(out), "\n"), []byte("\n"))
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return string(bytes.Join(lines, []byte("\n")))
+}
+
+// StreamRestore downloads the backup of the node with the FQDN and streams it into the cluster with sstableloader,
+// from the node in the pod. The tables must exist.
+func StreamRestore(executor Executor, pod *corev1.Pod, fqdn, name string) (string, error) {
+	return executor.Exec(pod, Container, []string{"python3", Binary, "--fqdn", fqdn, "restore-node", "--backup-name", name, "--use-sstableloader"})
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "cassandra_backup"
+
+var (
+	// IncrementalPendingFiles is the number of incremental backup files of the node that are not shipped yet.
+	IncrementalPendingFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "incremental_pending_files",
+		Help:      "Number of files in the incremental backup directories that are not shipped yet.",
+	})
+	// IncrementalPendingBytes is the size of the incremental backup files that are not shipped yet.
+	IncrementalPendingBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "incremental_pending_bytes",
+		Help:      "Size of the files in the incremental backup directories that are not shipped yet.",
+	})
+	// IncrementalLag is the age of the oldest incremental backup file that is not shipped yet.
+	IncrementalLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "incremental_lag_seconds",
+		Help:      "Age of the oldest file in the incremental backup directories that is not shipped yet, 0 if all files are shipped.",
+	})
+	// IncrementalUploadedFiles counts the uploaded incremental backup files.
+	IncrementalUploadedFiles = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "incremental_uploaded_files_total",
+		Help:      "Number of incremental backup files that were uploaded.",
+	})
+	// IncrementalUploadedBytes counts the size of the uploaded incremental backup files.
+	IncrementalUploadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "incremental_uploaded_bytes_total",
+		Help:      "Size of the incremental backup files that were uploaded.",
+	})
+	// IncrementalDeduplicatedFiles counts the incremental backup files that were removed without an upload.
+	IncrementalDeduplicatedFiles = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "incremental_deduplicated_files_total",
+		Help:      "Number of incremental backup files that were not uploaded because the last full backup or an earlier upload contains them.",
+	})
+	// IncrementalErrors counts the failed attempts to ship an incremental backup file.
+	IncrementalErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "incremental_errors_total",
+		Help:      "Number of failed attempts to ship an incremental backup file.",
+	})
+	// IncrementalLastShipped is the time the last incremental backup file was shipped.
+	IncrementalLastShipped = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "incremental_last_shipped_timestamp_seconds",
+		Help:      "Unix time the last incremental backup file was shipped.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(IncrementalPendingFiles, IncrementalPendingBytes, IncrementalLag, IncrementalUploadedFiles,
+		IncrementalUploadedBytes, IncrementalDeduplicatedFiles, IncrementalErrors, IncrementalLastShipped)
+}
+
+// Serve exposes the metrics on /metrics of the address. It does not return.
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("Serving metrics on %s/metrics", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Errorf("Metrics server failed: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package purge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/commitlog"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/incremental"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/manifest"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/retention"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+// DefaultGracePeriod is the minimum age of a data file before it is deleted as an orphan.
+const DefaultGracePeriod = 24 * time.Hour
+
+// Protection returns the backups that must not be purged, with the reason.
+type Protection interface {
+	Protected() (map[string]string, error)
+}
+
+// Options configures a purge.
+type Options struct {
+	Policy retention.Policy
+	// GracePeriod protects recently uploaded data files, which may belong to a backup in progress.
+	GracePeriod time.Duration
+	// Commitlogs are pruned up to the start of the oldest remaining backup if set, older commitlogs can not be
+	// replayed by a point-in-time restore anymore.
+	Commitlogs *commitlog.Store
+	// Incremental backups are pruned up to the start of the oldest remaining backup if set, that backup contains
+	// their data.
+	Incremental *incremental.Store
+}
+
+// Purger applies a retention policy to the backups in the backup storage.
+type Purger struct {
+	index      *medusa.Index
+	store      *manifest.Store
+	protection Protection
+	options    Options
+	now        func() time.Time
+}
+
+// NewPurger returns a purger for the backups in the index. The manifests of purged backups are removed from the
+// store.
+func NewPurger(index *medusa.Index, store *manifest.Store, protection Protection, options Options) *Purger {
+	if options.GracePeriod == 0 {
+		options.GracePeriod = DefaultGracePeriod
+	}
+	return &Purger{index: index, store: store, protection: protection, options: options, now: time.Now}
+}
+
+// Report describes the result of a purge.
+type Report struct {
+	Time      time.Time
+	Policy    retention.Policy
+	Decisions []Decision
+	// Orphans are the deleted data files per node that no backup referenced anymore.
+	Orphans map[string]Deleted
+	// Commitlogs are the deleted commitlog segments of all nodes.
+	Commitlogs Deleted
+	// Incremental are the deleted incremental backup files of all nodes.
+	Incremental Deleted
+	Errors      []string
+}
+
+// Decision is the retention decision for a backup and what was deleted.
+type Decision struct {
+	retention.Decision
+	// Protected is the reason why a backup that the policy purges is kept.
+	Protected string
+	Deleted   Deleted
+}
+
+// Deleted counts deleted objects.
+type Deleted struct {
+	Objects int
+	Bytes   int64
+}
+
+func (d *Deleted) add(objects []storage.Object) {
+	for _, o := range objects {
+		d.Objects++
+		d.Bytes += o.Size
+	}
+}
+
+func (d Deleted) String() string {
+	return fmt.Sprintf("%d objects, %d bytes", d.Objects, d.Bytes)
+}
+
+func (d Decision) String() string {
+	switch {
+	case d.Keep:
+		return d.Decision.String()
+	case d.Protected != "":
+		return fmt.Sprintf("%s: kept, %s", d.Backup.Name, d.Protected)
+	default:
+		return fmt.Sprintf("%s: purged, %s", d.Backup.Name, d.Deleted)
+	}
+}
+
+// Purged returns the names of the purged backups.
+func (r *Report) Purged() []string {
+	names := []string{}
+	for _, d := range r.Decisions {
+		if !d.Keep && d.Protected == "" {
+			names = append(names, d.Backup.Name)
+		}
+	}
+	return names
+}
+
+func (r *Report) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Purge at %s with policy %s: %d of %d backups purged\n", r.Time.UTC().Format(time.RFC3339), r.Policy, len(r.Purged()), len(r.Decisions))
+	for _, d := range r.Decisions {
+		fmt.Fprintf(b, "  %s\n", d)
+	}
+	nodes := make([]string, 0, len(r.Orphans))
+	for fqdn := range r.Orphans {
+		nodes = append(nodes, fqdn)
+	}
+	sort.Strings(nodes)
+	for _, fqdn := range nodes {
+		fmt.Fprintf(b, "  data files of %s: purged, %s\n", fqdn, r.Orphans[fqdn])
+	}
+	if r.Commitlogs.Objects > 0 {
+		fmt.Fprintf(b, "  commitlogs: purged, %s\n", r.Commitlogs)
+	}
+	if r.Incremental.Objects > 0 {
+		fmt.Fprintf(b, "  incremental backups: purged, %s\n", r.Incremental)
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(b, "  error: %s\n", e)
+	}
+	return b.String()
+}
+
+// Run purges the backups that the policy does not keep and the data files that are not referenced anymore.
+func (p *Purger) Run() (*Report, error) {
+	now := p.now()
+	report := &Report{Time: now, Policy: p.options.Policy, Orphans: map[string]Deleted{}}
+	if !p.options.Policy.Enabled() {
+		log.Infof("No retention policy is configured, all backups are kept")
+		return report, nil
+	}
+
+	backups, err := p.index.Backups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %v", err)
+	}
+	protected, err := p.protection.Protected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find protected backups: %v", err)
+	}
+
+	nodes := map[string]bool{}
+	// oldest is the start of the oldest complete backup that remains
+	oldest := time.Time{}
+	for _, decision := range p.options.Policy.Apply(backups, now) {
+		d := Decision{Decision: decision}
+		for _, fqdn := range d.Backup.Nodes {
+			nodes[fqdn] = true
+		}
+		if !d.Keep {
+			if reason, ok := protected[d.Backup.Name]; ok {
+				d.Protected = reason
+			} else {
+				log.Infof("Purging backup %s started at %s", d.Backup.Name, d.Backup.StartedAt.Format(time.RFC3339))
+				deleted, err := p.index.Delete(d.Backup)
+				d.Deleted.add(deleted)
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("failed to purge backup %s: %v", d.Backup.Name, err))
+				}
+			}
+		}
+		if (d.Keep || d.Protected != "") && d.Backup.Complete() && (oldest.IsZero() || d.Backup.StartedAt.Before(oldest)) {
+			oldest = d.Backup.StartedAt
+		}
+		log.Infof("Backup %s", d)
+		report.Decisions = append(report.Decisions, d)
+	}
+
+	for fqdn := range nodes {
+		orphans, err := p.index.Orphans(fqdn, now.Add(-p.options.GracePeriod))
+		if err == nil {
+			err = p.index.Storage().Delete(keys(orphans)...)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to purge data files of %s: %v", fqdn, err))
+			continue
+		}
+		if len(orphans) > 0 {
+			deleted := Deleted{}
+			deleted.add(orphans)
+			report.Orphans[fqdn] = deleted
+		}
+	}
+
+	if p.options.Commitlogs != nil && !oldest.IsZero() {
+		pruned, err := p.options.Commitlogs.Prune(oldest)
+		report.Commitlogs.add(pruned)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to purge commitlogs: %v", err))
+		}
+	}
+	if p.options.Incremental != nil && !oldest.IsZero() {
+		pruned, err := p.options.Incremental.Prune(oldest)
+		report.Incremental.add(pruned)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to purge incremental backups: %v", err))
+		}
+	}
+
+	if err := p.store.Delete(report.Purged()...); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	if err := p.store.SaveReport(manifest.PurgeReportKey, report.String()); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	if len(report.Errors) > 0 {
+		return report, fmt.Errorf("purge failed: %s", strings.Join(report.Errors, "; "))
+	}
+	return report, nil
+}
+
+func keys(objects []storage.Object) []string {
+	result := make([]string, 0, len(objects))
+	for _, o := range objects {
+		result = append(result, o.Key)
+	}
+	return result
+}
@@ -0,0 +1,227 @@
+package purge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/commitlog"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/incremental"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/manifest"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/retention"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+var (
+	now     = time.Date(2020, 6, 10, 12, 0, 0, 0, time.UTC)
+	longAgo = now.Add(-30 * 24 * time.Hour)
+	nodes   = []string{"cassandra-node-0.cassandra-svc.default.svc.cluster.local", "cassandra-node-1.cassandra-svc.default.svc.cluster.local"}
+)
+
+// layout writes files in the Medusa storage layout with the prefix "cluster" to a directory.
+type layout struct {
+	t   *testing.T
+	dir string
+}
+
+func (l *layout) write(key string, content []byte, modified time.Time) {
+	path := filepath.Join(l.dir, filepath.FromSlash(key))
+	assert.NoError(l.t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(l.t, ioutil.WriteFile(path, content, 0644))
+	assert.NoError(l.t, os.Chtimes(path, modified, modified))
+}
+
+func (l *layout) exists(key string) bool {
+	_, err := os.Stat(filepath.Join(l.dir, filepath.FromSlash(key)))
+	return err == nil
+}
+
+// dataFile writes a data file of a node.
+func (l *layout) dataFile(fqdn, file string, modified time.Time) string {
+	key := fmt.Sprintf("cluster/%s/data/ks/table/%s", fqdn, file)
+	l.write(key, []byte("data"), modified)
+	return key
+}
+
+// backup writes the backup of the nodes which reference the data files. Only the given number of nodes finish it.
+func (l *layout) backup(name string, started time.Time, finished int, files ...string) {
+	for i, fqdn := range nodes {
+		index := fmt.Sprintf("cluster/index/backup_index/%s/", name)
+		l.write(fmt.Sprintf("%sstarted_%s_%d.timestamp", index, fqdn, started.Unix()), nil, started)
+		l.write(fmt.Sprintf("%stokenmap_%s.json", index, fqdn), []byte("{}"), started)
+		if i >= finished {
+			continue
+		}
+		objects := []map[string]interface{}{}
+		for _, file := range files {
+			objects = append(objects, map[string]interface{}{"path": fmt.Sprintf("cluster/%s/data/ks/table/%s", fqdn, file), "MD5": "", "size": 4})
+		}
+		m, _ := json.Marshal([]map[string]interface{}{{"keyspace": "ks", "columnfamily": "table", "objects": objects}})
+		l.write(fmt.Sprintf("cluster/%s/%s/meta/manifest.json", fqdn, name), m, started)
+		l.write(fmt.Sprintf("cluster/%s/%s/meta/schema.cql", fqdn, name), []byte(""), started)
+		l.write(fmt.Sprintf("%sfinished_%s_%d.timestamp", index, fqdn, started.Add(time.Minute).Unix()), nil, started)
+	}
+}
+
+type protection map[string]string
+
+func (p protection) Protected() (map[string]string, error) {
+	return p, nil
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purge")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l := &layout{t: t, dir: dir}
+
+	for _, fqdn := range nodes {
+		l.dataFile(fqdn, "old", longAgo)
+		l.dataFile(fqdn, "shared", longAgo)
+		l.dataFile(fqdn, "restored", longAgo)
+		l.dataFile(fqdn, "uploading", now.Add(-time.Hour))
+	}
+	l.backup("b1", longAgo, 2, "old", "shared")
+	l.backup("b2", longAgo.Add(24*time.Hour), 2, "restored")
+	l.backup("b3", now.Add(-2*time.Hour), 2, "shared")
+	l.backup("b4", now.Add(-time.Hour), 1, "shared")
+	// Commitlogs before b2, the oldest remaining backup, can not be replayed anymore
+	l.write("cluster/commitlogs/"+nodes[0]+"/archived/CommitLog-7-1.log", []byte("segment"), longAgo)
+	l.write("cluster/commitlogs/"+nodes[0]+"/archived/CommitLog-7-2.log", []byte("segment"), now.Add(-3*time.Hour))
+	l.write("cluster/incremental/"+nodes[0]+"/ks/table/md-1-big-Data.db", []byte("sstable"), longAgo)
+	l.write("cluster/incremental/"+nodes[0]+"/ks/table/md-2-big-Data.db", []byte("sstable"), now.Add(-3*time.Hour))
+
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cassandra-backups", Namespace: "default"},
+		Data:       map[string]string{"b1.json": "{}", "b3.json": "{}"},
+	})
+	store := manifest.NewStore(client, "default", "cassandra")
+	index := medusa.NewIndex(storage.NewLocal(dir), "cluster")
+	commitlogs := commitlog.NewStore(storage.NewLocal(dir), "cluster")
+	incrementals := incremental.NewStore(storage.NewLocal(dir), "cluster")
+	p := NewPurger(index, store, protection{"b2": "restored by other/cassandra"}, Options{Policy: retention.Policy{KeepLast: 1}, Commitlogs: commitlogs, Incremental: incrementals})
+	p.now = func() time.Time { return now }
+
+	report, err := p.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b1"}, report.Purged())
+
+	backups, err := index.Backups()
+	assert.NoError(t, err)
+	names := []string{}
+	for _, b := range backups {
+		names = append(names, b.Name)
+	}
+	assert.Equal(t, []string{"b2", "b3", "b4"}, names)
+	for _, fqdn := range nodes {
+		assert.False(t, l.exists(fmt.Sprintf("cluster/%s/b1/meta/manifest.json", fqdn)))
+		assert.True(t, l.exists(fmt.Sprintf("cluster/%s/b2/meta/manifest.json", fqdn)))
+		assert.False(t, l.exists(fmt.Sprintf("cluster/%s/data/ks/table/old", fqdn)), "unreferenced data files are deleted")
+		assert.True(t, l.exists(fmt.Sprintf("cluster/%s/data/ks/table/shared", fqdn)))
+		assert.True(t, l.exists(fmt.Sprintf("cluster/%s/data/ks/table/restored", fqdn)))
+		assert.True(t, l.exists(fmt.Sprintf("cluster/%s/data/ks/table/uploading", fqdn)), "recent data files are kept")
+	}
+	assert.False(t, l.exists("cluster/commitlogs/"+nodes[0]+"/archived/CommitLog-7-1.log"))
+	assert.True(t, l.exists("cluster/commitlogs/"+nodes[0]+"/archived/CommitLog-7-2.log"))
+	assert.False(t, l.exists("cluster/incremental/"+nodes[0]+"/ks/table/md-1-big-Data.db"))
+	assert.True(t, l.exists("cluster/incremental/"+nodes[0]+"/ks/table/md-2-big-Data.db"))
+
+	cm, err := client.CoreV1().ConfigMaps("default").Get("cassandra-backups", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, cm.Data, "b1.json")
+	assert.Contains(t, cm.Data, "b3.json")
+	assert.Equal(t, `Purge at 2020-06-10T12:00:00Z with policy keep last 1, daily for 0 days, weekly for 0 weeks: 1 of 4 backups purged
+  b1: purged, 10 objects, 566 bytes
+  b2: kept, restored by other/cassandra
+  b3: keep (latest, last 1)
+  b4: keep (incomplete)
+  data files of cassandra-node-0.cassandra-svc.default.svc.cluster.local: purged, 1 objects, 4 bytes
+  data files of cassandra-node-1.cassandra-svc.default.svc.cluster.local: purged, 1 objects, 4 bytes
+  commitlogs: purged, 1 objects, 7 bytes
+  incremental backups: purged, 1 objects, 7 bytes
+`, cm.Data[manifest.PurgeReportKey])
+}
+
+func TestRun_disabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purge")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l := &layout{t: t, dir: dir}
+	l.backup("b1", longAgo, 2)
+	l.backup("b2", now, 2)
+
+	index := medusa.NewIndex(storage.NewLocal(dir), "cluster")
+	p := NewPurger(index, manifest.NewStore(fake.NewSimpleClientset(), "default", "cassandra"), protection{}, Options{})
+	report, err := p.Run()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Purged())
+	backups, err := index.Backups()
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+}
+
+func instance(namespace, name string, params map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kudo.dev/v1beta1",
+		"kind":       "Instance",
+		"metadata":   map[string]interface{}{"namespace": namespace, "name": name},
+		"spec":       map[string]interface{}{"parameters": params},
+	}}
+}
+
+func TestRestoreProtection(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		instance("a", "restored", map[string]interface{}{"RESTORE_FLAG": "true", "BACKUP_NAME": "b1", "BACKUP_AWS_S3_BUCKET_NAME": "bucket", "BACKUP_PREFIX": "cluster"}),
+		instance("b", "defaults", map[string]interface{}{"RESTORE_FLAG": "true", "BACKUP_NAME": "b2"}),
+		instance("c", "other-bucket", map[string]interface{}{"RESTORE_FLAG": "true", "BACKUP_NAME": "b3", "BACKUP_AWS_S3_BUCKET_NAME": "other"}),
+		instance("d", "not-restored", map[string]interface{}{"BACKUP_NAME": "b4"}),
+		instance("e", "storage-bucket", map[string]interface{}{"RESTORE_FLAG": "true", "BACKUP_NAME": "b5", "BACKUP_STORAGE_BUCKET": "bucket", "BACKUP_AWS_S3_BUCKET_NAME": "other"}),
+		instance("f", "deprecated-bucket", map[string]interface{}{"RESTORE_FLAG": "true", "BACKUP_NAME": "b6", "BACKUP_STORAGE_BUCKET": "other", "BACKUP_AWS_S3_BUCKET_NAME": "bucket"}),
+		instance("g", "other-provider", map[string]interface{}{"RESTORE_FLAG": "true", "BACKUP_NAME": "b7", "BACKUP_STORAGE_PROVIDER": "google_storage"}),
+		instance("h", "completed", map[string]interface{}{"RESTORE_FLAG": "true", "BACKUP_NAME": "b8"}),
+		instance("i", "completed-other", map[string]interface{}{"RESTORE_FLAG": "true", "BACKUP_NAME": "b9"}),
+	)
+	// The restore plans record the completed restores
+	client := fake.NewSimpleClientset(
+		restorePlan("h", "completed", "b8"),
+		restorePlan("i", "completed-other", "b8"),
+	)
+	protected, err := NewRestoreProtection(client, dynamicClient, Location{Provider: "s3_us_west_oregon", Bucket: "bucket", Prefix: "cluster"}).Protected()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"b1": "restored by a/restored", "b2": "restored by b/defaults", "b5": "restored by e/storage-bucket", "b9": "restored by i/completed-other"}, protected)
+}
+
+func restorePlan(namespace, instance, completed string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: instance + "-restore-plan"},
+		Data:       map[string]string{"completed": completed},
+	}
+}
+
+func TestRestoreProtection_local(t *testing.T) {
+	local := func(backup, claim string) map[string]interface{} {
+		return map[string]interface{}{"RESTORE_FLAG": "true", "BACKUP_NAME": backup, "BACKUP_STORAGE_PROVIDER": "local", "BACKUP_STORAGE_BUCKET": "bucket", "BACKUP_STORAGE_LOCAL_CLAIM": claim}
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		instance("a", "same-claim", local("b1", "backups")),
+		instance("a", "other-claim", local("b2", "other")),
+		instance("b", "other-namespace", local("b3", "backups")),
+		instance("a", "s3", map[string]interface{}{"RESTORE_FLAG": "true", "BACKUP_NAME": "b4", "BACKUP_AWS_S3_STORAGE_PROVIDER": "s3_us_west_oregon"}),
+	)
+	protected, err := NewRestoreProtection(fake.NewSimpleClientset(), dynamicClient, Location{Provider: "local", Bucket: "bucket", Namespace: "a", LocalClaim: "backups"}).Protected()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"b1": "restored by a/same-claim"}, protected)
+}
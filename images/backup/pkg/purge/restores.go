@@ -0,0 +1,95 @@
+package purge
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/restore"
+)
+
+var instancesResource = schema.GroupVersionResource{Group: "kudo.dev", Version: "v1beta1", Resource: "instances"}
+
+// Location identifies the backups of an instance.
+type Location struct {
+	Provider string
+	Bucket   string
+	Prefix   string
+	// Namespace and LocalClaim identify the volume of a 'local' storage.
+	Namespace  string
+	LocalClaim string
+}
+
+// RestoreProtection protects the backups that KUDO instances in any namespace restore from, as long as their
+// RESTORE_FLAG parameter is true and the restore plan of the instance does not record the restore as completed.
+type RestoreProtection struct {
+	client   kubernetes.Interface
+	dynamic  dynamic.Interface
+	location Location
+}
+
+// NewRestoreProtection protects the backups in the location. Instances that do not set a parameter of the location
+// are assumed to use the same value.
+func NewRestoreProtection(client kubernetes.Interface, dynamicClient dynamic.Interface, location Location) *RestoreProtection {
+	return &RestoreProtection{client: client, dynamic: dynamicClient, location: location}
+}
+
+// Protected returns the names of the restored backups and the instances that restore them.
+func (r *RestoreProtection) Protected() (map[string]string, error) {
+	list, err := r.dynamic.Resource(instancesResource).Namespace(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list KUDO instances: %v", err)
+	}
+	protected := map[string]string{}
+	for _, instance := range list.Items {
+		params, _, err := unstructured.NestedStringMap(instance.Object, "spec", "parameters")
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameters of instance %s/%s: %v", instance.GetNamespace(), instance.GetName(), err)
+		}
+		if params["RESTORE_FLAG"] != "true" || params["BACKUP_NAME"] == "" {
+			continue
+		}
+		if !r.sameLocation(instance.GetNamespace(), params) {
+			continue
+		}
+		// RESTORE_FLAG stays set after the restore, a restored backup can be purged
+		completed, err := restore.NewPlanStore(r.client, instance.GetNamespace(), instance.GetName()).Completed(params["BACKUP_NAME"])
+		if err != nil {
+			return nil, err
+		}
+		if completed {
+			continue
+		}
+		protected[params["BACKUP_NAME"]] = fmt.Sprintf("restored by %s/%s", instance.GetNamespace(), instance.GetName())
+	}
+	return protected, nil
+}
+
+// sameLocation returns true if the instance in the namespace with the parameters restores from the location. The
+// parameters are resolved with the same fallbacks as in the operator templates.
+func (r *RestoreProtection) sameLocation(namespace string, params map[string]string) bool {
+	if !matches(params, r.location.Bucket, "BACKUP_STORAGE_BUCKET", "BACKUP_AWS_S3_BUCKET_NAME") ||
+		!matches(params, r.location.Prefix, "BACKUP_PREFIX") ||
+		!matches(params, r.location.Provider, "BACKUP_STORAGE_PROVIDER", "BACKUP_AWS_S3_STORAGE_PROVIDER") {
+		return false
+	}
+	if r.location.Provider != "local" {
+		return true
+	}
+	// The claim of a local storage is a different volume in every namespace
+	return namespace == r.location.Namespace && matches(params, r.location.LocalClaim, "BACKUP_STORAGE_LOCAL_CLAIM")
+}
+
+// matches returns true if the first non-empty parameter of the names has the value, or if none of them is set.
+func matches(params map[string]string, value string, names ...string) bool {
+	for _, name := range names {
+		if v := params[name]; v != "" {
+			return v == value
+		}
+	}
+	return true
+}
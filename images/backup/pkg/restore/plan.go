@@ -0,0 +1,380 @@
+package restore
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/manifest"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+)
+
+// defaultDatacenter is the datacenter of the nodes of an instance without NODE_TOPOLOGY.
+const defaultDatacenter = "datacenter1"
+
+// Mode is the way a backup is restored.
+type Mode string
+
+const (
+	// InPlace restores the backup of every old node into one new node with the same tokens, before Cassandra
+	// starts. It requires the same datacenters with the same number of nodes and tokens.
+	InPlace Mode = "in-place"
+	// Stream starts the new cluster empty and streams the backups of the old nodes into it with sstableloader.
+	Stream Mode = "stream"
+)
+
+// Datacenter is a datacenter of the new cluster.
+type Datacenter struct {
+	Name  string `json:"name"`
+	Nodes int    `json:"nodes"`
+	// StatefulSet is the name of the StatefulSet of the datacenter, the pods are named <StatefulSet>-<ordinal>.
+	StatefulSet string `json:"statefulSet"`
+}
+
+// Pods returns the names of the pods of the datacenter.
+func (d Datacenter) Pods() []string {
+	pods := []string{}
+	for i := 0; i < d.Nodes; i++ {
+		pods = append(pods, fmt.Sprintf("%s-%d", d.StatefulSet, i))
+	}
+	return pods
+}
+
+// Topology is the topology of the new cluster.
+type Topology struct {
+	Datacenters []Datacenter
+	NumTokens   int
+	// Sidecar is true if the nodes run the Medusa sidecar, which is required to stream backups.
+	Sidecar bool
+}
+
+// nodeTopology is an entry of the NODE_TOPOLOGY parameter.
+type nodeTopology struct {
+	Datacenter string `json:"datacenter"`
+	Nodes      int    `json:"nodes"`
+}
+
+// NewTopology returns the topology of an instance from its parameters. nodeTopology is the JSON of NODE_TOPOLOGY,
+// nodeCount is only used if it is empty.
+func NewTopology(instance, nodeTopologyJSON string, nodeCount, numTokens int, sidecar bool) (Topology, error) {
+	t := Topology{NumTokens: numTokens, Sidecar: sidecar}
+	if nodeTopologyJSON == "" || nodeTopologyJSON == "null" {
+		t.Datacenters = []Datacenter{{Name: defaultDatacenter, Nodes: nodeCount, StatefulSet: instance + "-node"}}
+		return t, nil
+	}
+	entries := []nodeTopology{}
+	if err := json.Unmarshal([]byte(nodeTopologyJSON), &entries); err != nil {
+		return t, fmt.Errorf("invalid NODE_TOPOLOGY: %v", err)
+	}
+	for _, e := range entries {
+		t.Datacenters = append(t.Datacenters, Datacenter{Name: e.Datacenter, Nodes: e.Nodes, StatefulSet: fmt.Sprintf("%s-%s-node", instance, e.Datacenter)})
+	}
+	return t, nil
+}
+
+func (t Topology) datacenter(name string) (Datacenter, bool) {
+	for _, d := range t.Datacenters {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return Datacenter{}, false
+}
+
+func (t Topology) nodes() int {
+	n := 0
+	for _, d := range t.Datacenters {
+		n += d.Nodes
+	}
+	return n
+}
+
+// SourceNode is a node of the backed up cluster.
+type SourceNode struct {
+	FQDN       string `json:"fqdn"`
+	Datacenter string `json:"datacenter"`
+	Tokens     int    `json:"tokens"`
+}
+
+// Assignment assigns the backup of an old node to a new pod. In place, the pod restores the backup as its own data,
+// when streaming the pod loads the backup into the cluster.
+type Assignment struct {
+	Pod    string `json:"pod"`
+	Source string `json:"source"`
+}
+
+// Plan describes how a backup is restored into the new cluster.
+type Plan struct {
+	Backup string `json:"backup"`
+	Mode   Mode   `json:"mode"`
+	// Reason explains why the backup is streamed.
+	Reason string `json:"reason,omitempty"`
+	// Datacenters maps the datacenters of the backup to the datacenters of the new cluster.
+	Datacenters map[string]string `json:"datacenters"`
+	Sources     []SourceNode      `json:"sources"`
+	Assignments []Assignment      `json:"assignments"`
+	// Pods are all pods of the new cluster.
+	Pods []string `json:"pods"`
+	// StartedAt is the time the first node started the backup.
+	StartedAt time.Time `json:"startedAt"`
+	// PointInTime is the time up to which the archived commitlogs are replayed after the restore of the snapshots.
+	PointInTime *time.Time `json:"pointInTime,omitempty"`
+}
+
+// SetPointInTime replays the archived commitlogs of the old nodes up to the time. Commitlogs are only replayed by
+// nodes that restore a backup in place.
+func (p *Plan) SetPointInTime(t time.Time) error {
+	if p.Mode != InPlace {
+		return fmt.Errorf("a point-in-time restore requires an in-place restore, but backup %s is streamed (%s)", p.Backup, p.Reason)
+	}
+	if !t.After(p.StartedAt) {
+		return fmt.Errorf("the point in time %s is before backup %s started at %s", t.UTC().Format(time.RFC3339), p.Backup, p.StartedAt.UTC().Format(time.RFC3339))
+	}
+	p.PointInTime = &t
+	return nil
+}
+
+// PodInstruction returns what the restore init container of the pod does: "in-place <fqdn>" to restore the
+// backup of the old node, or "stream" to start empty.
+func (p *Plan) PodInstruction(pod string) string {
+	if source, ok := p.Source(pod); ok {
+		return fmt.Sprintf("%s %s", InPlace, source)
+	}
+	return string(Stream)
+}
+
+// Source returns the old node whose backup the pod restores in place.
+func (p *Plan) Source(pod string) (string, bool) {
+	if p.Mode == InPlace {
+		for _, a := range p.Assignments {
+			if a.Pod == pod {
+				return a.Source, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (p *Plan) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Restore of backup %s: %s", p.Backup, p.Mode)
+	if p.Reason != "" {
+		fmt.Fprintf(b, " (%s)", p.Reason)
+	}
+	if p.PointInTime != nil {
+		fmt.Fprintf(b, ", commitlogs replayed until %s", p.PointInTime.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintln(b)
+	olds := []string{}
+	for old := range p.Datacenters {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+	for _, old := range olds {
+		fmt.Fprintf(b, "  datacenter %s -> %s\n", old, p.Datacenters[old])
+	}
+	verb := "restores"
+	if p.Mode == Stream {
+		verb = "streams"
+	}
+	for _, a := range p.Assignments {
+		fmt.Fprintf(b, "  %s %s %s\n", a.Pod, verb, a.Source)
+	}
+	return b.String()
+}
+
+// Planner creates restore plans from the backups in the storage.
+type Planner struct {
+	index *medusa.Index
+	store *manifest.Store
+}
+
+// NewPlanner returns a planner for the backups in the index. The store is optional, the datacenters of the old
+// nodes are taken from the backup manifests if it is set and contains the backup.
+func NewPlanner(index *medusa.Index, store *manifest.Store) *Planner {
+	return &Planner{index: index, store: store}
+}
+
+// Plan creates and validates the plan to restore the backup into the topology. mapping renames datacenters of the
+// backup, datacenters that are not mapped keep their name.
+func (p *Planner) Plan(name string, topology Topology, mapping map[string]string) (*Plan, error) {
+	backup, sources, err := p.sources(name)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := p.index.Storage().Get(p.index.MetaPath(sources[0].FQDN, name, "schema.cql"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the schema of backup %s: %v", name, err)
+	}
+	plan, err := NewPlan(name, sources, topology, mapping)
+	if err != nil {
+		return nil, err
+	}
+	plan.StartedAt = backup.StartedAt
+	if err := ValidateSchema(string(schema), plan.Datacenters, topology); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// sources returns a complete backup and its nodes with their datacenter and number of tokens.
+func (p *Planner) sources(name string) (*medusa.StoredBackup, []SourceNode, error) {
+	backups, err := p.index.Backups()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list backups: %v", err)
+	}
+	var backup *medusa.StoredBackup
+	for i := range backups {
+		if backups[i].Name == name {
+			backup = &backups[i]
+		}
+	}
+	if backup == nil {
+		return nil, nil, fmt.Errorf("backup %s does not exist", name)
+	}
+	if !backup.Complete() {
+		return nil, nil, fmt.Errorf("backup %s is incomplete: %d of %d nodes finished", name, len(backup.Finished), len(backup.Nodes))
+	}
+	tokenMap, err := p.index.TokenMap(*backup)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the token map of backup %s: %v", name, err)
+	}
+	datacenters := map[string]string{}
+	if p.store != nil {
+		m, err := p.store.Get(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m != nil {
+			for _, n := range m.Nodes {
+				datacenters[n.FQDN] = n.Datacenter
+			}
+		}
+	}
+
+	sources := []SourceNode{}
+	for _, fqdn := range backup.Nodes {
+		entry, ok := tokenMap[fqdn]
+		if !ok {
+			return nil, nil, fmt.Errorf("node %s of backup %s is not in its token map", fqdn, name)
+		}
+		dc := datacenters[fqdn]
+		if dc == "" {
+			dc = entry.Datacenter
+		}
+		if dc == "" {
+			dc = defaultDatacenter
+		}
+		sources = append(sources, SourceNode{FQDN: fqdn, Datacenter: dc, Tokens: len(entry.Tokens)})
+	}
+	return backup, sources, nil
+}
+
+// NewPlan maps the old nodes onto the pods of the topology. The backup is restored in place if possible, and
+// streamed otherwise.
+func NewPlan(name string, sources []SourceNode, topology Topology, mapping map[string]string) (*Plan, error) {
+	plan := &Plan{Backup: name, Datacenters: map[string]string{}, Sources: sources}
+	for _, d := range topology.Datacenters {
+		if d.Nodes < 1 {
+			return nil, fmt.Errorf("datacenter %s has no nodes", d.Name)
+		}
+		plan.Pods = append(plan.Pods, d.Pods()...)
+	}
+
+	// Old nodes per new datacenter
+	byDatacenter := map[string][]SourceNode{}
+	for _, s := range sources {
+		target, ok := mapping[s.Datacenter]
+		if !ok {
+			target = s.Datacenter
+		}
+		if _, ok := topology.datacenter(target); !ok {
+			return nil, fmt.Errorf("datacenter %s of backup %s does not exist in the new cluster, map it to a new datacenter", target, name)
+		}
+		plan.Datacenters[s.Datacenter] = target
+		byDatacenter[target] = append(byDatacenter[target], s)
+	}
+	for old, target := range mapping {
+		if _, ok := plan.Datacenters[old]; !ok {
+			return nil, fmt.Errorf("the mapping of datacenter %s to %s is invalid, backup %s has no datacenter %s", old, target, name, old)
+		}
+	}
+
+	plan.Mode, plan.Reason = mode(plan.Datacenters, byDatacenter, topology)
+	if plan.Mode == Stream && !topology.Sidecar {
+		return nil, fmt.Errorf("backup %s can not be restored in place (%s) and streaming requires BACKUP_RESTORE_ENABLED", name, plan.Reason)
+	}
+
+	for _, d := range topology.Datacenters {
+		olds := byDatacenter[d.Name]
+		sort.Slice(olds, func(i, j int) bool { return lessNode(olds[i].FQDN, olds[j].FQDN) })
+		pods := d.Pods()
+		for i, old := range olds {
+			// Streamed backups are distributed over the pods of the datacenter
+			plan.Assignments = append(plan.Assignments, Assignment{Pod: pods[i%len(pods)], Source: old.FQDN})
+		}
+	}
+	return plan, nil
+}
+
+// mode returns InPlace if every datacenter keeps its name and its number of nodes and every node keeps its number
+// of tokens, Stream and the reason otherwise.
+func mode(datacenters map[string]string, byDatacenter map[string][]SourceNode, topology Topology) (Mode, string) {
+	for old, target := range datacenters {
+		if old != target {
+			return Stream, fmt.Sprintf("datacenter %s is renamed to %s", old, target)
+		}
+	}
+	for _, d := range topology.Datacenters {
+		if len(byDatacenter[d.Name]) != d.Nodes {
+			return Stream, fmt.Sprintf("datacenter %s has %d nodes instead of %d", d.Name, d.Nodes, len(byDatacenter[d.Name]))
+		}
+		for _, s := range byDatacenter[d.Name] {
+			if s.Tokens != topology.NumTokens {
+				return Stream, fmt.Sprintf("node %s has %d tokens instead of %d", s.FQDN, s.Tokens, topology.NumTokens)
+			}
+		}
+	}
+	return InPlace, ""
+}
+
+var ordinalPat = regexp.MustCompile(`-([0-9]+)$`)
+
+// lessNode orders FQDNs by the ordinal of the pod, then by name.
+func lessNode(a, b string) bool {
+	oa, ob := ordinal(a), ordinal(b)
+	if oa != ob {
+		return oa < ob
+	}
+	return a < b
+}
+
+func ordinal(fqdn string) int {
+	host := strings.SplitN(fqdn, ".", 2)[0]
+	if m := ordinalPat.FindStringSubmatch(host); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+	return -1
+}
+
+// ParseMapping parses a datacenter mapping, e.g. "dc1:east,dc2:west".
+func ParseMapping(s string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid datacenter mapping '%s', expected 'old:new'", entry)
+		}
+		mapping[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return mapping, nil
+}
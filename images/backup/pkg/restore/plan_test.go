@@ -0,0 +1,285 @@
+package restore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+const schema = `CREATE KEYSPACE system_auth WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '1'}  AND durable_writes = true;
+
+CREATE TABLE system_auth.roles (
+    role text PRIMARY KEY
+);
+
+CREATE KEYSPACE shop WITH replication = {'class': 'org.apache.cassandra.locator.NetworkTopologyStrategy', 'dc1': '3', 'dc2': '2'}  AND durable_writes = true;
+
+CREATE TYPE shop.address (
+    street text
+);
+
+CREATE TABLE shop.orders (
+    id uuid PRIMARY KEY,
+    address frozen<address>
+) WITH comment = 'orders; all of them';
+
+CREATE INDEX orders_address ON shop.orders (address);
+
+CREATE KEYSPACE cache WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '2'}  AND durable_writes = true;
+`
+
+// sources are three nodes in dc1 and two in dc2 with 256 tokens each.
+func sources() []SourceNode {
+	result := []SourceNode{}
+	for _, n := range []struct {
+		dc    string
+		nodes int
+	}{{"dc1", 3}, {"dc2", 2}} {
+		for i := n.nodes - 1; i >= 0; i-- {
+			result = append(result, SourceNode{
+				FQDN:       fmt.Sprintf("old-%s-node-%d.old-svc.default.svc.cluster.local", n.dc, i),
+				Datacenter: n.dc,
+				Tokens:     256,
+			})
+		}
+	}
+	return result
+}
+
+func topology(t *testing.T, nodeTopology string, sidecar bool) Topology {
+	topology, err := NewTopology("new", nodeTopology, 3, 256, sidecar)
+	assert.NoError(t, err)
+	return topology
+}
+
+func TestNewTopology(t *testing.T) {
+	topology := topology(t, "", false)
+	assert.Equal(t, []Datacenter{{Name: "datacenter1", Nodes: 3, StatefulSet: "new-node"}}, topology.Datacenters)
+	assert.Equal(t, []string{"new-node-0", "new-node-1", "new-node-2"}, topology.Datacenters[0].Pods())
+
+	topology, err := NewTopology("new", `[{"datacenter":"dc1","nodes":3,"rackLabelKey":""},{"datacenter":"dc2","nodes":2}]`, 3, 16, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []Datacenter{
+		{Name: "dc1", Nodes: 3, StatefulSet: "new-dc1-node"},
+		{Name: "dc2", Nodes: 2, StatefulSet: "new-dc2-node"},
+	}, topology.Datacenters)
+	assert.Equal(t, 16, topology.NumTokens)
+
+	_, err = NewTopology("new", "dc1", 3, 256, true)
+	assert.Error(t, err)
+}
+
+func TestNewPlan_inPlace(t *testing.T) {
+	topology := topology(t, `[{"datacenter":"dc1","nodes":3},{"datacenter":"dc2","nodes":2}]`, false)
+	plan, err := NewPlan("backup", sources(), topology, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, InPlace, plan.Mode)
+	assert.Equal(t, map[string]string{"dc1": "dc1", "dc2": "dc2"}, plan.Datacenters)
+	assert.Equal(t, "in-place old-dc1-node-0.old-svc.default.svc.cluster.local", plan.PodInstruction("new-dc1-node-0"))
+	assert.Equal(t, "in-place old-dc2-node-1.old-svc.default.svc.cluster.local", plan.PodInstruction("new-dc2-node-1"))
+	assert.Equal(t, `Restore of backup backup: in-place
+  datacenter dc1 -> dc1
+  datacenter dc2 -> dc2
+  new-dc1-node-0 restores old-dc1-node-0.old-svc.default.svc.cluster.local
+  new-dc1-node-1 restores old-dc1-node-1.old-svc.default.svc.cluster.local
+  new-dc1-node-2 restores old-dc1-node-2.old-svc.default.svc.cluster.local
+  new-dc2-node-0 restores old-dc2-node-0.old-svc.default.svc.cluster.local
+  new-dc2-node-1 restores old-dc2-node-1.old-svc.default.svc.cluster.local
+`, plan.String())
+}
+
+func TestSetPointInTime(t *testing.T) {
+	started := time.Date(2020, 6, 10, 3, 0, 0, 0, time.UTC)
+	plan, err := NewPlan("backup", sources(), topology(t, `[{"datacenter":"dc1","nodes":3},{"datacenter":"dc2","nodes":2}]`, true), nil)
+	assert.NoError(t, err)
+	plan.StartedAt = started
+
+	assert.EqualError(t, plan.SetPointInTime(started.Add(-time.Minute)), "the point in time 2020-06-10T02:59:00Z is before backup backup started at 2020-06-10T03:00:00Z")
+	assert.NoError(t, plan.SetPointInTime(started.Add(time.Hour)))
+	assert.Contains(t, plan.String(), "Restore of backup backup: in-place, commitlogs replayed until 2020-06-10T04:00:00Z\n")
+
+	plan, err = NewPlan("backup", sources(), topology(t, `[{"datacenter":"dc1","nodes":4},{"datacenter":"dc2","nodes":2}]`, true), nil)
+	assert.NoError(t, err)
+	assert.EqualError(t, plan.SetPointInTime(started.Add(time.Hour)), "a point-in-time restore requires an in-place restore, but backup backup is streamed (datacenter dc1 has 4 nodes instead of 3)")
+}
+
+func TestNewPlan_stream(t *testing.T) {
+	tests := []struct {
+		name         string
+		nodeTopology string
+		mapping      map[string]string
+		numTokens    int
+		reason       string
+		assignments  []Assignment
+	}{
+		{
+			name:         "more nodes",
+			nodeTopology: `[{"datacenter":"dc1","nodes":4},{"datacenter":"dc2","nodes":2}]`,
+			reason:       "datacenter dc1 has 4 nodes instead of 3",
+		},
+		{
+			name:         "fewer nodes",
+			nodeTopology: `[{"datacenter":"dc1","nodes":2},{"datacenter":"dc2","nodes":2}]`,
+			reason:       "datacenter dc1 has 2 nodes instead of 3",
+			assignments: []Assignment{
+				{Pod: "new-dc1-node-0", Source: "old-dc1-node-0.old-svc.default.svc.cluster.local"},
+				{Pod: "new-dc1-node-1", Source: "old-dc1-node-1.old-svc.default.svc.cluster.local"},
+				{Pod: "new-dc1-node-0", Source: "old-dc1-node-2.old-svc.default.svc.cluster.local"},
+				{Pod: "new-dc2-node-0", Source: "old-dc2-node-0.old-svc.default.svc.cluster.local"},
+				{Pod: "new-dc2-node-1", Source: "old-dc2-node-1.old-svc.default.svc.cluster.local"},
+			},
+		},
+		{
+			name:         "renamed datacenters",
+			nodeTopology: `[{"datacenter":"east","nodes":3},{"datacenter":"dc2","nodes":2}]`,
+			mapping:      map[string]string{"dc1": "east"},
+			reason:       "datacenter dc1 is renamed to east",
+		},
+		{
+			name:         "merged datacenters",
+			nodeTopology: `[{"datacenter":"dc1","nodes":5}]`,
+			mapping:      map[string]string{"dc2": "dc1"},
+			reason:       "datacenter dc2 is renamed to dc1",
+		},
+		{
+			name:         "other number of tokens",
+			nodeTopology: `[{"datacenter":"dc1","nodes":3},{"datacenter":"dc2","nodes":2}]`,
+			numTokens:    16,
+			reason:       "node old-dc1-node-2.old-svc.default.svc.cluster.local has 256 tokens instead of 16",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topology := topology(t, tt.nodeTopology, true)
+			if tt.numTokens != 0 {
+				topology.NumTokens = tt.numTokens
+			}
+			plan, err := NewPlan("backup", sources(), topology, tt.mapping)
+			assert.NoError(t, err)
+			assert.Equal(t, Stream, plan.Mode)
+			assert.Equal(t, tt.reason, plan.Reason)
+			assert.Len(t, plan.Assignments, 5)
+			if tt.assignments != nil {
+				assert.Equal(t, tt.assignments, plan.Assignments)
+			}
+			for _, pod := range plan.Pods {
+				assert.Equal(t, "stream", plan.PodInstruction(pod))
+			}
+		})
+	}
+}
+
+func TestNewPlan_invalid(t *testing.T) {
+	// Streaming requires the Medusa sidecar
+	_, err := NewPlan("backup", sources(), topology(t, `[{"datacenter":"dc1","nodes":4},{"datacenter":"dc2","nodes":2}]`, false), nil)
+	assert.EqualError(t, err, "backup backup can not be restored in place (datacenter dc1 has 4 nodes instead of 3) and streaming requires BACKUP_RESTORE_ENABLED")
+
+	_, err = NewPlan("backup", sources(), topology(t, `[{"datacenter":"dc1","nodes":3}]`, true), nil)
+	assert.EqualError(t, err, "datacenter dc2 of backup backup does not exist in the new cluster, map it to a new datacenter")
+
+	_, err = NewPlan("backup", sources(), topology(t, `[{"datacenter":"dc1","nodes":3},{"datacenter":"dc2","nodes":2}]`, true), map[string]string{"dc3": "dc1"})
+	assert.EqualError(t, err, "the mapping of datacenter dc3 to dc1 is invalid, backup backup has no datacenter dc3")
+}
+
+func TestParseMapping(t *testing.T) {
+	mapping, err := ParseMapping("dc1:east, dc2:west")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"dc1": "east", "dc2": "west"}, mapping)
+
+	mapping, err = ParseMapping("")
+	assert.NoError(t, err)
+	assert.Empty(t, mapping)
+
+	_, err = ParseMapping("dc1=east")
+	assert.Error(t, err)
+}
+
+func TestValidateSchema(t *testing.T) {
+	assert.NoError(t, ValidateSchema(schema, map[string]string{"dc1": "dc1", "dc2": "dc2"}, topology(t, `[{"datacenter":"dc1","nodes":3},{"datacenter":"dc2","nodes":2}]`, true)))
+	assert.NoError(t, ValidateSchema(schema, map[string]string{"dc1": "east", "dc2": "west"}, topology(t, `[{"datacenter":"east","nodes":3},{"datacenter":"west","nodes":2}]`, true)))
+
+	err := ValidateSchema(schema, map[string]string{"dc1": "dc1", "dc2": "dc1"}, topology(t, `[{"datacenter":"dc1","nodes":1}]`, true))
+	assert.EqualError(t, err, "the schema of the backup does not fit the new cluster: "+
+		"keyspace shop has replication factor 3 in datacenter dc1 with 1 nodes; "+
+		"keyspace shop has replication factor 2 in datacenter dc1 with 1 nodes; "+
+		"keyspace cache has replication factor 2 with 1 nodes")
+
+	err = ValidateSchema(schema, map[string]string{"dc1": "dc1"}, topology(t, `[{"datacenter":"dc1","nodes":3}]`, true))
+	assert.EqualError(t, err, "the schema of the backup does not fit the new cluster: "+
+		"keyspace shop is replicated to datacenter dc2, which does not exist in the new cluster")
+}
+
+func TestRewriteSchema(t *testing.T) {
+	statements, err := RewriteSchema(schema, map[string]string{"dc1": "east", "dc2": "west"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"CREATE KEYSPACE IF NOT EXISTS shop WITH replication = {'class': 'NetworkTopologyStrategy', 'east': '3', 'west': '2'}  AND durable_writes = true",
+		"CREATE TYPE IF NOT EXISTS shop.address (\n    street text\n)",
+		"CREATE TABLE IF NOT EXISTS shop.orders (\n    id uuid PRIMARY KEY,\n    address frozen<address>\n) WITH comment = 'orders; all of them'",
+		"CREATE INDEX IF NOT EXISTS orders_address ON shop.orders (address)",
+		"CREATE KEYSPACE IF NOT EXISTS cache WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '2'}  AND durable_writes = true",
+	}, statements)
+}
+
+func TestPlanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A backup of three nodes in datacenter1, without NODE_TOPOLOGY
+	tokenMap := map[string]interface{}{}
+	for i := 0; i < 3; i++ {
+		tokenMap[fmt.Sprintf("old-node-%d.old-svc", i)] = map[string]interface{}{"tokens": []int{i, i + 3}, "is_up": true, "dc": "datacenter1"}
+	}
+	tm, _ := json.Marshal(tokenMap)
+	for i := 0; i < 3; i++ {
+		fqdn := fmt.Sprintf("old-node-%d.old-svc", i)
+		write(t, dir, fmt.Sprintf("index/backup_index/backup/started_%s_1591758000.timestamp", fqdn), nil)
+		write(t, dir, fmt.Sprintf("index/backup_index/backup/finished_%s_1591758090.timestamp", fqdn), nil)
+		write(t, dir, fmt.Sprintf("index/backup_index/backup/tokenmap_%s.json", fqdn), tm)
+		write(t, dir, fmt.Sprintf("%s/backup/meta/schema.cql", fqdn), []byte(
+			"CREATE KEYSPACE shop WITH replication = {'class': 'NetworkTopologyStrategy', 'datacenter1': '3'};\n"))
+	}
+	write(t, dir, "index/backup_index/partial/started_old-node-0.old-svc_1591758000.timestamp", nil)
+	planner := NewPlanner(medusa.NewIndex(storage.NewLocal(dir), ""), nil)
+
+	topology, err := NewTopology("new", "", 3, 2, false)
+	assert.NoError(t, err)
+	plan, err := planner.Plan("backup", topology, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, InPlace, plan.Mode)
+	assert.Equal(t, "in-place old-node-2.old-svc", plan.PodInstruction("new-node-2"))
+
+	topology, err = NewTopology("new", `[{"datacenter":"east","nodes":4}]`, 3, 2, true)
+	assert.NoError(t, err)
+	plan, err = planner.Plan("backup", topology, map[string]string{"datacenter1": "east"})
+	assert.NoError(t, err)
+	assert.Equal(t, Stream, plan.Mode)
+	assert.Equal(t, "stream", plan.PodInstruction("new-east-node-3"))
+
+	// The replication factor of 3 does not fit into two nodes
+	topology, err = NewTopology("new", "", 2, 2, true)
+	assert.NoError(t, err)
+	_, err = planner.Plan("backup", topology, nil)
+	assert.Error(t, err)
+
+	_, err = planner.Plan("partial", topology, nil)
+	assert.EqualError(t, err, "backup partial is incomplete: 0 of 1 nodes finished")
+	_, err = planner.Plan("missing", topology, nil)
+	assert.EqualError(t, err, "backup missing does not exist")
+}
+
+func write(t *testing.T, dir, key string, content []byte) {
+	path := filepath.Join(dir, filepath.FromSlash(key))
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, ioutil.WriteFile(path, content, 0644))
+}
@@ -0,0 +1,144 @@
+package restore
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	keyspacePat    = regexp.MustCompile(`(?is)^CREATE KEYSPACE (?:IF NOT EXISTS )?"?(\w+)"?\s+WITH\s+replication\s*=\s*\{([^}]*)\}`)
+	replicationPat = regexp.MustCompile(`'([^']*)'\s*:\s*'([^']*)'`)
+	systemPat      = regexp.MustCompile(`(?i)^CREATE KEYSPACE (?:IF NOT EXISTS )?"?system\w*"?\s|\bsystem\w*\.`)
+	createPat      = regexp.MustCompile(`(?i)^CREATE (KEYSPACE|TABLE|TYPE|INDEX|CUSTOM INDEX|MATERIALIZED VIEW|FUNCTION|AGGREGATE) `)
+)
+
+// keyspace is a keyspace in the schema of a backup.
+type keyspace struct {
+	name     string
+	strategy string
+	// replication is the replication factor per datacenter, or of the key "replication_factor" for SimpleStrategy.
+	replication map[string]int
+	// statement is the position of the CREATE KEYSPACE statement.
+	statement int
+}
+
+// statements splits the schema that Medusa backs up, the output of DESCRIBE SCHEMA, into statements. Statements of
+// system keyspaces are left out, the new cluster creates them itself.
+func statements(schema string) []string {
+	result := []string{}
+	for _, s := range strings.Split(schema, ";\n") {
+		s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), ";"))
+		if s == "" || systemPat.MatchString(s) {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func keyspaces(statements []string) ([]keyspace, error) {
+	result := []keyspace{}
+	for i, s := range statements {
+		m := keyspacePat.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+		ks := keyspace{name: m[1], replication: map[string]int{}, statement: i}
+		for _, entry := range replicationPat.FindAllStringSubmatch(m[2], -1) {
+			if entry[1] == "class" {
+				parts := strings.Split(entry[2], ".")
+				ks.strategy = parts[len(parts)-1]
+				continue
+			}
+			rf, err := strconv.Atoi(entry[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid replication factor '%s' of keyspace %s", entry[2], ks.name)
+			}
+			ks.replication[entry[1]] = rf
+		}
+		result = append(result, ks)
+	}
+	return result, nil
+}
+
+// ValidateSchema checks that the replication of every keyspace of the schema can be satisfied by the topology,
+// after the datacenters were renamed with the mapping.
+func ValidateSchema(schema string, mapping map[string]string, topology Topology) error {
+	keyspaces, err := keyspaces(statements(schema))
+	if err != nil {
+		return err
+	}
+	problems := []string{}
+	for _, ks := range keyspaces {
+		switch ks.strategy {
+		case "SimpleStrategy":
+			if rf := ks.replication["replication_factor"]; rf > topology.nodes() {
+				problems = append(problems, fmt.Sprintf("keyspace %s has replication factor %d with %d nodes", ks.name, rf, topology.nodes()))
+			}
+		case "NetworkTopologyStrategy":
+			for _, dc := range sortedKeys(ks.replication) {
+				target, ok := mapping[dc]
+				if !ok {
+					target = dc
+				}
+				d, ok := topology.datacenter(target)
+				if !ok {
+					problems = append(problems, fmt.Sprintf("keyspace %s is replicated to datacenter %s, which does not exist in the new cluster", ks.name, target))
+					continue
+				}
+				if rf := ks.replication[dc]; rf > d.Nodes {
+					problems = append(problems, fmt.Sprintf("keyspace %s has replication factor %d in datacenter %s with %d nodes", ks.name, rf, target, d.Nodes))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the schema of the backup does not fit the new cluster: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// RewriteSchema returns the statements that create the schema of the backup in the new cluster. Existing objects
+// are kept, and the datacenters of the replication of the keyspaces are renamed with the mapping.
+func RewriteSchema(schema string, mapping map[string]string) ([]string, error) {
+	result := statements(schema)
+	keyspaces, err := keyspaces(result)
+	if err != nil {
+		return nil, err
+	}
+	for _, ks := range keyspaces {
+		if ks.strategy != "NetworkTopologyStrategy" {
+			continue
+		}
+		entries := []string{"'class': 'NetworkTopologyStrategy'"}
+		for _, dc := range sortedKeys(ks.replication) {
+			target, ok := mapping[dc]
+			if !ok {
+				target = dc
+			}
+			entries = append(entries, fmt.Sprintf("'%s': '%d'", target, ks.replication[dc]))
+		}
+		s := result[ks.statement]
+		loc := keyspacePat.FindStringSubmatchIndex(s)
+		// Replace the content of the replication map, group 2
+		result[ks.statement] = s[:loc[4]] + strings.Join(entries, ", ") + s[loc[5]:]
+	}
+	for i, s := range result {
+		if m := createPat.FindStringSubmatchIndex(s); m != nil && !strings.HasPrefix(strings.ToUpper(s[m[1]:]), "IF NOT EXISTS") {
+			result[i] = s[:m[1]] + "IF NOT EXISTS " + s[m[1]:]
+		}
+	}
+	return result, nil
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,162 @@
+package restore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	planKey     = "plan.json"
+	streamedKey = "streamed"
+	// completedKey contains the name of the backup once it is restored.
+	completedKey = "completed"
+)
+
+// ConfigMapName returns the name of the configmap with the restore plan of the instance.
+func ConfigMapName(instance string) string {
+	return fmt.Sprintf("%s-restore-plan", instance)
+}
+
+// PlanStore keeps the restore plan of an instance in a configmap. Next to the plan, the configmap has one key per
+// pod with its PodInstruction, which the restore init container reads from a volume, and the old nodes that were
+// streamed so far.
+type PlanStore struct {
+	client    kubernetes.Interface
+	namespace string
+	instance  string
+}
+
+// NewPlanStore returns a store for the restore plan of the instance.
+func NewPlanStore(client kubernetes.Interface, namespace, instance string) *PlanStore {
+	return &PlanStore{client: client, namespace: namespace, instance: instance}
+}
+
+// Get returns the plan, or nil if there is none.
+func (s *PlanStore) Get() (*Plan, error) {
+	cm, err := s.get()
+	if cm == nil || err != nil {
+		return nil, err
+	}
+	data, ok := cm.Data[planKey]
+	if !ok {
+		return nil, nil
+	}
+	plan := &Plan{}
+	if err := json.Unmarshal([]byte(data), plan); err != nil {
+		return nil, fmt.Errorf("invalid restore plan in %s/%s: %v", s.namespace, ConfigMapName(s.instance), err)
+	}
+	return plan, nil
+}
+
+// Save persists the plan and the instructions for all pods. Streamed nodes of an earlier plan are forgotten.
+func (s *PlanStore) Save(plan *Plan) error {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return fmt.Errorf("failed to serialize restore plan: %v", err)
+	}
+	cm, err := s.get()
+	if err != nil {
+		return err
+	}
+	create := cm == nil
+	if create {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ConfigMapName(s.instance),
+				Namespace: s.namespace,
+				Labels:    map[string]string{"app": s.instance},
+			},
+		}
+	}
+	cm.Data = map[string]string{planKey: string(data)}
+	for _, pod := range plan.Pods {
+		cm.Data[pod] = plan.PodInstruction(pod)
+	}
+	if create {
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(cm)
+	} else {
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Update(cm)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save restore plan in %s/%s: %v", s.namespace, ConfigMapName(s.instance), err)
+	}
+	return nil
+}
+
+// Streamed returns the old nodes whose backups were streamed into the cluster.
+func (s *PlanStore) Streamed() (map[string]bool, error) {
+	result := map[string]bool{}
+	cm, err := s.get()
+	if cm == nil || err != nil {
+		return result, err
+	}
+	for _, fqdn := range strings.Fields(cm.Data[streamedKey]) {
+		result[fqdn] = true
+	}
+	return result, nil
+}
+
+// MarkStreamed records that the backup of the old node was streamed into the cluster.
+func (s *PlanStore) MarkStreamed(fqdn string) error {
+	cm, err := s.get()
+	if err != nil {
+		return err
+	}
+	if cm == nil {
+		return fmt.Errorf("restore plan %s/%s does not exist", s.namespace, ConfigMapName(s.instance))
+	}
+	cm.Data[streamedKey] = strings.TrimSpace(cm.Data[streamedKey] + "\n" + fqdn)
+	if _, err := s.client.CoreV1().ConfigMaps(s.namespace).Update(cm); err != nil {
+		return fmt.Errorf("failed to update restore plan %s/%s: %v", s.namespace, ConfigMapName(s.instance), err)
+	}
+	return nil
+}
+
+// MarkCompleted records that the backup of the plan is restored, the restored instance does not need it anymore.
+func (s *PlanStore) MarkCompleted(backup string) error {
+	cm, err := s.get()
+	if err != nil {
+		return err
+	}
+	if cm == nil {
+		return fmt.Errorf("restore plan %s/%s does not exist", s.namespace, ConfigMapName(s.instance))
+	}
+	if cm.Data[completedKey] == backup {
+		return nil
+	}
+	cm.Data[completedKey] = backup
+	if _, err := s.client.CoreV1().ConfigMaps(s.namespace).Update(cm); err != nil {
+		return fmt.Errorf("failed to update restore plan %s/%s: %v", s.namespace, ConfigMapName(s.instance), err)
+	}
+	return nil
+}
+
+// Completed returns true if the restore of the backup is completed.
+func (s *PlanStore) Completed(backup string) (bool, error) {
+	cm, err := s.get()
+	if cm == nil || err != nil {
+		return false, err
+	}
+	return cm.Data[completedKey] == backup, nil
+}
+
+func (s *PlanStore) get() (*corev1.ConfigMap, error) {
+	name := ConfigMapName(s.instance)
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get restore plan %s/%s: %v", s.namespace, name, err)
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	return cm, nil
+}
@@ -0,0 +1,112 @@
+package restore
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+)
+
+// cassandraContainer is the name of the Cassandra container in the node pods, cqlsh uses its cqlshrc.
+const cassandraContainer = "cassandra"
+
+// Streamer executes a streaming restore plan once all pods of the new cluster are running.
+type Streamer struct {
+	client    kubernetes.Interface
+	executor  medusa.Executor
+	namespace string
+	index     *medusa.Index
+	store     *PlanStore
+}
+
+// NewStreamer returns a streamer for the restore plan in the store.
+func NewStreamer(client kubernetes.Interface, executor medusa.Executor, namespace string, index *medusa.Index, store *PlanStore) *Streamer {
+	return &Streamer{client: client, executor: executor, namespace: namespace, index: index, store: store}
+}
+
+// Run creates the schema of the backup with the renamed datacenters, then streams the backups of the old nodes one
+// after another. Streamed nodes are recorded, so a failed run continues with the next node when it is retried. Once
+// all nodes are streamed, or the backup was restored in place, the restore is recorded as completed.
+func (s *Streamer) Run() error {
+	plan, err := s.store.Get()
+	if err != nil {
+		return err
+	}
+	if plan == nil {
+		return fmt.Errorf("there is no restore plan in %s/%s", s.namespace, ConfigMapName(s.store.instance))
+	}
+	if plan.Mode != Stream {
+		log.Infof("Backup %s was restored in place, nothing to stream", plan.Backup)
+		return s.store.MarkCompleted(plan.Backup)
+	}
+	log.Infof("%s", plan)
+
+	pods := map[string]*corev1.Pod{}
+	for _, name := range plan.Pods {
+		pod, err := s.client.CoreV1().Pods(s.namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get pod %s: %v", name, err)
+		}
+		if !isReady(pod) {
+			return fmt.Errorf("pod %s is not ready", name)
+		}
+		pods[name] = pod
+	}
+
+	streamed, err := s.store.Streamed()
+	if err != nil {
+		return err
+	}
+	if err := s.createSchema(plan, pods[plan.Pods[0]]); err != nil {
+		return err
+	}
+	for _, a := range plan.Assignments {
+		if streamed[a.Source] {
+			log.Infof("Backup of %s was already streamed", a.Source)
+			continue
+		}
+		log.Infof("Streaming backup %s of %s from pod %s", plan.Backup, a.Source, a.Pod)
+		if out, err := medusa.StreamRestore(s.executor, pods[a.Pod], a.Source, plan.Backup); err != nil {
+			log.Infof("%s", out)
+			return fmt.Errorf("failed to stream backup of %s: %v", a.Source, err)
+		}
+		if err := s.store.MarkStreamed(a.Source); err != nil {
+			return err
+		}
+	}
+	log.Infof("Streamed backup %s of %d nodes", plan.Backup, len(plan.Assignments))
+	return s.store.MarkCompleted(plan.Backup)
+}
+
+// createSchema creates the keyspaces and tables of the backup, which sstableloader requires. Existing keyspaces and
+// tables are kept.
+func (s *Streamer) createSchema(plan *Plan, pod *corev1.Pod) error {
+	schema, err := s.index.Storage().Get(s.index.MetaPath(plan.Sources[0].FQDN, plan.Backup, "schema.cql"))
+	if err != nil {
+		return fmt.Errorf("failed to read the schema of backup %s: %v", plan.Backup, err)
+	}
+	statements, err := RewriteSchema(string(schema), plan.Datacenters)
+	if err != nil {
+		return err
+	}
+	log.Infof("Creating the schema of backup %s with %d statements", plan.Backup, len(statements))
+	for _, statement := range statements {
+		if _, err := s.executor.Exec(pod, cassandraContainer, []string{"cqlsh", "-e", statement}); err != nil {
+			return fmt.Errorf("failed to create the schema of backup %s: %v", plan.Backup, err)
+		}
+	}
+	return nil
+}
+
+func isReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
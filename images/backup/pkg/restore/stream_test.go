@@ -0,0 +1,109 @@
+package restore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+type fakeExecutor struct {
+	// fail contains the old nodes whose stream fails
+	fail     map[string]bool
+	cql      []string
+	streamed []string
+}
+
+func (e *fakeExecutor) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	switch {
+	case container == cassandraContainer && command[0] == "cqlsh":
+		e.cql = append(e.cql, command[2])
+		return "", nil
+	case container == medusa.Container && command[4] == "restore-node":
+		fqdn := command[3]
+		if e.fail[fqdn] {
+			return "", fmt.Errorf("sstableloader failed")
+		}
+		e.streamed = append(e.streamed, fmt.Sprintf("%s:%s", pod.Name, fqdn))
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected command %s in container %s", strings.Join(command, " "), container)
+}
+
+func TestStreamer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	write(t, dir, "old-node-0.old-svc/backup/meta/schema.cql", []byte(
+		"CREATE KEYSPACE shop WITH replication = {'class': 'NetworkTopologyStrategy', 'datacenter1': '1'};\n"))
+
+	client := fake.NewSimpleClientset()
+	for _, name := range []string{"new-east-node-0", "new-east-node-1"} {
+		_, _ = client.CoreV1().Pods("default").Create(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}},
+		})
+	}
+	sources := []SourceNode{
+		{FQDN: "old-node-0.old-svc", Datacenter: "datacenter1", Tokens: 256},
+		{FQDN: "old-node-1.old-svc", Datacenter: "datacenter1", Tokens: 256},
+		{FQDN: "old-node-2.old-svc", Datacenter: "datacenter1", Tokens: 256},
+	}
+	topology, err := NewTopology("new", `[{"datacenter":"east","nodes":2}]`, 0, 256, true)
+	assert.NoError(t, err)
+	plan, err := NewPlan("backup", sources, topology, map[string]string{"datacenter1": "east"})
+	assert.NoError(t, err)
+
+	store := NewPlanStore(client, "default", "new")
+	assert.NoError(t, store.Save(plan))
+	cm, err := client.CoreV1().ConfigMaps("default").Get("new-restore-plan", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "stream", cm.Data["new-east-node-1"])
+	saved, err := store.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, plan, saved)
+
+	// The second node fails, the retry continues with it
+	executor := &fakeExecutor{fail: map[string]bool{"old-node-1.old-svc": true}}
+	streamer := NewStreamer(client, executor, "default", medusa.NewIndex(storage.NewLocal(dir), ""), store)
+	assert.EqualError(t, streamer.Run(), "failed to stream backup of old-node-1.old-svc: sstableloader failed")
+	completed, err := store.Completed("backup")
+	assert.NoError(t, err)
+	assert.False(t, completed)
+	assert.Equal(t, []string{"new-east-node-0:old-node-0.old-svc"}, executor.streamed)
+	assert.Equal(t, []string{
+		"CREATE KEYSPACE IF NOT EXISTS shop WITH replication = {'class': 'NetworkTopologyStrategy', 'east': '1'}",
+	}, executor.cql)
+
+	executor.fail = nil
+	assert.NoError(t, streamer.Run())
+	assert.Equal(t, []string{
+		"new-east-node-0:old-node-0.old-svc",
+		"new-east-node-1:old-node-1.old-svc",
+		"new-east-node-0:old-node-2.old-svc",
+	}, executor.streamed)
+	streamed, err := store.Streamed()
+	assert.NoError(t, err)
+	assert.Len(t, streamed, 3)
+	completed, err = store.Completed("backup")
+	assert.NoError(t, err)
+	assert.True(t, completed)
+
+	// A new plan forgets the streamed nodes
+	assert.NoError(t, store.Save(plan))
+	streamed, err = store.Streamed()
+	assert.NoError(t, err)
+	assert.Empty(t, streamed)
+	completed, err = store.Completed("backup")
+	assert.NoError(t, err)
+	assert.False(t, completed)
+}
@@ -0,0 +1,112 @@
+package retention
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+)
+
+// Policy selects the backups to keep. A backup is kept if any of the rules keeps it.
+type Policy struct {
+	// KeepLast is the number of most recent backups to keep.
+	KeepLast int
+	// KeepDaily is the number of days for which the most recent backup of each day is kept.
+	KeepDaily int
+	// KeepWeekly is the number of weeks for which the most recent backup of each week is kept.
+	KeepWeekly int
+}
+
+// Enabled returns true if the policy purges any backups. Without any rule, all backups are kept.
+func (p Policy) Enabled() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0
+}
+
+func (p Policy) String() string {
+	return fmt.Sprintf("keep last %d, daily for %d days, weekly for %d weeks", p.KeepLast, p.KeepDaily, p.KeepWeekly)
+}
+
+// Validate checks that no value is negative.
+func (p Policy) Validate() error {
+	if p.KeepLast < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 {
+		return fmt.Errorf("invalid retention policy '%s': negative values are not allowed", p)
+	}
+	return nil
+}
+
+// Decision is the result of applying a policy to a backup.
+type Decision struct {
+	Backup medusa.StoredBackup
+	Keep   bool
+	// Reasons explains why a backup is kept.
+	Reasons []string
+}
+
+func (d *Decision) keep(reason string) {
+	d.Keep = true
+	d.Reasons = append(d.Reasons, reason)
+}
+
+func (d Decision) String() string {
+	if !d.Keep {
+		return fmt.Sprintf("%s: purge", d.Backup.Name)
+	}
+	return fmt.Sprintf("%s: keep (%s)", d.Backup.Name, strings.Join(d.Reasons, ", "))
+}
+
+// Apply decides for each backup whether it is kept, in the order of the backups. Days and weeks are calendar days
+// and weeks in UTC, the current one included. Incomplete backups are always kept, they may still be in progress, and
+// they are not counted by the rules. The most recent complete backup is always kept.
+func (p Policy) Apply(backups []medusa.StoredBackup, now time.Time) []Decision {
+	decisions := make([]Decision, len(backups))
+	for i, b := range backups {
+		decisions[i] = Decision{Backup: b}
+		if !b.Complete() {
+			decisions[i].keep("incomplete")
+		}
+	}
+
+	today := day(now)
+	thisWeek := week(now)
+	days := map[time.Time]bool{}
+	weeks := map[time.Time]bool{}
+	last := 0
+	// Most recent backups first
+	for i := len(decisions) - 1; i >= 0; i-- {
+		d := &decisions[i]
+		if !d.Backup.Complete() {
+			continue
+		}
+		if last == 0 {
+			d.keep("latest")
+		}
+		last++
+		if last <= p.KeepLast {
+			d.keep(fmt.Sprintf("last %d", p.KeepLast))
+		}
+		if t := day(d.Backup.StartedAt); !days[t] && today.Sub(t) < time.Duration(p.KeepDaily)*24*time.Hour {
+			days[t] = true
+			d.keep("daily " + t.Format("2006-01-02"))
+		}
+		if t := week(d.Backup.StartedAt); !weeks[t] && thisWeek.Sub(t) < time.Duration(p.KeepWeekly)*7*24*time.Hour {
+			weeks[t] = true
+			year, number := t.ISOWeek()
+			d.keep(fmt.Sprintf("weekly %d-W%02d", year, number))
+		}
+	}
+	return decisions
+}
+
+// day returns the start of the day of the time in UTC.
+func day(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// week returns the start of the ISO week, Monday, of the time in UTC.
+func week(t time.Time) time.Time {
+	d := day(t)
+	offset := (int(d.Weekday()) + 6) % 7
+	return d.AddDate(0, 0, -offset)
+}
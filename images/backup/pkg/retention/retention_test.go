@@ -0,0 +1,100 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/medusa"
+)
+
+func backup(name string, started string, complete bool) medusa.StoredBackup {
+	t, _ := time.Parse(time.RFC3339, started)
+	b := medusa.StoredBackup{Name: name, Nodes: []string{"node-0"}, StartedAt: t}
+	if complete {
+		b.Finished = b.Nodes
+	}
+	return b
+}
+
+func kept(decisions []Decision) []string {
+	result := []string{}
+	for _, d := range decisions {
+		if d.Keep {
+			result = append(result, d.Backup.Name)
+		}
+	}
+	return result
+}
+
+func TestApply(t *testing.T) {
+	// Wednesday
+	now, _ := time.Parse(time.RFC3339, "2020-06-10T12:00:00Z")
+	backups := []medusa.StoredBackup{
+		backup("may-17", "2020-05-17T03:00:00Z", true), // Sunday
+		backup("may-24", "2020-05-24T03:00:00Z", true), // Sunday
+		backup("may-25", "2020-05-25T03:00:00Z", true), // Monday
+		backup("jun-01", "2020-06-01T03:00:00Z", false),
+		backup("jun-05", "2020-06-05T03:00:00Z", true),
+		backup("jun-06", "2020-06-06T03:00:00Z", true),
+		backup("jun-08", "2020-06-08T03:00:00Z", true),
+		backup("jun-09-a", "2020-06-09T03:00:00Z", true),
+		backup("jun-09-b", "2020-06-09T15:00:00Z", true),
+		backup("jun-10", "2020-06-10T03:00:00Z", false),
+	}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		kept   []string
+	}{
+		{
+			name:   "latest and incomplete backups are always kept",
+			policy: Policy{KeepLast: 1},
+			kept:   []string{"jun-01", "jun-09-b", "jun-10"},
+		},
+		{
+			name:   "last",
+			policy: Policy{KeepLast: 3},
+			kept:   []string{"jun-01", "jun-08", "jun-09-a", "jun-09-b", "jun-10"},
+		},
+		{
+			name:   "daily keeps the latest backup of each day",
+			policy: Policy{KeepDaily: 5},
+			kept:   []string{"jun-01", "jun-06", "jun-08", "jun-09-b", "jun-10"},
+		},
+		{
+			name:   "weekly keeps the latest backup of each week",
+			policy: Policy{KeepWeekly: 3},
+			kept:   []string{"may-25", "jun-01", "jun-06", "jun-09-b", "jun-10"},
+		},
+		{
+			name:   "rules are combined",
+			policy: Policy{KeepLast: 2, KeepDaily: 2, KeepWeekly: 4},
+			kept:   []string{"may-24", "may-25", "jun-01", "jun-06", "jun-09-a", "jun-09-b", "jun-10"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.kept, kept(test.policy.Apply(backups, now)))
+		})
+	}
+}
+
+func TestApply_reasons(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2020-06-10T12:00:00Z")
+	decisions := Policy{KeepLast: 1, KeepDaily: 1, KeepWeekly: 1}.Apply([]medusa.StoredBackup{
+		backup("old", "2020-06-01T03:00:00Z", true),
+		backup("new", "2020-06-10T03:00:00Z", true),
+	}, now)
+	assert.Equal(t, "old: purge", decisions[0].String())
+	assert.Equal(t, "new: keep (latest, last 1, daily 2020-06-10, weekly 2020-W24)", decisions[1].String())
+}
+
+func TestPolicy(t *testing.T) {
+	assert.False(t, Policy{}.Enabled())
+	assert.True(t, Policy{KeepWeekly: 1}.Enabled())
+	assert.NoError(t, Policy{KeepLast: 1}.Validate())
+	assert.Error(t, Policy{KeepDaily: -1}.Validate())
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// azureBlockSize is the size of the blocks of an upload, a blob consists of at most 50000 blocks.
+const azureBlockSize = 8 * 1024 * 1024
+
+// azureCredentials is the key file of an Azure storage account, as Medusa reads it.
+type azureCredentials struct {
+	StorageAccount string `json:"storage_account"`
+	Key            string `json:"key"`
+}
+
+type azureStorage struct {
+	container azblob.ContainerURL
+	name      string
+}
+
+// NewAzure returns a storage in the Azure Blob container. The credentials are the storage account and its key in the
+// format of Medusa, {"storage_account": "...", "key": "..."}. The endpoint replaces the Blob service of the storage
+// account if it is not empty, e.g. in other Azure clouds.
+func NewAzure(container string, credentials []byte, endpoint string) (Storage, error) {
+	c := azureCredentials{}
+	if err := json.Unmarshal(credentials, &c); err != nil {
+		return nil, fmt.Errorf("invalid Azure credentials: %v", err)
+	}
+	if c.StorageAccount == "" || c.Key == "" {
+		return nil, fmt.Errorf("the Azure credentials require storage_account and key")
+	}
+	credential, err := azblob.NewSharedKeyCredential(c.StorageAccount, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure storage account key: %v", err)
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", c.StorageAccount)
+	}
+	u, err := url.Parse(fmt.Sprintf("%s/%s", endpoint, container))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure endpoint %s: %v", endpoint, err)
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	return &azureStorage{container: azblob.NewContainerURL(*u, pipeline), name: container}, nil
+}
+
+func (s *azureStorage) List(prefix string) ([]Object, error) {
+	objects := []Object{}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		page, err := s.container.ListBlobsFlatSegment(context.Background(), marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s in container %s: %v", prefix, s.name, err)
+		}
+		marker = page.NextMarker
+		for _, b := range page.Segment.BlobItems {
+			o := Object{Key: b.Name, LastModified: b.Properties.LastModified, Hash: hex.EncodeToString(b.Properties.ContentMD5)}
+			if b.Properties.ContentLength != nil {
+				o.Size = *b.Properties.ContentLength
+			}
+			objects = append(objects, o)
+		}
+	}
+	return objects, nil
+}
+
+func (s *azureStorage) Get(key string) ([]byte, error) {
+	body, err := s.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from container %s: %v", key, s.name, err)
+	}
+	return data, nil
+}
+
+func (s *azureStorage) Open(key string) (io.ReadCloser, error) {
+	blob := s.container.NewBlobURL(key)
+	resp, err := blob.Download(context.Background(), 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s from container %s: %v", key, s.name, err)
+	}
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3}), nil
+}
+
+func (s *azureStorage) Put(key string, r io.Reader) error {
+	blob := s.container.NewBlockBlobURL(key)
+	_, err := azblob.UploadStreamToBlockBlob(context.Background(), r, blob, azblob.UploadStreamToBlockBlobOptions{
+		BufferSize: azureBlockSize,
+		MaxBuffers: 2,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put %s into container %s: %v", key, s.name, err)
+	}
+	return nil
+}
+
+func (s *azureStorage) Delete(keys ...string) error {
+	for _, key := range keys {
+		_, err := s.container.NewBlobURL(key).Delete(context.Background(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+		if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete %s from container %s: %v", key, s.name, err)
+		}
+	}
+	return nil
+}
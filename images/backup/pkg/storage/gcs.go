@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+type gcsStorage struct {
+	bucket *gcs.BucketHandle
+	name   string
+}
+
+// NewGCS returns a storage in the Google Cloud Storage bucket. The credentials are the JSON key of a service account,
+// the default credentials of the environment are used if they are empty.
+func NewGCS(bucket string, credentials []byte, options ...option.ClientOption) (Storage, error) {
+	if len(credentials) > 0 {
+		options = append(options, option.WithCredentialsJSON(credentials))
+	}
+	client, err := gcs.NewClient(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %v", err)
+	}
+	return &gcsStorage{bucket: client.Bucket(bucket), name: bucket}, nil
+}
+
+func (s *gcsStorage) List(prefix string) ([]Object, error) {
+	objects := []Object{}
+	it := s.bucket.Objects(context.Background(), &gcs.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s in bucket %s: %v", prefix, s.name, err)
+		}
+		objects = append(objects, Object{
+			Key:          attrs.Name,
+			Size:         attrs.Size,
+			LastModified: attrs.Updated,
+			// Composite objects have no MD5
+			Hash: hex.EncodeToString(attrs.MD5),
+		})
+	}
+	return objects, nil
+}
+
+func (s *gcsStorage) Get(key string) ([]byte, error) {
+	body, err := s.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from bucket %s: %v", key, s.name, err)
+	}
+	return data, nil
+}
+
+func (s *gcsStorage) Open(key string) (io.ReadCloser, error) {
+	r, err := s.bucket.Object(key).NewReader(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s from bucket %s: %v", key, s.name, err)
+	}
+	return r, nil
+}
+
+func (s *gcsStorage) Put(key string, r io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := s.bucket.Object(key).NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		// Cancelling the context aborts the upload, so no partial object is created
+		cancel()
+		_ = w.Close()
+		return fmt.Errorf("failed to put %s into bucket %s: %v", key, s.name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to put %s into bucket %s: %v", key, s.name, err)
+	}
+	return nil
+}
+
+func (s *gcsStorage) Delete(keys ...string) error {
+	for _, key := range keys {
+		err := s.bucket.Object(key).Delete(context.Background())
+		if err != nil && err != gcs.ErrObjectNotExist {
+			return fmt.Errorf("failed to delete %s from bucket %s: %v", key, s.name, err)
+		}
+	}
+	return nil
+}
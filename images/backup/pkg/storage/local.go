@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type local struct {
+	basePath string
+}
+
+// NewLocal returns a storage in a local directory, e.g. a mounted NFS volume.
+func NewLocal(basePath string) Storage {
+	return &local{basePath: filepath.Clean(basePath)}
+}
+
+func (l *local) path(key string) string {
+	return filepath.Join(l.basePath, filepath.FromSlash(key))
+}
+
+func (l *local) List(prefix string) ([]Object, error) {
+	objects := []Object{}
+	// Only walk the directory that contains the prefix
+	root := l.basePath
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = l.path(prefix[:i])
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.basePath, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, Object{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list %s in %s: %v", prefix, l.basePath, err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (l *local) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(l.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	return data, nil
+}
+
+func (l *local) Open(key string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", key, err)
+	}
+	return f, nil
+}
+
+func (l *local) Put(key string, r io.Reader) error {
+	path := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory of %s: %v", key, err)
+	}
+	// Write a temporary file first, so a failed upload does not leave a partial object
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	return nil
+}
+
+func (l *local) Delete(keys ...string) error {
+	for _, key := range keys {
+		if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+		l.removeEmptyParents(filepath.Dir(l.path(key)))
+	}
+	return nil
+}
+
+// removeEmptyParents removes the directory and its parents up to the base path while they are empty.
+func (l *local) removeEmptyParents(dir string) {
+	for strings.HasPrefix(dir, l.basePath) && dir != l.basePath {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// maxDeleteKeys is the maximum number of keys of a DeleteObjects request.
+const maxDeleteKeys = 1000
+
+type s3Storage struct {
+	client s3iface.S3API
+	bucket string
+}
+
+// NewS3 returns a storage in the S3 bucket. The credentials are taken from the environment, e.g. AWS_ACCESS_KEY_ID
+// and AWS_SECRET_ACCESS_KEY.
+func NewS3(bucket, region string) (Storage, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	return NewS3WithClient(s3.New(sess), bucket), nil
+}
+
+// NewS3Compatible returns a storage in the bucket of an S3 compatible storage at the endpoint, e.g. MinIO. The bucket
+// is addressed in the path, as most S3 compatible storages do not support virtual hosted buckets.
+func NewS3Compatible(bucket, region, endpoint string) (Storage, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String(region),
+		Endpoint:         aws.String(endpoint),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	return NewS3WithClient(s3.New(sess), bucket), nil
+}
+
+// NewS3WithClient returns a storage in the S3 bucket that uses the client.
+func NewS3WithClient(client s3iface.S3API, bucket string) Storage {
+	return &s3Storage{client: client, bucket: bucket}
+}
+
+func (s *s3Storage) List(prefix string) ([]Object, error) {
+	objects := []Object{}
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(prefix)}
+	err := s.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			objects = append(objects, Object{
+				Key:          aws.StringValue(o.Key),
+				Size:         aws.Int64Value(o.Size),
+				LastModified: aws.TimeValue(o.LastModified),
+				Hash:         strings.Trim(aws.StringValue(o.ETag), `"`),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s in bucket %s: %v", prefix, s.bucket, err)
+	}
+	return objects, nil
+}
+
+func (s *s3Storage) Get(key string) ([]byte, error) {
+	body, err := s.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from bucket %s: %v", key, s.bucket, err)
+	}
+	return data, nil
+}
+
+func (s *s3Storage) Open(key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s from bucket %s: %v", key, s.bucket, err)
+	}
+	return out.Body, nil
+}
+
+func (s *s3Storage) Put(key string, r io.Reader) error {
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", key, err)
+		}
+		body = bytes.NewReader(data)
+	}
+	_, err := s.client.PutObject(&s3.PutObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key), Body: body})
+	if err != nil {
+		return fmt.Errorf("failed to put %s into bucket %s: %v", key, s.bucket, err)
+	}
+	return nil
+}
+
+func (s *s3Storage) Delete(keys ...string) error {
+	for start := 0; start < len(keys); start += maxDeleteKeys {
+		end := start + maxDeleteKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+		ids := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			ids = append(ids, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		out, err := s.client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects from bucket %s: %v", s.bucket, err)
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("failed to delete %d objects from bucket %s, e.g. %s: %s", len(out.Errors), s.bucket, aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Object is a file in the backup storage.
+type Object struct {
+	// Key is the path of the object, relative to the root of the storage.
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// Hash is the hash that the storage computed, e.g. the ETag of an S3 object. It is empty if the storage has none.
+	Hash string
+}
+
+// Storage is the location of the backups, e.g. an S3 bucket or a local directory. Keys are '/' separated paths.
+type Storage interface {
+	// List returns all objects whose key starts with the prefix, including objects in sub directories.
+	List(prefix string) ([]Object, error)
+	// Get returns the content of the object.
+	Get(key string) ([]byte, error)
+	// Open returns a reader for the content of the object, for objects that are too large for Get.
+	Open(key string) (io.ReadCloser, error)
+	// Put uploads the content of the reader as the object, replacing an existing object.
+	Put(key string, r io.Reader) error
+	// Delete deletes the objects. Keys that do not exist are ignored.
+	Delete(keys ...string) error
+}
+
+// Config selects and configures a storage.
+type Config struct {
+	// Provider is the Medusa storage provider: 'local', 's3_compatible', 'google_storage', 'azure_blobs' or one of
+	// the libcloud S3 provider types.
+	Provider string
+	// Bucket is the name of the S3 or GCS bucket, or of the Azure Blob container.
+	Bucket string
+	// BasePath is the directory of a local storage.
+	BasePath string
+	// Host, Port and Secure are the endpoint of an S3 compatible storage, e.g. MinIO. They optionally replace the
+	// Blob service endpoint of an Azure storage account.
+	Host   string
+	Port   string
+	Secure bool
+	// Region is the region of an S3 compatible storage, us-east-1 if empty.
+	Region string
+	// Credentials is the JSON key of a GCS service account, or the Azure storage account and key in the format of
+	// Medusa: {"storage_account": "...", "key": "..."}. GCS uses the default credentials if it is empty.
+	Credentials []byte
+}
+
+// Endpoint returns the URL of the configured host, or an empty string if there is none.
+func (c Config) Endpoint() string {
+	if c.Host == "" {
+		return ""
+	}
+	scheme := "http"
+	if c.Secure {
+		scheme = "https"
+	}
+	if c.Port == "" {
+		return fmt.Sprintf("%s://%s", scheme, c.Host)
+	}
+	return fmt.Sprintf("%s://%s:%s", scheme, c.Host, c.Port)
+}
+
+// New returns the storage of the configuration.
+func New(config Config) (Storage, error) {
+	switch {
+	case config.Provider == "local":
+		if config.BasePath == "" {
+			return nil, fmt.Errorf("the base path of the local storage is required")
+		}
+		return NewLocal(config.BasePath), nil
+	case config.Bucket == "":
+		return nil, fmt.Errorf("the bucket name is required")
+	case config.Provider == "s3_compatible":
+		if config.Host == "" {
+			return nil, fmt.Errorf("the host of the S3 compatible storage is required")
+		}
+		region := config.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return NewS3Compatible(config.Bucket, region, config.Endpoint())
+	case strings.HasPrefix(config.Provider, "s3"):
+		region, ok := s3Regions[config.Provider]
+		if !ok {
+			return nil, fmt.Errorf("unknown S3 storage provider '%s'", config.Provider)
+		}
+		return NewS3(config.Bucket, region)
+	case config.Provider == "google_storage":
+		return NewGCS(config.Bucket, config.Credentials)
+	case config.Provider == "azure_blobs":
+		return NewAzure(config.Bucket, config.Credentials, config.Endpoint())
+	}
+	return nil, fmt.Errorf("unsupported storage provider '%s'", config.Provider)
+}
+
+// s3Regions maps the libcloud S3 provider types that Medusa uses to AWS regions.
+var s3Regions = map[string]string{
+	"s3":                "us-east-1",
+	"s3_us_east_2":      "us-east-2",
+	"s3_us_west":        "us-west-1",
+	"s3_us_west_oregon": "us-west-2",
+	"s3_us_gov_west":    "us-gov-west-1",
+	"s3_cn_north":       "cn-north-1",
+	"s3_cn_northwest":   "cn-northwest-1",
+	"s3_eu_west":        "eu-west-1",
+	"s3_eu_west2":       "eu-west-2",
+	"s3_eu_central":     "eu-central-1",
+	"s3_eu_north_1":     "eu-north-1",
+	"s3_ap_south":       "ap-south-1",
+	"s3_ap_southeast":   "ap-southeast-1",
+	"s3_ap_southeast2":  "ap-southeast-2",
+	"s3_ap_northeast":   "ap-northeast-1",
+	"s3_ap_northeast1":  "ap-northeast-1",
+	"s3_ap_northeast2":  "ap-northeast-2",
+	"s3_sa_east":        "sa-east-1",
+	"s3_ca_central":     "ca-central-1",
+}
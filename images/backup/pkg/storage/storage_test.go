@@ -0,0 +1,452 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+)
+
+func writeFiles(t *testing.T, dir string, keys ...string) {
+	for _, key := range keys {
+		path := filepath.Join(dir, filepath.FromSlash(key))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(key), 0644))
+	}
+}
+
+func objectKeys(objects []Object) []string {
+	result := []string{}
+	for _, o := range objects {
+		result = append(result, o.Key)
+	}
+	return result
+}
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, "prefix/a/1", "prefix/a/2", "prefix/ab/1", "prefix/b/1", "other/1")
+
+	s := NewLocal(dir + "/")
+	objects, err := s.List("prefix/a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prefix/a/1", "prefix/a/2", "prefix/ab/1"}, objectKeys(objects))
+	assert.Equal(t, int64(len("prefix/a/1")), objects[0].Size)
+
+	objects, err = s.List("missing/")
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+
+	data, err := s.Get("prefix/b/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "prefix/b/1", string(data))
+	_, err = s.Get("prefix/b/2")
+	assert.Error(t, err)
+
+	assert.NoError(t, s.Put("new/c/1", strings.NewReader("new")))
+	assert.NoError(t, s.Put("new/c/1", strings.NewReader("replaced")))
+	data, err = s.Get("new/c/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "replaced", string(data))
+	objects, err = s.List("new/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"new/c/1"}, objectKeys(objects), "no temporary files are left")
+	assert.NoError(t, s.Delete("new/c/1"))
+
+	assert.NoError(t, s.Delete("prefix/a/1", "prefix/a/2", "prefix/a/3"))
+	objects, err = s.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other/1", "prefix/ab/1", "prefix/b/1"}, objectKeys(objects))
+	_, err = os.Stat(filepath.Join(dir, "prefix", "a"))
+	assert.True(t, os.IsNotExist(err), "empty directories are removed")
+	_, err = os.Stat(dir)
+	assert.NoError(t, err, "the base path is kept")
+}
+
+// fakeS3 is an S3 stand-in that keeps the objects of one bucket in memory.
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+	// failKeys fail to be deleted
+	failKeys map[string]bool
+	deletes  int
+}
+
+func (f *fakeS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	// Two objects per page
+	for start := 0; start < len(keys); start += 2 {
+		page := &s3.ListObjectsV2Output{}
+		for _, key := range keys[start:min(start+2, len(keys))] {
+			page.Contents = append(page.Contents, &s3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(f.objects[key]))),
+				LastModified: aws.Time(time.Unix(0, 0)),
+			})
+		}
+		if !fn(page, start+2 >= len(keys)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.StringValue(input.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	f.deletes++
+	out := &s3.DeleteObjectsOutput{}
+	for _, id := range input.Delete.Objects {
+		key := aws.StringValue(id.Key)
+		if f.failKeys[key] {
+			out.Errors = append(out.Errors, &s3.Error{Key: id.Key, Message: aws.String("access denied")})
+			continue
+		}
+		delete(f.objects, key)
+	}
+	return out, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestS3(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, failKeys: map[string]bool{}}
+	keys := []string{}
+	for i := 0; i < 1500; i++ {
+		key := fmt.Sprintf("prefix/%d/data", i)
+		fake.objects[key] = []byte("data")
+		keys = append(keys, key)
+	}
+	fake.objects["other/1"] = []byte("other")
+	s := NewS3WithClient(fake, "bucket")
+
+	objects, err := s.List("prefix/")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 1500)
+	assert.Equal(t, int64(4), objects[0].Size)
+
+	data, err := s.Get("other/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "other", string(data))
+	_, err = s.Get("other/2")
+	assert.Error(t, err)
+
+	assert.NoError(t, s.Put("other/2", strings.NewReader("put")))
+	assert.Equal(t, "put", string(fake.objects["other/2"]))
+	delete(fake.objects, "other/2")
+
+	assert.NoError(t, s.Delete(keys...))
+	assert.Equal(t, 2, fake.deletes, "at most 1000 keys are deleted per request")
+	assert.Len(t, fake.objects, 1)
+
+	fake.failKeys["other/1"] = true
+	err = s.Delete("other/1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "access denied")
+}
+
+// testStorage runs the operations of a storage against an empty bucket.
+func testStorage(t *testing.T, s Storage) {
+	for _, key := range []string{"prefix/a/1", "prefix/a/2", "prefix/ab/1", "prefix/b/1", "other/1"} {
+		assert.NoError(t, s.Put(key, strings.NewReader(key)))
+	}
+	objects, err := s.List("prefix/a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prefix/a/1", "prefix/a/2", "prefix/ab/1"}, objectKeys(objects))
+	assert.Equal(t, int64(len("prefix/a/1")), objects[0].Size)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("prefix/a/1"))), objects[0].Hash)
+	assert.False(t, objects[0].LastModified.IsZero())
+
+	objects, err = s.List("missing/")
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+
+	data, err := s.Get("prefix/b/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "prefix/b/1", string(data))
+	_, err = s.Get("prefix/b/2")
+	assert.Error(t, err)
+
+	assert.NoError(t, s.Put("other/1", strings.NewReader("replaced")))
+	data, err = s.Get("other/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "replaced", string(data))
+
+	assert.NoError(t, s.Delete("prefix/a/1", "prefix/a/2", "prefix/a/3"))
+	objects, err = s.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other/1", "prefix/ab/1", "prefix/b/1"}, objectKeys(objects))
+}
+
+// fakeGCS is a GCS stand-in that serves the JSON API and the downloads of one bucket from memory.
+type fakeGCS struct {
+	objects map[string][]byte
+}
+
+func (f *fakeGCS) object(name string) map[string]interface{} {
+	sum := md5.Sum(f.objects[name])
+	return map[string]interface{}{
+		"bucket":  "bucket",
+		"name":    name,
+		"size":    strconv.Itoa(len(f.objects[name])),
+		"updated": time.Unix(0, 0).UTC().Format(time.RFC3339),
+		"md5Hash": base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error": {"code": 404, "message": "Not Found"}}`))
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/bucket/o":
+		keys := []string{}
+		for key := range f.objects {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		// Two objects per page
+		start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		page := map[string]interface{}{"kind": "storage#objects"}
+		items := []interface{}{}
+		for _, key := range keys[min(start, len(keys)):min(start+2, len(keys))] {
+			items = append(items, f.object(key))
+		}
+		page["items"] = items
+		if start+2 < len(keys) {
+			page["nextPageToken"] = strconv.Itoa(start + 2)
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/bucket/o":
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parts := multipart.NewReader(r.Body, params["boundary"])
+		metadata := map[string]interface{}{}
+		part, err := parts.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(&metadata)
+		}
+		if err == nil {
+			part, err = parts.NextPart()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := metadata["name"].(string)
+		f.objects[name], _ = ioutil.ReadAll(part)
+		_ = json.NewEncoder(w).Encode(f.object(name))
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+		name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+		if _, ok := f.objects[name]; !ok {
+			notFound()
+			return
+		}
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/bucket/"):
+		data, ok := f.objects[strings.TrimPrefix(r.URL.Path, "/bucket/")]
+		if !ok {
+			notFound()
+			return
+		}
+		_, _ = w.Write(data)
+	default:
+		http.Error(w, fmt.Sprintf("unexpected request %s %s", r.Method, r.URL), http.StatusBadRequest)
+	}
+}
+
+func TestGCS(t *testing.T) {
+	server := httptest.NewTLSServer(&fakeGCS{objects: map[string][]byte{}})
+	defer server.Close()
+	s, err := NewGCS("bucket", nil, option.WithEndpoint(server.URL+"/storage/v1/"), option.WithHTTPClient(server.Client()))
+	assert.NoError(t, err)
+	testStorage(t, s)
+}
+
+// fakeAzure is an Azure Blob service stand-in that keeps the blobs of one container in memory.
+type fakeAzure struct {
+	blobs map[string][]byte
+	// blocks are the staged blocks by blob and block id
+	blocks map[string]map[string][]byte
+}
+
+type azureBlob struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int    `xml:"Content-Length"`
+		ContentMD5    string `xml:"Content-MD5"`
+		BlobType      string `xml:"BlobType"`
+	} `xml:"Properties"`
+}
+
+type azureList struct {
+	XMLName    xml.Name    `xml:"EnumerationResults"`
+	Blobs      []azureBlob `xml:"Blobs>Blob"`
+	NextMarker string      `xml:"NextMarker"`
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := strings.TrimPrefix(r.URL.Path, "/container/")
+	notFound := func() {
+		w.Header().Set("x-ms-error-code", "BlobNotFound")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?><Error><Code>BlobNotFound</Code><Message>The specified blob does not exist.</Message></Error>`))
+	}
+	switch {
+	case r.Method == http.MethodGet && query.Get("comp") == "list":
+		keys := []string{}
+		for key := range f.blobs {
+			if strings.HasPrefix(key, query.Get("prefix")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		// Two blobs per page
+		start, _ := strconv.Atoi(query.Get("marker"))
+		list := azureList{}
+		for _, key := range keys[min(start, len(keys)):min(start+2, len(keys))] {
+			b := azureBlob{Name: key}
+			sum := md5.Sum(f.blobs[key])
+			b.Properties.LastModified = time.Unix(0, 0).UTC().Format(http.TimeFormat)
+			b.Properties.ContentLength = len(f.blobs[key])
+			b.Properties.ContentMD5 = base64.StdEncoding.EncodeToString(sum[:])
+			b.Properties.BlobType = "BlockBlob"
+			list.Blobs = append(list.Blobs, b)
+		}
+		if start+2 < len(keys) {
+			list.NextMarker = strconv.Itoa(start + 2)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		if f.blocks[name] == nil {
+			f.blocks[name] = map[string][]byte{}
+		}
+		f.blocks[name][query.Get("blockid")], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		list := struct {
+			Latest []string `xml:"Latest"`
+		}{}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data := []byte{}
+		for _, id := range list.Latest {
+			data = append(data, f.blocks[name][id]...)
+		}
+		f.blobs[name] = data
+		delete(f.blocks, name)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet:
+		data, ok := f.blobs[name]
+		if !ok {
+			notFound()
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write(data)
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[name]; !ok {
+			notFound()
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, fmt.Sprintf("unexpected request %s %s", r.Method, r.URL), http.StatusBadRequest)
+	}
+}
+
+func TestAzure(t *testing.T) {
+	server := httptest.NewServer(&fakeAzure{blobs: map[string][]byte{}, blocks: map[string]map[string][]byte{}})
+	defer server.Close()
+	credentials := `{"storage_account": "account", "key": "` + base64.StdEncoding.EncodeToString([]byte("key")) + `"}`
+	s, err := NewAzure("container", []byte(credentials), server.URL)
+	assert.NoError(t, err)
+	testStorage(t, s)
+
+	_, err = NewAzure("container", []byte(`{"storage_account": "account"}`), "")
+	assert.EqualError(t, err, "the Azure credentials require storage_account and key")
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{Provider: "local"})
+	assert.EqualError(t, err, "the base path of the local storage is required")
+	_, err = New(Config{Provider: "s3_us_west_oregon"})
+	assert.EqualError(t, err, "the bucket name is required")
+	_, err = New(Config{Provider: "s3_mars", Bucket: "bucket"})
+	assert.EqualError(t, err, "unknown S3 storage provider 's3_mars'")
+	_, err = New(Config{Provider: "s3_compatible", Bucket: "bucket"})
+	assert.EqualError(t, err, "the host of the S3 compatible storage is required")
+	_, err = New(Config{Provider: "ftp", Bucket: "bucket"})
+	assert.EqualError(t, err, "unsupported storage provider 'ftp'")
+
+	config := Config{Provider: "s3_compatible", Bucket: "bucket", Host: "minio.default.svc", Port: "9000"}
+	assert.Equal(t, "http://minio.default.svc:9000", config.Endpoint())
+	s, err := New(config)
+	assert.NoError(t, err)
+	client := s.(*s3Storage).client.(*s3.S3)
+	assert.Equal(t, "http://minio.default.svc:9000", client.Endpoint)
+	assert.Equal(t, "us-east-1", aws.StringValue(client.Config.Region))
+	assert.True(t, aws.BoolValue(client.Config.S3ForcePathStyle))
+}
@@ -7,11 +7,11 @@ require (
 	github.com/fatih/color v1.9.0 // indirect
 	github.com/mattn/go-colorable v0.1.6 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/client_golang v1.7.1
 	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37 // indirect
+	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a // indirect
-	golang.org/x/sys v0.0.0-20200509044756-6aff5f38e54f // indirect
 	gotest.tools/gotestsum v0.4.2 // indirect
 	k8s.io/api v0.17.3
 	k8s.io/apimachinery v0.17.3
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/mesosphere/kudo-cassandra-operator/images/bootstrap/pkg/certificates"
 	"github.com/mesosphere/kudo-cassandra-operator/images/bootstrap/pkg/client"
 	"github.com/mesosphere/kudo-cassandra-operator/images/bootstrap/pkg/service"
 
 	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
 )
 
 func main() {
@@ -37,6 +43,14 @@ func main() {
 			os.Exit(1)
 		}
 		log.Infof("bootstrap: Finish Cassandra bootstrap init")
+	case "tls-artifacts":
+		if err := newTLSGenerator().Generate(); err != nil {
+			log.Errorf("bootstrap: failed to generate the TLS artifacts: %v", err)
+			os.Exit(1)
+		}
+		log.Infof("bootstrap: Generated the TLS artifacts")
+	case "tls-agent":
+		runTLSAgent(client)
 	default:
 		log.Errorf("bootstrap: unrecognized command '%s' for cassandra bootstrap", command)
 		os.Exit(1)
@@ -44,3 +58,67 @@ func main() {
 
 	os.Exit(0)
 }
+
+// runTLSAgent regenerates the TLS artifacts when the TLS secret changes and exposes the expiry of the certificates.
+// It does not return.
+func runTLSAgent(client kubernetes.Interface) {
+	interval := 60 * time.Second
+	if v := os.Getenv("TLS_RELOAD_INTERVAL_S"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			log.Fatalf("tls-agent: invalid TLS_RELOAD_INTERVAL_S '%s'", v)
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+	options := certificates.Options{
+		Generator: newTLSGenerator(),
+		Interval:  interval,
+	}
+
+	selector := fmt.Sprintf("app = %s, cassandra", os.Getenv("INSTANCE_NAME"))
+	restarter := certificates.NewRestarter(client, os.Getenv("POD_NAMESPACE"), os.Getenv("POD_NAME"), os.Getenv("CASSANDRA_IP_LOCK_CM"), selector, interval)
+	// A node that was restarted by its agent releases the lock once it is ready again
+	go restarter.ReleaseWhenReady()
+
+	if port := os.Getenv("TLS_METRICS_PORT"); port != "" {
+		go certificates.Serve(":" + port)
+	}
+
+	reloader := certificates.NewNodetoolReloader(service.NewNodetool(os.Getenv("USE_SSL") == "true"), restarter)
+	log.Infof("tls-agent: Watching %s every %s", options.Generator.SourceDir, options.Interval)
+	certificates.NewAgent(options, reloader).Run()
+}
+
+// newTLSGenerator returns the generator of the TLS artifacts of this node, configured by the environment.
+func newTLSGenerator() *certificates.Generator {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("bootstrap: failed to get the hostname: %v", err)
+	}
+	identity := certificates.Identity{FQDN: os.Getenv("FQDN"), Hostname: hostname}
+	if identity.FQDN == "" {
+		identity.FQDN = hostname
+	}
+	if ip := net.ParseIP(os.Getenv("POD_IP")); ip != nil {
+		identity.IPs = append(identity.IPs, ip)
+	}
+
+	generator := &certificates.Generator{
+		SourceDir:    "/etc/tls/certs",
+		ArtifactsDir: "/etc/cassandra/tls",
+		PasswordDir:  "/etc/cassandra/truststore",
+		Identity:     identity,
+		Validity:     900 * 24 * time.Hour,
+	}
+	if os.Getenv("USE_SSL") == "true" {
+		generator.NodetoolProperties = []string{
+			"/etc/cassandra/nodetool-ssl.properties",
+			"/home/cassandra/.cassandra/nodetool-ssl.properties",
+		}
+	}
+	if os.Getenv("TRANSPORT_ENCRYPTION_CLIENT_ENABLED") == "true" {
+		generator.Cqlshrc = "/home/cassandra/.cassandra/cqlshrc"
+		generator.ClientAuth = os.Getenv("TRANSPORT_ENCRYPTION_CLIENT_REQUIRE_CLIENT_AUTH") == "true"
+	}
+	return generator
+}
@@ -0,0 +1,183 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/bootstrap/pkg/service"
+)
+
+const (
+	// Certificate is the CA or node certificate in the TLS secret, followed by its intermediates.
+	Certificate = "tls.crt"
+	// PrivateKey is the key of the certificate in the TLS secret.
+	PrivateKey = "tls.key"
+)
+
+var releaseVersionPat = regexp.MustCompile(`ReleaseVersion:\s+([0-9]+)\.`)
+
+// Options configures the TLS agent.
+type Options struct {
+	// Generator generates the artifacts from the secret. The kubelet updates the mounted secret in its SourceDir when
+	// the secret changes.
+	Generator *Generator
+	// Interval in which the secret is compared with the artifacts.
+	Interval time.Duration
+}
+
+// Reloader makes Cassandra use the regenerated artifacts.
+type Reloader interface {
+	Reload() error
+}
+
+// Agent regenerates the TLS artifacts of a node when the TLS secret changes.
+type Agent struct {
+	options  Options
+	generate func() error
+	reloader Reloader
+	// pending is set while regenerated artifacts are not reloaded yet
+	pending bool
+}
+
+// NewAgent returns an agent that regenerates the artifacts with the generator of the options.
+func NewAgent(options Options, reloader Reloader) *Agent {
+	return &Agent{options: options, generate: options.Generator.Generate, reloader: reloader}
+}
+
+// Run checks the secret in the interval of the options. It does not return.
+func (a *Agent) Run() {
+	for {
+		if _, err := a.Check(); err != nil {
+			log.Errorf("tls-agent: %v", err)
+			ReloadErrors.Inc()
+		}
+		time.Sleep(a.options.Interval)
+	}
+}
+
+// Check updates the expiry metrics, and regenerates and reloads the artifacts if the secret changed. It returns
+// whether the artifacts were regenerated.
+func (a *Agent) Check() (bool, error) {
+	defer a.updateExpiry()
+
+	changed, err := Changed(a.options.Generator.SourceDir, a.options.Generator.ArtifactsDir)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		log.Infof("tls-agent: The TLS secret changed, regenerating the keystore and truststores")
+		if err := a.generate(); err != nil {
+			return false, fmt.Errorf("failed to regenerate the TLS artifacts: %v", err)
+		}
+		a.pending = true
+	}
+	if !a.pending {
+		return false, nil
+	}
+	// A failed reload is retried in the next check, the artifacts are already up to date then
+	if err := a.reloader.Reload(); err != nil {
+		return changed, fmt.Errorf("failed to reload the TLS artifacts: %v", err)
+	}
+	a.pending = false
+	return changed, nil
+}
+
+func (a *Agent) updateExpiry() {
+	for label, path := range map[string]string{
+		"ca":   filepath.Join(a.options.Generator.SourceDir, Certificate),
+		"node": filepath.Join(a.options.Generator.ArtifactsDir, NodeCertificate),
+	} {
+		expiry, err := Expiry(path)
+		if err != nil {
+			log.Warnf("tls-agent: %v", err)
+			CertificateExpiry.DeleteLabelValues(label)
+			continue
+		}
+		CertificateExpiry.WithLabelValues(label).Set(float64(expiry.Unix()))
+	}
+}
+
+// Changed returns whether the fingerprint of the secret in the source directory differs from the one the artifacts
+// in the artifacts directory were generated from.
+func Changed(sourceDir, artifactsDir string) (bool, error) {
+	fingerprint, err := SecretFingerprint(sourceDir)
+	if err != nil {
+		return false, err
+	}
+	generated, err := ioutil.ReadFile(filepath.Join(artifactsDir, Fingerprint))
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read the TLS artifacts: %v", err)
+	}
+	return strings.TrimSpace(string(generated)) != fingerprint, nil
+}
+
+// Expiry returns the end of the validity of the first certificate in the PEM file.
+func Expiry(path string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read certificate: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, fmt.Errorf("%s contains no PEM certificate", path)
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse certificate %s: %v", path, err)
+	}
+	return certificate.NotAfter, nil
+}
+
+// NodetoolReloader reloads the artifacts with 'nodetool reloadssl', which Cassandra supports since 4.0. Older versions
+// only read the artifacts at startup, the node is restarted instead.
+type NodetoolReloader struct {
+	nodetool  service.Nodetool
+	restarter *Restarter
+}
+
+func NewNodetoolReloader(nodetool service.Nodetool, restarter *Restarter) *NodetoolReloader {
+	return &NodetoolReloader{nodetool: nodetool, restarter: restarter}
+}
+
+func (r *NodetoolReloader) Reload() error {
+	version, err := r.nodetool.RunCommand("version")
+	if err != nil {
+		return fmt.Errorf("failed to get the Cassandra version: %v", err)
+	}
+	major, err := parseMajorVersion(version)
+	if err != nil {
+		return err
+	}
+	if major >= 4 {
+		if _, err := r.nodetool.RunCommand("reloadssl"); err != nil {
+			return fmt.Errorf("nodetool reloadssl failed: %v", err)
+		}
+		log.Infof("tls-agent: Reloaded the TLS artifacts with nodetool reloadssl")
+		Reloads.WithLabelValues("reloadssl").Inc()
+		return nil
+	}
+	log.Infof("tls-agent: Cassandra %d can not reload the TLS artifacts, restarting the node", major)
+	Reloads.WithLabelValues("restart").Inc()
+	return r.restarter.Restart()
+}
+
+func parseMajorVersion(version string) (int, error) {
+	match := releaseVersionPat.FindStringSubmatch(version)
+	if match == nil {
+		return 0, fmt.Errorf("failed to find the release version in %q", version)
+	}
+	return strconv.Atoi(match[1])
+}
@@ -0,0 +1,171 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func writeCertificate(t *testing.T, path string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cassandra"},
+		NotBefore:    notAfter.Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+}
+
+type fakeReloader struct {
+	reloads int
+	fail    bool
+}
+
+func (r *fakeReloader) Reload() error {
+	if r.fail {
+		return fmt.Errorf("node is not ready")
+	}
+	r.reloads++
+	return nil
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	source, artifacts := filepath.Join(dir, "certs"), filepath.Join(dir, "tls")
+	assert.NoError(t, os.Mkdir(source, 0700))
+	assert.NoError(t, os.Mkdir(artifacts, 0700))
+
+	expiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	writeCertificate(t, filepath.Join(source, Certificate), expiry)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, PrivateKey), []byte("key"), 0600))
+
+	reloader := &fakeReloader{fail: true}
+	agent := NewAgent(Options{Generator: &Generator{SourceDir: source, ArtifactsDir: artifacts}}, reloader)
+	generated := 0
+	agent.generate = func() error {
+		generated++
+		fingerprint, err := SecretFingerprint(source)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(artifacts, Fingerprint), []byte(fingerprint), 0600)
+	}
+
+	// The artifacts are regenerated once, the failed reload is retried
+	changed, err := agent.Check()
+	assert.EqualError(t, err, "failed to reload the TLS artifacts: node is not ready")
+	assert.True(t, changed)
+	reloader.fail = false
+	changed, err = agent.Check()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, generated)
+	assert.Equal(t, 1, reloader.reloads)
+
+	changed, err = agent.Check()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, reloader.reloads)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, PrivateKey), []byte("renewed"), 0600))
+	changed, err = agent.Check()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 2, generated)
+	assert.Equal(t, 2, reloader.reloads)
+
+	actual, err := Expiry(filepath.Join(source, Certificate))
+	assert.NoError(t, err)
+	assert.Equal(t, expiry.Unix(), actual.Unix())
+	_, err = Expiry(filepath.Join(source, PrivateKey))
+	assert.EqualError(t, err, filepath.Join(source, PrivateKey)+" contains no PEM certificate")
+}
+
+func TestParseMajorVersion(t *testing.T) {
+	major, err := parseMajorVersion("ReleaseVersion: 3.11.7\n")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, major)
+	major, err = parseMajorVersion("ReleaseVersion: 4.0-beta2\n")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, major)
+	_, err = parseMajorVersion("error: connection refused")
+	assert.Error(t, err)
+}
+
+func pod(name string, ready bool) *v1.Pod {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "cassandra", "cassandra": "cassandra"}},
+		Status:     v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}}},
+	}
+}
+
+func TestRestart(t *testing.T) {
+	replicas := int32(2)
+	client := fake.NewSimpleClientset(
+		&v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: "cassandra-topology-lock", Namespace: "default"}},
+		&appsv1.StatefulSet{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "cassandra-node", Namespace: "default", Labels: map[string]string{"app": "cassandra", "cassandra": "cassandra"}},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+		},
+		pod("cassandra-node-0", true),
+		pod("cassandra-node-1", true),
+	)
+	restarter := func(name string) *Restarter {
+		return NewRestarter(client, "default", name, "cassandra-topology-lock", "app = cassandra, cassandra", time.Millisecond)
+	}
+	lock := func() string {
+		cm, err := client.CoreV1().ConfigMaps("default").Get("cassandra-topology-lock", meta_v1.GetOptions{})
+		assert.NoError(t, err)
+		return cm.Annotations[RestartLockAnnotation]
+	}
+
+	assert.NoError(t, restarter("cassandra-node-0").Restart())
+	assert.Equal(t, "cassandra-node-0", lock())
+	_, err := client.CoreV1().Pods("default").Get("cassandra-node-0", meta_v1.GetOptions{})
+	assert.Error(t, err)
+
+	// The other node waits until the restarted node is ready and released the lock
+	acquired, err := restarter("cassandra-node-1").tryAcquire()
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	_, err = client.CoreV1().Pods("default").Create(pod("cassandra-node-0", false))
+	assert.NoError(t, err)
+	acquired, err = restarter("cassandra-node-1").tryAcquire()
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+
+	_, err = client.CoreV1().Pods("default").UpdateStatus(pod("cassandra-node-0", true))
+	assert.NoError(t, err)
+	restarter("cassandra-node-0").ReleaseWhenReady()
+	assert.Equal(t, "", lock())
+	acquired, err = restarter("cassandra-node-1").tryAcquire()
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, "cassandra-node-1", lock())
+}
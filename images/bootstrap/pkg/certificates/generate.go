@@ -0,0 +1,481 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CABundle is the optional CA bundle in the TLS secret, e.g. the ca.crt of cert-manager.
+	CABundle = "ca.crt"
+
+	// KeyStore contains the key and certificate chain of the node.
+	KeyStore = "cassandra.server.keystore.p12"
+	// TrustStore contains the trusted CA certificates.
+	TrustStore = "cassandra.server.truststore.p12"
+	// TrustBundle contains the trusted CA certificates as PEM, for cqlsh.
+	TrustBundle = "ca.pem"
+	// NodeCertificate contains the certificate chain of the node as PEM.
+	NodeCertificate = "node.pem"
+	// NodeKey contains the key of the node as PEM.
+	NodeKey = "node.key"
+	// Fingerprint is the hash of the secret the artifacts were generated from.
+	Fingerprint = "secret.sha256"
+
+	// KeyAlias is the alias of the node key in the keystore.
+	KeyAlias = "localhost"
+	// KeystorePasswordFile and TruststorePasswordFile are the keys of the tls-store-credentials secret.
+	KeystorePasswordFile   = "keystore_password"
+	TruststorePasswordFile = "truststore_password"
+)
+
+// Identity are the names and addresses of a node, which its certificate must cover.
+type Identity struct {
+	FQDN     string
+	Hostname string
+	IPs      []net.IP
+}
+
+// Secret is the content of the TLS secret.
+type Secret struct {
+	// Chain is the certificate in tls.crt followed by its intermediates.
+	Chain []*x509.Certificate
+	// Key is the private key of the first certificate of the chain.
+	Key crypto.Signer
+	// CAs are the certificates of the optional CA bundle.
+	CAs []*x509.Certificate
+}
+
+// Generator creates the keystore, truststore and SSL settings of a node from the TLS secret.
+//
+// The secret either contains a CA certificate and its key, then the generator creates a key and a certificate for the
+// node signed by the CA. Or it contains a certificate for the node with its intermediates, as issued by cert-manager,
+// which is used as it is.
+type Generator struct {
+	// SourceDir is the mounted TLS secret.
+	SourceDir string
+	// ArtifactsDir is the directory of the keystore and truststore.
+	ArtifactsDir string
+	// PasswordDir is the mounted tls-store-credentials secret.
+	PasswordDir string
+	Identity    Identity
+	// Validity of the certificates signed for the node.
+	Validity time.Duration
+	// NodetoolProperties are written with the JMX SSL settings for 'nodetool --ssl', if set.
+	NodetoolProperties []string
+	// Cqlshrc gets an [ssl] section, if set.
+	Cqlshrc string
+	// ClientAuth adds the certificate of the node to the [ssl] section of the cqlshrc.
+	ClientAuth bool
+}
+
+// Generate writes the artifacts. Each file is replaced atomically, the fingerprint of the secret is written last.
+func (g *Generator) Generate() error {
+	fingerprint, err := SecretFingerprint(g.SourceDir)
+	if err != nil {
+		return err
+	}
+	keystorePassword, err := readPassword(g.PasswordDir, KeystorePasswordFile)
+	if err != nil {
+		return err
+	}
+	truststorePassword, err := readPassword(g.PasswordDir, TruststorePasswordFile)
+	if err != nil {
+		return err
+	}
+	secret, err := ReadSecret(g.SourceDir, truststorePassword)
+	if err != nil {
+		return err
+	}
+
+	var key crypto.Signer
+	var chain, trusted []*x509.Certificate
+	if isCA(secret.Chain[0]) {
+		log.Infof("bootstrap: Signing a certificate for %s with CA %s", g.Identity.FQDN, secret.Chain[0].Subject)
+		if key, chain, err = g.sign(secret); err != nil {
+			return err
+		}
+		trusted = appendUnique(secret.CAs, secret.Chain[len(secret.Chain)-1])
+	} else {
+		log.Infof("bootstrap: Using certificate %s for %s", secret.Chain[0].Subject, g.Identity.FQDN)
+		if trusted, err = g.verify(secret); err != nil {
+			return err
+		}
+		key, chain = secret.Key, secret.Chain
+	}
+
+	keystore, err := EncodeKeyStore(key, chain, KeyAlias, keystorePassword)
+	if err != nil {
+		return err
+	}
+	truststore, err := EncodeTrustStore(trusted, truststorePassword)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(g.ArtifactsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", g.ArtifactsDir, err)
+	}
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{KeyStore, keystore},
+		{TrustStore, truststore},
+		{TrustBundle, encodeCertificates(trusted)},
+		{NodeCertificate, encodeCertificates(chain)},
+		{NodeKey, keyPEM},
+	} {
+		if err := writeFile(filepath.Join(g.ArtifactsDir, file.name), file.data); err != nil {
+			return err
+		}
+	}
+
+	properties := g.nodetoolProperties(keystorePassword, truststorePassword)
+	for _, path := range g.NodetoolProperties {
+		if err := writeFile(path, []byte(properties)); err != nil {
+			return err
+		}
+	}
+	if g.Cqlshrc != "" {
+		if err := g.writeCqlshrc(); err != nil {
+			return err
+		}
+	}
+	return writeFile(filepath.Join(g.ArtifactsDir, Fingerprint), []byte(fingerprint+"\n"))
+}
+
+// sign creates a key and a certificate for the node, signed by the CA of the secret.
+func (g *Generator) sign(secret *Secret) (crypto.Signer, []*x509.Certificate, error) {
+	if err := checkKey(secret); err != nil {
+		return nil, nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate the node key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate a serial number: %v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: g.Identity.FQDN},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(g.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost", g.Identity.FQDN},
+		IPAddresses:  append([]net.IP{net.IPv4(127, 0, 0, 1)}, g.Identity.IPs...),
+	}
+	if g.Identity.Hostname != "" && g.Identity.Hostname != g.Identity.FQDN {
+		template.DNSNames = append(template.DNSNames, g.Identity.Hostname)
+	}
+	// A node certificate must not outlive its CA
+	if ca := secret.Chain[0]; template.NotAfter.After(ca.NotAfter) {
+		template.NotAfter = ca.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, secret.Chain[0], key.Public(), secret.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sign the node certificate with CA %s: %v", secret.Chain[0].Subject, err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse the node certificate: %v", err)
+	}
+	return key, append([]*x509.Certificate{certificate}, secret.Chain...), nil
+}
+
+// verify checks that the certificate of the secret belongs to its key, covers the node and is issued by a CA of the
+// bundle. It returns the certificates to trust.
+func (g *Generator) verify(secret *Secret) ([]*x509.Certificate, error) {
+	if err := checkKey(secret); err != nil {
+		return nil, err
+	}
+	certificate := secret.Chain[0]
+	if err := certificate.VerifyHostname(g.Identity.FQDN); err != nil {
+		return nil, fmt.Errorf("%s of the TLS secret does not cover the node %s, its SANs are %s",
+			Certificate, g.Identity.FQDN, strings.Join(subjectAltNames(certificate), ", "))
+	}
+
+	trusted := secret.CAs
+	if len(trusted) == 0 {
+		if len(secret.Chain) == 1 {
+			return nil, fmt.Errorf("the TLS secret contains no CA certificate to trust, add the CA bundle as %s or the issuing CA to %s", CABundle, Certificate)
+		}
+		trusted = secret.Chain[len(secret.Chain)-1:]
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for _, ca := range trusted {
+		roots.AddCert(ca)
+	}
+	for _, intermediate := range secret.Chain[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	if _, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, fmt.Errorf("%s of the TLS secret is not issued by a trusted CA: %v", Certificate, err)
+	}
+	return trusted, nil
+}
+
+func (g *Generator) nodetoolProperties(keystorePassword, truststorePassword string) string {
+	return strings.Join([]string{
+		"-Dcom.sun.management.jmxremote.ssl=true",
+		"-Dcom.sun.management.jmxremote.ssl.need.client.auth=true",
+		"-Dcom.sun.management.jmxremote.registry.ssl=true",
+		"-Djavax.net.ssl.keyStore=" + filepath.Join(g.ArtifactsDir, KeyStore),
+		"-Djavax.net.ssl.keyStorePassword=" + keystorePassword,
+		"-Djavax.net.ssl.keyStoreType=PKCS12",
+		"-Djavax.net.ssl.trustStore=" + filepath.Join(g.ArtifactsDir, TrustStore),
+		"-Djavax.net.ssl.trustStorePassword=" + truststorePassword,
+		"-Djavax.net.ssl.trustStoreType=PKCS12",
+	}, "\n") + "\n"
+}
+
+// writeCqlshrc replaces the [ssl] section of the cqlshrc, the other sections are kept.
+func (g *Generator) writeCqlshrc() error {
+	section := []string{"[ssl]", "certfile = " + filepath.Join(g.ArtifactsDir, TrustBundle)}
+	if g.ClientAuth {
+		section = append(section,
+			"userkey = "+filepath.Join(g.ArtifactsDir, NodeKey),
+			"usercert = "+filepath.Join(g.ArtifactsDir, NodeCertificate))
+	}
+
+	data, err := ioutil.ReadFile(g.Cqlshrc)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %v", g.Cqlshrc, err)
+	}
+	lines := []string{}
+	skip := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if strings.HasPrefix(line, "[") {
+			skip = strings.TrimSpace(line) == "[ssl]"
+		}
+		if !skip && (line != "" || len(lines) > 0) {
+			lines = append(lines, line)
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > 0 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, section...)
+	return writeFile(g.Cqlshrc, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// ReadSecret parses the TLS secret. An encrypted key is decrypted with the password.
+func ReadSecret(dir, password string) (*Secret, error) {
+	chain, err := readCertificates(filepath.Join(dir, Certificate))
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s of the TLS secret contains no certificate", Certificate)
+	}
+	key, err := readKey(filepath.Join(dir, PrivateKey), password)
+	if err != nil {
+		return nil, err
+	}
+	secret := &Secret{Chain: chain, Key: key}
+	if _, err := os.Stat(filepath.Join(dir, CABundle)); err == nil {
+		if secret.CAs, err = readCertificates(filepath.Join(dir, CABundle)); err != nil {
+			return nil, err
+		}
+	}
+	return secret, nil
+}
+
+// SecretFingerprint returns a hash of the files of the TLS secret.
+func SecretFingerprint(dir string) (string, error) {
+	hash := sha256.New()
+	for _, name := range []string{Certificate, PrivateKey, CABundle} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) && name == CABundle {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read the TLS secret: %v", err)
+		}
+		fmt.Fprintf(hash, "%s:%d:", name, len(data))
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func checkKey(secret *Secret) error {
+	certificate := secret.Chain[0]
+	public, err := x509.MarshalPKIXPublicKey(secret.Key.Public())
+	if err != nil {
+		return fmt.Errorf("failed to encode the public key of %s of the TLS secret: %v", PrivateKey, err)
+	}
+	if !bytes.Equal(public, certificate.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("%s of the TLS secret is not the key of the certificate %s in %s", PrivateKey, certificate.Subject, Certificate)
+	}
+	return nil
+}
+
+// isCA returns whether the certificate can sign node certificates. Self-signed version 1 certificates have no basic
+// constraints, they are accepted as CAs as well.
+func isCA(certificate *x509.Certificate) bool {
+	if certificate.BasicConstraintsValid {
+		return certificate.IsCA
+	}
+	return certificate.Version < 3 && bytes.Equal(certificate.RawIssuer, certificate.RawSubject)
+}
+
+func subjectAltNames(certificate *x509.Certificate) []string {
+	names := append([]string{}, certificate.DNSNames...)
+	for _, ip := range certificate.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		return []string{"empty"}
+	}
+	return names
+}
+
+func appendUnique(certificates []*x509.Certificate, certificate *x509.Certificate) []*x509.Certificate {
+	for _, c := range certificates {
+		if c.Equal(certificate) {
+			return certificates
+		}
+	}
+	return append(append([]*x509.Certificate{}, certificates...), certificate)
+}
+
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the TLS secret: %v", err)
+	}
+	certificates := []*x509.Certificate{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate %d of %s: %v", len(certificates)+1, filepath.Base(path), err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+func readKey(path, password string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the TLS secret: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s of the TLS secret contains no PEM key", PrivateKey)
+	}
+	der := block.Bytes
+	//nolint:staticcheck // Keys encrypted with the truststore password were supported by the shell scripts
+	if x509.IsEncryptedPEMBlock(block) {
+		if der, err = x509.DecryptPEMBlock(block, []byte(password)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s of the TLS secret with the truststore password: %v", PrivateKey, err)
+		}
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case "ENCRYPTED PRIVATE KEY":
+		return nil, fmt.Errorf("%s of the TLS secret is an encrypted PKCS #8 key, which is not supported", PrivateKey)
+	default:
+		return nil, fmt.Errorf("%s of the TLS secret contains an unknown key type %s", PrivateKey, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s of the TLS secret: %v", PrivateKey, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s of the TLS secret is a %T, only RSA and ECDSA keys are supported", PrivateKey, key)
+}
+
+func readPassword(dir, name string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the %s of the TLS stores: %v", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func encodeCertificates(certificates []*x509.Certificate) []byte {
+	data := []byte{}
+	for _, certificate := range certificates {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})...)
+	}
+	return data
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the node key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeFile replaces the file atomically, readers see either the old or the new content.
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package certificates
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pkcs12"
+)
+
+const fqdn = "cassandra-node-0.cassandra-svc.default.svc.cluster.local"
+
+type issued struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+}
+
+func issue(t *testing.T, name string, ca bool, dnsNames []string, issuer *issued) *issued {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+		DNSNames:              dnsNames,
+	}
+	if ca {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	parent, signer := template, crypto.Signer(key)
+	if issuer != nil {
+		parent, signer = issuer.certificate, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	assert.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &issued{certificate: certificate, key: key}
+}
+
+func writeSecret(t *testing.T, dir string, key crypto.Signer, chain []*x509.Certificate, cas []*x509.Certificate) {
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, Certificate), encodeCertificates(chain), 0600))
+	data, err := encodeKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, PrivateKey), data, 0600))
+	if cas != nil {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, CABundle), encodeCertificates(cas), 0600))
+	}
+}
+
+func newGenerator(t *testing.T) (*Generator, func()) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	g := &Generator{
+		SourceDir:          filepath.Join(dir, "certs"),
+		ArtifactsDir:       filepath.Join(dir, "tls"),
+		PasswordDir:        filepath.Join(dir, "truststore"),
+		Identity:           Identity{FQDN: fqdn, Hostname: "cassandra-node-0", IPs: []net.IP{net.ParseIP("10.0.0.1")}},
+		Validity:           900 * 24 * time.Hour,
+		NodetoolProperties: []string{filepath.Join(dir, "nodetool-ssl.properties")},
+		Cqlshrc:            filepath.Join(dir, "cqlshrc"),
+		ClientAuth:         true,
+	}
+	for _, d := range []string{g.SourceDir, g.PasswordDir} {
+		assert.NoError(t, os.Mkdir(d, 0700))
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(g.PasswordDir, KeystorePasswordFile), []byte("keystore\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(g.PasswordDir, TruststorePasswordFile), []byte("truststore"), 0600))
+	return g, func() { os.RemoveAll(dir) }
+}
+
+// readKeyStore decodes the keystore and verifies its certificate against the trust bundle.
+func readKeyStore(t *testing.T, g *Generator) *x509.Certificate {
+	data, err := ioutil.ReadFile(filepath.Join(g.ArtifactsDir, KeyStore))
+	assert.NoError(t, err)
+	blocks, err := pkcs12.ToPEM(data, "keystore")
+	assert.NoError(t, err)
+	var certificate *x509.Certificate
+	for _, block := range blocks {
+		if block.Type == "CERTIFICATE" && block.Headers["friendlyName"] == KeyAlias {
+			certificate, err = x509.ParseCertificate(block.Bytes)
+			assert.NoError(t, err)
+		}
+	}
+	if !assert.NotNil(t, certificate) {
+		return nil
+	}
+
+	trusted, err := readCertificates(filepath.Join(g.ArtifactsDir, TrustBundle))
+	assert.NoError(t, err)
+	chain, err := readCertificates(filepath.Join(g.ArtifactsDir, NodeCertificate))
+	assert.NoError(t, err)
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for _, c := range trusted {
+		roots.AddCert(c)
+	}
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = certificate.Verify(x509.VerifyOptions{DNSName: fqdn, Roots: roots, Intermediates: intermediates})
+	assert.NoError(t, err)
+	return certificate
+}
+
+func TestGenerateWithCA(t *testing.T) {
+	g, cleanup := newGenerator(t)
+	defer cleanup()
+	ca := issue(t, "CassandraCA", true, nil, nil)
+	writeSecret(t, g.SourceDir, ca.key, []*x509.Certificate{ca.certificate}, nil)
+	assert.NoError(t, ioutil.WriteFile(g.Cqlshrc, []byte("[authentication]\nusername = cassandra\n\n[ssl]\ncertfile = /etc/tls/certs/tls.crt\n"), 0600))
+
+	assert.NoError(t, g.Generate())
+	certificate := readKeyStore(t, g)
+	assert.Equal(t, []string{"localhost", fqdn, "cassandra-node-0"}, certificate.DNSNames)
+	assert.Equal(t, "10.0.0.1", certificate.IPAddresses[1].String())
+	assert.Equal(t, ca.certificate.NotAfter, certificate.NotAfter)
+
+	properties, err := ioutil.ReadFile(g.NodetoolProperties[0])
+	assert.NoError(t, err)
+	assert.Contains(t, string(properties), "-Djavax.net.ssl.keyStorePassword=keystore\n")
+	assert.Contains(t, string(properties), "-Djavax.net.ssl.trustStoreType=PKCS12\n")
+	cqlshrc, err := ioutil.ReadFile(g.Cqlshrc)
+	assert.NoError(t, err)
+	assert.Equal(t, "[authentication]\nusername = cassandra\n\n[ssl]\n"+
+		"certfile = "+filepath.Join(g.ArtifactsDir, TrustBundle)+"\n"+
+		"userkey = "+filepath.Join(g.ArtifactsDir, NodeKey)+"\n"+
+		"usercert = "+filepath.Join(g.ArtifactsDir, NodeCertificate)+"\n", string(cqlshrc))
+
+	fingerprint, err := SecretFingerprint(g.SourceDir)
+	assert.NoError(t, err)
+	changed, err := Changed(g.SourceDir, g.ArtifactsDir)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	writeSecret(t, g.SourceDir, ca.key, []*x509.Certificate{ca.certificate}, []*x509.Certificate{ca.certificate})
+	changed, err = Changed(g.SourceDir, g.ArtifactsDir)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	renewed, err := SecretFingerprint(g.SourceDir)
+	assert.NoError(t, err)
+	assert.NotEqual(t, fingerprint, renewed)
+}
+
+func TestGenerateWithNodeCertificate(t *testing.T) {
+	g, cleanup := newGenerator(t)
+	defer cleanup()
+	root := issue(t, "root", true, nil, nil)
+	intermediate := issue(t, "intermediate", true, nil, root)
+	node := issue(t, "node", false, []string{"*.cassandra-svc.default.svc.cluster.local"}, intermediate)
+	writeSecret(t, g.SourceDir, node.key, []*x509.Certificate{node.certificate, intermediate.certificate}, []*x509.Certificate{root.certificate})
+
+	assert.NoError(t, g.Generate())
+	certificate := readKeyStore(t, g)
+	assert.True(t, certificate.Equal(node.certificate))
+	trusted, err := readCertificates(filepath.Join(g.ArtifactsDir, TrustBundle))
+	assert.NoError(t, err)
+	assert.Len(t, trusted, 1)
+	assert.True(t, trusted[0].Equal(root.certificate))
+}
+
+func TestGenerateErrors(t *testing.T) {
+	g, cleanup := newGenerator(t)
+	defer cleanup()
+	root := issue(t, "root", true, nil, nil)
+	other := issue(t, "other", true, nil, nil)
+	node := issue(t, "node", false, []string{fqdn}, root)
+	wrongName := issue(t, "node", false, []string{"cassandra-node-0.example.com"}, root)
+
+	writeSecret(t, g.SourceDir, other.key, []*x509.Certificate{node.certificate}, []*x509.Certificate{root.certificate})
+	assert.EqualError(t, g.Generate(), "tls.key of the TLS secret is not the key of the certificate CN=node in tls.crt")
+
+	writeSecret(t, g.SourceDir, wrongName.key, []*x509.Certificate{wrongName.certificate}, []*x509.Certificate{root.certificate})
+	assert.EqualError(t, g.Generate(), "tls.crt of the TLS secret does not cover the node "+fqdn+", its SANs are cassandra-node-0.example.com")
+
+	writeSecret(t, g.SourceDir, node.key, []*x509.Certificate{node.certificate}, []*x509.Certificate{other.certificate})
+	err := g.Generate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tls.crt of the TLS secret is not issued by a trusted CA")
+	}
+
+	assert.NoError(t, os.Remove(filepath.Join(g.SourceDir, CABundle)))
+	assert.EqualError(t, g.Generate(), "the TLS secret contains no CA certificate to trust, add the CA bundle as ca.crt or the issuing CA to tls.crt")
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(g.SourceDir, PrivateKey), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY"}), 0600))
+	assert.EqualError(t, g.Generate(), "tls.key of the TLS secret contains an unknown key type PUBLIC KEY")
+
+	_, err = os.Stat(filepath.Join(g.ArtifactsDir, KeyStore))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,46 @@
+package certificates
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "cassandra_tls"
+
+var (
+	// CertificateExpiry is the end of the validity of the CA certificate and of the node certificate.
+	CertificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Unix time the certificate expires, the 'ca' certificate of the TLS secret or the 'node' certificate signed with it.",
+	}, []string{"certificate"})
+	// Reloads counts the reloads of regenerated TLS artifacts by method.
+	Reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reloads_total",
+		Help:      "Number of times the regenerated TLS artifacts were reloaded, with 'reloadssl' or by a 'restart' of the node.",
+	}, []string{"method"})
+	// ReloadErrors counts the failed attempts to regenerate or reload the TLS artifacts.
+	ReloadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reload_errors_total",
+		Help:      "Number of failed attempts to regenerate or reload the TLS artifacts.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(CertificateExpiry, Reloads, ReloadErrors)
+}
+
+// Serve exposes the metrics on /metrics of the address. It does not return.
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("tls-agent: Serving metrics on %s/metrics", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Errorf("tls-agent: Metrics server failed: %v", err)
+	}
+}
@@ -0,0 +1,320 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"unicode/utf16"
+)
+
+// The PKCS #12 encoding follows RFC 7292. Keys are encrypted with pbeWithSHAAnd3-KeyTripleDES-CBC and the stores are
+// protected with a SHA-1 HMAC, which every Java version reads.
+
+const pbeIterations = 2048
+
+var (
+	oidDataContentType               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidShroudedKeyBag                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509Certificate       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidSHA1                          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	// Java only loads certificates without a key as trusted certificates if they have this attribute
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+	oidAnyExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	AlgorithmIdentifier pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// EncodeKeyStore returns a PKCS #12 keystore with the key and its certificate chain under the alias.
+func EncodeKeyStore(key crypto.PrivateKey, chain []*x509.Certificate, alias, password string) ([]byte, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("the certificate chain of %s is empty", alias)
+	}
+	keyID := sha1.Sum(chain[0].Raw)
+	attributes, err := keyAttributes(alias, keyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	keyBag, err := encodeKeyBag(key, password, attributes)
+	if err != nil {
+		return nil, err
+	}
+	bags := []safeBag{}
+	for i, certificate := range chain {
+		var bag safeBag
+		if i == 0 {
+			bag, err = encodeCertBag(certificate, attributes)
+		} else {
+			bag, err = encodeCertBag(certificate, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		bags = append(bags, bag)
+	}
+	return encodePFX(password, bags, []safeBag{keyBag})
+}
+
+// EncodeTrustStore returns a PKCS #12 truststore with the certificates as trusted certificates. The aliases are
+// "ca-<n>", "ca-0" for the first certificate.
+func EncodeTrustStore(certificates []*x509.Certificate, password string) ([]byte, error) {
+	trusted, err := attribute(oidJavaTrustedKeyUsage, oidAnyExtendedKeyUsage)
+	if err != nil {
+		return nil, err
+	}
+	bags := []safeBag{}
+	for i, certificate := range certificates {
+		name, err := friendlyName(fmt.Sprintf("ca-%d", i))
+		if err != nil {
+			return nil, err
+		}
+		bag, err := encodeCertBag(certificate, []pkcs12Attribute{name, trusted})
+		if err != nil {
+			return nil, err
+		}
+		bags = append(bags, bag)
+	}
+	return encodePFX(password, bags)
+}
+
+func keyAttributes(alias string, keyID []byte) ([]pkcs12Attribute, error) {
+	name, err := friendlyName(alias)
+	if err != nil {
+		return nil, err
+	}
+	id, err := attribute(oidLocalKeyID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return []pkcs12Attribute{name, id}, nil
+}
+
+func friendlyName(name string) (pkcs12Attribute, error) {
+	return attribute(oidFriendlyName, asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(name)})
+}
+
+func attribute(id asn1.ObjectIdentifier, value interface{}) (pkcs12Attribute, error) {
+	data, err := asn1.Marshal(value)
+	if err != nil {
+		return pkcs12Attribute{}, fmt.Errorf("failed to encode PKCS #12 attribute %s: %v", id, err)
+	}
+	return pkcs12Attribute{ID: id, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: data}}, nil
+}
+
+func encodeCertBag(certificate *x509.Certificate, attributes []pkcs12Attribute) (safeBag, error) {
+	data, err := asn1.Marshal(certBag{ID: oidCertTypeX509Certificate, Data: certificate.Raw})
+	if err != nil {
+		return safeBag{}, fmt.Errorf("failed to encode certificate %s: %v", certificate.Subject, err)
+	}
+	return safeBag{ID: oidCertBag, Value: explicit(data), Attributes: attributes}, nil
+}
+
+func encodeKeyBag(key crypto.PrivateKey, password string, attributes []pkcs12Attribute) (safeBag, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return safeBag{}, fmt.Errorf("failed to encode private key: %v", err)
+	}
+	salt, err := randomSalt()
+	if err != nil {
+		return safeBag{}, err
+	}
+	params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: pbeIterations})
+	if err != nil {
+		return safeBag{}, fmt.Errorf("failed to encode PBE parameters: %v", err)
+	}
+
+	password16 := bmpString(password)
+	block, err := des.NewTripleDESCipher(pbkdf(salt, password16, pbeIterations, 1, 24))
+	if err != nil {
+		return safeBag{}, fmt.Errorf("failed to encrypt private key: %v", err)
+	}
+	padding := block.BlockSize() - len(pkcs8)%block.BlockSize()
+	encrypted := append(pkcs8, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, pbkdf(salt, password16, pbeIterations, 2, block.BlockSize())).CryptBlocks(encrypted, encrypted)
+
+	data, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		AlgorithmIdentifier: pkix.AlgorithmIdentifier{Algorithm: oidPBEWithSHAAnd3KeyTripleDESCBC, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData:       encrypted,
+	})
+	if err != nil {
+		return safeBag{}, fmt.Errorf("failed to encode private key: %v", err)
+	}
+	return safeBag{ID: oidShroudedKeyBag, Value: explicit(data), Attributes: attributes}, nil
+}
+
+// encodePFX returns the PFX with a data content for each of the safe contents.
+func encodePFX(password string, safeContents ...[]safeBag) ([]byte, error) {
+	contents := []contentInfo{}
+	for _, bags := range safeContents {
+		data, err := asn1.Marshal(bags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode PKCS #12 safe contents: %v", err)
+		}
+		content, err := dataContent(data)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, content)
+	}
+	authenticatedSafe, err := asn1.Marshal(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode PKCS #12 authenticated safe: %v", err)
+	}
+	authSafe, err := dataContent(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := randomSalt()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pbkdf(salt, bmpString(password), pbeIterations, 3, sha1.Size))
+	mac.Write(authenticatedSafe)
+	pfx, err := asn1.Marshal(pfxPdu{
+		Version:  3,
+		AuthSafe: authSafe,
+		MacData: macData{
+			Mac:        digestInfo{Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue}, Digest: mac.Sum(nil)},
+			MacSalt:    salt,
+			Iterations: pbeIterations,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode PKCS #12 store: %v", err)
+	}
+	return pfx, nil
+}
+
+func dataContent(data []byte) (contentInfo, error) {
+	octets, err := asn1.Marshal(data)
+	if err != nil {
+		return contentInfo{}, fmt.Errorf("failed to encode PKCS #12 content: %v", err)
+	}
+	return contentInfo{ContentType: oidDataContentType, Content: explicit(octets)}, nil
+}
+
+// explicit wraps DER in an explicit [0] tag. encoding/asn1 ignores the tag of RawValue fields when marshaling.
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	return salt, nil
+}
+
+// bmpString returns the password encoding of PKCS #12: UTF-16 big endian with a terminating zero.
+func bmpString(s string) []byte {
+	encoded := []byte{}
+	for _, c := range utf16.Encode([]rune(s)) {
+		encoded = append(encoded, byte(c>>8), byte(c))
+	}
+	return append(encoded, 0, 0)
+}
+
+// pbkdf derives key material with SHA-1 as in appendix B of RFC 7292. The id is 1 for keys, 2 for IVs and 3 for MAC
+// keys.
+func pbkdf(salt, password []byte, iterations int, id byte, size int) []byte {
+	const u, v = sha1.Size, 64
+
+	fill := func(data []byte) []byte {
+		if len(data) == 0 {
+			return nil
+		}
+		filled := make([]byte, v*((len(data)+v-1)/v))
+		for i := range filled {
+			filled[i] = data[i%len(data)]
+		}
+		return filled
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	result := []byte{}
+	one := big.NewInt(1)
+	for len(result) < size {
+		a := sha1.Sum(append(d, i...))
+		for n := 1; n < iterations; n++ {
+			a = sha1.Sum(a[:])
+		}
+		result = append(result, a[:]...)
+
+		// I_j = (I_j + B + 1) mod 2^(v*8) for each v byte block I_j of I
+		b := new(big.Int).SetBytes(fill(a[:])[:v])
+		b.Add(b, one)
+		for j := 0; j < len(i); j += v {
+			sum := new(big.Int).SetBytes(i[j : j+v])
+			sum.Add(sum, b)
+			block := sum.Bytes()
+			if len(block) > v {
+				block = block[len(block)-v:]
+			}
+			copy(i[j:j+v], make([]byte, v))
+			copy(i[j+v-len(block):j+v], block)
+		}
+	}
+	return result[:size]
+}
@@ -0,0 +1,169 @@
+package certificates
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RestartLockAnnotation on the topology lock configmap names the pod that restarts to use new TLS artifacts.
+const RestartLockAnnotation = "cassandra.kudo.dev/tlsRestartLock"
+
+// Restarter restarts the nodes of an instance one at a time. A node only restarts if all nodes are ready and no
+// other node holds the restart lock. The lock is released by the restarted node once its pod is ready again.
+type Restarter struct {
+	client    kubernetes.Interface
+	namespace string
+	podName   string
+	// lockName is the configmap with the lock annotation
+	lockName string
+	// selector of the pods and stateful sets of the instance
+	selector string
+	interval time.Duration
+}
+
+func NewRestarter(client kubernetes.Interface, namespace, podName, lockName, selector string, interval time.Duration) *Restarter {
+	return &Restarter{client: client, namespace: namespace, podName: podName, lockName: lockName, selector: selector, interval: interval}
+}
+
+// Restart waits for the restart lock and deletes the pod of this node, which the stateful set recreates. The preStop
+// hook of the pod drains the node.
+func (r *Restarter) Restart() error {
+	for {
+		acquired, err := r.tryAcquire()
+		if err != nil {
+			return err
+		}
+		if acquired {
+			break
+		}
+		time.Sleep(r.interval)
+	}
+	log.Infof("tls-agent: Acquired the restart lock, deleting pod %s", r.podName)
+	if err := r.client.CoreV1().Pods(r.namespace).Delete(r.podName, &meta_v1.DeleteOptions{}); err != nil {
+		if releaseErr := r.release(); releaseErr != nil {
+			log.Errorf("tls-agent: %v", releaseErr)
+		}
+		return fmt.Errorf("failed to delete pod %s: %v", r.podName, err)
+	}
+	return nil
+}
+
+// ReleaseWhenReady releases the restart lock if this node holds it, as soon as the pod is ready. It returns when the
+// lock is not held by this node anymore.
+func (r *Restarter) ReleaseWhenReady() {
+	for {
+		pod, err := r.client.CoreV1().Pods(r.namespace).Get(r.podName, meta_v1.GetOptions{})
+		if err != nil {
+			log.Warnf("tls-agent: failed to get pod %s: %v", r.podName, err)
+		} else if isReady(pod) {
+			if err := r.release(); err != nil {
+				log.Warnf("tls-agent: %v", err)
+			} else {
+				return
+			}
+		}
+		time.Sleep(r.interval)
+	}
+}
+
+func (r *Restarter) tryAcquire() (bool, error) {
+	cm, err := r.client.CoreV1().ConfigMaps(r.namespace).Get(r.lockName, meta_v1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get the restart lock %s: %v", r.lockName, err)
+	}
+	pods, err := r.readyPods()
+	if err != nil {
+		return false, err
+	}
+	holder := cm.Annotations[RestartLockAnnotation]
+	if holder != "" && holder != r.podName {
+		if _, exists := pods[holder]; exists || pods == nil {
+			log.Infof("tls-agent: Waiting for pod %s to restart", holder)
+			return false, nil
+		}
+		// The pod of the holder was removed, e.g. by scaling down the instance
+		log.Warnf("tls-agent: Ignoring the restart lock of pod %s, which does not exist anymore", holder)
+	}
+	if pods == nil {
+		log.Infof("tls-agent: Waiting for all nodes to be ready")
+		return false, nil
+	}
+
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	cm.Annotations[RestartLockAnnotation] = r.podName
+	if _, err := r.client.CoreV1().ConfigMaps(r.namespace).Update(cm); errors.IsConflict(err) {
+		// Another node acquired the lock at the same time
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to acquire the restart lock %s: %v", r.lockName, err)
+	}
+	return true, nil
+}
+
+func (r *Restarter) release() error {
+	for {
+		cm, err := r.client.CoreV1().ConfigMaps(r.namespace).Get(r.lockName, meta_v1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get the restart lock %s: %v", r.lockName, err)
+		}
+		if cm.Annotations[RestartLockAnnotation] != r.podName {
+			return nil
+		}
+		cm.Annotations[RestartLockAnnotation] = ""
+		_, err = r.client.CoreV1().ConfigMaps(r.namespace).Update(cm)
+		if err == nil {
+			log.Infof("tls-agent: Released the restart lock %s", r.lockName)
+			return nil
+		}
+		if !errors.IsConflict(err) {
+			return fmt.Errorf("failed to release the restart lock %s: %v", r.lockName, err)
+		}
+	}
+}
+
+// readyPods returns the names of the pods of the instance, or nil if not all of the pods of its stateful sets exist
+// and are ready.
+func (r *Restarter) readyPods() (map[string]struct{}, error) {
+	statefulSets, err := r.client.AppsV1().StatefulSets(r.namespace).List(meta_v1.ListOptions{LabelSelector: r.selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stateful sets: %v", err)
+	}
+	replicas := 0
+	for _, s := range statefulSets.Items {
+		if s.Spec.Replicas != nil {
+			replicas += int(*s.Spec.Replicas)
+		}
+	}
+	pods, err := r.client.CoreV1().Pods(r.namespace).List(meta_v1.ListOptions{LabelSelector: r.selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	names := map[string]struct{}{}
+	for i := range pods.Items {
+		if !isReady(&pods.Items[i]) || pods.Items[i].DeletionTimestamp != nil {
+			return nil, nil
+		}
+		names[pods.Items[i].Name] = struct{}{}
+	}
+	if len(names) < replicas {
+		return nil, nil
+	}
+	return names, nil
+}
+
+func isReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -61,13 +61,29 @@ func (c *CassandraService) SetReplaceIP() error {
 		log.Errorf("bootstrap: cassandra-topology configmap %s could not be found\n", configmapName)
 		return err
 	}
+	if err != nil {
+		return err
+	}
 	oldIp := cfg.Data[podName]
 	log.Infof("bootstrap: Got old IP %s for pod %s, current IP is %s", oldIp, podName, podIpAddress)
-	if oldIp == podIpAddress || oldIp == "" {
+
+	replacement, err := GetReplacement(cfg)
+	if err != nil {
+		log.Warnf("bootstrap: ignoring replacement marker of pod %s: %v", podName, err)
+	}
+	if replacement != nil {
+		// The recovery controller wiped the data of this pod, the node must replace the old node even if the
+		// pod got the same IP
+		log.Infof("bootstrap: Pod %s is marked for replacement of node %s (host ID: %s, reason: %s)", podName, replacement.Address, replacement.HostID, replacement.Reason)
+		oldIp = replacement.Address
+	} else if oldIp == podIpAddress {
+		return nil
+	}
+	if oldIp == "" {
 		return nil
 	}
 
-	if shutdownOldReachableNode {
+	if shutdownOldReachableNode && oldIp != podIpAddress {
 		// This is guarded by a feature flag, as this call can have quite a timeout and delay node startup
 		if isOldNodeReachableAndUp(oldIp) {
 			log.Infof("old node %s is still reachable and marked as UP. Try to shutdown old node now", oldIp)
@@ -173,6 +189,35 @@ func (c *CassandraService) WaitforReplacement(duration time.Duration) error {
 	}
 }
 
+// VerifyReplacement checks that a node which replaced another node took over the host ID of the replaced node.
+func (c *CassandraService) VerifyReplacement() {
+	cfg, err := c.CMService.GetConfigMap(namespace, configmapName)
+	if err != nil {
+		log.Warnf("bootstrap: could not read configmap %s to verify the replacement: %v", configmapName, err)
+		return
+	}
+	replacement, err := GetReplacement(cfg)
+	if err != nil || replacement == nil || replacement.HostID == "" {
+		return
+	}
+	status, err := NewNodetool(useSSL).Status()
+	if err != nil {
+		log.Warnf("bootstrap: could not get the node status to verify the replacement: %v", err)
+		return
+	}
+	node := status.FindNodeWithIP(podIpAddress)
+	if node == nil {
+		log.Warnf("bootstrap: Node %s is not part of the ring, can not verify the replacement", podIpAddress)
+		return
+	}
+	hostID := node.HostID
+	if hostID == replacement.HostID {
+		log.Infof("bootstrap: Node %s replaced node %s with host ID %s", podIpAddress, replacement.Address, hostID)
+	} else {
+		log.Warnf("bootstrap: Node %s has host ID %s, but was expected to replace host ID %s of node %s", podIpAddress, hostID, replacement.HostID, replacement.Address)
+	}
+}
+
 func (c *CassandraService) NewIpRegistered() bool {
 	nodetool := NewNodetool(useSSL)
 	status, err := nodetool.Status()
@@ -204,6 +249,7 @@ func (c *CassandraService) Wait() error {
 		log.Errorf("bootstrap: error joining the cluster with replace ip: %v\n", err)
 		return err
 	}
+	c.VerifyReplacement()
 	log.Infoln("bootstrap: updating the configmap with new node ip")
 	if err := retry.Do(c.CMService.UpdateCM, retry.Delay(RETRY_DELAY), retry.Attempts(RETRY_ATTEMPTS)); err != nil {
 		log.Errorf("bootstrap: error updating the configmap with replace ip: %v\n", err)
@@ -77,6 +77,11 @@ func (c *ConfigMapLock) UpdateConfigMap(ns string, cm *v1.ConfigMap) (*v1.Config
 	}
 	cm.Data[podName] = podIpAddress
 	cm.Data["last-updated-by"] = podName
+	if _, ok := cm.Data[replacementKey()]; ok {
+		// The node has joined the ring, the replacement is complete
+		log.Infof("bootstrap: Removing replacement marker %s from configmap %s/%s", replacementKey(), ns, cm.GetName())
+		delete(cm.Data, replacementKey())
+	}
 	log.Infof("bootstrap: Updating configmap %s/%s with IP [%s] for pod [%s]\n", ns, cm.GetName(), podIpAddress, podName)
 	return c.CoreV1().ConfigMaps(ns).Update(cm)
 }
@@ -46,3 +46,46 @@ func TestCMUpdate_no_CM_fail(t *testing.T) {
 	err := cm.UpdateCM()
 	assert.NotNil(t, err)
 }
+
+func TestCMUpdate_removesReplacement(t *testing.T) {
+	namespace = v1.NamespaceDefault
+	podName = "cassandra-node-1"
+	podIpAddress = "10.10.10.2"
+	configmapName = "cassandra-topology-lock"
+	cmLock := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cassandra-topology-lock",
+			Namespace: v1.NamespaceDefault,
+		},
+		Data: map[string]string{
+			"cassandra-node-1":         "10.10.10.2",
+			"replace.cassandra-node-1": `{"address":"10.10.10.2","hostID":"0f2d8c61-98e0-4bb1-9f8e-0a0c43c8d9f1"}`,
+		},
+	}
+
+	fakeClient := fake.NewSimpleClientset(cmLock)
+	cm := &ConfigMapLock{fakeClient}
+
+	replacement, err := GetReplacement(cmLock)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.10.10.2", replacement.Address)
+	assert.Equal(t, "0f2d8c61-98e0-4bb1-9f8e-0a0c43c8d9f1", replacement.HostID)
+
+	assert.NoError(t, cm.UpdateCM())
+
+	updated, err := cm.GetConfigMap(namespace, configmapName)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.10.10.2", updated.Data["cassandra-node-1"])
+	assert.NotContains(t, updated.Data, "replace.cassandra-node-1")
+	replacement, err = GetReplacement(updated)
+	assert.NoError(t, err)
+	assert.Nil(t, replacement)
+}
+
+func TestGetReplacement_invalid(t *testing.T) {
+	podName = "cassandra-node-1"
+	for _, value := range []string{"10.10.10.2", `{"hostID":"0f2d8c61-98e0-4bb1-9f8e-0a0c43c8d9f1"}`} {
+		_, err := GetReplacement(&v1.ConfigMap{Data: map[string]string{"replace.cassandra-node-1": value}})
+		assert.Error(t, err, value)
+	}
+}
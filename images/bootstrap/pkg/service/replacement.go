@@ -0,0 +1,40 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// REPLACEMENT_KEY_PREFIX is the prefix of the topology configmap keys that the recovery controller sets for pods
+// whose data it wiped. Such a pod must replace the old node, even if it got the same IP.
+const REPLACEMENT_KEY_PREFIX = "replace."
+
+type Replacement struct {
+	Address     string    `json:"address"`
+	HostID      string    `json:"hostID,omitempty"`
+	RequestedAt time.Time `json:"requestedAt"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+func replacementKey() string {
+	return REPLACEMENT_KEY_PREFIX + podName
+}
+
+// GetReplacement returns the pending replacement of this pod, or nil if the pod is not marked for replacement.
+func GetReplacement(cm *v1.ConfigMap) (*Replacement, error) {
+	value := cm.Data[replacementKey()]
+	if value == "" {
+		return nil, nil
+	}
+	replacement := &Replacement{}
+	if err := json.Unmarshal([]byte(value), replacement); err != nil {
+		return nil, fmt.Errorf("invalid replacement marker %s: %v", replacementKey(), err)
+	}
+	if replacement.Address == "" {
+		return nil, fmt.Errorf("replacement marker %s has no address", replacementKey())
+	}
+	return replacement, nil
+}
@@ -21,6 +21,8 @@ readonly prometheus_exporter_docker_image="${PROMETHEUS_EXPORTER_DOCKER_IMAGE:-}
 readonly medusa_backup_docker_image="${MEDUSA_BACKUP_DOCKER_IMAGE:-}"
 readonly integration_tests_docker_image="${INTEGRATION_TESTS_DOCKER_IMAGE:-}"
 readonly recovery_controller_docker_image="${RECOVERY_CONTROLLER_DOCKER_IMAGE:-}"
+readonly repair_docker_image="${REPAIR_DOCKER_IMAGE:-}"
+readonly backup_docker_image="${BACKUP_DOCKER_IMAGE:-}"
 
 if [[ -z ${cassandra_docker_image} ]]; then
   echo "Missing CASSANDRA_DOCKER_IMAGE" >&2
@@ -47,6 +49,16 @@ if [[ -z ${recovery_controller_docker_image} ]]; then
   exit 1
 fi
 
+if [[ -z ${repair_docker_image} ]]; then
+  echo "Missing REPAIR_DOCKER_IMAGE" >&2
+  exit 1
+fi
+
+if [[ -z ${backup_docker_image} ]]; then
+  echo "Missing BACKUP_DOCKER_IMAGE" >&2
+  exit 1
+fi
+
 docker image build \
        -t "${cassandra_docker_image}" \
        -f "${project_directory}/images/Dockerfile" \
@@ -72,12 +84,24 @@ docker image build \
        -f "${project_directory}/images/Dockerfile.recovery-controller" \
        "${project_directory}/images"
 
+docker image build \
+       -t "${repair_docker_image}" \
+       -f "${project_directory}/images/Dockerfile.repair" \
+       "${project_directory}/images"
+
+docker image build \
+       -t "${backup_docker_image}" \
+       -f "${project_directory}/images/Dockerfile.backup" \
+       "${project_directory}/images"
+
 if [[ "${1:-}" == "push" ]]; then
   docker push "${cassandra_docker_image}"
   docker push "${prometheus_exporter_docker_image}"
   docker push "${medusa_backup_docker_image}"
   docker push "${integration_tests_docker_image}"
   docker push "${recovery_controller_docker_image}"
+  docker push "${repair_docker_image}"
+  docker push "${backup_docker_image}"
 fi
 
 if [[ "${1:-}" == "kind-load" ]]; then
@@ -86,4 +110,6 @@ if [[ "${1:-}" == "kind-load" ]]; then
   kind load docker-image "${medusa_backup_docker_image}"
   kind load docker-image "${integration_tests_docker_image}"
   kind load docker-image "${recovery_controller_docker_image}"
+  kind load docker-image "${repair_docker_image}"
+  kind load docker-image "${backup_docker_image}"
 fi
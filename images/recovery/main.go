@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/cassandra"
 	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/client"
 	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/controller"
 
@@ -19,6 +20,19 @@ func main() {
 		return
 	}
 
-	cont := controller.NewController(clientSet, controller.NewOptions())
+	dynamicClient, err := client.GetDynamicClient()
+	if err != nil {
+		log.Fatalf("failed to get dynamic kube client: %v", err)
+		return
+	}
+
+	config, err := client.GetKubeConfig()
+	if err != nil {
+		log.Fatalf("failed to get kube config: %v", err)
+		return
+	}
+
+	executor := cassandra.NewPodExecutor(config, clientSet)
+	cont := controller.NewController(clientSet, dynamicClient, executor, controller.NewOptions())
 	cont.Run(context.Background())
 }
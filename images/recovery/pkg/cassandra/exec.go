@@ -0,0 +1,79 @@
+package cassandra
+
+import (
+	"bytes"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// Container is the name of the Cassandra container in the node pods.
+	Container = "cassandra"
+	// DrainScript drains the Cassandra node, it is also used as preStop hook of the node pods.
+	DrainScript = "/etc/cassandra/node-drain.sh"
+	// DecommissionScript streams the data of the Cassandra node to the other nodes and removes it from the ring.
+	DecommissionScript = "/etc/cassandra/node-decommission.sh"
+)
+
+// Executor runs commands in containers of a pod.
+type Executor interface {
+	Exec(pod *corev1.Pod, container string, command []string) (string, error)
+}
+
+type podExecutor struct {
+	config *rest.Config
+	client kubernetes.Interface
+}
+
+// NewPodExecutor returns an Executor that uses the pods/exec subresource.
+func NewPodExecutor(config *rest.Config, client kubernetes.Interface) Executor {
+	return &podExecutor{config: config, client: client}
+}
+
+func (e *podExecutor) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	req := e.client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod.Name).
+		Namespace(pod.Namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(e.config, "POST", req.URL())
+	if err != nil {
+		return "", fmt.Errorf("failed to create executor for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = exec.Stream(remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		return stdout.String(), fmt.Errorf("command %v in pod %s/%s failed: %v: %s", command, pod.Namespace, pod.Name, err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// Drain flushes all memtables of the Cassandra node in the pod and stops it from accepting writes.
+func Drain(executor Executor, pod *corev1.Pod) error {
+	log.Printf("Draining Cassandra node in pod %s/%s", pod.Namespace, pod.Name)
+	out, err := executor.Exec(pod, Container, []string{"/bin/bash", DrainScript})
+	log.Printf("Drain output:\n%s", out)
+	return err
+}
+
+// Decommission streams the data of the Cassandra node in the pod to the other nodes and removes it from the ring.
+func Decommission(executor Executor, pod *corev1.Pod) error {
+	log.Printf("Decommissioning Cassandra node in pod %s/%s", pod.Namespace, pod.Name)
+	out, err := executor.Exec(pod, Container, []string{"/bin/bash", DecommissionScript})
+	log.Printf("Decommission output:\n%s", out)
+	return err
+}
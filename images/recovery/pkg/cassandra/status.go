@@ -0,0 +1,80 @@
+package cassandra
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// StatusScript prints the status of the ring as seen by the Cassandra node.
+const StatusScript = "/etc/cassandra/node-status.sh"
+
+var hostIDPat = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// statusFields returns the fields of the line of the node with the address in the output of 'nodetool status', or
+// nil if the address is not part of the ring.
+func statusFields(status, address string) []string {
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		// UN  10.0.0.1  1.2 MiB  256  ?  2f3c9a4e-...  rack1
+		if len(fields) < 3 || len(fields[0]) != 2 || fields[1] != address {
+			continue
+		}
+		return fields
+	}
+	return nil
+}
+
+// ParseHostID returns the host ID of the node with the address from the output of 'nodetool status', or an empty
+// string if the address is not part of the ring.
+func ParseHostID(status, address string) string {
+	fields := statusFields(status, address)
+	if fields == nil {
+		return ""
+	}
+	for _, field := range fields[2:] {
+		if hostIDPat.MatchString(field) {
+			return field
+		}
+	}
+	return ""
+}
+
+// ParseState returns the status and state of the node with the address from the output of 'nodetool status', e.g.
+// "UN" or "UJ", or an empty string if the address is not part of the ring.
+func ParseState(status, address string) string {
+	fields := statusFields(status, address)
+	if fields == nil {
+		return ""
+	}
+	return fields[0]
+}
+
+// HostID returns the host ID of the node with the address, as seen by the Cassandra node in the pod.
+func HostID(executor Executor, pod *corev1.Pod, address string) (string, error) {
+	out, err := executor.Exec(pod, Container, []string{"/bin/bash", StatusScript})
+	if err != nil {
+		return "", err
+	}
+	hostID := ParseHostID(out, address)
+	if hostID == "" {
+		return "", fmt.Errorf("node %s is not part of the ring seen by pod %s/%s", address, pod.Namespace, pod.Name)
+	}
+	return hostID, nil
+}
+
+// State returns the status and state of the Cassandra node in the pod as seen by itself, e.g. "UN" once it is up
+// and normal.
+func State(executor Executor, pod *corev1.Pod) (string, error) {
+	out, err := executor.Exec(pod, Container, []string{"/bin/bash", StatusScript})
+	if err != nil {
+		return "", err
+	}
+	state := ParseState(out, pod.Status.PodIP)
+	if state == "" {
+		return "", fmt.Errorf("node %s is not part of the ring seen by pod %s/%s", pod.Status.PodIP, pod.Namespace, pod.Name)
+	}
+	return state, nil
+}
@@ -0,0 +1,30 @@
+package cassandra
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const status = `Datacenter: dc1
+===============
+Status=Up/Down
+|/ State=Normal/Leaving/Joining/Moving
+--  Address       Load       Tokens       Owns (effective)  Host ID                               Rack
+UN  10.244.1.12   1.43 MiB   256          66.5%             6bb0a8e3-3a4b-4c6f-a4a4-52b0c5f1e1a2  rack1
+DN  10.244.2.7    ?          256          68.1%             0f2d8c61-98e0-4bb1-9f8e-0a0c43c8d9f1  rack1
+UN  10.244.3.4    1.38 MiB   256          65.4%             c1d9a7a3-1e3b-46f4-8e9b-19e1d3f2a0b7  rack1
+`
+
+func TestParseHostID(t *testing.T) {
+	assert.Equal(t, "0f2d8c61-98e0-4bb1-9f8e-0a0c43c8d9f1", ParseHostID(status, "10.244.2.7"))
+	assert.Equal(t, "6bb0a8e3-3a4b-4c6f-a4a4-52b0c5f1e1a2", ParseHostID(status, "10.244.1.12"))
+	assert.Equal(t, "", ParseHostID(status, "10.244.1.1"))
+	assert.Equal(t, "", ParseHostID("", "10.244.1.12"))
+}
+
+func TestParseState(t *testing.T) {
+	assert.Equal(t, "UN", ParseState(status, "10.244.1.12"))
+	assert.Equal(t, "DN", ParseState(status, "10.244.2.7"))
+	assert.Equal(t, "", ParseState(status, "10.244.1.1"))
+}
@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gate"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gc"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/sts"
+)
+
+// setting is a per-instance setting. The controller reads its default from the environment variable, and the
+// parameter of a KUDO instance overrides it for that instance.
+type setting struct {
+	env   string
+	param string
+}
+
+var (
+	evictionLabelSetting   = setting{env: "EVICTION_LABEL", param: "RECOVERY_CONTROLLER_EVICTION_LABEL"}
+	policyConfigMapSetting = setting{env: "POLICY_CONFIGMAP", param: "RECOVERY_CONTROLLER_POLICY_CM_NAME"}
+	evictionModeSetting    = setting{env: "EVICTION_MODE", param: "RECOVERY_CONTROLLER_EVICTION_MODE"}
+	decommissionSetting    = setting{env: "EVICTION_DECOMMISSION", param: "RECOVERY_CONTROLLER_EVICTION_DECOMMISSION"}
+	historyLimitSetting    = setting{env: "HISTORY_LIMIT", param: "RECOVERY_CONTROLLER_HISTORY_LIMIT"}
+	rateLimitSetting       = setting{env: "RECOVERY_RATE_LIMIT", param: "RECOVERY_CONTROLLER_RATE_LIMIT"}
+	windowsSetting         = setting{env: "RECOVERY_WINDOWS", param: "RECOVERY_CONTROLLER_MAINTENANCE_WINDOWS"}
+	gcModeSetting          = setting{env: "GC_MODE", param: "RECOVERY_CONTROLLER_GC_MODE"}
+	gcGracePeriodSetting   = setting{env: "GC_GRACE_PERIOD", param: "RECOVERY_CONTROLLER_GC_GRACE_PERIOD"}
+
+	instanceSettings = []setting{
+		evictionLabelSetting,
+		policyConfigMapSetting,
+		evictionModeSetting,
+		decommissionSetting,
+		historyLimitSetting,
+		rateLimitSetting,
+		windowsSetting,
+		gcModeSetting,
+		gcGracePeriodSetting,
+	}
+)
+
+// instanceConfig configures how the pods of a Cassandra instance are recovered.
+type instanceConfig struct {
+	evictionLabel   string
+	policyConfigMap string
+	evictionMode    string
+	decommission    bool
+	historyLimit    int
+	windows         []gate.Window
+	rateLimit       gate.RateLimit
+	gc              gc.Config
+}
+
+func defaultInstanceConfig() instanceConfig {
+	return instanceConfig{
+		evictionMode: sts.EvictionModeWipe,
+		historyLimit: history.DefaultLimit,
+		gc:           gc.Config{Mode: gc.ModeReport, GracePeriod: 24 * time.Hour},
+	}
+}
+
+// parseInstanceConfig overrides the settings of the defaults that are returned by lookup.
+func parseInstanceConfig(lookup func(s setting) (string, bool), defaults instanceConfig) (instanceConfig, error) {
+	config := defaults
+	if v, ok := lookup(evictionLabelSetting); ok {
+		config.evictionLabel = v
+	}
+	if v, ok := lookup(policyConfigMapSetting); ok {
+		config.policyConfigMap = v
+	}
+	if v, ok := lookup(evictionModeSetting); ok && v != "" {
+		if v != sts.EvictionModeWipe && v != sts.EvictionModeSnapshot {
+			return config, fmt.Errorf("unknown eviction mode '%s'", v)
+		}
+		config.evictionMode = v
+	}
+	if v, ok := lookup(decommissionSetting); ok {
+		config.decommission = v == "true"
+	}
+	if v, ok := lookup(historyLimitSetting); ok && v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return config, fmt.Errorf("invalid history limit '%s'", v)
+		}
+		config.historyLimit = limit
+	}
+	if v, ok := lookup(rateLimitSetting); ok {
+		rateLimit, err := gate.ParseRateLimit(v)
+		if err != nil {
+			return config, err
+		}
+		config.rateLimit = rateLimit
+	}
+	if v, ok := lookup(windowsSetting); ok {
+		windows, err := gate.ParseWindows(v)
+		if err != nil {
+			return config, err
+		}
+		config.windows = windows
+	}
+	if v, ok := lookup(gcModeSetting); ok && v != "" {
+		mode, err := gc.ParseMode(v)
+		if err != nil {
+			return config, err
+		}
+		config.gc.Mode = mode
+	}
+	if v, ok := lookup(gcGracePeriodSetting); ok && v != "" {
+		grace, err := time.ParseDuration(v)
+		if err != nil || grace < 0 {
+			return config, fmt.Errorf("invalid garbage collection grace period '%s'", v)
+		}
+		config.gc.GracePeriod = grace
+	}
+	if config.decommission && config.evictionMode == sts.EvictionModeSnapshot {
+		log.Warnf("Decommission is not supported with eviction mode '%s', evicted nodes will be drained", config.evictionMode)
+		config.decommission = false
+	}
+	return config, nil
+}
+
+func envLookup(s setting) (string, bool) {
+	return os.LookupEnv(s.env)
+}
+
+// paramLookup returns a lookup for the parameters of a KUDO instance.
+func paramLookup(params map[string]string) func(s setting) (string, bool) {
+	return func(s setting) (string, bool) {
+		v, ok := params[s.param]
+		return v, ok
+	}
+}
+
+// logConfig prints the configuration of an instance.
+func logConfig(name string, config instanceConfig) {
+	if config.evictionLabel == "" {
+		log.Infof("%s: no eviction label set, eviction is not supported", name)
+	} else {
+		log.Infof("%s: watching for eviction label '%s'", name, config.evictionLabel)
+	}
+	if config.policyConfigMap == "" {
+		log.Infof("%s: no policy configmap set, using the default recovery policies", name)
+	} else {
+		log.Infof("%s: watching configmap '%s' for recovery policies", name, config.policyConfigMap)
+	}
+	log.Infof("%s: using eviction mode '%s'", name, config.evictionMode)
+	if config.decommission {
+		log.Infof("%s: evicted nodes will be decommissioned", name)
+	}
+	log.Infof("%s: recording the last %d recoveries", name, config.historyLimit)
+	if len(config.windows) == 0 {
+		log.Infof("%s: no maintenance windows set, recoveries are allowed at any time", name)
+	} else {
+		log.Infof("%s: recoveries are only allowed in the maintenance windows %v", name, config.windows)
+	}
+	if config.rateLimit.Count > 0 {
+		log.Infof("%s: allowing at most %v recoveries", name, config.rateLimit)
+	}
+	switch config.gc.Mode {
+	case gc.ModeReport:
+		log.Infof("%s: reporting orphaned volumes", name)
+	case gc.ModeDelete:
+		log.Infof("%s: deleting orphaned volumes after %v", name, config.gc.GracePeriod)
+	}
+}
+
+// loopConfig configures how often the controller looks at pods, and how failures are retried.
+type loopConfig struct {
+	// resyncInterval is the interval in which the informers deliver all pods again.
+	resyncInterval time.Duration
+	// reconcileInterval is the interval of the full reconciliation of all pods and PVCs.
+	reconcileInterval time.Duration
+	// maxRetries is the number of retries of a pod that failed to process, before it is left to the
+	// next reconciliation.
+	maxRetries int
+	// retryBaseDelay is the delay of the first retry, it doubles with every retry up to retryMaxDelay.
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+}
+
+func defaultLoopConfig() loopConfig {
+	return loopConfig{
+		resyncInterval:    10 * time.Minute,
+		reconcileInterval: 5 * time.Minute,
+		maxRetries:        5,
+		retryBaseDelay:    5 * time.Second,
+		retryMaxDelay:     5 * time.Minute,
+	}
+}
+
+// parseLoopConfig reads the loop configuration from the environment variables returned by lookup. A duration of
+// 0 disables the resync and the reconciliation.
+func parseLoopConfig(lookup func(env string) (string, bool)) (loopConfig, error) {
+	config := defaultLoopConfig()
+	durations := []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"RESYNC_INTERVAL", &config.resyncInterval},
+		{"RECONCILE_INTERVAL", &config.reconcileInterval},
+		{"RETRY_BASE_DELAY", &config.retryBaseDelay},
+		{"RETRY_MAX_DELAY", &config.retryMaxDelay},
+	}
+	for _, d := range durations {
+		v, ok := lookup(d.env)
+		if !ok || v == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(v)
+		if err != nil || duration < 0 {
+			return config, fmt.Errorf("invalid %s '%s'", d.env, v)
+		}
+		*d.value = duration
+	}
+	if v, ok := lookup("MAX_RETRIES"); ok && v != "" {
+		retries, err := strconv.Atoi(v)
+		if err != nil || retries < 0 {
+			return config, fmt.Errorf("invalid MAX_RETRIES '%s'", v)
+		}
+		config.maxRetries = retries
+	}
+	if config.retryBaseDelay == 0 || config.retryMaxDelay < config.retryBaseDelay {
+		return config, fmt.Errorf("RETRY_BASE_DELAY must be positive and not larger than RETRY_MAX_DELAY")
+	}
+	return config, nil
+}
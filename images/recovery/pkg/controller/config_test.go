@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gate"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gc"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/sts"
+)
+
+func TestParseInstanceConfig_overridesDefaults(t *testing.T) {
+	defaults := defaultInstanceConfig()
+	defaults.evictionLabel = "kudo-cassandra/evict"
+	defaults.rateLimit = gate.RateLimit{Count: 1, Period: 30 * time.Minute}
+
+	config, err := parseInstanceConfig(paramLookup(map[string]string{
+		"RECOVERY_CONTROLLER_EVICTION_LABEL":        "example.com/evict",
+		"RECOVERY_CONTROLLER_POLICY_CM_NAME":        "policies",
+		"RECOVERY_CONTROLLER_EVICTION_DECOMMISSION": "true",
+		"RECOVERY_CONTROLLER_HISTORY_LIMIT":         "10",
+		"RECOVERY_CONTROLLER_MAINTENANCE_WINDOWS":   "0 2 * * * 4h",
+		"RECOVERY_CONTROLLER_GC_MODE":               "delete",
+		"RECOVERY_CONTROLLER_GC_GRACE_PERIOD":       "1h",
+	}), defaults)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com/evict", config.evictionLabel)
+	assert.Equal(t, "policies", config.policyConfigMap)
+	assert.Equal(t, sts.EvictionModeWipe, config.evictionMode)
+	assert.True(t, config.decommission)
+	assert.Equal(t, 10, config.historyLimit)
+	assert.Len(t, config.windows, 1)
+	assert.Equal(t, defaults.rateLimit, config.rateLimit)
+	assert.Equal(t, gc.Config{Mode: gc.ModeDelete, GracePeriod: time.Hour}, config.gc)
+}
+
+func TestParseInstanceConfig_snapshotDisablesDecommission(t *testing.T) {
+	config, err := parseInstanceConfig(paramLookup(map[string]string{
+		"RECOVERY_CONTROLLER_EVICTION_MODE":         "snapshot",
+		"RECOVERY_CONTROLLER_EVICTION_DECOMMISSION": "true",
+	}), defaultInstanceConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, sts.EvictionModeSnapshot, config.evictionMode)
+	assert.False(t, config.decommission)
+}
+
+func TestParseInstanceConfig_invalid(t *testing.T) {
+	for param, value := range map[string]string{
+		"RECOVERY_CONTROLLER_EVICTION_MODE":       "move",
+		"RECOVERY_CONTROLLER_HISTORY_LIMIT":       "-1",
+		"RECOVERY_CONTROLLER_RATE_LIMIT":          "often",
+		"RECOVERY_CONTROLLER_MAINTENANCE_WINDOWS": "sometimes",
+		"RECOVERY_CONTROLLER_GC_MODE":             "always",
+		"RECOVERY_CONTROLLER_GC_GRACE_PERIOD":     "a day",
+	} {
+		_, err := parseInstanceConfig(paramLookup(map[string]string{param: value}), defaultInstanceConfig())
+		assert.Error(t, err, param)
+	}
+}
+
+func TestParseLoopConfig(t *testing.T) {
+	config, err := parseLoopConfig(func(string) (string, bool) { return "", false })
+	assert.NoError(t, err)
+	assert.Equal(t, defaultLoopConfig(), config)
+
+	env := map[string]string{
+		"RESYNC_INTERVAL":    "0",
+		"RECONCILE_INTERVAL": "1m",
+		"MAX_RETRIES":        "10",
+		"RETRY_BASE_DELAY":   "1s",
+		"RETRY_MAX_DELAY":    "1m",
+	}
+	config, err = parseLoopConfig(func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), config.resyncInterval)
+	assert.Equal(t, time.Minute, config.reconcileInterval)
+	assert.Equal(t, 10, config.maxRetries)
+	assert.Equal(t, time.Second, config.retryBaseDelay)
+	assert.Equal(t, time.Minute, config.retryMaxDelay)
+}
+
+func TestParseLoopConfig_invalid(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"RESYNC_INTERVAL": "often"},
+		{"RECONCILE_INTERVAL": "-1m"},
+		{"MAX_RETRIES": "-1"},
+		{"RETRY_BASE_DELAY": "0"},
+		{"RETRY_BASE_DELAY": "10m", "RETRY_MAX_DELAY": "1m"},
+	} {
+		_, err := parseLoopConfig(func(name string) (string, bool) {
+			v, ok := env[name]
+			return v, ok
+		})
+		assert.Error(t, err, env)
+	}
+}
@@ -4,39 +4,74 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"time"
+	"reflect"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	uruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/workqueue"
 
-	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/sts"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/cassandra"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gate"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gc"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/metrics"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/notify"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/snapshot"
 )
 
 const (
-	InstanceLabel = "kudo.dev/instance"
+	InstanceLabel = gate.InstanceLabel
+	// OperatorLabel is set by KUDO on instances and contains the name of the operator.
+	OperatorLabel = "kudo.dev/operator"
+
+	// DiscoveryLabel recovers all pods that match the pod selector. Parameters of KUDO instances override the
+	// defaults of the controller.
+	DiscoveryLabel = "label"
+	// DiscoveryInstance recovers only the pods of KUDO instances of the Cassandra operator.
+	DiscoveryInstance = "instance"
+
+	// ownControllerParam is the instance parameter that deploys a recovery controller for the instance.
+	ownControllerParam = "RECOVERY_CONTROLLER"
 )
 
 type Controller struct {
-	client     *kubernetes.Clientset
-	queue      workqueue.RateLimitingInterface
-	informer   cache.SharedIndexInformer
-	maxRetries int
+	client           kubernetes.Interface
+	dynamicClient    dynamic.Interface
+	executor         cassandra.Executor
+	snapshotter      *snapshot.Snapshotter
+	collector        *gc.Collector
+	informer         cache.SharedIndexInformer
+	instanceInformer cache.SharedIndexInformer
+
+	lock sync.Mutex
+	// instances are the running instance workers by namespace/name
+	instances map[string]*instance
+	// excluded are the KUDO instances that run their own recovery controller
+	excluded map[string]bool
 
 	options Options
 }
 
 type Options struct {
-	namespace             string
-	evictionLabel         string
-	instanceLabelSelector string
+	namespace     string
+	podSelector   string
+	discovery     string
+	operatorName  string
+	snapshotClass string
+	notifier      *notify.Notifier
+	loop          loopConfig
+	// metricsAddress is the listen address of the metrics endpoint, empty to disable it
+	metricsAddress string
+	// defaults is the configuration of instances without own parameters
+	defaults instanceConfig
 }
 
 func NewOptions() Options {
@@ -48,134 +83,298 @@ func NewOptions() Options {
 	}
 	log.Infof("Starting the controller for namespace %s...", namespace)
 
-	evictionLabel := os.Getenv("EVICTION_LABEL")
-	if evictionLabel == "" {
-		log.Info("No eviction label set, eviction is not supported")
-	} else {
-		log.Infof("Watching for eviction label '%s'", evictionLabel)
+	operatorName := os.Getenv("OPERATOR_NAME")
+	if operatorName == "" {
+		operatorName = "cassandra"
 	}
 
-	labelSelector := ""
+	discovery := os.Getenv("DISCOVERY")
+	switch discovery {
+	case "":
+	case DiscoveryLabel, DiscoveryInstance:
+		if instance != "" {
+			log.Fatalf("INSTANCE_NAME can not be used with discovery '%s'", discovery)
+		}
+		log.Infof("Discovering Cassandra instances by %s", discovery)
+	default:
+		log.Fatalf("Unknown discovery '%s', must be one of '%s' or '%s'", discovery, DiscoveryLabel, DiscoveryInstance)
+	}
+
+	podSelector := os.Getenv("POD_SELECTOR")
 	if instance != "" {
-		labelSelector = fmt.Sprintf("%s = %s", InstanceLabel, instance)
+		podSelector = fmt.Sprintf("%s = %s", InstanceLabel, instance)
 		log.Infof("Acting only on pods with KUDO instance label %s", instance)
-	} else {
+	} else if podSelector == "" && discovery != "" {
+		// The pods of the Cassandra nodes are labeled with the operator name
+		podSelector = fmt.Sprintf("cassandra = %s, %s", operatorName, InstanceLabel)
+	}
+	if podSelector == "" {
 		log.Infof("Acting on ALL pods in selected namespace")
+	} else {
+		log.Infof("Acting on pods matching '%s'", podSelector)
+	}
+
+	defaults, err := parseInstanceConfig(envLookup, defaultInstanceConfig())
+	if err != nil {
+		log.Fatalf("Invalid recovery configuration: %v", err)
+	}
+
+	loop, err := parseLoopConfig(os.LookupEnv)
+	if err != nil {
+		log.Fatalf("Invalid controller configuration: %v", err)
+	}
+	log.Infof("Resync interval %v, reconciliation interval %v, %d retries with %v to %v backoff",
+		loop.resyncInterval, loop.reconcileInterval, loop.maxRetries, loop.retryBaseDelay, loop.retryMaxDelay)
+
+	metricsAddress, ok := os.LookupEnv("METRICS_ADDRESS")
+	if !ok {
+		metricsAddress = ":8080"
+	}
+
+	var notifier *notify.Notifier
+	if webhookConfig := os.Getenv("WEBHOOK_CONFIG"); webhookConfig != "" {
+		notifier, err = notify.FromFile(webhookConfig, os.Getenv("WEBHOOK_SECRET"))
+		if err != nil {
+			log.Fatalf("Invalid webhook configuration: %v", err)
+		}
+		log.Infof("Sending recovery notifications configured in %s", webhookConfig)
 	}
 
 	return Options{
-		instanceLabelSelector: labelSelector,
-		evictionLabel:         evictionLabel,
-		namespace:             namespace,
+		namespace:      namespace,
+		podSelector:    podSelector,
+		discovery:      discovery,
+		operatorName:   operatorName,
+		snapshotClass:  os.Getenv("SNAPSHOT_CLASS"),
+		notifier:       notifier,
+		loop:           loop,
+		metricsAddress: metricsAddress,
+		defaults:       defaults,
 	}
 }
 
-func NewController(client *kubernetes.Clientset, options Options) *Controller {
+func NewController(client kubernetes.Interface, dynamicClient dynamic.Interface, executor cassandra.Executor, options Options) *Controller {
 	return &Controller{
-		client:  client,
-		options: options,
+		client:        client,
+		dynamicClient: dynamicClient,
+		executor:      executor,
+		collector:     gc.NewCollector(client),
+		instances:     map[string]*instance{},
+		excluded:      map[string]bool{},
+		options:       options,
 	}
 }
 
-func (c *Controller) Run(ctx context.Context) {
+// instanceFor returns the worker of a Cassandra instance, and starts it if necessary. It returns nil if the
+// pods of the instance should not be recovered, or if the pod has no instance label.
+func (c *Controller) instanceFor(namespace, name string) *instance {
+	if name == "" {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	stopCh := make(chan struct{})
-	defer close(stopCh)
-	c.queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
-	c.informer = cache.NewSharedIndexInformer(
+	key := instanceKey(namespace, name)
+	if i, ok := c.instances[key]; ok {
+		return i
+	}
+	if c.options.discovery == DiscoveryInstance || c.excluded[key] {
+		return nil
+	}
+	i := c.newInstance(namespace, name, c.options.defaults, nil)
+	if err := i.start(); err != nil {
+		log.Errorf("Failed to start recovery of %s: %v", i, err)
+		return nil
+	}
+	c.instances[key] = i
+	return i
+}
+
+// syncInstance (re)starts the worker of a KUDO instance with the recovery settings of its parameters.
+func (c *Controller) syncInstance(obj *unstructured.Unstructured) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := instanceKey(obj.GetNamespace(), obj.GetName())
+	params, _, err := unstructured.NestedStringMap(obj.Object, "spec", "parameters")
+	if err != nil {
+		log.Errorf("Failed to read parameters of instance %s: %v", key, err)
+		return
+	}
+
+	if params[ownControllerParam] == "true" {
+		if !c.excluded[key] {
+			log.Infof("Instance %s runs its own recovery controller, ignoring it", key)
+		}
+		c.excluded[key] = true
+		c.stopInstance(key)
+		return
+	}
+	delete(c.excluded, key)
+
+	relevant := map[string]string{}
+	for _, s := range instanceSettings {
+		if v, ok := params[s.param]; ok {
+			relevant[s.param] = v
+		}
+	}
+	if existing, ok := c.instances[key]; ok && reflect.DeepEqual(existing.params, relevant) {
+		return
+	}
+
+	config, err := parseInstanceConfig(paramLookup(relevant), c.options.defaults)
+	if err != nil {
+		log.Errorf("Invalid recovery parameters of instance %s, using the defaults: %v", key, err)
+		config = c.options.defaults
+	}
+	c.stopInstance(key)
+	i := c.newInstance(obj.GetNamespace(), obj.GetName(), config, relevant)
+	if err := i.start(); err != nil {
+		log.Errorf("Failed to start recovery of %s: %v", i, err)
+		return
+	}
+	c.instances[key] = i
+}
+
+// stopInstance stops the worker of an instance. The caller must hold the lock.
+func (c *Controller) stopInstance(key string) {
+	if i, ok := c.instances[key]; ok {
+		i.stop()
+		delete(c.instances, key)
+	}
+}
+
+func (c *Controller) removeInstance(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := instanceKey(u.GetNamespace(), u.GetName())
+	delete(c.excluded, key)
+	c.stopInstance(key)
+}
+
+// watchInstances discovers the KUDO instances of the Cassandra operator and their parameters.
+func (c *Controller) watchInstances(stopCh <-chan struct{}) bool {
+	labelSelector := fmt.Sprintf("%s = %s", OperatorLabel, c.options.operatorName)
+	resource := c.dynamicClient.Resource(gate.InstanceResource).Namespace(c.options.namespace)
+	c.instanceInformer = cache.NewSharedIndexInformer(
 		&cache.ListWatch{
 			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-				options.LabelSelector = c.options.instanceLabelSelector
-				return c.client.CoreV1().Pods(c.options.namespace).List(options)
+				options.LabelSelector = labelSelector
+				return resource.List(options)
 			},
 			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-				options.LabelSelector = c.options.instanceLabelSelector
-				return c.client.CoreV1().Pods(c.options.namespace).Watch(options)
+				options.LabelSelector = labelSelector
+				return resource.Watch(options)
 			},
 		},
-		&corev1.Pod{},
+		&unstructured.Unstructured{},
 		0, //No resync
 		cache.Indexers{},
 	)
-
-	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	c.instanceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			key, err := cache.MetaNamespaceKeyFunc(obj)
-			if err == nil {
-				c.queue.Add(key)
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				c.syncInstance(u)
 			}
 		},
 		UpdateFunc: func(old, new interface{}) {
-			oldEvent, _ := old.(*corev1.Pod)
-			newEvent, _ := new.(*corev1.Pod)
-			if oldEvent.ResourceVersion != newEvent.ResourceVersion {
-				key, err := cache.MetaNamespaceKeyFunc(new)
-				if err == nil {
-					c.queue.Add(key)
-				}
-			}
-		},
-		DeleteFunc: func(obj interface{}) {
-			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
-			if err == nil {
-				c.queue.Add(key)
+			if u, ok := new.(*unstructured.Unstructured); ok {
+				c.syncInstance(u)
 			}
 		},
+		DeleteFunc: c.removeInstance,
 	})
 
-	go c.informer.Run(stopCh)
+	go c.instanceInformer.Run(stopCh)
+	return cache.WaitForCacheSync(stopCh, c.instanceInformer.HasSynced)
+}
 
-	log.Infoln("Controller started.")
-	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
-		uruntime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+// enqueue adds the pod to the queue of its instance.
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
 		return
 	}
-	log.Infoln("Controller synced.")
-
-	wait.Until(c.runWorker, time.Second, stopCh)
-}
-
-func (c *Controller) runWorker() {
-	for c.processNext() {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	if i := c.instanceFor(pod.Namespace, pod.Labels[InstanceLabel]); i != nil {
+		i.queue.Add(key)
 	}
 }
 
-func (c *Controller) processNext() bool {
-	key, quit := c.queue.Get()
+func (c *Controller) Run(ctx context.Context) {
 
-	if quit {
-		return false
-	}
-	defer c.queue.Done(key)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
 
-	err := c.processItem(key.(string))
-	if err == nil {
-		c.queue.Forget(key)
-	} else if c.queue.NumRequeues(key) < c.maxRetries {
-		log.Errorf("Error processing %s (will retry): %v", key, err)
-		c.queue.AddRateLimited(key)
-	} else {
-		log.Errorf("Error processing %s (giving up): %v", key, err)
-		c.queue.Forget(key)
-		uruntime.HandleError(err)
+	c.snapshotter = snapshot.NewSnapshotter(c.client, c.dynamicClient, c.options.snapshotClass)
+	go c.options.notifier.Run(stopCh)
+	if c.options.metricsAddress != "" {
+		go metrics.Serve(c.options.metricsAddress)
 	}
 
-	return true
-}
+	// The pod informer is created before any instance worker is started, the workers read the pods from its store
+	c.informer = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = c.options.podSelector
+				return c.client.CoreV1().Pods(c.options.namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = c.options.podSelector
+				return c.client.CoreV1().Pods(c.options.namespace).Watch(options)
+			},
+		},
+		&corev1.Pod{},
+		c.options.loop.resyncInterval,
+		cache.Indexers{},
+	)
 
-func (c *Controller) processItem(key string) error {
-	obj, _, err := c.informer.GetIndexer().GetByKey(key)
-	if err != nil {
-		return fmt.Errorf("error fetching object with key %s from store: %v", key, err)
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		// Periodic resyncs deliver unchanged pods, they are processed again as well
+		UpdateFunc: func(old, new interface{}) { c.enqueue(new) },
+		DeleteFunc: c.enqueue,
+	})
+
+	// The instances are known before the pods, so the pods are queued with the settings of their instance
+	if c.options.discovery != "" {
+		if !c.watchInstances(stopCh) {
+			uruntime.HandleError(fmt.Errorf("timed out waiting for instances to sync"))
+			return
+		}
 	}
-	if obj == nil {
-		return nil
+
+	go c.informer.Run(stopCh)
+
+	log.Infoln("Controller started.")
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		uruntime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+		return
 	}
-	ro, ok := obj.(runtime.Object)
-	if !ok {
-		return fmt.Errorf("object with key %s is not a runtime.Object", key)
+	log.Infoln("Controller synced.")
+
+	if c.options.loop.reconcileInterval > 0 {
+		go wait.Until(c.reconcile, c.options.loop.reconcileInterval, stopCh)
 	}
 
-	sts.Process(c.client, c.options.evictionLabel, ro)
-	return nil
+	<-ctx.Done()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key := range c.instances {
+		c.stopInstance(key)
+	}
 }
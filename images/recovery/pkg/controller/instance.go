@@ -0,0 +1,253 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	uruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gate"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/metrics"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/policy"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/sts"
+)
+
+// instance recovers the pods of a single Cassandra instance. Every instance has its own queue and worker, so a
+// broken instance cannot block the recovery of other instances.
+type instance struct {
+	namespace string
+	name      string
+	config    instanceConfig
+	// params are the instance parameters the configuration was built from.
+	params map[string]string
+
+	controller     *Controller
+	queue          workqueue.RateLimitingInterface
+	policyInformer cache.SharedIndexInformer
+	history        *history.Recorder
+	gate           *gate.Gate
+	stopCh         chan struct{}
+
+	policyLock sync.RWMutex
+	policies   *policy.Set
+}
+
+func instanceKey(namespace, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+func (c *Controller) newInstance(namespace, name string, config instanceConfig, params map[string]string) *instance {
+	i := &instance{
+		namespace:  namespace,
+		name:       name,
+		config:     config,
+		params:     params,
+		controller: c,
+		queue:      workqueue.NewNamedRateLimitingQueue(c.rateLimiter(), instanceKey(namespace, name)),
+		stopCh:     make(chan struct{}),
+	}
+	if name != "" {
+		i.history = history.NewRecorder(c.client, fmt.Sprintf("%s-recovery-history", name), config.historyLimit)
+	}
+	i.gate = gate.New(c.client, c.dynamicClient, config.windows, config.rateLimit, i.history)
+	return i
+}
+
+// rateLimiter delays the retries of a pod exponentially, and limits the overall rate of retries.
+func (c *Controller) rateLimiter() workqueue.RateLimiter {
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(c.options.loop.retryBaseDelay, c.options.loop.retryMaxDelay),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
+func (i *instance) String() string {
+	if i.name == "" {
+		return fmt.Sprintf("pods without instance in namespace '%s'", i.namespace)
+	}
+	return fmt.Sprintf("instance %s", instanceKey(i.namespace, i.name))
+}
+
+// start loads the policies of the instance and starts its worker.
+func (i *instance) start() error {
+	logConfig(i.String(), i.config)
+	i.loadPolicies(nil)
+	if i.currentPolicies() == nil {
+		return fmt.Errorf("failed to load the default recovery policies of %s", i)
+	}
+	i.watchPolicies()
+	go wait.Until(i.runWorker, time.Second, i.stopCh)
+	log.Infof("Started recovery of %s", i)
+	return nil
+}
+
+// stop shuts down the worker of the instance. Work that is in progress is finished first.
+func (i *instance) stop() {
+	close(i.stopCh)
+	i.queue.ShutDown()
+	log.Infof("Stopped recovery of %s", i)
+}
+
+// enqueueAll adds all known pods of the instance to its queue.
+func (i *instance) enqueueAll() {
+	for _, obj := range i.controller.informer.GetStore().List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Namespace != i.namespace || pod.Labels[InstanceLabel] != i.name {
+			continue
+		}
+		if key, err := cache.MetaNamespaceKeyFunc(pod); err == nil {
+			i.queue.Add(key)
+		}
+	}
+}
+
+// policyDefaults are the parameters of the built-in policies that are derived from the instance configuration.
+func (i *instance) policyDefaults() map[string]policy.Parameters {
+	return map[string]policy.Parameters{
+		policy.EvictionLabelPolicy: {policy.ParamLabel: i.config.evictionLabel},
+	}
+}
+
+// loadPolicies rebuilds the policy set from the given configmap. An invalid configuration keeps the
+// previously loaded policies.
+func (i *instance) loadPolicies(cm *corev1.ConfigMap) {
+	config, err := policy.ConfigFromConfigMap(cm)
+	if err != nil {
+		log.Errorf("Invalid recovery policy configuration of %s, keeping current policies: %v", i, err)
+		return
+	}
+	policies, err := policy.NewSet(config, i.policyDefaults())
+	if err != nil {
+		log.Errorf("Invalid recovery policy configuration of %s, keeping current policies: %v", i, err)
+		return
+	}
+	log.Infof("Enabled recovery policies of %s: %v", i, policies.Names())
+
+	i.policyLock.Lock()
+	i.policies = policies
+	i.policyLock.Unlock()
+
+	// Re-evaluate all pods with the new policies
+	i.enqueueAll()
+}
+
+func (i *instance) currentPolicies() *policy.Set {
+	i.policyLock.RLock()
+	defer i.policyLock.RUnlock()
+	return i.policies
+}
+
+func (i *instance) watchPolicies() {
+	if i.config.policyConfigMap == "" {
+		return
+	}
+	client := i.controller.client
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", i.config.policyConfigMap).String()
+	i.policyInformer = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = fieldSelector
+				return client.CoreV1().ConfigMaps(i.namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = fieldSelector
+				return client.CoreV1().ConfigMaps(i.namespace).Watch(options)
+			},
+		},
+		&corev1.ConfigMap{},
+		0, //No resync
+		cache.Indexers{},
+	)
+	i.policyInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				i.loadPolicies(cm)
+			}
+		},
+		UpdateFunc: func(old, new interface{}) {
+			if cm, ok := new.(*corev1.ConfigMap); ok {
+				i.loadPolicies(cm)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Infof("Policy configmap %s of %s was deleted, using the default recovery policies", i.config.policyConfigMap, i)
+			i.loadPolicies(nil)
+		},
+	})
+
+	go i.policyInformer.Run(i.stopCh)
+}
+
+func (i *instance) runWorker() {
+	for i.processNext() {
+	}
+}
+
+func (i *instance) processNext() bool {
+	key, quit := i.queue.Get()
+
+	if quit {
+		return false
+	}
+	defer i.queue.Done(key)
+
+	err := i.processItem(key.(string))
+	if requeue, ok := err.(*sts.RequeueError); ok {
+		log.Infof("Processing %s is in progress: %s", key, requeue.Reason)
+		i.queue.Forget(key)
+		i.queue.AddAfter(key, requeue.After)
+	} else if err == nil {
+		i.queue.Forget(key)
+	} else if i.queue.NumRequeues(key) < i.controller.options.loop.maxRetries {
+		log.Errorf("Error processing %s (will retry): %v", key, err)
+		metrics.ProcessingErrors.WithLabelValues(i.namespace, i.name).Inc()
+		i.queue.AddRateLimited(key)
+	} else {
+		log.Errorf("Error processing %s (giving up until the next reconciliation): %v", key, err)
+		metrics.ProcessingErrors.WithLabelValues(i.namespace, i.name).Inc()
+		metrics.ProcessingGaveUp.WithLabelValues(i.namespace, i.name).Inc()
+		i.queue.Forget(key)
+		uruntime.HandleError(err)
+	}
+
+	return true
+}
+
+func (i *instance) processItem(key string) error {
+	obj, _, err := i.controller.informer.GetIndexer().GetByKey(key)
+	if err != nil {
+		return fmt.Errorf("error fetching object with key %s from store: %v", key, err)
+	}
+	if obj == nil {
+		return nil
+	}
+	ro, ok := obj.(runtime.Object)
+	if !ok {
+		return fmt.Errorf("object with key %s is not a runtime.Object", key)
+	}
+
+	c := i.controller
+	return sts.Process(c.client, i.currentPolicies(), sts.Options{
+		EvictionMode:  i.config.evictionMode,
+		EvictionLabel: i.config.evictionLabel,
+		Decommission:  i.config.decommission,
+		Snapshotter:   c.snapshotter,
+		Executor:      c.executor,
+		History:       i.history,
+		Gate:          i.gate,
+		Notifier:      c.options.notifier,
+		FinalAttempt:  i.queue.NumRequeues(key) >= c.options.loop.maxRetries,
+	}, ro)
+}
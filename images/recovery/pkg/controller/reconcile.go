@@ -0,0 +1,187 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/metrics"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/sts"
+)
+
+// pvcSelector selects the PVCs of the Cassandra nodes. The StatefulSet labels them with its selector, which
+// contains the 'cassandra' label with the operator name and the 'app' label with the instance name.
+const pvcSelector = "cassandra"
+
+// instanceStatus is the result of the reconciliation of the pods and PVCs of one instance.
+type instanceStatus struct {
+	pods, notReady, unschedulable, recoveryNeeded, deferred, evicting int
+	pvcs                                                              map[corev1.PersistentVolumeClaimPhase]int
+	unusedPVCs                                                        int
+}
+
+// reconcile lists all Cassandra pods and their PVCs from the API server, queues all pods to be processed again,
+// and updates the metrics. It catches pods whose events were missed or that were dropped after failing too often.
+func (c *Controller) reconcile() {
+	start := time.Now()
+	statuses, err := c.reconcileAll()
+	metrics.ReconcileDuration.Set(time.Since(start).Seconds())
+	if err != nil {
+		log.Errorf("Reconciliation failed: %v", err)
+		metrics.ReconcileRuns.WithLabelValues("error").Inc()
+		return
+	}
+	metrics.ReconcileRuns.WithLabelValues("success").Inc()
+	metrics.ReconcileLastSuccess.SetToCurrentTime()
+
+	for _, g := range metrics.InstanceGauges {
+		g.Reset()
+	}
+	for key, status := range statuses {
+		metrics.Pods.WithLabelValues(key.namespace, key.name).Set(float64(status.pods))
+		metrics.PodsNotReady.WithLabelValues(key.namespace, key.name).Set(float64(status.notReady))
+		metrics.PodsUnschedulable.WithLabelValues(key.namespace, key.name).Set(float64(status.unschedulable))
+		metrics.PodsRecoveryNeeded.WithLabelValues(key.namespace, key.name).Set(float64(status.recoveryNeeded))
+		metrics.PodsDeferred.WithLabelValues(key.namespace, key.name).Set(float64(status.deferred))
+		metrics.PodsEvicting.WithLabelValues(key.namespace, key.name).Set(float64(status.evicting))
+		for phase, count := range status.pvcs {
+			metrics.PVCs.WithLabelValues(key.namespace, key.name, string(phase)).Set(float64(count))
+		}
+		metrics.PVCsUnused.WithLabelValues(key.namespace, key.name).Set(float64(status.unusedPVCs))
+	}
+	c.collectGarbage()
+	log.Infof("Reconciled %d instances in %v", len(statuses), time.Since(start).Round(time.Millisecond))
+}
+
+// collectGarbage reports or deletes the orphaned volumes of all instances.
+func (c *Controller) collectGarbage() {
+	c.lock.Lock()
+	instances := make([]*instance, 0, len(c.instances))
+	for _, i := range c.instances {
+		instances = append(instances, i)
+	}
+	c.lock.Unlock()
+
+	for _, i := range instances {
+		result, err := c.collector.Collect(i.namespace, i.name, i.config.gc)
+		if err != nil {
+			log.Errorf("Garbage collection of %s failed: %v", i, err)
+			continue
+		}
+		for _, candidate := range result.Candidates {
+			metrics.GCCandidates.WithLabelValues(i.namespace, i.name, candidate.Kind).Inc()
+		}
+		for _, deleted := range result.Deleted {
+			metrics.GCCandidates.WithLabelValues(i.namespace, i.name, deleted.Kind).Dec()
+			metrics.GCDeleted.WithLabelValues(i.namespace, i.name, deleted.Kind).Inc()
+		}
+	}
+}
+
+type statusKey struct {
+	namespace, name string
+}
+
+func (c *Controller) reconcileAll() (map[statusKey]*instanceStatus, error) {
+	pods, err := c.client.CoreV1().Pods(c.options.namespace).List(metav1.ListOptions{LabelSelector: c.options.podSelector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	pvcs, err := c.client.CoreV1().PersistentVolumeClaims(c.options.namespace).List(metav1.ListOptions{LabelSelector: pvcSelector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PVCs: %v", err)
+	}
+
+	statuses := map[statusKey]*instanceStatus{}
+	statusOf := func(namespace, name string) *instanceStatus {
+		key := statusKey{namespace, name}
+		if _, ok := statuses[key]; !ok {
+			statuses[key] = &instanceStatus{pvcs: map[corev1.PersistentVolumeClaimPhase]int{}}
+		}
+		return statuses[key]
+	}
+
+	// claims maps namespace/claim to the instance of the pod that uses it
+	claims := map[string]string{}
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		name := pod.Labels[InstanceLabel]
+		i := c.instanceFor(pod.Namespace, name)
+		if i == nil {
+			continue
+		}
+		status := statusOf(pod.Namespace, name)
+		c.reconcilePod(i, pod, status)
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil {
+				claims[pod.Namespace+"/"+vol.PersistentVolumeClaim.ClaimName] = name
+			}
+		}
+	}
+
+	for _, pvc := range pvcs.Items {
+		name, used := claims[pvc.Namespace+"/"+pvc.Name]
+		if !used {
+			name = pvc.Labels["app"]
+			if _, ok := statuses[statusKey{pvc.Namespace, name}]; !ok {
+				// Not a PVC of a recovered instance
+				continue
+			}
+		}
+		status := statusOf(pvc.Namespace, name)
+		status.pvcs[pvc.Status.Phase]++
+		if !used {
+			status.unusedPVCs++
+		}
+	}
+	return statuses, nil
+}
+
+// reconcilePod queues the pod in its instance and adds it to the status.
+func (c *Controller) reconcilePod(i *instance, pod *corev1.Pod, status *instanceStatus) {
+	if key, err := cache.MetaNamespaceKeyFunc(pod); err == nil {
+		i.queue.Add(key)
+	}
+
+	status.pods++
+	if !isReady(pod) {
+		status.notReady++
+	}
+	if isUnschedulable(pod) {
+		status.unschedulable++
+	}
+	if _, ok := pod.Annotations[sts.DeferredAnnotation]; ok {
+		status.deferred++
+	}
+	if _, ok := pod.Annotations[sts.EvictionAnnotation]; ok {
+		status.evicting++
+	}
+	if policies := i.currentPolicies(); policies != nil {
+		decision, err := policies.Evaluate(c.client, pod)
+		if err == nil && decision.Recover {
+			status.recoveryNeeded++
+		}
+	}
+}
+
+func isReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func isUnschedulable(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled {
+			return condition.Status == corev1.ConditionFalse && condition.Reason == corev1.PodReasonUnschedulable
+		}
+	}
+	return false
+}
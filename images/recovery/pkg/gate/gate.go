@@ -0,0 +1,285 @@
+package gate
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+)
+
+const (
+	// PauseAnnotation pauses all new recoveries when it is set to "true" on the namespace or the KUDO instance.
+	PauseAnnotation = "kudo-cassandra/recovery-paused"
+	// InstanceLabel contains the name of the KUDO instance of a pod.
+	InstanceLabel = "kudo.dev/instance"
+
+	// defaultRetryAfter is used when it is not known when a deferred recovery can start.
+	defaultRetryAfter = time.Minute
+)
+
+// InstanceResource is the KUDO Instance API.
+var InstanceResource = schema.GroupVersionResource{Group: "kudo.dev", Version: "v1beta1", Resource: "instances"}
+
+// Window is a time window in which recoveries are allowed. It starts at every activation of the schedule and
+// lasts for the duration.
+type Window struct {
+	spec     string
+	schedule cron.Schedule
+	duration time.Duration
+}
+
+// ParseWindows parses a list of windows separated by ';'. Each window is a five field cron expression, optionally
+// prefixed with CRON_TZ=<zone>, followed by a duration, e.g. "0 2 * * 6 4h".
+func ParseWindows(spec string) ([]Window, error) {
+	windows := []Window{}
+	for _, w := range strings.Split(spec, ";") {
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+		idx := strings.LastIndex(w, " ")
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid maintenance window '%s': expected '<cron expression> <duration>'", w)
+		}
+		duration, err := time.ParseDuration(w[idx+1:])
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid duration of maintenance window '%s': %v", w, err)
+		}
+		schedule, err := cron.ParseStandard(strings.TrimSpace(w[:idx]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule of maintenance window '%s': %v", w, err)
+		}
+		windows = append(windows, Window{spec: w, schedule: schedule, duration: duration})
+	}
+	return windows, nil
+}
+
+// Contains returns true if the time is inside the window.
+func (w Window) Contains(t time.Time) bool {
+	// The window contains t if it started in (t - duration, t]
+	return !w.schedule.Next(t.Add(-w.duration)).After(t)
+}
+
+// Next returns the next start of the window after t.
+func (w Window) Next(t time.Time) time.Time {
+	return w.schedule.Next(t)
+}
+
+func (w Window) String() string {
+	return w.spec
+}
+
+// RateLimit allows at most Count recoveries per instance in Period.
+type RateLimit struct {
+	Count  int
+	Period time.Duration
+}
+
+// ParseRateLimit parses a rate limit in the format "<count>/<period>", e.g. "1/30m". An empty value disables the
+// rate limit.
+func ParseRateLimit(spec string) (RateLimit, error) {
+	if spec == "" {
+		return RateLimit{}, nil
+	}
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit '%s': expected '<count>/<period>'", spec)
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid count of rate limit '%s'", spec)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid period of rate limit '%s'", spec)
+	}
+	return RateLimit{Count: count, Period: period}, nil
+}
+
+func (r RateLimit) enabled() bool {
+	return r.Count > 0
+}
+
+func (r RateLimit) String() string {
+	return fmt.Sprintf("%d/%v", r.Count, r.Period)
+}
+
+// Result is the outcome of a gate check.
+type Result struct {
+	Allowed bool
+	// Reason explains why a recovery is deferred.
+	Reason string
+	// RetryAfter is the time after which the recovery should be checked again.
+	RetryAfter time.Duration
+}
+
+// Gate decides whether a new recovery may start now. A nil gate allows all recoveries.
+type Gate struct {
+	client    kubernetes.Interface
+	dynamic   dynamic.Interface
+	windows   []Window
+	rateLimit RateLimit
+	history   *history.Recorder
+	now       func() time.Time
+
+	lock       sync.Mutex
+	recoveries map[string][]time.Time
+}
+
+// New creates a gate. The recovery history is used to restore the rate limit after a restart of the controller.
+func New(client kubernetes.Interface, dynamicClient dynamic.Interface, windows []Window, rateLimit RateLimit, recorder *history.Recorder) *Gate {
+	return &Gate{
+		client:     client,
+		dynamic:    dynamicClient,
+		windows:    windows,
+		rateLimit:  rateLimit,
+		history:    recorder,
+		now:        time.Now,
+		recoveries: map[string][]time.Time{},
+	}
+}
+
+func instanceKey(pod *corev1.Pod) string {
+	return fmt.Sprintf("%s/%s", pod.Namespace, pod.Labels[InstanceLabel])
+}
+
+// Check returns whether a new recovery of the pod may start now.
+func (g *Gate) Check(pod *corev1.Pod) (Result, error) {
+	if g == nil {
+		return Result{Allowed: true}, nil
+	}
+	paused, err := g.paused(pod)
+	if err != nil {
+		return Result{}, err
+	}
+	if paused != "" {
+		return Result{Reason: fmt.Sprintf("recoveries are paused by the %s annotation on %s", PauseAnnotation, paused), RetryAfter: defaultRetryAfter}, nil
+	}
+
+	now := g.now()
+	if result := g.checkWindows(now); !result.Allowed {
+		return result, nil
+	}
+
+	if !g.rateLimit.enabled() {
+		return Result{Allowed: true}, nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if err := g.seed(pod); err != nil {
+		return Result{}, err
+	}
+	recent := g.recent(instanceKey(pod), now)
+	if len(recent) >= g.rateLimit.Count {
+		next := recent[0].Add(g.rateLimit.Period)
+		return Result{
+			Reason:     fmt.Sprintf("rate limit of %v recoveries reached, the next recovery is allowed at %s", g.rateLimit, next.UTC().Format(time.RFC3339)),
+			RetryAfter: next.Sub(now),
+		}, nil
+	}
+	return Result{Allowed: true}, nil
+}
+
+// Started records the start of a recovery for the rate limit.
+func (g *Gate) Started(pod *corev1.Pod) {
+	if g == nil || !g.rateLimit.enabled() {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	key := instanceKey(pod)
+	g.recoveries[key] = append(g.recent(key, g.now()), g.now())
+}
+
+// recent returns the recoveries of the instance in the current rate limit period, oldest first.
+func (g *Gate) recent(key string, now time.Time) []time.Time {
+	recent := []time.Time{}
+	for _, t := range g.recoveries[key] {
+		if now.Sub(t) < g.rateLimit.Period {
+			recent = append(recent, t)
+		}
+	}
+	g.recoveries[key] = recent
+	return recent
+}
+
+// seed loads the recoveries of the instance from the recovery history, once per instance.
+func (g *Gate) seed(pod *corev1.Pod) error {
+	key := instanceKey(pod)
+	if _, ok := g.recoveries[key]; ok {
+		return nil
+	}
+	entries, err := g.history.Load(pod.Namespace)
+	if err != nil {
+		return err
+	}
+	times := []time.Time{}
+	for _, entry := range entries {
+		// Like at runtime, only recoveries that started count toward the rate limit
+		if entry.Outcome == history.OutcomeFailed {
+			continue
+		}
+		times = append(times, entry.Time)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	g.recoveries[key] = times
+	return nil
+}
+
+func (g *Gate) checkWindows(now time.Time) Result {
+	if len(g.windows) == 0 {
+		return Result{Allowed: true}
+	}
+	var next time.Time
+	for _, w := range g.windows {
+		if w.Contains(now) {
+			return Result{Allowed: true}
+		}
+		if n := w.Next(now); next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+	return Result{
+		Reason:     fmt.Sprintf("outside of the maintenance windows, the next window starts at %s", next.UTC().Format(time.RFC3339)),
+		RetryAfter: next.Sub(now),
+	}
+}
+
+// paused returns a description of the object whose annotation pauses recoveries of the pod, or an empty string.
+func (g *Gate) paused(pod *corev1.Pod) (string, error) {
+	ns, err := g.client.CoreV1().Namespaces().Get(pod.Namespace, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return "", fmt.Errorf("failed to get namespace %s: %v", pod.Namespace, err)
+	}
+	if err == nil && ns.Annotations[PauseAnnotation] == "true" {
+		return fmt.Sprintf("namespace %s", pod.Namespace), nil
+	}
+
+	instance := pod.Labels[InstanceLabel]
+	if instance == "" || g.dynamic == nil {
+		return "", nil
+	}
+	obj, err := g.dynamic.Resource(InstanceResource).Namespace(pod.Namespace).Get(instance, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get KUDO instance %s/%s: %v", pod.Namespace, instance, err)
+	}
+	if obj.GetAnnotations()[PauseAnnotation] == "true" {
+		return fmt.Sprintf("instance %s", instance), nil
+	}
+	return "", nil
+}
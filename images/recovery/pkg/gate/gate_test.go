@@ -0,0 +1,145 @@
+package gate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+)
+
+func TestParseWindows(t *testing.T) {
+	windows, err := ParseWindows("0 2 * * 6 4h; CRON_TZ=Europe/Berlin 30 22 * * * 90m;")
+	assert.NoError(t, err)
+	assert.Len(t, windows, 2)
+
+	for _, spec := range []string{"0 2 * * 6", "0 2 * * 6 forever", "0 2 * * 4h", "0 2 * * 6 -1h"} {
+		_, err := ParseWindows(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestWindow_Contains(t *testing.T) {
+	windows, err := ParseWindows("0 2 * * * 4h")
+	assert.NoError(t, err)
+	w := windows[0]
+
+	day := time.Date(2020, 5, 4, 0, 0, 0, 0, time.Local)
+	assert.False(t, w.Contains(day.Add(time.Hour)))
+	assert.True(t, w.Contains(day.Add(2*time.Hour)))
+	assert.True(t, w.Contains(day.Add(5*time.Hour+59*time.Minute)))
+	assert.False(t, w.Contains(day.Add(6*time.Hour)))
+	assert.Equal(t, day.Add(26*time.Hour), w.Next(day.Add(6*time.Hour)))
+}
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := ParseRateLimit("1/30m")
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimit{Count: 1, Period: 30 * time.Minute}, limit)
+
+	limit, err = ParseRateLimit("")
+	assert.NoError(t, err)
+	assert.False(t, limit.enabled())
+
+	for _, spec := range []string{"1", "0/30m", "x/30m", "1/x", "1/-1m"} {
+		_, err := ParseRateLimit(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestGate_windows(t *testing.T) {
+	windows, err := ParseWindows("0 2 * * * 4h")
+	assert.NoError(t, err)
+	g := New(nil, nil, windows, RateLimit{}, nil)
+
+	day := time.Date(2020, 5, 4, 0, 0, 0, 0, time.Local)
+	result := g.checkWindows(day.Add(time.Hour))
+	assert.False(t, result.Allowed)
+	assert.Equal(t, time.Hour, result.RetryAfter)
+	assert.True(t, g.checkWindows(day.Add(3*time.Hour)).Allowed)
+}
+
+func TestGate_rateLimit(t *testing.T) {
+	g := New(nil, nil, nil, RateLimit{Count: 1, Period: 30 * time.Minute}, nil)
+	now := time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Labels: map[string]string{InstanceLabel: "cassandra"}}}
+	other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Labels: map[string]string{InstanceLabel: "other"}}}
+	for _, p := range []*corev1.Pod{pod, other} {
+		assert.NoError(t, g.seed(p))
+	}
+
+	assert.Empty(t, g.recent(instanceKey(pod), now))
+	g.Started(pod)
+	assert.Len(t, g.recent(instanceKey(pod), now), 1)
+	assert.Empty(t, g.recent(instanceKey(other), now))
+
+	now = now.Add(30 * time.Minute)
+	assert.Empty(t, g.recent(instanceKey(pod), now))
+}
+
+func TestGate_seed(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	recorder := history.NewRecorder(client, "cassandra-recovery-history", 0)
+	now := time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cassandra-node-0", Namespace: "ns", Labels: map[string]string{InstanceLabel: "cassandra"}}}
+	assert.NoError(t, recorder.Record(pod, history.Entry{Time: now.Add(-time.Minute), Pod: pod.Name, Outcome: history.OutcomeFailed}))
+
+	// A failed recovery does not count toward the rate limit after a restart
+	g := New(client, nil, nil, RateLimit{Count: 1, Period: 30 * time.Minute}, recorder)
+	g.now = func() time.Time { return now }
+	assert.NoError(t, g.seed(pod))
+	assert.Empty(t, g.recent(instanceKey(pod), now))
+
+	assert.NoError(t, recorder.Record(pod, history.Entry{Time: now.Add(-time.Minute), Pod: pod.Name, Outcome: history.OutcomeSucceeded}))
+	g = New(client, nil, nil, RateLimit{Count: 1, Period: 30 * time.Minute}, recorder)
+	assert.NoError(t, g.seed(pod))
+	assert.Len(t, g.recent(instanceKey(pod), now), 1)
+}
+
+func TestGate_nil(t *testing.T) {
+	var g *Gate
+	result, err := g.Check(&corev1.Pod{})
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	g.Started(&corev1.Pod{})
+}
+
+func TestGate_paused(t *testing.T) {
+	instance := &unstructured.Unstructured{}
+	instance.SetAPIVersion("kudo.dev/v1beta1")
+	instance.SetKind("Instance")
+	instance.SetNamespace("ns")
+	instance.SetName("cassandra")
+	instance.SetAnnotations(map[string]string{PauseAnnotation: "true"})
+	g := New(fake.NewSimpleClientset(), dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), instance), nil, RateLimit{}, nil)
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Labels: map[string]string{InstanceLabel: "cassandra"}}}
+	result, err := g.Check(pod)
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, "recoveries are paused by the kudo-cassandra/recovery-paused annotation on instance cassandra", result.Reason)
+
+	other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Labels: map[string]string{InstanceLabel: "other"}}}
+	result, err = g.Check(other)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	// A recovery is not allowed if the instance can not be read
+	g.dynamic = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	g.dynamic.(*dynamicfake.FakeDynamicClient).PrependReactor("get", "instances", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("connection refused")
+	})
+	_, err = g.Check(pod)
+	assert.EqualError(t, err, "failed to get KUDO instance ns/cassandra: connection refused")
+}
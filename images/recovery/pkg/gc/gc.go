@@ -0,0 +1,314 @@
+package gc
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ModeOff disables the garbage collection.
+	ModeOff = "off"
+	// ModeReport logs and counts orphaned volumes, but does not delete them.
+	ModeReport = "report"
+	// ModeDelete deletes orphaned volumes once the grace period has passed.
+	ModeDelete = "delete"
+
+	// ProtectedAnnotation excludes a PVC or PV from the garbage collection when it is set to "true".
+	ProtectedAnnotation = "kudo-cassandra/gc-protected"
+	// OrphanedSinceAnnotation is the time a volume was first found to be orphaned. The grace period starts then.
+	OrphanedSinceAnnotation = "kudo-cassandra/orphaned-since"
+	// WipedClaimAnnotation is set on a PV when it is detached from the PVC of a recovered pod, "<namespace>/<name>".
+	WipedClaimAnnotation = "kudo-cassandra/wiped-claim"
+	// WipedAtAnnotation is the time a PV was detached from the PVC of a recovered pod.
+	WipedAtAnnotation = "kudo-cassandra/wiped-at"
+
+	KindPVC = "PersistentVolumeClaim"
+	KindPV  = "PersistentVolume"
+)
+
+// ParseMode validates a garbage collection mode.
+func ParseMode(mode string) (string, error) {
+	switch mode {
+	case ModeOff, ModeReport, ModeDelete:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown garbage collection mode '%s', must be one of '%s', '%s' or '%s'", mode, ModeOff, ModeReport, ModeDelete)
+}
+
+// Config configures the garbage collection of an instance.
+type Config struct {
+	Mode        string
+	GracePeriod time.Duration
+}
+
+// Candidate is an orphaned volume.
+type Candidate struct {
+	Kind      string
+	Namespace string
+	Name      string
+	UID       types.UID
+	Reason    string
+	// Since is the time the volume was found to be orphaned, zero if it is not known yet.
+	Since     time.Time
+	Protected bool
+}
+
+func (c Candidate) String() string {
+	if c.Namespace == "" {
+		return fmt.Sprintf("%s %s", c.Kind, c.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", c.Kind, c.Namespace, c.Name)
+}
+
+// Result is the outcome of a garbage collection.
+type Result struct {
+	Candidates []Candidate
+	Deleted    []Candidate
+}
+
+// Collector finds and deletes orphaned volumes of Cassandra instances.
+type Collector struct {
+	client kubernetes.Interface
+	now    func() time.Time
+}
+
+func NewCollector(client kubernetes.Interface) *Collector {
+	return &Collector{client: client, now: time.Now}
+}
+
+// Collect finds the orphaned volumes of the instance and deletes them if the mode is ModeDelete.
+func (c *Collector) Collect(namespace, instance string, config Config) (Result, error) {
+	result := Result{}
+	if config.Mode == ModeOff || instance == "" {
+		return result, nil
+	}
+	selector := metav1.ListOptions{LabelSelector: fmt.Sprintf("app = %s", instance)}
+	statefulSets, err := c.client.AppsV1().StatefulSets(namespace).List(selector)
+	if err != nil {
+		return result, fmt.Errorf("failed to list statefulsets of instance %s/%s: %v", namespace, instance, err)
+	}
+	if len(statefulSets.Items) == 0 {
+		return result, nil
+	}
+	pods, err := c.client.CoreV1().Pods(namespace).List(selector)
+	if err != nil {
+		return result, fmt.Errorf("failed to list pods of instance %s/%s: %v", namespace, instance, err)
+	}
+	pvcs, err := c.client.CoreV1().PersistentVolumeClaims(namespace).List(selector)
+	if err != nil {
+		return result, fmt.Errorf("failed to list PVCs of instance %s/%s: %v", namespace, instance, err)
+	}
+	pvs, err := c.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return result, fmt.Errorf("failed to list PVs: %v", err)
+	}
+
+	result.Candidates = FindCandidates(statefulSets.Items, pods.Items, pvcs.Items, pvs.Items)
+	c.unmarkReused(result.Candidates, pvcs.Items, pvs.Items)
+	now := c.now()
+	for i := range result.Candidates {
+		candidate := &result.Candidates[i]
+		if candidate.Protected {
+			log.Infof("Orphaned %s of instance %s/%s is protected by %s: %s", candidate, namespace, instance, ProtectedAnnotation, candidate.Reason)
+			continue
+		}
+		if candidate.Since.IsZero() {
+			if err := c.markOrphaned(*candidate, now); err != nil {
+				log.Errorf("%v", err)
+				continue
+			}
+			candidate.Since = now
+		}
+		remaining := config.GracePeriod - now.Sub(candidate.Since)
+		if config.Mode != ModeDelete {
+			log.Infof("Found orphaned %s of instance %s/%s: %s", candidate, namespace, instance, candidate.Reason)
+			continue
+		}
+		if remaining > 0 {
+			log.Infof("Found orphaned %s of instance %s/%s, deleting it in %v: %s", candidate, namespace, instance, remaining.Round(time.Second), candidate.Reason)
+			continue
+		}
+		if err := c.delete(*candidate); err != nil {
+			log.Errorf("%v", err)
+			continue
+		}
+		log.Infof("Deleted orphaned %s of instance %s/%s: %s", candidate, namespace, instance, candidate.Reason)
+		result.Deleted = append(result.Deleted, *candidate)
+	}
+	return result, nil
+}
+
+// markOrphaned records when a volume was found to be orphaned, if it is not known yet.
+func (c *Collector) markOrphaned(candidate Candidate, now time.Time) error {
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, OrphanedSinceAnnotation, now.UTC().Format(time.RFC3339)))
+	var err error
+	if candidate.Kind == KindPVC {
+		_, err = c.client.CoreV1().PersistentVolumeClaims(candidate.Namespace).Patch(candidate.Name, types.MergePatchType, patch)
+	} else {
+		_, err = c.client.CoreV1().PersistentVolumes().Patch(candidate.Name, types.MergePatchType, patch)
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to mark %s as orphaned: %v", candidate, err)
+	}
+	return nil
+}
+
+// unmarkReused removes the orphaned annotation from volumes that are in use again, e.g. after a scale up, so their
+// grace period starts over if they become orphaned again.
+func (c *Collector) unmarkReused(candidates []Candidate, pvcs []corev1.PersistentVolumeClaim, pvs []corev1.PersistentVolume) {
+	orphaned := map[types.UID]bool{}
+	for _, candidate := range candidates {
+		orphaned[candidate.UID] = true
+	}
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, OrphanedSinceAnnotation))
+	for _, pvc := range pvcs {
+		if _, ok := pvc.Annotations[OrphanedSinceAnnotation]; ok && !orphaned[pvc.UID] {
+			if _, err := c.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(pvc.Name, types.MergePatchType, patch); err != nil && !errors.IsNotFound(err) {
+				log.Errorf("Failed to remove orphaned annotation from PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+			}
+		}
+	}
+	// A wiped PV that is bound to a new claim is not orphaned anymore
+	pvPatch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:null,%q:null,%q:null}}}`, OrphanedSinceAnnotation, WipedClaimAnnotation, WipedAtAnnotation))
+	for _, pv := range pvs {
+		if _, ok := pv.Annotations[WipedClaimAnnotation]; ok && pv.Status.Phase == corev1.VolumeBound && pv.Spec.ClaimRef != nil {
+			if _, err := c.client.CoreV1().PersistentVolumes().Patch(pv.Name, types.MergePatchType, pvPatch); err != nil && !errors.IsNotFound(err) {
+				log.Errorf("Failed to remove orphaned annotation from PV %s: %v", pv.Name, err)
+			}
+		}
+	}
+}
+
+func (c *Collector) delete(candidate Candidate) error {
+	options := &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &candidate.UID}}
+	var err error
+	if candidate.Kind == KindPVC {
+		err = c.client.CoreV1().PersistentVolumeClaims(candidate.Namespace).Delete(candidate.Name, options)
+	} else {
+		err = c.client.CoreV1().PersistentVolumes().Delete(candidate.Name, options)
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete orphaned %s: %v", candidate, err)
+	}
+	return nil
+}
+
+// claimOwner matches the names of the PVCs of the StatefulSets, "<template>-<statefulset>-<ordinal>".
+type claimOwner struct {
+	pattern  *regexp.Regexp
+	replicas int
+}
+
+func claimOwners(statefulSets []appsv1.StatefulSet) []claimOwner {
+	owners := []claimOwner{}
+	for _, sts := range statefulSets {
+		replicas := 1
+		if sts.Spec.Replicas != nil {
+			replicas = int(*sts.Spec.Replicas)
+		}
+		for _, template := range sts.Spec.VolumeClaimTemplates {
+			pattern := regexp.MustCompile(fmt.Sprintf("^%s-%s-([0-9]+)$", regexp.QuoteMeta(template.Name), regexp.QuoteMeta(sts.Name)))
+			owners = append(owners, claimOwner{pattern: pattern, replicas: replicas})
+		}
+	}
+	return owners
+}
+
+// claimOrdinal returns the ordinal of the pod of a claim, and the replicas of its StatefulSet.
+func claimOrdinal(owners []claimOwner, claim string) (int, int, bool) {
+	for _, owner := range owners {
+		if m := owner.pattern.FindStringSubmatch(claim); m != nil {
+			ordinal, err := strconv.Atoi(m[1])
+			if err != nil {
+				return 0, 0, false
+			}
+			return ordinal, owner.replicas, true
+		}
+	}
+	return 0, 0, false
+}
+
+func annotationTime(annotations map[string]string, key string) time.Time {
+	t, err := time.Parse(time.RFC3339, annotations[key])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// FindCandidates returns the PVCs of removed ordinals of the StatefulSets that are not used by any pod, and the
+// PVs that were detached from wiped claims of the StatefulSets and are not bound again.
+func FindCandidates(statefulSets []appsv1.StatefulSet, pods []corev1.Pod, pvcs []corev1.PersistentVolumeClaim, pvs []corev1.PersistentVolume) []Candidate {
+	owners := claimOwners(statefulSets)
+	if len(owners) == 0 {
+		return nil
+	}
+	candidates := []Candidate{}
+
+	used := map[string]bool{}
+	for _, pod := range pods {
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil {
+				used[vol.PersistentVolumeClaim.ClaimName] = true
+			}
+		}
+	}
+	for _, pvc := range pvcs {
+		ordinal, replicas, ok := claimOrdinal(owners, pvc.Name)
+		if !ok || ordinal < replicas || used[pvc.Name] || pvc.DeletionTimestamp != nil {
+			continue
+		}
+		candidates = append(candidates, Candidate{
+			Kind:      KindPVC,
+			Namespace: pvc.Namespace,
+			Name:      pvc.Name,
+			UID:       pvc.UID,
+			Reason:    fmt.Sprintf("ordinal %d is not below the replica count %d", ordinal, replicas),
+			Since:     annotationTime(pvc.Annotations, OrphanedSinceAnnotation),
+			Protected: pvc.Annotations[ProtectedAnnotation] == "true",
+		})
+	}
+
+	namespace := statefulSets[0].Namespace
+	for _, pv := range pvs {
+		claim := pv.Annotations[WipedClaimAnnotation]
+		parts := strings.SplitN(claim, "/", 2)
+		if len(parts) != 2 || parts[0] != namespace || pv.DeletionTimestamp != nil {
+			continue
+		}
+		if _, _, ok := claimOrdinal(owners, parts[1]); !ok {
+			continue
+		}
+		if pv.Status.Phase != corev1.VolumeAvailable && pv.Status.Phase != corev1.VolumeReleased {
+			continue
+		}
+		if pv.Spec.ClaimRef != nil && pv.Status.Phase != corev1.VolumeReleased {
+			// Reserved for a new claim
+			continue
+		}
+		since := annotationTime(pv.Annotations, WipedAtAnnotation)
+		if since.IsZero() {
+			since = annotationTime(pv.Annotations, OrphanedSinceAnnotation)
+		}
+		candidates = append(candidates, Candidate{
+			Kind:      KindPV,
+			Name:      pv.Name,
+			UID:       pv.UID,
+			Reason:    fmt.Sprintf("detached from the wiped claim %s", claim),
+			Since:     since,
+			Protected: pv.Annotations[ProtectedAnnotation] == "true",
+		})
+	}
+	return candidates
+}
@@ -0,0 +1,140 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func statefulSet(name string, replicas int32) appsv1.StatefulSet {
+	return appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+				{ObjectMeta: metav1.ObjectMeta{Name: "var-lib-cassandra"}},
+			},
+		},
+	}
+}
+
+func pod(name, claim string) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+			Name:         "var-lib-cassandra",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim}},
+		}}},
+	}
+}
+
+func pvc(name string, annotations map[string]string) corev1.PersistentVolumeClaim {
+	return corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name), Annotations: annotations},
+	}
+}
+
+func pv(name string, phase corev1.PersistentVolumePhase, annotations map[string]string) corev1.PersistentVolume {
+	return corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID("uid-" + name), Annotations: annotations},
+		Status:     corev1.PersistentVolumeStatus{Phase: phase},
+	}
+}
+
+func TestFindCandidates_scaleDown(t *testing.T) {
+	statefulSets := []appsv1.StatefulSet{statefulSet("cassandra-node", 2)}
+	pods := []corev1.Pod{
+		pod("cassandra-node-0", "var-lib-cassandra-cassandra-node-0"),
+		pod("cassandra-node-1", "var-lib-cassandra-cassandra-node-1"),
+		// Still terminating after the scale down
+		pod("cassandra-node-2", "var-lib-cassandra-cassandra-node-2"),
+	}
+	since := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	pvcs := []corev1.PersistentVolumeClaim{
+		pvc("var-lib-cassandra-cassandra-node-0", nil),
+		pvc("var-lib-cassandra-cassandra-node-1", nil),
+		pvc("var-lib-cassandra-cassandra-node-2", nil),
+		pvc("var-lib-cassandra-cassandra-node-3", map[string]string{OrphanedSinceAnnotation: since.Format(time.RFC3339)}),
+		pvc("var-lib-cassandra-cassandra-node-4", map[string]string{ProtectedAnnotation: "true"}),
+		pvc("var-lib-cassandra-other-node-5", nil),
+	}
+
+	candidates := FindCandidates(statefulSets, pods, pvcs, nil)
+	assert.Len(t, candidates, 2)
+	assert.Equal(t, "var-lib-cassandra-cassandra-node-3", candidates[0].Name)
+	assert.Equal(t, KindPVC, candidates[0].Kind)
+	assert.Equal(t, since, candidates[0].Since.UTC())
+	assert.False(t, candidates[0].Protected)
+	assert.Equal(t, "var-lib-cassandra-cassandra-node-4", candidates[1].Name)
+	assert.True(t, candidates[1].Protected)
+	assert.True(t, candidates[1].Since.IsZero())
+}
+
+func TestFindCandidates_wipedVolumes(t *testing.T) {
+	statefulSets := []appsv1.StatefulSet{statefulSet("cassandra-node", 3)}
+	wipedAt := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	wiped := func(claim string) map[string]string {
+		return map[string]string{WipedClaimAnnotation: claim, WipedAtAnnotation: wipedAt.Format(time.RFC3339)}
+	}
+	pvs := []corev1.PersistentVolume{
+		pv("local-pv-1", corev1.VolumeAvailable, wiped("default/var-lib-cassandra-cassandra-node-1")),
+		pv("local-pv-2", corev1.VolumeBound, wiped("default/var-lib-cassandra-cassandra-node-2")),
+		pv("local-pv-3", corev1.VolumeAvailable, wiped("other/var-lib-cassandra-cassandra-node-1")),
+		pv("local-pv-4", corev1.VolumeAvailable, wiped("default/var-lib-cassandra-other-node-1")),
+		pv("local-pv-5", corev1.VolumeAvailable, nil),
+	}
+
+	candidates := FindCandidates(statefulSets, nil, nil, pvs)
+	assert.Len(t, candidates, 1)
+	assert.Equal(t, KindPV, candidates[0].Kind)
+	assert.Equal(t, "local-pv-1", candidates[0].Name)
+	assert.Equal(t, wipedAt, candidates[0].Since.UTC())
+}
+
+func TestFindCandidates_noStatefulSets(t *testing.T) {
+	pvcs := []corev1.PersistentVolumeClaim{pvc("var-lib-cassandra-cassandra-node-3", nil)}
+	assert.Empty(t, FindCandidates(nil, nil, pvcs, nil))
+}
+
+func TestParseMode(t *testing.T) {
+	for _, mode := range []string{ModeOff, ModeReport, ModeDelete} {
+		parsed, err := ParseMode(mode)
+		assert.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+	_, err := ParseMode("purge")
+	assert.Error(t, err)
+}
+
+func TestCollect_gracePeriod(t *testing.T) {
+	sts := statefulSet("cassandra-node", 1)
+	sts.Labels = map[string]string{"app": "cassandra"}
+	orphan := pvc("var-lib-cassandra-cassandra-node-1", nil)
+	orphan.Labels = map[string]string{"app": "cassandra"}
+	client := fake.NewSimpleClientset(&sts, &orphan)
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	collector := &Collector{client: client, now: func() time.Time { return now }}
+	config := Config{Mode: ModeDelete, GracePeriod: time.Hour}
+
+	result, err := collector.Collect("default", "cassandra", config)
+	assert.NoError(t, err)
+	assert.Len(t, result.Candidates, 1)
+	assert.Empty(t, result.Deleted)
+	claim, err := client.CoreV1().PersistentVolumeClaims("default").Get(orphan.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, now.Format(time.RFC3339), claim.Annotations[OrphanedSinceAnnotation])
+
+	now = now.Add(2 * time.Hour)
+	result, err = collector.Collect("default", "cassandra", config)
+	assert.NoError(t, err)
+	assert.Len(t, result.Deleted, 1)
+	_, err = client.CoreV1().PersistentVolumeClaims("default").Get(orphan.Name, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
@@ -0,0 +1,173 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// HistoryKey contains all recorded recoveries, one JSON entry per line, oldest first.
+	HistoryKey = "history"
+	// LastKeyPrefix is the prefix of the keys that contain the last recovery of each pod.
+	LastKeyPrefix = "last."
+
+	OutcomeSucceeded = "Succeeded"
+	OutcomeFailed    = "Failed"
+
+	// DefaultLimit is the default number of entries kept in the history.
+	DefaultLimit = 100
+)
+
+// Entry describes a single recovery action.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Pod      string    `json:"pod"`
+	Node     string    `json:"node,omitempty"`
+	Trigger  string    `json:"trigger"`
+	Reason   string    `json:"reason,omitempty"`
+	Mode     string    `json:"mode,omitempty"`
+	PVCs     []string  `json:"pvcs,omitempty"`
+	PVs      []string  `json:"pvs,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+	Duration string    `json:"duration"`
+}
+
+// Recorder appends recovery entries to a history configmap.
+type Recorder struct {
+	client kubernetes.Interface
+	name   string
+	limit  int
+}
+
+// NewRecorder returns a recorder for the configmap with the given name. The configmap is created in the namespace
+// of the recovered pod on the first recorded entry. Only the latest limit entries are kept.
+func NewRecorder(client kubernetes.Interface, name string, limit int) *Recorder {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	return &Recorder{client: client, name: name, limit: limit}
+}
+
+// Record appends the entry for the recovered pod to the history. A nil recorder does nothing.
+func (r *Recorder) Record(pod *corev1.Pod, entry Entry) error {
+	if r == nil {
+		return nil
+	}
+	namespace := pod.Namespace
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize recovery history entry: %v", err)
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := r.client.CoreV1().ConfigMaps(namespace).Get(r.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			cm = r.newConfigMap(pod)
+			apply(cm, string(line), entry.Pod, r.limit)
+			_, err = r.client.CoreV1().ConfigMaps(namespace).Create(cm)
+			if errors.IsAlreadyExists(err) {
+				// Retry as update
+				return errors.NewConflict(corev1.Resource("configmaps"), r.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		apply(cm, string(line), entry.Pod, r.limit)
+		_, err = r.client.CoreV1().ConfigMaps(namespace).Update(cm)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record recovery of pod %s in configmap %s/%s: %v", entry.Pod, namespace, r.name, err)
+	}
+	log.Printf("Recorded recovery of pod %s: %s", entry.Pod, entry.Outcome)
+	return nil
+}
+
+// Load returns the recorded entries of the namespace. A nil recorder returns no entries.
+func (r *Recorder) Load(namespace string) ([]Entry, error) {
+	if r == nil {
+		return nil, nil
+	}
+	cm, err := r.client.CoreV1().ConfigMaps(namespace).Get(r.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recovery history %s/%s: %v", namespace, r.name, err)
+	}
+	return Entries(cm)
+}
+
+// newConfigMap creates the history configmap. It is owned by the StatefulSet of the pod, so it is removed together
+// with the Cassandra instance.
+func (r *Recorder) newConfigMap(pod *corev1.Pod) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.name,
+			Namespace: pod.Namespace,
+		},
+		Data: map[string]string{},
+	}
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "StatefulSet" {
+			cm.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: ref.APIVersion,
+				Kind:       ref.Kind,
+				Name:       ref.Name,
+				UID:        ref.UID,
+			}}
+		}
+	}
+	return cm
+}
+
+// apply appends the line to the history, prunes the oldest entries beyond the limit and updates the last recovery
+// of the pod.
+func apply(cm *corev1.ConfigMap, line, pod string, limit int) {
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	lines := Lines(cm.Data[HistoryKey])
+	lines = append(lines, line)
+	if len(lines) > limit {
+		lines = lines[len(lines)-limit:]
+	}
+	cm.Data[HistoryKey] = strings.Join(lines, "\n") + "\n"
+	cm.Data[LastKeyPrefix+pod] = line
+}
+
+// Lines splits the history into its entries.
+func Lines(data string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Entries parses the history of a configmap.
+func Entries(cm *corev1.ConfigMap) ([]Entry, error) {
+	entries := []Entry{}
+	for _, line := range Lines(cm.Data[HistoryKey]) {
+		entry := Entry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("invalid recovery history entry '%s': %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
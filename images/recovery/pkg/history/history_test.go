@@ -0,0 +1,41 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestApply_prunesOldEntries(t *testing.T) {
+	cm := &corev1.ConfigMap{}
+	for i := 0; i < 5; i++ {
+		line, err := json.Marshal(Entry{Pod: fmt.Sprintf("cassandra-node-%d", i%2), Trigger: "pvc-lost", Outcome: OutcomeSucceeded, Duration: fmt.Sprintf("%ds", i)})
+		assert.NoError(t, err)
+		apply(cm, string(line), fmt.Sprintf("cassandra-node-%d", i%2), 3)
+	}
+
+	entries, err := Entries(cm)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "2s", entries[0].Duration)
+	assert.Equal(t, "4s", entries[2].Duration)
+
+	last := Entry{}
+	assert.NoError(t, json.Unmarshal([]byte(cm.Data[LastKeyPrefix+"cassandra-node-1"]), &last))
+	assert.Equal(t, "3s", last.Duration)
+	assert.Contains(t, cm.Data, LastKeyPrefix+"cassandra-node-0")
+}
+
+func TestEntries_invalid(t *testing.T) {
+	cm := &corev1.ConfigMap{Data: map[string]string{HistoryKey: "{invalid\n"}}
+	_, err := Entries(cm)
+	assert.Error(t, err)
+}
+
+func TestRecord_nilRecorder(t *testing.T) {
+	var r *Recorder
+	assert.NoError(t, r.Record(&corev1.Pod{}, Entry{}))
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "cassandra_recovery"
+
+var instanceLabels = []string{"namespace", "instance"}
+
+var (
+	// ReconcileRuns counts the full reconciliations by result.
+	ReconcileRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_runs_total",
+		Help:      "Number of full reconciliations of all Cassandra pods, by result.",
+	}, []string{"result"})
+	// ReconcileDuration is the duration of the last full reconciliation.
+	ReconcileDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of the last full reconciliation.",
+	})
+	// ReconcileLastSuccess is the time of the last successful full reconciliation.
+	ReconcileLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful full reconciliation.",
+	})
+
+	// Pods is the number of Cassandra pods found by the last reconciliation.
+	Pods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pods",
+		Help:      "Number of Cassandra pods.",
+	}, instanceLabels)
+	// PodsNotReady is the number of Cassandra pods that are not ready.
+	PodsNotReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pods_not_ready",
+		Help:      "Number of Cassandra pods that are not ready.",
+	}, instanceLabels)
+	// PodsUnschedulable is the number of Cassandra pods that can not be scheduled.
+	PodsUnschedulable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pods_unschedulable",
+		Help:      "Number of Cassandra pods that can not be scheduled.",
+	}, instanceLabels)
+	// PodsRecoveryNeeded is the number of Cassandra pods that meet the conditions of a recovery policy.
+	PodsRecoveryNeeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pods_recovery_needed",
+		Help:      "Number of Cassandra pods that meet the conditions of a recovery policy.",
+	}, instanceLabels)
+	// PodsDeferred is the number of Cassandra pods whose recovery is deferred.
+	PodsDeferred = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pods_deferred",
+		Help:      "Number of Cassandra pods whose recovery is deferred.",
+	}, instanceLabels)
+	// PodsEvicting is the number of Cassandra pods with an eviction in progress.
+	PodsEvicting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pods_evicting",
+		Help:      "Number of Cassandra pods with an eviction in progress.",
+	}, instanceLabels)
+	// PVCs is the number of PVCs of Cassandra pods by phase.
+	PVCs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pvcs",
+		Help:      "Number of PVCs of Cassandra nodes, by phase.",
+	}, append(instanceLabels, "phase"))
+	// PVCsUnused is the number of PVCs of Cassandra nodes that are not used by any pod.
+	PVCsUnused = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pvcs_unused",
+		Help:      "Number of PVCs of Cassandra nodes that are not used by any existing pod.",
+	}, instanceLabels)
+
+	// GCCandidates is the number of orphaned volumes found by the last garbage collection.
+	GCCandidates = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "gc_orphaned_volumes",
+		Help:      "Number of orphaned PVCs and PVs of Cassandra nodes, by kind.",
+	}, append(instanceLabels, "kind"))
+	// GCDeleted counts the deleted orphaned volumes.
+	GCDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gc_deleted_volumes_total",
+		Help:      "Number of orphaned PVCs and PVs of Cassandra nodes that were deleted, by kind.",
+	}, append(instanceLabels, "kind"))
+
+	// ProcessingErrors counts the failed attempts to process a pod.
+	ProcessingErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "processing_errors_total",
+		Help:      "Number of failed attempts to process a pod.",
+	}, instanceLabels)
+	// ProcessingGaveUp counts the pods that failed more often than the retry limit.
+	ProcessingGaveUp = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "processing_gave_up_total",
+		Help:      "Number of pods that were dropped from the queue after exceeding the retry limit. They are processed again by the next reconciliation.",
+	}, instanceLabels)
+)
+
+// InstanceGauges are reset by every reconciliation.
+var InstanceGauges = []*prometheus.GaugeVec{Pods, PodsNotReady, PodsUnschedulable, PodsRecoveryNeeded, PodsDeferred, PodsEvicting, PVCs, PVCsUnused, GCCandidates}
+
+func init() {
+	prometheus.MustRegister(ReconcileRuns, ReconcileDuration, ReconcileLastSuccess, ProcessingErrors, ProcessingGaveUp, GCDeleted)
+	for _, g := range InstanceGauges {
+		prometheus.MustRegister(g)
+	}
+}
+
+// Serve exposes the metrics on /metrics of the address. It does not return.
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("Serving metrics on %s/metrics", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Errorf("Metrics server failed: %v", err)
+	}
+}
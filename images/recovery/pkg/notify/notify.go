@@ -0,0 +1,297 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gate"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+)
+
+const (
+	// EventDecision is sent when the controller starts a recovery or an eviction.
+	EventDecision = "decision"
+	// EventDeferred is sent when a recovery is deferred by a pause, a maintenance window or the rate limit.
+	EventDeferred = "deferred"
+	// EventOutcome is sent when a recovery or an eviction completed or failed.
+	EventOutcome = "outcome"
+
+	// SignatureHeader contains the hex encoded HMAC-SHA256 of the body, prefixed with "sha256=".
+	SignatureHeader = "X-Cassandra-Recovery-Signature"
+	// EventHeader contains the type of the event.
+	EventHeader = "X-Cassandra-Recovery-Event"
+
+	defaultMaxRetries = 5
+	defaultBackoff    = time.Second
+	defaultTimeout    = 10 * time.Second
+	queueSize         = 100
+)
+
+// Event is the payload of a notification. Without a template it is sent as JSON.
+type Event struct {
+	Type      string `json:"type"`
+	Namespace string `json:"namespace"`
+	Instance  string `json:"instance,omitempty"`
+	history.Entry
+}
+
+// NewEvent creates an event for a recovery of the pod.
+func NewEvent(eventType string, pod *corev1.Pod, entry history.Entry) Event {
+	return Event{
+		Type:      eventType,
+		Namespace: pod.Namespace,
+		Instance:  pod.Labels[gate.InstanceLabel],
+		Entry:     entry,
+	}
+}
+
+// Config configures the webhook.
+type Config struct {
+	// URL receives a POST request for every event.
+	URL string `json:"url"`
+	// Template is a Go template for the request body. The event is passed as data.
+	Template string `json:"template,omitempty"`
+	// ContentType of the request body, defaults to application/json.
+	ContentType string `json:"contentType,omitempty"`
+	// Headers are added to every request.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Events limits the notifications to the given event types. All events are sent if empty.
+	Events []string `json:"events,omitempty"`
+	// MaxRetries is the number of retries of a failed request.
+	MaxRetries *int `json:"maxRetries,omitempty"`
+	// Backoff is the delay before the first retry, it doubles with every retry.
+	Backoff string `json:"backoff,omitempty"`
+	// Timeout of a single request.
+	Timeout string `json:"timeout,omitempty"`
+	// DeadLetterFile receives the events that could not be delivered, one JSON object per line.
+	DeadLetterFile string `json:"deadLetterFile,omitempty"`
+}
+
+// ParseConfig reads the webhook configuration.
+func ParseConfig(data []byte) (Config, error) {
+	config := Config{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse webhook configuration: %v", err)
+	}
+	if config.URL == "" {
+		return config, fmt.Errorf("webhook configuration has no url")
+	}
+	return config, nil
+}
+
+// Notifier sends events to a webhook in the background. A nil notifier drops all events.
+type Notifier struct {
+	config     Config
+	secret     []byte
+	template   *template.Template
+	events     map[string]bool
+	maxRetries int
+	backoff    time.Duration
+	client     *http.Client
+	queue      chan Event
+}
+
+// New creates a notifier. If secret is not empty, every request is signed with it.
+func New(config Config, secret string) (*Notifier, error) {
+	n := &Notifier{
+		config:     config,
+		secret:     []byte(secret),
+		events:     map[string]bool{},
+		maxRetries: defaultMaxRetries,
+		backoff:    defaultBackoff,
+		client:     &http.Client{Timeout: defaultTimeout},
+		queue:      make(chan Event, queueSize),
+	}
+	if config.Template != "" {
+		tmpl, err := template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook template: %v", err)
+		}
+		n.template = tmpl
+	}
+	for _, e := range config.Events {
+		if e != EventDecision && e != EventDeferred && e != EventOutcome {
+			return nil, fmt.Errorf("unknown webhook event '%s'", e)
+		}
+		n.events[e] = true
+	}
+	if config.MaxRetries != nil {
+		n.maxRetries = *config.MaxRetries
+	}
+	if config.Backoff != "" {
+		backoff, err := time.ParseDuration(config.Backoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook backoff '%s': %v", config.Backoff, err)
+		}
+		n.backoff = backoff
+	}
+	if config.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook timeout '%s': %v", config.Timeout, err)
+		}
+		n.client.Timeout = timeout
+	}
+	return n, nil
+}
+
+// FromFile creates a notifier from a configuration file.
+func FromFile(path, secret string) (*Notifier, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook configuration %s: %v", path, err)
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	return New(config, secret)
+}
+
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// Notify queues the event. It never blocks, if the queue is full the event goes to the dead letter log.
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+	if len(n.events) > 0 && !n.events[event.Type] {
+		return
+	}
+	select {
+	case n.queue <- event:
+	default:
+		n.deadLetter(event, fmt.Errorf("notification queue is full"))
+	}
+}
+
+// Run sends the queued events until the stop channel is closed.
+func (n *Notifier) Run(stopCh <-chan struct{}) {
+	if n == nil {
+		return
+	}
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event := <-n.queue:
+			if err := n.Send(event, stopCh); err != nil {
+				n.deadLetter(event, err)
+			}
+		}
+	}
+}
+
+// Body renders the request body of the event.
+func (n *Notifier) Body(event Event) ([]byte, error) {
+	if n.template == nil {
+		return json.Marshal(event)
+	}
+	var buf bytes.Buffer
+	if err := n.template.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("failed to render webhook template: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Sign returns the signature of the body.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send delivers the event, retrying with exponential backoff on connection errors, 429 and 5xx responses.
+func (n *Notifier) Send(event Event, stopCh <-chan struct{}) error {
+	body, err := n.Body(event)
+	if err != nil {
+		return err
+	}
+	backoff := n.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(event, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= n.maxRetries {
+			return err
+		}
+		log.Warnf("Webhook notification failed (attempt %d of %d), retrying in %v: %v", attempt+1, n.maxRetries+1, backoff, err)
+		select {
+		case <-stopCh:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post sends the request once. It returns whether a failed request can be retried.
+func (n *Notifier) post(event Event, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, n.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create webhook request: %v", err)
+	}
+	contentType := n.config.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(EventHeader, event.Type)
+	for k, v := range n.config.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(n.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("webhook request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	_, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook responded with %s", resp.Status)
+}
+
+// deadLetter logs an event that could not be delivered, and appends it to the dead letter file if configured.
+func (n *Notifier) deadLetter(event Event, reason error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Failed to serialize undeliverable webhook event: %v", err)
+		return
+	}
+	log.WithField("deadLetter", string(data)).Errorf("Failed to deliver webhook notification: %v", reason)
+	if n.config.DeadLetterFile == "" {
+		return
+	}
+	file, err := os.OpenFile(n.config.DeadLetterFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Errorf("Failed to open dead letter file %s: %v", n.config.DeadLetterFile, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Errorf("Failed to write dead letter file %s: %v", n.config.DeadLetterFile, err)
+	}
+}
@@ -0,0 +1,192 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+)
+
+type request struct {
+	headers http.Header
+	body    []byte
+}
+
+// standIn is a webhook receiver that responds with the given status codes, and 200 once they are used up.
+type standIn struct {
+	lock     sync.Mutex
+	statuses []int
+	requests []request
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, request{headers: r.Header, body: body})
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func testEvent() Event {
+	return Event{
+		Type:      EventOutcome,
+		Namespace: "default",
+		Instance:  "cassandra",
+		Entry: history.Entry{
+			Time:    time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+			Pod:     "cassandra-node-0",
+			Node:    "node-1",
+			Trigger: "node-deleted",
+			Mode:    "wipe",
+			Outcome: history.OutcomeSucceeded,
+		},
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestSend_signsDefaultBody(t *testing.T) {
+	receiver := &standIn{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	n, err := New(Config{URL: server.URL}, "secret")
+	assert.NoError(t, err)
+	assert.NoError(t, n.Send(testEvent(), nil))
+
+	assert.Len(t, receiver.requests, 1)
+	req := receiver.requests[0]
+	assert.Equal(t, "application/json", req.headers.Get("Content-Type"))
+	assert.Equal(t, EventOutcome, req.headers.Get(EventHeader))
+	assert.Equal(t, Sign([]byte("secret"), req.body), req.headers.Get(SignatureHeader))
+
+	payload := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(req.body, &payload))
+	assert.Equal(t, "outcome", payload["type"])
+	assert.Equal(t, "cassandra", payload["instance"])
+	assert.Equal(t, "cassandra-node-0", payload["pod"])
+	assert.Equal(t, "node-deleted", payload["trigger"])
+}
+
+func TestSend_template(t *testing.T) {
+	receiver := &standIn{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	n, err := New(Config{
+		URL:      server.URL,
+		Template: `{"text": {{ printf "%s of %s/%s: %s" .Type .Namespace .Pod .Outcome | json }}}`,
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	}, "")
+	assert.NoError(t, err)
+	assert.NoError(t, n.Send(testEvent(), nil))
+
+	assert.Len(t, receiver.requests, 1)
+	assert.Equal(t, `{"text": "outcome of default/cassandra-node-0: Succeeded"}`, string(receiver.requests[0].body))
+	assert.Equal(t, "Bearer token", receiver.requests[0].headers.Get("Authorization"))
+	assert.Empty(t, receiver.requests[0].headers.Get(SignatureHeader))
+}
+
+func TestSend_retriesServerErrors(t *testing.T) {
+	receiver := &standIn{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	n, err := New(Config{URL: server.URL, Backoff: "1ms"}, "")
+	assert.NoError(t, err)
+	assert.NoError(t, n.Send(testEvent(), nil))
+	assert.Len(t, receiver.requests, 3)
+}
+
+func TestSend_doesNotRetryClientErrors(t *testing.T) {
+	receiver := &standIn{statuses: []int{http.StatusBadRequest}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	n, err := New(Config{URL: server.URL, Backoff: "1ms"}, "")
+	assert.NoError(t, err)
+	assert.Error(t, n.Send(testEvent(), nil))
+	assert.Len(t, receiver.requests, 1)
+}
+
+func TestRun_writesDeadLetters(t *testing.T) {
+	receiver := &standIn{statuses: []int{500, 500, 500}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "notify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	deadLetters := filepath.Join(dir, "dead-letters.jsonl")
+
+	n, err := New(Config{
+		URL:            server.URL,
+		MaxRetries:     intPtr(2),
+		Backoff:        "1ms",
+		DeadLetterFile: deadLetters,
+		Events:         []string{EventOutcome},
+	}, "")
+	assert.NoError(t, err)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go n.Run(stopCh)
+
+	deferred := testEvent()
+	deferred.Type = EventDeferred
+	n.Notify(deferred)
+	n.Notify(testEvent())
+
+	assert.Eventually(t, func() bool {
+		data, err := ioutil.ReadFile(deadLetters)
+		return err == nil && len(data) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	data, _ := ioutil.ReadFile(deadLetters)
+	event := Event{}
+	assert.NoError(t, json.Unmarshal(data, &event))
+	assert.Equal(t, EventOutcome, event.Type)
+	assert.Equal(t, "cassandra-node-0", event.Pod)
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	// The deferred event is filtered, the outcome is sent three times
+	assert.Len(t, receiver.requests, 3)
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+url: https://hooks.example.com/recovery
+template: '{"text": "{{ .Pod }}"}'
+events: [outcome]
+maxRetries: 3
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://hooks.example.com/recovery", config.URL)
+	assert.Equal(t, 3, *config.MaxRetries)
+
+	_, err = ParseConfig([]byte(`template: "{{ .Pod }}"`))
+	assert.Error(t, err)
+	_, err = ParseConfig([]byte("url: https://example.com\nretries: 3"))
+	assert.Error(t, err)
+
+	_, err = New(Config{URL: "https://example.com", Events: []string{"started"}}, "")
+	assert.Error(t, err)
+	_, err = New(Config{URL: "https://example.com", Template: "{{ .Pod "}, "")
+	assert.Error(t, err)
+}
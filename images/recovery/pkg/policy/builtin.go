@@ -0,0 +1,224 @@
+package policy
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	EvictionLabelPolicy = "eviction-label"
+	PVCLostPolicy       = "pvc-lost"
+	NodeDeletedPolicy   = "node-deleted"
+
+	// ParamLabel is the pod label that triggers an eviction.
+	ParamLabel = "label"
+	// ParamValue is the value of the eviction label that triggers an eviction.
+	ParamValue = "value"
+	// ParamGracePeriod is the time a pod needs to be unschedulable before a policy triggers.
+	ParamGracePeriod = "gracePeriod"
+	// ParamRecoverPendingPVC allows the recovery of pods whose PVC is unbound and still pending.
+	ParamRecoverPendingPVC = "recoverPendingPVC"
+	// ParamHostnameKey is the node affinity key of local PVs that identifies the node.
+	ParamHostnameKey = "hostnameKey"
+)
+
+func init() {
+	Register(EvictionLabelPolicy, newEvictionLabel)
+	Register(PVCLostPolicy, newPVCLost)
+	Register(NodeDeletedPolicy, newNodeDeleted)
+}
+
+// evictionLabel recovers a pod when the eviction label is set on it.
+type evictionLabel struct {
+	label string
+	value string
+}
+
+func newEvictionLabel(params Parameters) (RecoveryPolicy, error) {
+	return &evictionLabel{
+		label: params.String(ParamLabel, ""),
+		value: params.String(ParamValue, "true"),
+	}, nil
+}
+
+func (p *evictionLabel) Name() string { return EvictionLabelPolicy }
+
+func (p *evictionLabel) Evaluate(_ kubernetes.Interface, pod *corev1.Pod) (Decision, error) {
+	if p.label == "" {
+		return Decision{}, nil
+	}
+	if val, ok := pod.Labels[p.label]; ok && val == p.value {
+		log.Printf("Pod %s has eviction label set", pod.Name)
+		return Decision{Recover: true, Eviction: true, Reason: fmt.Sprintf("eviction label %s=%s is set", p.label, p.value)}, nil
+	}
+	return Decision{}, nil
+}
+
+// pvcLost recovers an unschedulable pod whose PVC was deleted or lost its PV.
+type pvcLost struct {
+	gracePeriod    time.Duration
+	recoverPending bool
+}
+
+func newPVCLost(params Parameters) (RecoveryPolicy, error) {
+	gracePeriod, err := params.Duration(ParamGracePeriod, 0)
+	if err != nil {
+		return nil, err
+	}
+	recoverPending, err := params.Bool(ParamRecoverPendingPVC, false)
+	if err != nil {
+		return nil, err
+	}
+	return &pvcLost{gracePeriod: gracePeriod, recoverPending: recoverPending}, nil
+}
+
+func (p *pvcLost) Name() string { return PVCLostPolicy }
+
+func (p *pvcLost) Evaluate(client kubernetes.Interface, pod *corev1.Pod) (Decision, error) {
+	if !detectUnschedulable(pod, p.gracePeriod) {
+		return Decision{}, nil
+	}
+	pvcDown, err := detectPVCDown(client, pod, p.recoverPending)
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to detect if pv for pod %s/%s is down: %v", pod.Namespace, pod.Name, err)
+	}
+	log.Printf("Detected PVC status for %s/%s: %v", pod.Namespace, pod.Name, pvcDown)
+	if pvcDown {
+		log.Printf("PVC for %s/%s is not available, assuming it is already deleted.", pod.Namespace, pod.Name)
+		return Decision{Recover: true, Reason: "pod is unschedulable and its PVC is not available"}, nil
+	}
+	return Decision{}, nil
+}
+
+// nodeDeleted recovers an unschedulable pod whose local PV is bound to a node that does not exist anymore.
+type nodeDeleted struct {
+	gracePeriod time.Duration
+	hostnameKey string
+}
+
+func newNodeDeleted(params Parameters) (RecoveryPolicy, error) {
+	gracePeriod, err := params.Duration(ParamGracePeriod, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &nodeDeleted{
+		gracePeriod: gracePeriod,
+		hostnameKey: params.String(ParamHostnameKey, corev1.LabelHostname),
+	}, nil
+}
+
+func (p *nodeDeleted) Name() string { return NodeDeletedPolicy }
+
+func (p *nodeDeleted) Evaluate(client kubernetes.Interface, pod *corev1.Pod) (Decision, error) {
+	if !detectUnschedulable(pod, p.gracePeriod) {
+		return Decision{}, nil
+	}
+	nodeDown, err := detectNodeDown(client, pod, p.hostnameKey)
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to detect if node for pod %s/%s is down: %v", pod.Namespace, pod.Name, err)
+	}
+	if nodeDown {
+		log.Printf("Node is down for %s/%s.", pod.Namespace, pod.Name)
+		return Decision{Recover: true, Reason: "pod is unschedulable and the node of its local volume was deleted"}, nil
+	}
+	return Decision{}, nil
+}
+
+// detectUnschedulable returns true if the pod failed scheduling for at least the grace period.
+func detectUnschedulable(pod *corev1.Pod, gracePeriod time.Duration) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Reason == corev1.PodReasonUnschedulable {
+			if gracePeriod > 0 && time.Since(condition.LastTransitionTime.Time) < gracePeriod {
+				log.Printf("FailedScheduling detected for %s/%s, but grace period of %v has not passed yet.", pod.Namespace, pod.Name, gracePeriod)
+				return false
+			}
+			log.Printf("FailedScheduling detected for %s/%s.", pod.Namespace, pod.Name)
+			return true
+		}
+	}
+	return false
+}
+
+func detectPVCDown(client kubernetes.Interface, pod *corev1.Pod, recoverPending bool) (bool, error) {
+	// we need to check if PVC is still deleted
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim != nil {
+			pvc, err := client.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(vol.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+			if errors.IsNotFound(err) {
+				return true, nil
+			}
+			if err != nil {
+				return false, fmt.Errorf("failed to retrieve pvc %s/%s: %v", pod.Namespace, vol.PersistentVolumeClaim.ClaimName, err)
+			}
+			log.Printf(" Volume Claim Status: %s", pvc.Status.Phase)
+			if pvc.Spec.VolumeName == "" {
+				log.Printf("Volume Name for PVC %s/%s has no PV attached", pvc.Namespace, pvc.Name)
+				if pvc.Status.Phase == corev1.ClaimPending && !recoverPending {
+					log.Printf("PVC is still in phase Pending, it's not down")
+					return false, nil
+				}
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func detectNodeDown(client kubernetes.Interface, pod *corev1.Pod, hostnameKey string) (bool, error) {
+	// we cannot check by node name here as the node will be  Nil here
+	// we need to check through PVC
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim != nil {
+
+			pvc, err := client.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(vol.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+			if err != nil {
+				return false, fmt.Errorf("failed to get pvc %s/%s: %v", pod.Namespace, vol.PersistentVolumeClaim.ClaimName, err)
+			}
+			if pvc.Spec.VolumeName == "" {
+				continue
+			}
+
+			pv, err := client.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+			if err != nil {
+				return false, fmt.Errorf("failed to get PV '%s': %v", pvc.Spec.VolumeName, err)
+			}
+
+			if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+				log.Printf("PV %s has no required node affinity, it is not bound to a node", pv.Name)
+				continue
+			}
+
+			for _, node := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+				for _, expr := range node.MatchExpressions {
+					if expr.Key == hostnameKey && len(expr.Values) > 0 {
+						log.Printf("Found required hostname affinity for PV %s: %+v", pv.Name, expr)
+
+						if len(expr.Values) > 1 {
+							log.Printf("WARN: Required NodeAffinity for PV %s has more than one value for hostname: %v", pv.Name, expr.Values)
+						}
+
+						node, err := client.CoreV1().Nodes().Get(expr.Values[0], metav1.GetOptions{})
+						if err != nil {
+							if errors.IsNotFound(err) {
+								return true, nil
+							} else {
+								return false, fmt.Errorf("failed to get node %s: %v", expr.Values[0], err)
+							}
+						}
+						if node == nil {
+							return true, nil
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func podWithClaim(claim string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "cassandra-node-0", Namespace: "default"},
+		Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+			Name:         "var-lib-cassandra",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim}},
+		}}},
+	}
+}
+
+func claim(volumeName string, phase corev1.PersistentVolumeClaimPhase) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "var-lib-cassandra-cassandra-node-0", Namespace: "default"},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: volumeName},
+		Status:     corev1.PersistentVolumeClaimStatus{Phase: phase},
+	}
+}
+
+func localVolume(name string, hostnames ...string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if len(hostnames) > 0 {
+		pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{{
+				Key:      corev1.LabelHostname,
+				Operator: corev1.NodeSelectorOpIn,
+				Values:   hostnames,
+			}}}},
+		}}
+	}
+	return pv
+}
+
+func TestDetectPVCDown(t *testing.T) {
+	pod := podWithClaim("var-lib-cassandra-cassandra-node-0")
+
+	down, err := detectPVCDown(fake.NewSimpleClientset(), pod, false)
+	assert.NoError(t, err)
+	assert.True(t, down, "a missing PVC is down")
+
+	client := fake.NewSimpleClientset(claim("", corev1.ClaimPending))
+	down, err = detectPVCDown(client, pod, false)
+	assert.NoError(t, err)
+	assert.False(t, down, "a pending PVC is not down")
+	down, err = detectPVCDown(client, pod, true)
+	assert.NoError(t, err)
+	assert.True(t, down)
+
+	down, err = detectPVCDown(fake.NewSimpleClientset(claim("", corev1.ClaimLost)), pod, false)
+	assert.NoError(t, err)
+	assert.True(t, down, "a PVC without PV is down")
+
+	down, err = detectPVCDown(fake.NewSimpleClientset(claim("pv-1", corev1.ClaimBound)), pod, false)
+	assert.NoError(t, err)
+	assert.False(t, down)
+}
+
+func TestDetectNodeDown(t *testing.T) {
+	pod := podWithClaim("var-lib-cassandra-cassandra-node-0")
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+
+	client := fake.NewSimpleClientset(claim("pv-1", corev1.ClaimBound), localVolume("pv-1", "node-1"))
+	down, err := detectNodeDown(client, pod, corev1.LabelHostname)
+	assert.NoError(t, err)
+	assert.True(t, down, "the node of the local PV was deleted")
+
+	down, err = detectNodeDown(client, pod, "topology.example.com/host")
+	assert.NoError(t, err)
+	assert.False(t, down, "the affinity does not use the hostname key")
+
+	client = fake.NewSimpleClientset(claim("pv-1", corev1.ClaimBound), localVolume("pv-1", "node-1"), node)
+	down, err = detectNodeDown(client, pod, corev1.LabelHostname)
+	assert.NoError(t, err)
+	assert.False(t, down)
+
+	client = fake.NewSimpleClientset(claim("pv-1", corev1.ClaimBound), localVolume("pv-1"))
+	down, err = detectNodeDown(client, pod, corev1.LabelHostname)
+	assert.NoError(t, err)
+	assert.False(t, down, "a PV without node affinity is not bound to a node")
+
+	client = fake.NewSimpleClientset(claim("", corev1.ClaimPending))
+	down, err = detectNodeDown(client, pod, corev1.LabelHostname)
+	assert.NoError(t, err)
+	assert.False(t, down)
+
+	_, err = detectNodeDown(fake.NewSimpleClientset(), pod, corev1.LabelHostname)
+	assert.Error(t, err, "a missing PVC can not be checked")
+}
@@ -0,0 +1,96 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// ConfigKey is the key in the policy ConfigMap that contains the policy configuration.
+	ConfigKey = "policies.yaml"
+)
+
+// Parameters are the string key/value settings of a single policy.
+type Parameters map[string]string
+
+// String returns the parameter value or the given default.
+func (p Parameters) String(key, def string) string {
+	if v, ok := p[key]; ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// Bool returns the parameter value parsed as boolean or the given default.
+func (p Parameters) Bool(key string, def bool) (bool, error) {
+	v, ok := p[key]
+	if !ok || v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("parameter '%s' is not a boolean: %v", key, err)
+	}
+	return b, nil
+}
+
+// Duration returns the parameter value parsed as duration or the given default.
+func (p Parameters) Duration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := p[key]
+	if !ok || v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("parameter '%s' is not a duration: %v", key, err)
+	}
+	return d, nil
+}
+
+// PolicyConfig enables, disables or parameterises a single policy.
+type PolicyConfig struct {
+	Name       string     `json:"name"`
+	Enabled    *bool      `json:"enabled,omitempty"`
+	Parameters Parameters `json:"parameters,omitempty"`
+}
+
+// IsEnabled returns true if the policy is not explicitly disabled.
+func (pc PolicyConfig) IsEnabled() bool {
+	return pc.Enabled == nil || *pc.Enabled
+}
+
+// Config is the policy configuration of a Cassandra instance.
+type Config struct {
+	Policies []PolicyConfig `json:"policies"`
+}
+
+// ParseConfig parses the YAML policy configuration.
+func ParseConfig(data string) (Config, error) {
+	config := Config{}
+	if err := yaml.UnmarshalStrict([]byte(data), &config); err != nil {
+		return Config{}, fmt.Errorf("failed to parse policy configuration: %v", err)
+	}
+	for i, pc := range config.Policies {
+		if pc.Name == "" {
+			return Config{}, fmt.Errorf("policy %d has no name", i)
+		}
+	}
+	return config, nil
+}
+
+// ConfigFromConfigMap reads the policy configuration from a ConfigMap. A nil ConfigMap results in the
+// default configuration.
+func ConfigFromConfigMap(cm *corev1.ConfigMap) (Config, error) {
+	if cm == nil {
+		return Config{}, nil
+	}
+	data, ok := cm.Data[ConfigKey]
+	if !ok {
+		return Config{}, fmt.Errorf("configmap %s/%s has no key '%s'", cm.Namespace, cm.Name, ConfigKey)
+	}
+	return ParseConfig(data)
+}
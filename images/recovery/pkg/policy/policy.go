@@ -0,0 +1,145 @@
+package policy
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Decision is the result of evaluating a RecoveryPolicy for a pod.
+type Decision struct {
+	// Recover is true when the pod should be clean started on a different node.
+	Recover bool
+	// Eviction is true when the recovery was requested by an operator, and the node of the pod is still available.
+	Eviction bool
+	// Reason is a human readable explanation of the decision.
+	Reason string
+	// Policy is the name of the policy that made the decision.
+	Policy string
+}
+
+// RecoveryPolicy evaluates a pod and its related objects (PVCs, PVs, nodes) and decides
+// whether the pod needs to be recovered.
+type RecoveryPolicy interface {
+	Name() string
+	Evaluate(client kubernetes.Interface, pod *corev1.Pod) (Decision, error)
+}
+
+// Factory creates a configured policy from its parameters.
+type Factory func(params Parameters) (RecoveryPolicy, error)
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]Factory{}
+	// builtinOrder is the order in which the built-in policies are evaluated by default.
+	builtinOrder []string
+)
+
+// Register adds a policy factory to the registry. Registering the same name twice replaces the factory.
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[name]; !ok {
+		builtinOrder = append(builtinOrder, name)
+	}
+	registry[name] = factory
+}
+
+func lookup(name string) (Factory, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	f, ok := registry[name]
+	return f, ok
+}
+
+func registeredNames() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return append([]string{}, builtinOrder...)
+}
+
+// Set is an ordered list of enabled policies. The first policy that decides to recover a pod wins.
+type Set struct {
+	policies []RecoveryPolicy
+}
+
+// NewSet builds the policy set from the given configuration. Policies that are not mentioned in the
+// configuration are enabled with their default parameters, in registration order after the configured ones.
+func NewSet(config Config, defaults map[string]Parameters) (*Set, error) {
+	set := &Set{}
+	seen := map[string]bool{}
+
+	add := func(name string, params Parameters) error {
+		factory, ok := lookup(name)
+		if !ok {
+			return fmt.Errorf("unknown recovery policy '%s'", name)
+		}
+		merged := Parameters{}
+		for k, v := range defaults[name] {
+			merged[k] = v
+		}
+		for k, v := range params {
+			merged[k] = v
+		}
+		p, err := factory(merged)
+		if err != nil {
+			return fmt.Errorf("failed to configure recovery policy '%s': %v", name, err)
+		}
+		set.policies = append(set.policies, p)
+		return nil
+	}
+
+	for _, pc := range config.Policies {
+		if seen[pc.Name] {
+			return nil, fmt.Errorf("recovery policy '%s' is configured more than once", pc.Name)
+		}
+		seen[pc.Name] = true
+		if !pc.IsEnabled() {
+			log.Infof("Recovery policy '%s' is disabled", pc.Name)
+			continue
+		}
+		if err := add(pc.Name, pc.Parameters); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range registeredNames() {
+		if seen[name] {
+			continue
+		}
+		if err := add(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// Names returns the names of all enabled policies in evaluation order.
+func (s *Set) Names() []string {
+	names := make([]string, 0, len(s.policies))
+	for _, p := range s.policies {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// Evaluate runs all enabled policies against the pod and returns the first decision to recover.
+// Errors of single policies are logged and do not prevent other policies from being evaluated.
+func (s *Set) Evaluate(client kubernetes.Interface, pod *corev1.Pod) (Decision, error) {
+	var lastErr error
+	for _, p := range s.policies {
+		decision, err := p.Evaluate(client, pod)
+		if err != nil {
+			log.Printf("ERROR: recovery policy '%s' failed for pod %s/%s: %v", p.Name(), pod.Namespace, pod.Name, err)
+			lastErr = err
+			continue
+		}
+		if decision.Recover {
+			decision.Policy = p.Name()
+			return decision, nil
+		}
+	}
+	return Decision{}, lastErr
+}
@@ -0,0 +1,101 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig(`
+policies:
+  - name: node-deleted
+    parameters:
+      gracePeriod: 10m
+  - name: pvc-lost
+    enabled: false
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(config.Policies))
+	assert.True(t, config.Policies[0].IsEnabled())
+	assert.Equal(t, "10m", config.Policies[0].Parameters[ParamGracePeriod])
+	assert.False(t, config.Policies[1].IsEnabled())
+}
+
+func TestParseConfig_invalid(t *testing.T) {
+	_, err := ParseConfig(`
+policies:
+  - enabled: true
+`)
+	assert.NotNil(t, err)
+
+	_, err = ParseConfig(`
+policies:
+  - name: node-deleted
+    unknownField: true
+`)
+	assert.NotNil(t, err)
+}
+
+func TestNewSet_defaults(t *testing.T) {
+	set, err := NewSet(Config{}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{EvictionLabelPolicy, PVCLostPolicy, NodeDeletedPolicy}, set.Names())
+}
+
+func TestNewSet_orderAndDisable(t *testing.T) {
+	disabled := false
+	set, err := NewSet(Config{Policies: []PolicyConfig{
+		{Name: NodeDeletedPolicy},
+		{Name: PVCLostPolicy, Enabled: &disabled},
+	}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{NodeDeletedPolicy, EvictionLabelPolicy}, set.Names())
+}
+
+func TestNewSet_invalid(t *testing.T) {
+	_, err := NewSet(Config{Policies: []PolicyConfig{{Name: "unknown"}}}, nil)
+	assert.NotNil(t, err)
+
+	_, err = NewSet(Config{Policies: []PolicyConfig{
+		{Name: NodeDeletedPolicy, Parameters: Parameters{ParamGracePeriod: "soon"}},
+	}}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestEvictionLabel(t *testing.T) {
+	set, err := NewSet(Config{}, map[string]Parameters{
+		EvictionLabelPolicy: {ParamLabel: "kudo-cassandra/evict"},
+	})
+	assert.Nil(t, err)
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:   "cassandra-node-0",
+		Labels: map[string]string{"kudo-cassandra/evict": "true"},
+	}}
+	decision, err := set.Evaluate(nil, pod)
+	assert.Nil(t, err)
+	assert.True(t, decision.Recover)
+	assert.Equal(t, EvictionLabelPolicy, decision.Policy)
+
+	pod.Labels["kudo-cassandra/evict"] = "false"
+	decision, err = set.Evaluate(nil, pod)
+	assert.Nil(t, err)
+	assert.False(t, decision.Recover)
+}
+
+func TestDetectUnschedulable_gracePeriod(t *testing.T) {
+	pod := &corev1.Pod{Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{
+		Type:               corev1.PodScheduled,
+		Reason:             corev1.PodReasonUnschedulable,
+		LastTransitionTime: metav1.NewTime(time.Now().Add(-2 * time.Minute)),
+	}}}}
+
+	assert.True(t, detectUnschedulable(pod, 0))
+	assert.True(t, detectUnschedulable(pod, time.Minute))
+	assert.False(t, detectUnschedulable(pod, 5*time.Minute))
+	assert.False(t, detectUnschedulable(&corev1.Pod{}, 0))
+}
@@ -0,0 +1,221 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	Group = "snapshot.storage.k8s.io"
+	Kind  = "VolumeSnapshot"
+
+	// PodLabel is set on eviction snapshots and contains the name of the evicted pod.
+	PodLabel = "kudo-cassandra/evicted-pod"
+	// PVCLabel is set on eviction snapshots and contains the name of the PVC the snapshot was taken from.
+	PVCLabel = "kudo-cassandra/evicted-pvc"
+	// PVCTemplateAnnotation contains the labels and spec of the original PVC, used to recreate the claim.
+	PVCTemplateAnnotation = "kudo-cassandra/pvc-template"
+	// SourceUIDAnnotation contains the UID of the PVC the snapshot was taken from.
+	SourceUIDAnnotation = "kudo-cassandra/source-pvc-uid"
+	// RestoredAnnotation is set on a snapshot once a PVC was created from it.
+	RestoredAnnotation = "kudo-cassandra/restored"
+)
+
+// supportedVersions are the VolumeSnapshot API versions in order of preference.
+var supportedVersions = []string{"v1", "v1beta1"}
+
+// Snapshotter takes CSI VolumeSnapshots of PVCs and restores PVCs from them.
+type Snapshotter struct {
+	client        kubernetes.Interface
+	dynamic       dynamic.Interface
+	resource      schema.GroupVersionResource
+	snapshotClass string
+	supported     bool
+}
+
+// NewSnapshotter discovers the VolumeSnapshot API of the cluster. If the API is not available, the returned
+// Snapshotter reports that snapshots are not supported.
+func NewSnapshotter(client kubernetes.Interface, dynamicClient dynamic.Interface, snapshotClass string) *Snapshotter {
+	s := &Snapshotter{
+		client:        client,
+		dynamic:       dynamicClient,
+		snapshotClass: snapshotClass,
+	}
+	for _, version := range supportedVersions {
+		resources, err := client.Discovery().ServerResourcesForGroupVersion(fmt.Sprintf("%s/%s", Group, version))
+		if err != nil {
+			continue
+		}
+		for _, r := range resources.APIResources {
+			if r.Kind == Kind {
+				s.resource = schema.GroupVersionResource{Group: Group, Version: version, Resource: r.Name}
+				s.supported = true
+				log.Infof("Using VolumeSnapshot API %s/%s", Group, version)
+				return s
+			}
+		}
+	}
+	log.Infof("VolumeSnapshot API is not available, snapshot eviction will fall back to wiping the volumes")
+	return s
+}
+
+// Supported returns true if the cluster supports the VolumeSnapshot API.
+func (s *Snapshotter) Supported() bool {
+	return s != nil && s.supported
+}
+
+// Name returns the name of the eviction snapshot for a PVC.
+func Name(pvcName string) string {
+	return fmt.Sprintf("%s-eviction", pvcName)
+}
+
+// Status describes the state of an eviction snapshot.
+type Status struct {
+	Exists     bool
+	ReadyToUse bool
+	Error      string
+}
+
+// Create takes a snapshot of the PVC, unless a snapshot for it already exists.
+func (s *Snapshotter) Create(pod *corev1.Pod, pvc *corev1.PersistentVolumeClaim) error {
+	template := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Labels: pvc.Labels},
+		Spec:       pvc.Spec,
+	}
+	templateJSON, err := json.Marshal(template)
+	if err != nil {
+		return fmt.Errorf("failed to serialize spec of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": pvc.Name,
+		},
+	}
+	if s.snapshotClass != "" {
+		spec["volumeSnapshotClassName"] = s.snapshotClass
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": fmt.Sprintf("%s/%s", s.resource.Group, s.resource.Version),
+		"kind":       Kind,
+		"metadata": map[string]interface{}{
+			"name":      Name(pvc.Name),
+			"namespace": pvc.Namespace,
+			"labels": map[string]interface{}{
+				PodLabel: pod.Name,
+				PVCLabel: pvc.Name,
+			},
+			"annotations": map[string]interface{}{
+				PVCTemplateAnnotation: string(templateJSON),
+				SourceUIDAnnotation:   string(pvc.UID),
+			},
+		},
+		"spec": spec,
+	}}
+
+	_, err = s.dynamic.Resource(s.resource).Namespace(pvc.Namespace).Create(obj, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	log.Printf("Created VolumeSnapshot %s/%s of PVC %s", pvc.Namespace, Name(pvc.Name), pvc.Name)
+	return nil
+}
+
+// Get returns the eviction snapshot of a PVC, or nil if it does not exist.
+func (s *Snapshotter) Get(namespace, pvcName string) (*unstructured.Unstructured, error) {
+	obj, err := s.dynamic.Resource(s.resource).Namespace(namespace).Get(Name(pvcName), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot %s/%s: %v", namespace, Name(pvcName), err)
+	}
+	return obj, nil
+}
+
+// GetStatus returns the state of the eviction snapshot of a PVC.
+func (s *Snapshotter) GetStatus(namespace, pvcName string) (Status, error) {
+	obj, err := s.Get(namespace, pvcName)
+	if err != nil || obj == nil {
+		return Status{}, err
+	}
+	ready, _, _ := unstructured.NestedBool(obj.Object, "status", "readyToUse")
+	message, _, _ := unstructured.NestedString(obj.Object, "status", "error", "message")
+	return Status{Exists: true, ReadyToUse: ready, Error: message}, nil
+}
+
+// Delete removes the eviction snapshot of a PVC.
+func (s *Snapshotter) Delete(namespace, pvcName string) error {
+	err := s.dynamic.Resource(s.resource).Namespace(namespace).Delete(Name(pvcName), &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete snapshot %s/%s: %v", namespace, Name(pvcName), err)
+	}
+	return nil
+}
+
+// IsRestored returns true if a PVC was already created from the snapshot.
+func IsRestored(obj *unstructured.Unstructured) bool {
+	return obj.GetAnnotations()[RestoredAnnotation] == "true"
+}
+
+// Restore creates the PVC from its eviction snapshot and marks the snapshot as restored.
+func (s *Snapshotter) Restore(obj *unstructured.Unstructured) error {
+	template := corev1.PersistentVolumeClaim{}
+	if err := json.Unmarshal([]byte(obj.GetAnnotations()[PVCTemplateAnnotation]), &template); err != nil {
+		return fmt.Errorf("failed to read PVC template from snapshot %s/%s: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      obj.GetLabels()[PVCLabel],
+			Namespace: obj.GetNamespace(),
+			Labels:    template.Labels,
+		},
+		Spec: template.Spec,
+	}
+	// The new claim must not bind to the old volume
+	pvc.Spec.VolumeName = ""
+	apiGroup := Group
+	pvc.Spec.DataSource = &corev1.TypedLocalObjectReference{
+		APIGroup: &apiGroup,
+		Kind:     Kind,
+		Name:     obj.GetName(),
+	}
+	_, err := s.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(pvc)
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create PVC %s/%s from snapshot %s: %v", pvc.Namespace, pvc.Name, obj.GetName(), err)
+	}
+	log.Printf("Created PVC %s/%s from VolumeSnapshot %s", pvc.Namespace, pvc.Name, obj.GetName())
+
+	annotations := obj.GetAnnotations()
+	annotations[RestoredAnnotation] = "true"
+	obj.SetAnnotations(annotations)
+	if _, err := s.dynamic.Resource(s.resource).Namespace(obj.GetNamespace()).Update(obj, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to mark snapshot %s/%s as restored: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+	return nil
+}
+
+// IsSource returns true if the snapshot was taken from the PVC.
+func IsSource(pvc *corev1.PersistentVolumeClaim, obj *unstructured.Unstructured) bool {
+	return string(pvc.UID) == obj.GetAnnotations()[SourceUIDAnnotation]
+}
+
+// IsRestoredFrom returns true if the PVC was created from the given snapshot.
+func IsRestoredFrom(pvc *corev1.PersistentVolumeClaim, obj *unstructured.Unstructured) bool {
+	ds := pvc.Spec.DataSource
+	return ds != nil && ds.Kind == Kind && ds.Name == obj.GetName()
+}
@@ -0,0 +1,126 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestSnapshotter returns a snapshotter for a fake cluster that serves the VolumeSnapshot API in the version.
+func newTestSnapshotter(version string) (*fake.Clientset, *Snapshotter) {
+	client := fake.NewSimpleClientset()
+	if version != "" {
+		client.Resources = []*metav1.APIResourceList{{
+			GroupVersion: Group + "/" + version,
+			APIResources: []metav1.APIResource{{Name: "volumesnapshots", Kind: Kind, Namespaced: true}},
+		}}
+	}
+	return client, NewSnapshotter(client, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), "csi-snapshots")
+}
+
+func testPVC() *corev1.PersistentVolumeClaim {
+	storageClass := "local"
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "var-lib-cassandra-cassandra-node-0",
+			Namespace: "default",
+			UID:       "pvc-1",
+			Labels:    map[string]string{"app": "cassandra"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &storageClass,
+			VolumeName:       "pv-1",
+		},
+	}
+}
+
+func TestNewSnapshotter(t *testing.T) {
+	_, s := newTestSnapshotter("")
+	assert.False(t, s.Supported())
+
+	_, s = newTestSnapshotter("v1beta1")
+	assert.True(t, s.Supported())
+	assert.Equal(t, "v1beta1", s.resource.Version)
+	assert.Equal(t, "volumesnapshots", s.resource.Resource)
+
+	var nilSnapshotter *Snapshotter
+	assert.False(t, nilSnapshotter.Supported())
+}
+
+func TestCreate(t *testing.T) {
+	_, s := newTestSnapshotter("v1")
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cassandra-node-0", Namespace: "default"}}
+	pvc := testPVC()
+
+	assert.NoError(t, s.Create(pod, pvc))
+	// An existing snapshot is kept
+	assert.NoError(t, s.Create(pod, pvc))
+
+	obj, err := s.Get("default", pvc.Name)
+	assert.NoError(t, err)
+	if !assert.NotNil(t, obj) {
+		return
+	}
+	assert.Equal(t, "var-lib-cassandra-cassandra-node-0-eviction", obj.GetName())
+	assert.Equal(t, "snapshot.storage.k8s.io/v1", obj.GetAPIVersion())
+	assert.Equal(t, map[string]string{PodLabel: "cassandra-node-0", PVCLabel: pvc.Name}, obj.GetLabels())
+	assert.Equal(t, "pvc-1", obj.GetAnnotations()[SourceUIDAnnotation])
+	source, _, _ := unstructured.NestedString(obj.Object, "spec", "source", "persistentVolumeClaimName")
+	assert.Equal(t, pvc.Name, source)
+	class, _, _ := unstructured.NestedString(obj.Object, "spec", "volumeSnapshotClassName")
+	assert.Equal(t, "csi-snapshots", class)
+	assert.True(t, IsSource(pvc, obj))
+
+	status, err := s.GetStatus("default", pvc.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, Status{Exists: true}, status)
+
+	assert.NoError(t, unstructured.SetNestedField(obj.Object, true, "status", "readyToUse"))
+	_, err = s.dynamic.Resource(s.resource).Namespace("default").Update(obj, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	status, err = s.GetStatus("default", pvc.Name)
+	assert.NoError(t, err)
+	assert.True(t, status.ReadyToUse)
+
+	assert.NoError(t, s.Delete("default", pvc.Name))
+	assert.NoError(t, s.Delete("default", pvc.Name))
+	status, err = s.GetStatus("default", pvc.Name)
+	assert.NoError(t, err)
+	assert.False(t, status.Exists)
+}
+
+func TestRestore(t *testing.T) {
+	client, s := newTestSnapshotter("v1beta1")
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cassandra-node-0", Namespace: "default"}}
+	assert.NoError(t, s.Create(pod, testPVC()))
+	obj, err := s.Get("default", testPVC().Name)
+	assert.NoError(t, err)
+	assert.False(t, IsRestored(obj))
+
+	assert.NoError(t, s.Restore(obj))
+	pvc, err := client.CoreV1().PersistentVolumeClaims("default").Get(testPVC().Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"app": "cassandra"}, pvc.Labels)
+	assert.Equal(t, "local", *pvc.Spec.StorageClassName)
+	assert.Empty(t, pvc.Spec.VolumeName, "the restored PVC must not bind to the old volume")
+	if assert.NotNil(t, pvc.Spec.DataSource) {
+		assert.Equal(t, Group, *pvc.Spec.DataSource.APIGroup)
+		assert.Equal(t, Kind, pvc.Spec.DataSource.Kind)
+		assert.Equal(t, "var-lib-cassandra-cassandra-node-0-eviction", pvc.Spec.DataSource.Name)
+	}
+	assert.True(t, IsRestoredFrom(pvc, obj))
+	assert.False(t, IsSource(pvc, obj))
+
+	obj, err = s.Get("default", testPVC().Name)
+	assert.NoError(t, err)
+	assert.True(t, IsRestored(obj))
+
+	// Restoring again keeps the existing PVC
+	assert.NoError(t, s.Restore(obj))
+}
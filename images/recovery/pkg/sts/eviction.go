@@ -0,0 +1,579 @@
+package sts
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/cassandra"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/policy"
+)
+
+const (
+	// EvictionAnnotation contains the state of an eviction that is in progress for a pod.
+	EvictionAnnotation = "kudo-cassandra/eviction"
+	// evictionRecordPrefix is the prefix of the StatefulSet annotation that keeps the eviction state
+	// while the evicted pod is replaced.
+	evictionRecordPrefix = "kudo-cassandra/eviction."
+
+	// CordonLabel prevents Cassandra pods from being scheduled to a node.
+	CordonLabel = "kudo-cassandra/cordon"
+	// CordonedByAnnotation lists the pods whose eviction added the cordon label to a node.
+	CordonedByAnnotation = "kudo-cassandra/cordoned-by"
+
+	// topologyConfigMapEnv is the environment variable of the node pods that contains the topology configmap name.
+	topologyConfigMapEnv = "CASSANDRA_IP_LOCK_CM"
+
+	replacementPollInterval = 15 * time.Second
+)
+
+// Phase is a step of an eviction.
+type Phase string
+
+const (
+	// PhaseCordon prevents the replacement pod from being scheduled to the old node.
+	PhaseCordon Phase = "Cordon"
+	// PhaseDrain drains or decommissions the Cassandra node.
+	PhaseDrain Phase = "Drain"
+	// PhaseMigrate wipes or snapshots the volumes and deletes the pod.
+	PhaseMigrate Phase = "Migrate"
+	// PhaseWaitReplacement waits until the replacement pod is up and normal.
+	PhaseWaitReplacement Phase = "WaitReplacement"
+	// PhaseCleanup removes the cordon label, the eviction label and the eviction state.
+	PhaseCleanup Phase = "Cleanup"
+)
+
+// EvictionState is the persisted progress of an eviction.
+type EvictionState struct {
+	Phase        Phase       `json:"phase"`
+	Node         string      `json:"node,omitempty"`
+	PodUID       types.UID   `json:"podUID"`
+	Mode         string      `json:"mode"`
+	Decommission bool        `json:"decommission,omitempty"`
+	StartedAt    metav1.Time `json:"startedAt"`
+	Trigger      string      `json:"trigger,omitempty"`
+	Reason       string      `json:"reason,omitempty"`
+	PVCs         []string    `json:"pvcs,omitempty"`
+	PVs          []string    `json:"pvs,omitempty"`
+	// Failed is set once the failure of the current phase is recorded, so retries in later reconciliations do
+	// not record it again.
+	Failed bool `json:"failed,omitempty"`
+}
+
+// getEvictionState returns the eviction state of the pod, or nil if no eviction is in progress.
+func getEvictionState(pod *corev1.Pod) (*EvictionState, error) {
+	data, ok := pod.Annotations[EvictionAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	state := &EvictionState{}
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil, fmt.Errorf("failed to read eviction state of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	return state, nil
+}
+
+// annotationPatch returns a merge patch that sets the annotation, or removes it if the value is nil.
+func annotationPatch(key string, value interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{key: value},
+		},
+	})
+}
+
+func stateValue(state *EvictionState) (interface{}, error) {
+	if state == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func setEvictionState(client kubernetes.Interface, pod *corev1.Pod, state *EvictionState) error {
+	value, err := stateValue(state)
+	if err != nil {
+		return fmt.Errorf("failed to serialize eviction state of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	patch, err := annotationPatch(EvictionAnnotation, value)
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, patch)
+	if err != nil {
+		return fmt.Errorf("failed to update eviction state of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	return nil
+}
+
+func statefulSetName(pod *corev1.Pod) string {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "StatefulSet" {
+			return ref.Name
+		}
+	}
+	return ""
+}
+
+// getEvictionRecord returns the eviction state that was stored on the StatefulSet of the pod before the evicted
+// pod was deleted, or nil if there is none.
+func getEvictionRecord(client kubernetes.Interface, pod *corev1.Pod) (*EvictionState, error) {
+	name := statefulSetName(pod)
+	if name == "" {
+		return nil, nil
+	}
+	statefulSet, err := client.AppsV1().StatefulSets(pod.Namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get statefulset %s/%s: %v", pod.Namespace, name, err)
+	}
+	data, ok := statefulSet.Annotations[evictionRecordPrefix+pod.Name]
+	if !ok {
+		return nil, nil
+	}
+	state := &EvictionState{}
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil, fmt.Errorf("failed to read eviction record of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	return state, nil
+}
+
+// setEvictionRecord stores the eviction state on the StatefulSet of the pod, or removes it if state is nil.
+func setEvictionRecord(client kubernetes.Interface, pod *corev1.Pod, state *EvictionState) error {
+	name := statefulSetName(pod)
+	if name == "" {
+		if state != nil {
+			log.Warnf("Pod %s/%s is not owned by a statefulset, the eviction cannot be resumed after the pod is deleted", pod.Namespace, pod.Name)
+		}
+		return nil
+	}
+	value, err := stateValue(state)
+	if err != nil {
+		return fmt.Errorf("failed to serialize eviction state of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	patch, err := annotationPatch(evictionRecordPrefix+pod.Name, value)
+	if err != nil {
+		return err
+	}
+	_, err = client.AppsV1().StatefulSets(pod.Namespace).Patch(name, types.MergePatchType, patch)
+	if errors.IsNotFound(err) && state == nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update eviction record of pod %s/%s on statefulset %s: %v", pod.Namespace, pod.Name, name, err)
+	}
+	return nil
+}
+
+// resumeEviction continues an eviction that is in progress for the pod. It returns false if there is none.
+func resumeEviction(client kubernetes.Interface, options Options, pod *corev1.Pod) (bool, error) {
+	state, err := getEvictionState(pod)
+	if err != nil {
+		return false, err
+	}
+	if state != nil && pod.DeletionTimestamp != nil {
+		// The evicted pod is being deleted, the eviction continues with its replacement
+		return true, nil
+	}
+
+	if state == nil {
+		if pod.DeletionTimestamp != nil {
+			return false, nil
+		}
+		record, err := getEvictionRecord(client, pod)
+		if err != nil {
+			return false, err
+		}
+		if record == nil {
+			return false, nil
+		}
+		if record.PodUID == pod.UID {
+			// The evicted pod lost its annotation, continue with the recorded phase
+			state = record
+		} else {
+			if record.Phase == PhaseMigrate {
+				log.Warnf("Pod %s/%s was replaced before the migration of its volumes was recorded as completed", pod.Namespace, pod.Name)
+			}
+			log.Printf("Pod %s/%s is the replacement of evicted pod %s", pod.Namespace, pod.Name, record.PodUID)
+			state = record
+			state.PodUID = pod.UID
+			if state.Phase == PhaseMigrate {
+				state.Phase = PhaseWaitReplacement
+			}
+		}
+		if err := setEvictionState(client, pod, state); err != nil {
+			return true, err
+		}
+		if err := setEvictionRecord(client, pod, nil); err != nil {
+			return true, err
+		}
+	}
+
+	return true, runEviction(client, options, pod, state)
+}
+
+// startEviction starts the eviction of a pod whose eviction label is set.
+func startEviction(client kubernetes.Interface, options Options, pod *corev1.Pod, decision policy.Decision) error {
+	pvcs, pvs, err := volumeNames(client, pod)
+	if err != nil {
+		return err
+	}
+	state := &EvictionState{
+		Phase:        PhaseCordon,
+		Node:         pod.Spec.NodeName,
+		PodUID:       pod.UID,
+		Mode:         options.EvictionMode,
+		Decommission: options.Decommission,
+		StartedAt:    metav1.Now(),
+		Trigger:      decision.Policy,
+		Reason:       decision.Reason,
+		PVCs:         pvcs,
+		PVs:          pvs,
+	}
+	if state.Mode == EvictionModeSnapshot && !options.Snapshotter.Supported() {
+		log.Printf("Snapshots are not supported, falling back to clean start of pod %s/%s", pod.Namespace, pod.Name)
+		state.Mode = EvictionModeWipe
+	}
+	log.Printf("Starting eviction of pod %s/%s from node '%s' (mode: %s, decommission: %v)", pod.Namespace, pod.Name, state.Node, state.Mode, state.Decommission)
+	if err := setEvictionState(client, pod, state); err != nil {
+		return err
+	}
+	options.Gate.Started(pod)
+	announce(options, pod, state.historyEntry(pod, ""))
+	return runEviction(client, options, pod, state)
+}
+
+// runEviction executes the phases of an eviction, starting with the current phase of the state. The state is
+// persisted after every completed phase, so an eviction can be resumed after a restart of the controller.
+// A failed phase is retried, and only recorded in the recovery history once the eviction is abandoned.
+func runEviction(client kubernetes.Interface, options Options, pod *corev1.Pod, state *EvictionState) error {
+	phase := state.Phase
+	err := runEvictionPhases(client, options, pod, state)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*RequeueError); ok {
+		return err
+	}
+	if !options.FinalAttempt {
+		log.Printf("ERROR: Eviction of pod %s/%s failed in phase %s, retrying: %v", pod.Namespace, pod.Name, phase, err)
+		return err
+	}
+	if state.Failed {
+		log.Printf("ERROR: Eviction of pod %s/%s failed in phase %s again: %v", pod.Namespace, pod.Name, phase, err)
+		return err
+	}
+	state.Failed = true
+	if err := setEvictionState(client, pod, state); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+	entry := state.historyEntry(pod, history.OutcomeFailed)
+	entry.Error = fmt.Sprintf("phase %s: %v", phase, err)
+	record(options, pod, entry)
+	return err
+}
+
+func (s *EvictionState) historyEntry(pod *corev1.Pod, outcome string) history.Entry {
+	return history.Entry{
+		Time:     s.StartedAt.Time,
+		Pod:      pod.Name,
+		Node:     s.Node,
+		Trigger:  s.Trigger,
+		Reason:   s.Reason,
+		Mode:     s.Mode,
+		PVCs:     s.PVCs,
+		PVs:      s.PVs,
+		Outcome:  outcome,
+		Duration: time.Since(s.StartedAt.Time).Round(time.Second).String(),
+	}
+}
+
+func runEvictionPhases(client kubernetes.Interface, options Options, pod *corev1.Pod, state *EvictionState) error {
+	for {
+		log.Printf("Eviction of pod %s/%s is in phase %s", pod.Namespace, pod.Name, state.Phase)
+		switch state.Phase {
+		case PhaseCordon:
+			if err := cordonNode(client, pod, state.Node); err != nil {
+				return err
+			}
+			state.Phase = PhaseDrain
+		case PhaseDrain:
+			if err := drainNode(client, options, pod, state.Decommission); err != nil {
+				return err
+			}
+			state.Phase = PhaseMigrate
+		case PhaseMigrate:
+			return migrateVolumes(client, options, pod, state)
+		case PhaseWaitReplacement:
+			if reason := replacementPending(options, pod); reason != "" {
+				return &RequeueError{After: replacementPollInterval, Reason: reason}
+			}
+			state.Phase = PhaseCleanup
+		case PhaseCleanup:
+			return cleanupEviction(client, options, pod, state)
+		default:
+			return fmt.Errorf("unknown eviction phase '%s' of pod %s/%s", state.Phase, pod.Namespace, pod.Name)
+		}
+		state.Failed = false
+		if err := setEvictionState(client, pod, state); err != nil {
+			return err
+		}
+	}
+}
+
+// replacementPending returns why the replacement pod is not up and normal yet, or an empty string once it is.
+func replacementPending(options Options, pod *corev1.Pod) string {
+	if !isPodReady(pod) {
+		return fmt.Sprintf("waiting for replacement pod %s/%s to be ready", pod.Namespace, pod.Name)
+	}
+	if options.Executor == nil {
+		return ""
+	}
+	state, err := cassandra.State(options.Executor, pod)
+	if err != nil {
+		return fmt.Sprintf("waiting for replacement pod %s/%s to join the ring: %v", pod.Namespace, pod.Name, err)
+	}
+	if state != "UN" {
+		return fmt.Sprintf("waiting for replacement pod %s/%s to be up and normal, its node is %s", pod.Namespace, pod.Name, state)
+	}
+	return ""
+}
+
+func podKey(pod *corev1.Pod) string {
+	return fmt.Sprintf("%s.%s", pod.Namespace, pod.Name)
+}
+
+// cordonNode sets the cordon label on the node, so the replacement pod is scheduled to a different node. The pod
+// is recorded on the node, so the label is only removed once all evictions that set it are completed. A cordon
+// label that was set manually is left untouched.
+func cordonNode(client kubernetes.Interface, pod *corev1.Pod, nodeName string) error {
+	if nodeName == "" {
+		log.Printf("Pod %s/%s is not scheduled to a node, nothing to cordon", pod.Namespace, pod.Name)
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := client.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			log.Printf("Node %s of pod %s/%s does not exist anymore, nothing to cordon", nodeName, pod.Namespace, pod.Name)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get node %s: %v", nodeName, err)
+		}
+		owners := splitOwners(node.Annotations[CordonedByAnnotation])
+		if _, ok := node.Labels[CordonLabel]; ok && len(owners) == 0 {
+			log.Printf("Node %s is already cordoned", nodeName)
+			return nil
+		}
+		if containsString(owners, podKey(pod)) {
+			return nil
+		}
+		if node.Labels == nil {
+			node.Labels = map[string]string{}
+		}
+		if node.Annotations == nil {
+			node.Annotations = map[string]string{}
+		}
+		node.Labels[CordonLabel] = "true"
+		node.Annotations[CordonedByAnnotation] = strings.Join(append(owners, podKey(pod)), ",")
+		if _, err := client.CoreV1().Nodes().Update(node); err != nil {
+			return err
+		}
+		log.Printf("Cordoned node %s for eviction of pod %s/%s", nodeName, pod.Namespace, pod.Name)
+		return nil
+	})
+}
+
+// uncordonNode removes the pod from the cordon owners of the node, and the cordon label once no eviction needs it.
+func uncordonNode(client kubernetes.Interface, pod *corev1.Pod, nodeName string) error {
+	if nodeName == "" {
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := client.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get node %s: %v", nodeName, err)
+		}
+		owners := splitOwners(node.Annotations[CordonedByAnnotation])
+		if !containsString(owners, podKey(pod)) {
+			return nil
+		}
+		remaining := make([]string, 0, len(owners))
+		for _, owner := range owners {
+			if owner != podKey(pod) {
+				remaining = append(remaining, owner)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(node.Labels, CordonLabel)
+			delete(node.Annotations, CordonedByAnnotation)
+		} else {
+			node.Annotations[CordonedByAnnotation] = strings.Join(remaining, ",")
+		}
+		if _, err := client.CoreV1().Nodes().Update(node); err != nil {
+			return err
+		}
+		if len(remaining) == 0 {
+			log.Printf("Removed cordon label from node %s", nodeName)
+		}
+		return nil
+	})
+}
+
+func splitOwners(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// drainNode drains the Cassandra node of the pod. With decommission, the node streams its data to the other nodes
+// and leaves the ring, and its entry is removed from the topology configmap so the replacement joins as a new node.
+func drainNode(client kubernetes.Interface, options Options, pod *corev1.Pod, decommission bool) error {
+	if pod.Status.Phase != corev1.PodRunning || options.Executor == nil {
+		log.Printf("Pod %s/%s is not running, skipping drain", pod.Namespace, pod.Name)
+		return nil
+	}
+	if !decommission {
+		if err := cassandra.Drain(options.Executor, pod); err != nil {
+			return fmt.Errorf("failed to drain pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+		return nil
+	}
+	if err := cassandra.Decommission(options.Executor, pod); err != nil {
+		return fmt.Errorf("failed to decommission pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	return removeFromTopology(client, pod)
+}
+
+// removeFromTopology deletes the IP of the pod from the topology configmap used by the bootstrap of the node pods.
+func removeFromTopology(client kubernetes.Interface, pod *corev1.Pod) error {
+	name := podEnv(pod, topologyConfigMapEnv)
+	if name == "" {
+		log.Warnf("Pod %s/%s has no topology configmap", pod.Namespace, pod.Name)
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := client.CoreV1().ConfigMaps(pod.Namespace).Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get topology configmap %s/%s: %v", pod.Namespace, name, err)
+		}
+		if _, ok := cm.Data[pod.Name]; !ok {
+			return nil
+		}
+		delete(cm.Data, pod.Name)
+		if _, err := client.CoreV1().ConfigMaps(pod.Namespace).Update(cm); err != nil {
+			return err
+		}
+		log.Printf("Removed pod %s from topology configmap %s/%s", pod.Name, pod.Namespace, name)
+		return nil
+	})
+}
+
+func podEnv(pod *corev1.Pod, name string) string {
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		for _, env := range container.Env {
+			if env.Name == name {
+				return env.Value
+			}
+		}
+	}
+	return ""
+}
+
+// migrateVolumes records the eviction on the StatefulSet, then wipes or snapshots the volumes and deletes the pod.
+func migrateVolumes(client kubernetes.Interface, options Options, pod *corev1.Pod, state *EvictionState) error {
+	if err := setEvictionRecord(client, pod, state); err != nil {
+		return err
+	}
+	// A decommissioned node has left the ring, its replacement joins as a new node
+	if !state.Decommission {
+		if err := markReplacement(client, options, pod, state.Reason); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if state.Mode == EvictionModeSnapshot && options.Snapshotter.Supported() {
+		err = snapshotStartPod(client, options.Snapshotter, pod)
+	} else {
+		err = cleanStartPod(client, pod)
+	}
+	if err != nil {
+		return err
+	}
+
+	next := *state
+	next.Phase = PhaseWaitReplacement
+	next.Failed = false
+	return setEvictionRecord(client, pod, &next)
+}
+
+// cleanupEviction completes the eviction of the replacement pod.
+func cleanupEviction(client kubernetes.Interface, options Options, pod *corev1.Pod, state *EvictionState) error {
+	if err := uncordonNode(client, pod, state.Node); err != nil {
+		return fmt.Errorf("failed to remove cordon label from node %s: %v", state.Node, err)
+	}
+	if _, ok := pod.Labels[options.EvictionLabel]; ok && options.EvictionLabel != "" {
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": map[string]interface{}{options.EvictionLabel: nil},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := client.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, patch); err != nil {
+			return fmt.Errorf("failed to remove eviction label from pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+	}
+	if err := setEvictionRecord(client, pod, nil); err != nil {
+		return err
+	}
+	if err := setEvictionState(client, pod, nil); err != nil {
+		return err
+	}
+	log.Printf("Eviction of pod %s/%s from node '%s' completed after %v", pod.Namespace, pod.Name, state.Node, time.Since(state.StartedAt.Time).Round(time.Second))
+	record(options, pod, state.historyEntry(pod, history.OutcomeSucceeded))
+	return nil
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
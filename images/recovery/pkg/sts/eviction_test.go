@@ -0,0 +1,251 @@
+package sts
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/cassandra"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/policy"
+)
+
+func TestGetEvictionState(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cassandra-node-0"}}
+	state, err := getEvictionState(pod)
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+
+	data, err := json.Marshal(EvictionState{Phase: PhaseDrain, Node: "node-1", PodUID: "uid", Mode: EvictionModeWipe})
+	assert.NoError(t, err)
+	pod.Annotations = map[string]string{EvictionAnnotation: string(data)}
+	state, err = getEvictionState(pod)
+	assert.NoError(t, err)
+	assert.Equal(t, PhaseDrain, state.Phase)
+	assert.Equal(t, "node-1", state.Node)
+
+	pod.Annotations[EvictionAnnotation] = "{invalid"
+	_, err = getEvictionState(pod)
+	assert.Error(t, err)
+}
+
+func TestSplitOwners(t *testing.T) {
+	assert.Empty(t, splitOwners(""))
+	assert.Equal(t, []string{"ns.cassandra-node-0", "ns.cassandra-node-1"}, splitOwners("ns.cassandra-node-0,ns.cassandra-node-1"))
+}
+
+func TestPodEnv(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Env: []corev1.EnvVar{{Name: topologyConfigMapEnv, Value: "cassandra-topology-lock"}}}},
+	}}
+	assert.Equal(t, "cassandra-topology-lock", podEnv(pod, topologyConfigMapEnv))
+	assert.Equal(t, "", podEnv(pod, "OTHER"))
+}
+
+func TestIsPodReady(t *testing.T) {
+	pod := &corev1.Pod{}
+	assert.False(t, isPodReady(pod))
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	assert.True(t, isPodReady(pod))
+}
+
+// testExecutor runs the scripts of the Cassandra container by returning canned results.
+type testExecutor struct {
+	// status is the output of the status script.
+	status string
+	// fail makes the script fail with the error.
+	fail map[string]error
+	runs map[string]int
+}
+
+func newTestExecutor() *testExecutor {
+	return &testExecutor{fail: map[string]error{}, runs: map[string]int{}}
+}
+
+func (e *testExecutor) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	script := command[len(command)-1]
+	e.runs[script]++
+	if err := e.fail[script]; err != nil {
+		return "", err
+	}
+	if script == cassandra.StatusScript {
+		return e.status, nil
+	}
+	return "", nil
+}
+
+// countActions returns how often the fake API server received the verb on the resource.
+func countActions(client *fake.Clientset, verb, resource string) int {
+	count := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == verb && action.GetResource().Resource == resource {
+			count++
+		}
+	}
+	return count
+}
+
+// failOnce makes the next request with the verb on the resource fail.
+func failOnce(client *fake.Clientset, verb, resource string) {
+	failed := false
+	client.PrependReactor(verb, resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failed {
+			return false, nil, nil
+		}
+		failed = true
+		return true, nil, fmt.Errorf("injected %s %s failure", verb, resource)
+	})
+}
+
+func evictionPhase(t *testing.T, client kubernetes.Interface) Phase {
+	pod, err := client.CoreV1().Pods(testNamespace).Get(testPod, metav1.GetOptions{})
+	assert.NoError(t, err)
+	state, err := getEvictionState(pod)
+	assert.NoError(t, err)
+	if state == nil {
+		return ""
+	}
+	return state.Phase
+}
+
+// createReplacement creates the replacement pod of the evicted pod, ready or not.
+func createReplacement(t *testing.T, client kubernetes.Interface, ready bool) {
+	replacement := testPodWith("pod-2", false)
+	replacement.Spec.NodeName = "node-2"
+	replacement.Status.PodIP = "10.0.0.2"
+	if !ready {
+		replacement.Status.Conditions = nil
+	}
+	_, err := client.CoreV1().Pods(testNamespace).Create(replacement)
+	assert.NoError(t, err)
+}
+
+func setReady(t *testing.T, client kubernetes.Interface) {
+	pod, err := client.CoreV1().Pods(testNamespace).Get(testPod, metav1.GetOptions{})
+	assert.NoError(t, err)
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	_, err = client.CoreV1().Pods(testNamespace).UpdateStatus(pod)
+	assert.NoError(t, err)
+}
+
+func newEvictionScenario() (*fake.Clientset, *testExecutor) {
+	pod := testPodWith("pod-1", false)
+	pod.Labels[testEvictionKey] = "true"
+	client := fake.NewSimpleClientset(testStatefulSet(), pod, testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", testNode), testNodeObject(), testTopology())
+	executor := newTestExecutor()
+	executor.status = "UN  10.0.0.2  1.2 MiB  256  ?  2f3c9a4e-1b2c-4d5e-8f90-123456789abc  rack1"
+	return client, executor
+}
+
+func TestEvictionResume_afterCordon(t *testing.T) {
+	client, executor := newEvictionScenario()
+	policies := testPolicies(t, policy.Config{})
+	options := testOptions(client)
+	options.Executor = executor
+
+	executor.fail[cassandra.DrainScript] = fmt.Errorf("nodetool drain failed")
+	assert.Error(t, process(t, client, policies, options))
+	assert.Equal(t, PhaseDrain, evictionPhase(t, client))
+	assert.Empty(t, historyEntries(t, client), "a failure that is retried is not recorded")
+
+	options.FinalAttempt = true
+	assert.Error(t, process(t, client, policies, options))
+	entries := historyEntries(t, client)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, history.OutcomeFailed, entries[0].Outcome)
+		assert.Equal(t, "phase Drain: failed to drain pod default/cassandra-node-0: nodetool drain failed", entries[0].Error)
+	}
+	// The final attempts of later reconciliations do not record the failure again
+	assert.Error(t, process(t, client, policies, options))
+	assert.Len(t, historyEntries(t, client), 1)
+
+	options.FinalAttempt = false
+	delete(executor.fail, cassandra.DrainScript)
+	assert.NoError(t, process(t, client, policies, options))
+	assert.False(t, podExists(t, client, "pod-1"))
+	assert.Equal(t, 1, countActions(client, "update", "nodes"), "the node is cordoned once")
+	assert.Equal(t, 4, executor.runs[cassandra.DrainScript])
+}
+
+func TestEvictionResume_afterDrain(t *testing.T) {
+	client, executor := newEvictionScenario()
+	policies := testPolicies(t, policy.Config{})
+	options := testOptions(client)
+	options.Executor = executor
+
+	failOnce(client, "delete", "persistentvolumeclaims")
+	assert.Error(t, process(t, client, policies, options))
+	assert.Equal(t, PhaseMigrate, evictionPhase(t, client))
+	assert.True(t, podExists(t, client, "pod-1"))
+
+	assert.NoError(t, process(t, client, policies, options))
+	assert.False(t, podExists(t, client, "pod-1"))
+	assert.False(t, pvcExists(t, client))
+	assert.Equal(t, 1, countActions(client, "update", "nodes"), "the node is cordoned once")
+	assert.Equal(t, 1, executor.runs[cassandra.DrainScript], "the node is drained once")
+}
+
+func TestEvictionResume_afterMigrate(t *testing.T) {
+	client, executor := newEvictionScenario()
+	policies := testPolicies(t, policy.Config{})
+	options := testOptions(client)
+	options.Executor = executor
+
+	assert.NoError(t, process(t, client, policies, options))
+	assert.False(t, podExists(t, client, "pod-1"))
+
+	createReplacement(t, client, false)
+	err := process(t, client, policies, options)
+	assert.IsType(t, &RequeueError{}, err, "the eviction should wait for the replacement to be ready")
+	assert.Equal(t, PhaseWaitReplacement, evictionPhase(t, client))
+
+	// The pod is ready while its node is still joining the ring
+	setReady(t, client)
+	executor.status = "UJ  10.0.0.2  1.2 MiB  256  ?  2f3c9a4e-1b2c-4d5e-8f90-123456789abc  rack1"
+	err = process(t, client, policies, options)
+	assert.IsType(t, &RequeueError{}, err, "the eviction should wait for the replacement to be up and normal")
+	assert.Equal(t, PhaseWaitReplacement, evictionPhase(t, client))
+
+	executor.status = "UN  10.0.0.2  1.2 MiB  256  ?  2f3c9a4e-1b2c-4d5e-8f90-123456789abc  rack1"
+	assert.NoError(t, process(t, client, policies, options))
+	assert.Equal(t, Phase(""), evictionPhase(t, client))
+	assert.Equal(t, 1, executor.runs[cassandra.DrainScript], "the node is drained once")
+	assert.Equal(t, 1, countActions(client, "delete", "persistentvolumeclaims"), "the volumes are migrated once")
+	assert.Equal(t, 2, countActions(client, "update", "nodes"), "the node is cordoned and uncordoned once")
+}
+
+func TestEvictionResume_afterWaitReplacement(t *testing.T) {
+	client, executor := newEvictionScenario()
+	policies := testPolicies(t, policy.Config{})
+	options := testOptions(client)
+	options.Executor = executor
+
+	assert.NoError(t, process(t, client, policies, options))
+	createReplacement(t, client, true)
+
+	failOnce(client, "update", "nodes")
+	assert.Error(t, process(t, client, policies, options))
+	assert.Equal(t, PhaseCleanup, evictionPhase(t, client))
+	assert.Equal(t, 1, executor.runs[cassandra.StatusScript])
+
+	assert.NoError(t, process(t, client, policies, options))
+	assert.Equal(t, Phase(""), evictionPhase(t, client))
+	assert.Equal(t, 1, executor.runs[cassandra.StatusScript], "the replacement is checked once")
+	assert.Equal(t, 1, executor.runs[cassandra.DrainScript], "the node is drained once")
+	assert.Equal(t, 1, countActions(client, "delete", "persistentvolumeclaims"), "the volumes are migrated once")
+	node, err := client.CoreV1().Nodes().Get(testNode, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, node.Labels, CordonLabel)
+	entries := historyEntries(t, client)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, history.OutcomeSucceeded, entries[0].Outcome)
+	}
+}
@@ -0,0 +1,144 @@
+package sts
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/cassandra"
+)
+
+// ReplacementKeyPrefix is the prefix of the topology configmap keys that mark a pod whose Cassandra node has to be
+// replaced. The bootstrap of the new pod starts the node with replace_address, even if the pod got the same IP,
+// and removes the marker once the node has joined the ring.
+const ReplacementKeyPrefix = "replace."
+
+// Replacement is the pending replacement of the Cassandra node of a pod.
+type Replacement struct {
+	// Address is the last known address of the node that is replaced.
+	Address string `json:"address"`
+	// HostID of the node that is replaced, empty if it could not be determined.
+	HostID      string      `json:"hostID,omitempty"`
+	RequestedAt metav1.Time `json:"requestedAt"`
+	Reason      string      `json:"reason,omitempty"`
+}
+
+func replacementKey(pod *corev1.Pod) string {
+	return ReplacementKeyPrefix + pod.Name
+}
+
+// markReplacement records in the topology configmap that the Cassandra node of the pod is going to lose its data
+// and has to be replaced by the next pod.
+func markReplacement(client kubernetes.Interface, options Options, pod *corev1.Pod, reason string) error {
+	name := podEnv(pod, topologyConfigMapEnv)
+	if name == "" {
+		log.Warnf("Pod %s/%s has no topology configmap, can not mark it for replacement", pod.Namespace, pod.Name)
+		return nil
+	}
+	cm, err := client.CoreV1().ConfigMaps(pod.Namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		log.Warnf("Topology configmap %s/%s does not exist, can not mark pod %s for replacement", pod.Namespace, name, pod.Name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get topology configmap %s/%s: %v", pod.Namespace, name, err)
+	}
+	address := cm.Data[pod.Name]
+	if address == "" {
+		log.Printf("Pod %s/%s has never joined the ring, no replacement needed", pod.Namespace, pod.Name)
+		return nil
+	}
+	if existing, err := parseReplacement(cm.Data[replacementKey(pod)]); err == nil && existing != nil && existing.Address == address {
+		log.Printf("Pod %s/%s is already marked for replacement of node %s", pod.Namespace, pod.Name, address)
+		return nil
+	}
+
+	replacement := Replacement{
+		Address:     address,
+		RequestedAt: metav1.Now(),
+		Reason:      reason,
+	}
+	replacement.HostID, err = lookupHostID(client, options.Executor, pod, address)
+	if err != nil {
+		log.Warnf("Failed to look up the host ID of node %s of pod %s/%s: %v", address, pod.Namespace, pod.Name, err)
+	}
+	value, err := json.Marshal(replacement)
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := client.CoreV1().ConfigMaps(pod.Namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get topology configmap %s/%s: %v", pod.Namespace, name, err)
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[replacementKey(pod)] = string(value)
+		if _, err := client.CoreV1().ConfigMaps(pod.Namespace).Update(cm); err != nil {
+			return err
+		}
+		log.Printf("Marked pod %s/%s in topology configmap %s for replacement of node %s (host ID: %s)", pod.Namespace, pod.Name, name, address, replacement.HostID)
+		return nil
+	})
+}
+
+func parseReplacement(value string) (*Replacement, error) {
+	if value == "" {
+		return nil, nil
+	}
+	replacement := &Replacement{}
+	if err := json.Unmarshal([]byte(value), replacement); err != nil {
+		return nil, fmt.Errorf("invalid replacement marker: %v", err)
+	}
+	return replacement, nil
+}
+
+// lookupHostID asks a ready peer of the pod for the host ID of the node with the address.
+func lookupHostID(client kubernetes.Interface, executor cassandra.Executor, pod *corev1.Pod, address string) (string, error) {
+	if executor == nil {
+		return "", fmt.Errorf("no executor configured")
+	}
+	peer, err := readyPeer(client, pod)
+	if err != nil {
+		return "", err
+	}
+	if peer == nil {
+		return "", fmt.Errorf("no ready peer found")
+	}
+	return cassandra.HostID(executor, peer, address)
+}
+
+// readyPeer returns another ready pod of the StatefulSet of the pod, or nil if there is none.
+func readyPeer(client kubernetes.Interface, pod *corev1.Pod) (*corev1.Pod, error) {
+	stsName := statefulSetName(pod)
+	if stsName == "" {
+		return nil, nil
+	}
+	statefulSet, err := client.AppsV1().StatefulSets(pod.Namespace).Get(stsName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get statefulset %s/%s: %v", pod.Namespace, stsName, err)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(statefulSet.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector of statefulset %s/%s: %v", pod.Namespace, stsName, err)
+	}
+	pods, err := client.CoreV1().Pods(pod.Namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods of statefulset %s/%s: %v", pod.Namespace, stsName, err)
+	}
+	for i := range pods.Items {
+		peer := &pods.Items[i]
+		if peer.Name != pod.Name && peer.DeletionTimestamp == nil && peer.Status.Phase == corev1.PodRunning && isPodReady(peer) {
+			return peer, nil
+		}
+	}
+	return nil, nil
+}
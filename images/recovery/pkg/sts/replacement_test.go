@@ -0,0 +1,28 @@
+package sts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseReplacement(t *testing.T) {
+	replacement, err := parseReplacement(`{"address":"10.0.0.1","hostID":"0f2d8c61-98e0-4bb1-9f8e-0a0c43c8d9f1","requestedAt":"2020-05-01T10:00:00Z"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", replacement.Address)
+	assert.Equal(t, "0f2d8c61-98e0-4bb1-9f8e-0a0c43c8d9f1", replacement.HostID)
+
+	replacement, err = parseReplacement("")
+	assert.NoError(t, err)
+	assert.Nil(t, replacement)
+
+	_, err = parseReplacement("10.0.0.1")
+	assert.Error(t, err)
+}
+
+func TestReplacementKey(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cassandra-node-1"}}
+	assert.Equal(t, "replace.cassandra-node-1", replacementKey(pod))
+}
@@ -0,0 +1,419 @@
+package sts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gate"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gc"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/policy"
+)
+
+// The scenarios run the recovery of a single pod against a fake API server. The pod "cassandra-node-0" of the
+// StatefulSet "cassandra-node" uses the PVC "var-lib-cassandra-cassandra-node-0".
+
+const (
+	testNamespace   = "default"
+	testPod         = "cassandra-node-0"
+	testClaim       = "var-lib-cassandra-cassandra-node-0"
+	testTopologyCM  = "cassandra-topology-lock"
+	testHistoryCM   = "cassandra-recovery-history"
+	testNode        = "node-1"
+	testEvictionKey = "kudo-cassandra/evict"
+)
+
+func testStatefulSet() *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "cassandra-node", Namespace: testNamespace, UID: "sts-uid"},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "cassandra"}},
+		},
+	}
+}
+
+// testPodWith returns the Cassandra pod with the given UID. An unschedulable pod is pending and not assigned to a
+// node, a schedulable pod runs on testNode and is ready.
+func testPodWith(uid types.UID, unschedulable bool) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testPod,
+			Namespace: testNamespace,
+			UID:       uid,
+			Labels:    map[string]string{"app": "cassandra"},
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "cassandra-node", UID: "sts-uid"},
+			},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{
+				Name: "bootstrap",
+				Env:  []corev1.EnvVar{{Name: topologyConfigMapEnv, Value: testTopologyCM}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "var-lib-cassandra",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: testClaim},
+				},
+			}},
+		},
+	}
+	if unschedulable {
+		pod.Status = corev1.PodStatus{
+			Phase: corev1.PodPending,
+			Conditions: []corev1.PodCondition{{
+				Type:   corev1.PodScheduled,
+				Status: corev1.ConditionFalse,
+				Reason: corev1.PodReasonUnschedulable,
+			}},
+		}
+	} else {
+		pod.Spec.NodeName = testNode
+		pod.Status = corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		}
+	}
+	return pod
+}
+
+func testPVC(volumeName string, phase corev1.PersistentVolumeClaimPhase) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: testClaim, Namespace: testNamespace},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: volumeName},
+		Status:     corev1.PersistentVolumeClaimStatus{Phase: phase},
+	}
+}
+
+// testPV returns a PV bound to the test PVC. With a node name, it is a local PV that is bound to the node.
+func testPV(name, nodeName string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			ClaimRef: &corev1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: testNamespace, Name: testClaim},
+		},
+		Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeBound},
+	}
+	if nodeName != "" {
+		pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+			Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{
+					Key:      corev1.LabelHostname,
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   []string{nodeName},
+				}},
+			}}},
+		}
+	}
+	return pv
+}
+
+func testNodeObject() *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNode}}
+}
+
+func testTopology() *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: testTopologyCM, Namespace: testNamespace},
+		Data:       map[string]string{testPod: "10.0.0.1"},
+	}
+}
+
+func testPolicies(t *testing.T, config policy.Config) *policy.Set {
+	policies, err := policy.NewSet(config, map[string]policy.Parameters{
+		policy.EvictionLabelPolicy: {policy.ParamLabel: testEvictionKey},
+	})
+	assert.NoError(t, err)
+	return policies
+}
+
+func testOptions(client kubernetes.Interface) Options {
+	return Options{
+		EvictionMode:  EvictionModeWipe,
+		EvictionLabel: testEvictionKey,
+		History:       history.NewRecorder(client, testHistoryCM, 0),
+	}
+}
+
+// process runs the recovery for the current state of the pod in the fake API server.
+func process(t *testing.T, client kubernetes.Interface, policies *policy.Set, options Options) error {
+	pod, err := client.CoreV1().Pods(testNamespace).Get(testPod, metav1.GetOptions{})
+	assert.NoError(t, err)
+	return Process(client, policies, options, pod)
+}
+
+func podExists(t *testing.T, client kubernetes.Interface, uid types.UID) bool {
+	pod, err := client.CoreV1().Pods(testNamespace).Get(testPod, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false
+	}
+	assert.NoError(t, err)
+	return pod.UID == uid
+}
+
+func pvcExists(t *testing.T, client kubernetes.Interface) bool {
+	_, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(testClaim, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false
+	}
+	assert.NoError(t, err)
+	return true
+}
+
+func historyEntries(t *testing.T, client kubernetes.Interface) []history.Entry {
+	entries, err := history.NewRecorder(client, testHistoryCM, 0).Load(testNamespace)
+	assert.NoError(t, err)
+	return entries
+}
+
+func TestProcess_pvcMissing(t *testing.T) {
+	client := fake.NewSimpleClientset(testStatefulSet(), testPodWith("pod-1", true), testTopology())
+
+	err := process(t, client, testPolicies(t, policy.Config{}), testOptions(client))
+	assert.NoError(t, err)
+	assert.False(t, podExists(t, client, "pod-1"), "the pod should be deleted for rescheduling")
+
+	// The next pod replaces the node, even if it gets the same IP
+	cm, err := client.CoreV1().ConfigMaps(testNamespace).Get(testTopologyCM, metav1.GetOptions{})
+	assert.NoError(t, err)
+	replacement, err := parseReplacement(cm.Data[ReplacementKeyPrefix+testPod])
+	assert.NoError(t, err)
+	if assert.NotNil(t, replacement) {
+		assert.Equal(t, "10.0.0.1", replacement.Address)
+	}
+
+	entries := historyEntries(t, client)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, policy.PVCLostPolicy, entries[0].Trigger)
+		assert.Equal(t, history.OutcomeSucceeded, entries[0].Outcome)
+	}
+}
+
+func TestProcess_pvcPending(t *testing.T) {
+	client := fake.NewSimpleClientset(testStatefulSet(), testPodWith("pod-1", true), testPVC("", corev1.ClaimPending))
+	options := testOptions(client)
+
+	// A pending PVC may still be provisioned
+	err := process(t, client, testPolicies(t, policy.Config{}), options)
+	assert.NoError(t, err)
+	assert.True(t, podExists(t, client, "pod-1"))
+	assert.True(t, pvcExists(t, client))
+	assert.Empty(t, historyEntries(t, client))
+
+	policies := testPolicies(t, policy.Config{Policies: []policy.PolicyConfig{{
+		Name:       policy.PVCLostPolicy,
+		Parameters: policy.Parameters{policy.ParamRecoverPendingPVC: "true"},
+	}}})
+	err = process(t, client, policies, options)
+	assert.NoError(t, err)
+	assert.False(t, podExists(t, client, "pod-1"))
+	assert.False(t, pvcExists(t, client))
+	assert.Len(t, historyEntries(t, client), 1)
+}
+
+func TestProcess_pvWithoutAffinity(t *testing.T) {
+	client := fake.NewSimpleClientset(testStatefulSet(), testPodWith("pod-1", true), testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", ""))
+
+	err := process(t, client, testPolicies(t, policy.Config{}), testOptions(client))
+	assert.NoError(t, err)
+	assert.True(t, podExists(t, client, "pod-1"), "a PV that is not bound to a node should not trigger a recovery")
+	assert.True(t, pvcExists(t, client))
+	pv, err := client.CoreV1().PersistentVolumes().Get("pv-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotNil(t, pv.Spec.ClaimRef)
+	assert.Empty(t, historyEntries(t, client))
+}
+
+func TestProcess_nodeAvailable(t *testing.T) {
+	client := fake.NewSimpleClientset(testStatefulSet(), testPodWith("pod-1", true), testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", testNode), testNodeObject())
+
+	err := process(t, client, testPolicies(t, policy.Config{}), testOptions(client))
+	assert.NoError(t, err)
+	assert.True(t, podExists(t, client, "pod-1"))
+	assert.True(t, pvcExists(t, client))
+}
+
+func TestProcess_nodeDeleted(t *testing.T) {
+	client := fake.NewSimpleClientset(testStatefulSet(), testPodWith("pod-1", true), testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", testNode))
+
+	err := process(t, client, testPolicies(t, policy.Config{}), testOptions(client))
+	assert.NoError(t, err)
+	assert.False(t, podExists(t, client, "pod-1"))
+	assert.False(t, pvcExists(t, client))
+
+	pv, err := client.CoreV1().PersistentVolumes().Get("pv-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, pv.Spec.ClaimRef, "the PV should be detached from the deleted PVC")
+	assert.Equal(t, testNamespace+"/"+testClaim, pv.Annotations[gc.WipedClaimAnnotation])
+	assert.NotEmpty(t, pv.Annotations[gc.WipedAtAnnotation])
+
+	entries := historyEntries(t, client)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, policy.NodeDeletedPolicy, entries[0].Trigger)
+		assert.Equal(t, []string{testClaim}, entries[0].PVCs)
+		assert.Equal(t, []string{"pv-1"}, entries[0].PVs)
+	}
+}
+
+func TestProcess_wipeFailed(t *testing.T) {
+	client := fake.NewSimpleClientset(testStatefulSet(), testPodWith("pod-1", true), testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", testNode))
+	policies := testPolicies(t, policy.Config{})
+	options := testOptions(client)
+	options.Gate = gate.New(client, nil, nil, gate.RateLimit{Count: 1, Period: time.Hour}, options.History)
+
+	// A failed wipe is retried without using up the rate limit and without being recorded
+	failOnce(client, "delete", "persistentvolumeclaims")
+	assert.Error(t, process(t, client, policies, options))
+	assert.True(t, podExists(t, client, "pod-1"))
+	assert.Empty(t, historyEntries(t, client))
+	assert.Equal(t, recoveryStarted, recoveryStatus(t, client), "the recovery is announced once")
+
+	assert.NoError(t, process(t, client, policies, options))
+	assert.False(t, podExists(t, client, "pod-1"))
+	entries := historyEntries(t, client)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, history.OutcomeSucceeded, entries[0].Outcome)
+	}
+
+	// The failure of the final attempt is recorded
+	_, err := client.CoreV1().Pods(testNamespace).Create(testPodWith("pod-2", true))
+	assert.NoError(t, err)
+	options.Gate = nil
+	options.FinalAttempt = true
+	failOnce(client, "delete", "pods")
+	assert.Error(t, process(t, client, policies, options))
+	entries = historyEntries(t, client)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, history.OutcomeFailed, entries[1].Outcome)
+		assert.Contains(t, entries[1].Error, "injected delete pods failure")
+	}
+	assert.Equal(t, recoveryFailed, recoveryStatus(t, client))
+
+	// The final attempts of later reconciliations do not record the failure again
+	failOnce(client, "delete", "pods")
+	assert.Error(t, process(t, client, policies, options))
+	assert.Len(t, historyEntries(t, client), 2)
+}
+
+func recoveryStatus(t *testing.T, client kubernetes.Interface) string {
+	pod, err := client.CoreV1().Pods(testNamespace).Get(testPod, metav1.GetOptions{})
+	assert.NoError(t, err)
+	return pod.Annotations[RecoveryAnnotation]
+}
+
+func TestProcess_policyError(t *testing.T) {
+	client := fake.NewSimpleClientset(testStatefulSet(), testPodWith("pod-1", true), testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", testNode))
+	failOnce(client, "get", "nodes")
+
+	// The recovery condition can not be detected, the pod is retried
+	assert.Error(t, process(t, client, testPolicies(t, policy.Config{}), testOptions(client)))
+	assert.True(t, podExists(t, client, "pod-1"))
+
+	assert.NoError(t, process(t, client, testPolicies(t, policy.Config{}), testOptions(client)))
+	assert.False(t, podExists(t, client, "pod-1"))
+}
+
+func TestProcess_evictionLabel(t *testing.T) {
+	pod := testPodWith("pod-1", false)
+	pod.Labels[testEvictionKey] = "true"
+	client := fake.NewSimpleClientset(testStatefulSet(), pod, testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", testNode), testNodeObject(), testTopology())
+	policies := testPolicies(t, policy.Config{})
+	options := testOptions(client)
+
+	// Without an executor the drain is skipped, the eviction continues until the pod is deleted
+	err := process(t, client, policies, options)
+	assert.NoError(t, err)
+	assert.False(t, podExists(t, client, "pod-1"))
+	assert.False(t, pvcExists(t, client))
+
+	node, err := client.CoreV1().Nodes().Get(testNode, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "true", node.Labels[CordonLabel])
+	assert.Equal(t, testNamespace+"."+testPod, node.Annotations[CordonedByAnnotation])
+
+	statefulSet, err := client.AppsV1().StatefulSets(testNamespace).Get("cassandra-node", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, statefulSet.Annotations, evictionRecordPrefix+testPod)
+
+	// The StatefulSet creates the replacement pod without the eviction label
+	replacement := testPodWith("pod-2", false)
+	replacement.Spec.NodeName = "node-2"
+	replacement.Status.Conditions = nil
+	_, err = client.CoreV1().Pods(testNamespace).Create(replacement)
+	assert.NoError(t, err)
+
+	err = process(t, client, policies, options)
+	assert.IsType(t, &RequeueError{}, err, "the eviction should wait for the replacement to be ready")
+	current, err := client.CoreV1().Pods(testNamespace).Get(testPod, metav1.GetOptions{})
+	assert.NoError(t, err)
+	state, err := getEvictionState(current)
+	assert.NoError(t, err)
+	if assert.NotNil(t, state) {
+		assert.Equal(t, PhaseWaitReplacement, state.Phase)
+		assert.Equal(t, types.UID("pod-2"), state.PodUID)
+	}
+
+	current.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	_, err = client.CoreV1().Pods(testNamespace).UpdateStatus(current)
+	assert.NoError(t, err)
+
+	err = process(t, client, policies, options)
+	assert.NoError(t, err)
+	node, err = client.CoreV1().Nodes().Get(testNode, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, node.Labels, CordonLabel)
+	current, err = client.CoreV1().Pods(testNamespace).Get(testPod, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, current.Annotations, EvictionAnnotation)
+	statefulSet, err = client.AppsV1().StatefulSets(testNamespace).Get("cassandra-node", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, statefulSet.Annotations, evictionRecordPrefix+testPod)
+
+	entries := historyEntries(t, client)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, policy.EvictionLabelPolicy, entries[0].Trigger)
+		assert.Equal(t, history.OutcomeSucceeded, entries[0].Outcome)
+	}
+}
+
+func TestProcess_repeatedEvents(t *testing.T) {
+	client := fake.NewSimpleClientset(testStatefulSet(), testPodWith("pod-1", false), testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", testNode), testNodeObject())
+	policies := testPolicies(t, policy.Config{})
+	options := testOptions(client)
+
+	// A healthy pod is left alone, however often it is processed
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, process(t, client, policies, options))
+	}
+	assert.True(t, podExists(t, client, "pod-1"))
+	assert.True(t, pvcExists(t, client))
+
+	// The node is deleted and the pod can not be scheduled anymore
+	assert.NoError(t, client.CoreV1().Nodes().Delete(testNode, &metav1.DeleteOptions{}))
+	assert.NoError(t, client.CoreV1().Pods(testNamespace).Delete(testPod, &metav1.DeleteOptions{}))
+	_, err := client.CoreV1().Pods(testNamespace).Create(testPodWith("pod-2", true))
+	assert.NoError(t, err)
+	assert.NoError(t, process(t, client, policies, options))
+	assert.False(t, podExists(t, client, "pod-2"))
+
+	// The replacement pod waits for its new PVC to be provisioned
+	_, err = client.CoreV1().Pods(testNamespace).Create(testPodWith("pod-3", true))
+	assert.NoError(t, err)
+	_, err = client.CoreV1().PersistentVolumeClaims(testNamespace).Create(testPVC("", corev1.ClaimPending))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, process(t, client, policies, options))
+	}
+	assert.True(t, podExists(t, client, "pod-3"))
+	assert.True(t, pvcExists(t, client))
+	assert.Len(t, historyEntries(t, client), 1, "the pod should be recovered only once")
+}
@@ -0,0 +1,155 @@
+package sts
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/snapshot"
+)
+
+const (
+	snapshotPollInterval = 10 * time.Second
+)
+
+// snapshotStartPod takes a snapshot of every PVC of the pod, and deletes the PVCs and the pod once all snapshots
+// are ready. The PVCs are recreated from the snapshots by restoreFromSnapshots when the pod is rescheduled.
+// If a snapshot fails, the pod is clean started instead.
+func snapshotStartPod(client kubernetes.Interface, snapshotter *snapshot.Snapshotter, pod *corev1.Pod) error {
+	pvcs, err := getPVCs(client, pod)
+	if err != nil {
+		return fmt.Errorf("failed to get PVCs from pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	log.Printf("Found %d PVCs for pod %s/%s", len(pvcs), pod.Namespace, pod.Name)
+
+	for _, pvc := range pvcs {
+		if err := snapshotter.Create(pod, pvc); err != nil {
+			log.Printf("ERROR: %v, falling back to clean start", err)
+			return fallbackToCleanStart(client, snapshotter, pod, pvcs)
+		}
+	}
+
+	for _, pvc := range pvcs {
+		status, err := snapshotter.GetStatus(pvc.Namespace, pvc.Name)
+		if err != nil {
+			return err
+		}
+		if status.Error != "" {
+			log.Printf("ERROR: snapshot of PVC %s/%s failed: %s, falling back to clean start", pvc.Namespace, pvc.Name, status.Error)
+			return fallbackToCleanStart(client, snapshotter, pod, pvcs)
+		}
+		if !status.ReadyToUse {
+			return &RequeueError{
+				After:  snapshotPollInterval,
+				Reason: fmt.Sprintf("snapshot of PVC %s/%s is not ready yet", pvc.Namespace, pvc.Name),
+			}
+		}
+	}
+
+	// The PVs are not detached here: the data is preserved in the snapshots and the old volumes can be
+	// reclaimed by their reclaim policy.
+	for _, pvc := range pvcs {
+		log.Printf("Delete PVC %s/%s for pod %s/%s", pvc.Namespace, pvc.Name, pod.Namespace, pod.Name)
+		err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Delete(pvc.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+	}
+
+	log.Printf("Delete pod %s/%s for rescheduling", pod.Namespace, pod.Name)
+	err = client.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete pod %s/%s for rescheduling: %s", pod.Namespace, pod.Name, err)
+	}
+	return nil
+}
+
+func fallbackToCleanStart(client kubernetes.Interface, snapshotter *snapshot.Snapshotter, pod *corev1.Pod, pvcs []*corev1.PersistentVolumeClaim) error {
+	for _, pvc := range pvcs {
+		if err := snapshotter.Delete(pvc.Namespace, pvc.Name); err != nil {
+			log.Printf("ERROR: %v", err)
+		}
+	}
+	return cleanStartPod(client, pod)
+}
+
+// restoreFromSnapshots recreates the PVCs of a rescheduled pod from its eviction snapshots. It returns true if the
+// pod has pending eviction snapshots, in which case the recovery policies must not be evaluated for it.
+func restoreFromSnapshots(client kubernetes.Interface, snapshotter *snapshot.Snapshotter, pod *corev1.Pod) (bool, error) {
+	handled := false
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim == nil {
+			continue
+		}
+		claimName := vol.PersistentVolumeClaim.ClaimName
+		snap, err := snapshotter.Get(pod.Namespace, claimName)
+		if err != nil {
+			return false, err
+		}
+		if snap == nil || snap.GetLabels()[snapshot.PodLabel] != pod.Name {
+			continue
+		}
+
+		pvc, err := client.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(claimName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			handled = true
+			if pod.DeletionTimestamp != nil {
+				// Wait for the replacement pod before creating the PVC
+				continue
+			}
+			if err := snapshotter.Restore(snap); err != nil {
+				return true, err
+			}
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to get PVC %s/%s: %v", pod.Namespace, claimName, err)
+		}
+
+		if snapshot.IsSource(pvc, snap) {
+			if pvc.DeletionTimestamp != nil {
+				// The old PVC is still being deleted
+				handled = true
+			}
+			// Otherwise the eviction is still waiting for the snapshot
+			continue
+		}
+
+		if snapshot.IsRestoredFrom(pvc, snap) {
+			if pvc.Status.Phase == corev1.ClaimBound {
+				log.Printf("PVC %s/%s was restored from snapshot %s, eviction of pod %s completed", pvc.Namespace, pvc.Name, snap.GetName(), pod.Name)
+				if err := snapshotter.Delete(pvc.Namespace, pvc.Name); err != nil {
+					return false, err
+				}
+				continue
+			}
+			handled = true
+			continue
+		}
+
+		if pvc.Spec.VolumeName == "" {
+			// The StatefulSet controller created an empty PVC before the snapshot could be restored. It is not
+			// bound yet, so it is deleted together with the pod to retry the restore.
+			handled = true
+			log.Printf("PVC %s/%s was not created from snapshot %s, deleting it to restore the snapshot", pvc.Namespace, pvc.Name, snap.GetName())
+			if err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Delete(pvc.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				return true, fmt.Errorf("failed to delete PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+			}
+			if err := client.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				return true, fmt.Errorf("failed to delete pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			}
+			continue
+		}
+
+		log.Printf("WARN: PVC %s/%s is bound to a new volume that was not created from snapshot %s, the node will stream its data from its peers", pvc.Namespace, pvc.Name, snap.GetName())
+		if err := snapshotter.Delete(pvc.Namespace, pvc.Name); err != nil {
+			return false, err
+		}
+	}
+	return handled, nil
+}
@@ -0,0 +1,203 @@
+package sts
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/policy"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/snapshot"
+)
+
+var testSnapshotResource = schema.GroupVersionResource{Group: snapshot.Group, Version: "v1", Resource: "volumesnapshots"}
+
+// testSnapshotter returns a snapshotter for the fake cluster, which serves the VolumeSnapshot API if supported.
+func testSnapshotter(client *fake.Clientset, supported bool) (*snapshot.Snapshotter, *dynamicfake.FakeDynamicClient) {
+	if supported {
+		client.Resources = []*metav1.APIResourceList{{
+			GroupVersion: testSnapshotResource.GroupVersion().String(),
+			APIResources: []metav1.APIResource{{Name: testSnapshotResource.Resource, Kind: snapshot.Kind, Namespaced: true}},
+		}}
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	return snapshot.NewSnapshotter(client, dynamicClient, ""), dynamicClient
+}
+
+func getSnapshot(t *testing.T, dynamicClient *dynamicfake.FakeDynamicClient) *unstructured.Unstructured {
+	obj, err := dynamicClient.Resource(testSnapshotResource).Namespace(testNamespace).Get(snapshot.Name(testClaim), metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	return obj
+}
+
+func setSnapshotStatus(t *testing.T, dynamicClient *dynamicfake.FakeDynamicClient, value interface{}, fields ...string) {
+	obj := getSnapshot(t, dynamicClient)
+	if !assert.NotNil(t, obj) {
+		return
+	}
+	assert.NoError(t, unstructured.SetNestedField(obj.Object, value, append([]string{"status"}, fields...)...))
+	_, err := dynamicClient.Resource(testSnapshotResource).Namespace(testNamespace).Update(obj, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+}
+
+func getPVC(t *testing.T, client kubernetes.Interface) *corev1.PersistentVolumeClaim {
+	pvc, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(testClaim, metav1.GetOptions{})
+	assert.NoError(t, err)
+	return pvc
+}
+
+func TestProcess_snapshotEviction(t *testing.T) {
+	pod := testPodWith("pod-1", false)
+	pod.Labels[testEvictionKey] = "true"
+	// The fake API server does not assign UIDs, the restored PVC must differ from the source
+	source := testPVC("pv-1", corev1.ClaimBound)
+	source.UID = "pvc-1"
+	client := fake.NewSimpleClientset(testStatefulSet(), pod, source, testPV("pv-1", testNode), testNodeObject(), testTopology())
+	policies := testPolicies(t, policy.Config{})
+	options := testOptions(client)
+	options.EvictionMode = EvictionModeSnapshot
+	snapshotter, dynamicClient := testSnapshotter(client, true)
+	options.Snapshotter = snapshotter
+
+	// The pod is kept until the snapshot is ready
+	err := process(t, client, policies, options)
+	assert.IsType(t, &RequeueError{}, err)
+	assert.True(t, podExists(t, client, "pod-1"))
+	assert.True(t, pvcExists(t, client))
+	snap := getSnapshot(t, dynamicClient)
+	if assert.NotNil(t, snap) {
+		assert.Equal(t, "var-lib-cassandra-cassandra-node-0-eviction", snap.GetName())
+		assert.Equal(t, testPod, snap.GetLabels()[snapshot.PodLabel])
+	}
+
+	setSnapshotStatus(t, dynamicClient, true, "readyToUse")
+	assert.NoError(t, process(t, client, policies, options))
+	assert.False(t, podExists(t, client, "pod-1"))
+	assert.False(t, pvcExists(t, client))
+
+	// The PVC of the replacement pod is restored from the snapshot
+	replacement := testPodWith("pod-2", false)
+	replacement.Spec.NodeName = "node-2"
+	_, err = client.CoreV1().Pods(testNamespace).Create(replacement)
+	assert.NoError(t, err)
+	assert.NoError(t, process(t, client, policies, options))
+	pvc := getPVC(t, client)
+	assert.Empty(t, pvc.Spec.VolumeName)
+	if assert.NotNil(t, pvc.Spec.DataSource) {
+		assert.Equal(t, snapshot.Kind, pvc.Spec.DataSource.Kind)
+		assert.Equal(t, snapshot.Name(testClaim), pvc.Spec.DataSource.Name)
+	}
+	assert.True(t, snapshot.IsRestored(getSnapshot(t, dynamicClient)))
+
+	// Once the restored PVC is bound, the snapshot is deleted and the eviction completes
+	pvc.Status.Phase = corev1.ClaimBound
+	_, err = client.CoreV1().PersistentVolumeClaims(testNamespace).UpdateStatus(pvc)
+	assert.NoError(t, err)
+	assert.NoError(t, process(t, client, policies, options))
+	assert.Nil(t, getSnapshot(t, dynamicClient))
+	assert.Equal(t, Phase(""), evictionPhase(t, client))
+	entries := historyEntries(t, client)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, EvictionModeSnapshot, entries[0].Mode)
+		assert.Equal(t, history.OutcomeSucceeded, entries[0].Outcome)
+	}
+}
+
+func TestProcess_snapshotEmptyPVC(t *testing.T) {
+	evicted := testPodWith("pod-1", false)
+	source := testPVC("pv-1", corev1.ClaimBound)
+	source.UID = "pvc-1"
+	client := fake.NewSimpleClientset(testStatefulSet(), testPodWith("pod-2", true))
+	snapshotter, dynamicClient := testSnapshotter(client, true)
+	assert.NoError(t, snapshotter.Create(evicted, source))
+	setSnapshotStatus(t, dynamicClient, true, "readyToUse")
+
+	// The StatefulSet controller created an empty PVC before the snapshot was restored
+	empty := testPVC("", corev1.ClaimPending)
+	empty.UID = "pvc-2"
+	_, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Create(empty)
+	assert.NoError(t, err)
+
+	options := testOptions(client)
+	options.Snapshotter = snapshotter
+	assert.NoError(t, process(t, client, testPolicies(t, policy.Config{}), options))
+	assert.False(t, pvcExists(t, client), "the empty PVC should be deleted")
+	assert.False(t, podExists(t, client, "pod-2"), "the pod should be deleted to retry the restore")
+
+	_, err = client.CoreV1().Pods(testNamespace).Create(testPodWith("pod-3", true))
+	assert.NoError(t, err)
+	assert.NoError(t, process(t, client, testPolicies(t, policy.Config{}), options))
+	assert.True(t, snapshot.IsRestoredFrom(getPVC(t, client), getSnapshot(t, dynamicClient)))
+	assert.True(t, podExists(t, client, "pod-3"))
+}
+
+func TestProcess_snapshotUnsupported(t *testing.T) {
+	pod := testPodWith("pod-1", false)
+	pod.Labels[testEvictionKey] = "true"
+	client := fake.NewSimpleClientset(testStatefulSet(), pod, testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", testNode), testNodeObject(), testTopology())
+	options := testOptions(client)
+	options.EvictionMode = EvictionModeSnapshot
+	options.Snapshotter, _ = testSnapshotter(client, false)
+
+	// Without the VolumeSnapshot API the volumes are wiped
+	assert.NoError(t, process(t, client, testPolicies(t, policy.Config{}), options))
+	assert.False(t, podExists(t, client, "pod-1"))
+	assert.False(t, pvcExists(t, client))
+	pv, err := client.CoreV1().PersistentVolumes().Get("pv-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, pv.Spec.ClaimRef)
+
+	record, err := getEvictionRecord(client, pod)
+	assert.NoError(t, err)
+	if assert.NotNil(t, record) {
+		assert.Equal(t, EvictionModeWipe, record.Mode)
+	}
+}
+
+func TestProcess_snapshotFailed(t *testing.T) {
+	pod := testPodWith("pod-1", false)
+	pod.Labels[testEvictionKey] = "true"
+	client := fake.NewSimpleClientset(testStatefulSet(), pod, testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", testNode), testNodeObject(), testTopology())
+	options := testOptions(client)
+	options.EvictionMode = EvictionModeSnapshot
+	snapshotter, dynamicClient := testSnapshotter(client, true)
+	options.Snapshotter = snapshotter
+
+	assert.IsType(t, &RequeueError{}, process(t, client, testPolicies(t, policy.Config{}), options))
+	setSnapshotStatus(t, dynamicClient, "volume is busy", "error", "message")
+
+	// A failed snapshot is deleted and the volumes are wiped instead
+	assert.NoError(t, process(t, client, testPolicies(t, policy.Config{}), options))
+	assert.Nil(t, getSnapshot(t, dynamicClient))
+	assert.False(t, podExists(t, client, "pod-1"))
+	assert.False(t, pvcExists(t, client))
+}
+
+func TestProcess_snapshotCreateFailed(t *testing.T) {
+	pod := testPodWith("pod-1", false)
+	pod.Labels[testEvictionKey] = "true"
+	client := fake.NewSimpleClientset(testStatefulSet(), pod, testPVC("pv-1", corev1.ClaimBound), testPV("pv-1", testNode), testNodeObject(), testTopology())
+	options := testOptions(client)
+	options.EvictionMode = EvictionModeSnapshot
+	snapshotter, dynamicClient := testSnapshotter(client, true)
+	options.Snapshotter = snapshotter
+	dynamicClient.PrependReactor("create", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("no snapshot class")
+	})
+
+	assert.NoError(t, process(t, client, testPolicies(t, policy.Config{}), options))
+	assert.False(t, podExists(t, client, "pod-1"))
+	assert.False(t, pvcExists(t, client))
+}
@@ -2,166 +2,250 @@ package sts
 
 import (
 	"fmt"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/cassandra"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gate"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/gc"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/history"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/notify"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/policy"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-recovery/pkg/snapshot"
+)
+
+const (
+	// EvictionModeWipe deletes the data of an evicted pod, the node streams its data from its peers.
+	EvictionModeWipe = "wipe"
+	// EvictionModeSnapshot moves the data of an evicted pod with CSI VolumeSnapshots.
+	EvictionModeSnapshot = "snapshot"
 )
 
-func Process(client *kubernetes.Clientset, evictionLabel string, item runtime.Object) {
+const (
+	// DeferredAnnotation is set on pods whose recovery is deferred by a pause, a maintenance window or the rate limit.
+	DeferredAnnotation = "kudo-cassandra/recovery-deferred"
+	// RecoveryAnnotation is set on pods whose volumes are being wiped, to announce the recovery and record its
+	// failure only once across retries.
+	RecoveryAnnotation = "kudo-cassandra/recovery"
+
+	recoveryStarted = "started"
+	recoveryFailed  = "failed"
+
+	deferredPollInterval = 5 * time.Minute
+)
+
+// Options configure how pods are recovered.
+type Options struct {
+	EvictionMode  string
+	EvictionLabel string
+	// Decommission removes evicted nodes from the ring instead of draining them.
+	Decommission bool
+	Snapshotter  *snapshot.Snapshotter
+	Executor     cassandra.Executor
+	History      *history.Recorder
+	Gate         *gate.Gate
+	Notifier     *notify.Notifier
+	// FinalAttempt is set if the pod is not retried when processing fails, so the failure is recorded.
+	FinalAttempt bool
+}
+
+// RequeueError signals that the recovery of a pod is in progress and the pod needs to be processed again later.
+type RequeueError struct {
+	After  time.Duration
+	Reason string
+}
+
+func (e *RequeueError) Error() string {
+	return fmt.Sprintf("requeue after %v: %s", e.After, e.Reason)
+}
+
+func Process(client kubernetes.Interface, policies *policy.Set, options Options, item runtime.Object) error {
 	if item == nil {
 		// Event was deleted
-		return
+		return nil
 	}
 
 	pod, ok := item.(*corev1.Pod)
 	if !ok {
 		// We only act on Pods
-		return
+		return nil
 	}
 
-	if detectEvictionCondition(evictionLabel, pod) {
-		log.Printf("the pod %s/%s meets the eviction conditions.", pod.Namespace, pod.Name)
-		if err := cleanStartPod(client, pod); err != nil {
-			log.Printf("ERROR: Failed to clean start pod: %v", err)
+	if options.Snapshotter.Supported() {
+		restoring, err := restoreFromSnapshots(client, options.Snapshotter, pod)
+		if err != nil {
+			return fmt.Errorf("failed to restore pod %s/%s from snapshots: %v", pod.Namespace, pod.Name, err)
 		}
+		if restoring {
+			log.Printf("the pod %s/%s is being restored from eviction snapshots.", pod.Namespace, pod.Name)
+			return nil
+		}
+	}
+
+	evicting, err := resumeEviction(client, options, pod)
+	if evicting {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resume eviction of pod %s/%s: %v", pod.Namespace, pod.Name, err)
 	}
 
-	needsRecovery, err := detectRecoveryConditions(client, pod)
+	// A policy that recovers the pod wins over the errors of other policies
+	decision, err := policies.Evaluate(client, pod)
 	if err != nil {
-		log.Printf("ERROR: failed to detect recovery condition: %v", err)
-		return
+		return fmt.Errorf("failed to detect recovery condition of pod %s/%s: %v", pod.Namespace, pod.Name, err)
 	}
 
-	if needsRecovery {
-		log.Printf("the pod %s/%s meets the recovery conditions.", pod.Namespace, pod.Name)
-		if err = cleanStartPod(client, pod); err != nil {
-			log.Printf("ERROR: Failed to clean start pod: %v", err)
+	if !decision.Recover {
+		if err := setRecoveryStatus(client, pod, ""); err != nil {
+			return err
 		}
-		return
+		return setDeferred(client, pod, "")
 	}
-}
 
-func detectEvictionCondition(evictionLabel string, pod *corev1.Pod) bool {
-	if evictionLabel == "" {
-		return false
+	log.Printf("the pod %s/%s meets the recovery conditions of policy '%s': %s", pod.Namespace, pod.Name, decision.Policy, decision.Reason)
+	if decision.Eviction && pod.DeletionTimestamp != nil {
+		log.Printf("the pod %s/%s is already terminating, not starting an eviction", pod.Namespace, pod.Name)
+		return nil
+	}
+
+	result, err := options.Gate.Check(pod)
+	if err != nil {
+		return fmt.Errorf("failed to check if recovery of pod %s/%s is allowed: %v", pod.Namespace, pod.Name, err)
 	}
-	if val, ok := pod.Labels[evictionLabel]; ok {
-		if val == "true" {
-			log.Printf("Pod %s has eviction label set", pod.Name)
-			return true
+	if !result.Allowed {
+		log.Printf("the recovery of pod %s/%s is deferred: %s", pod.Namespace, pod.Name, result.Reason)
+		if pod.Annotations[DeferredAnnotation] != result.Reason {
+			options.Notifier.Notify(notify.NewEvent(notify.EventDeferred, pod, history.Entry{
+				Time:    time.Now(),
+				Pod:     pod.Name,
+				Node:    pod.Spec.NodeName,
+				Trigger: decision.Policy,
+				Reason:  result.Reason,
+			}))
 		}
+		if err := setDeferred(client, pod, result.Reason); err != nil {
+			log.Printf("ERROR: %v", err)
+		}
+		after := result.RetryAfter
+		if after <= 0 || after > deferredPollInterval {
+			after = deferredPollInterval
+		}
+		return &RequeueError{After: after, Reason: result.Reason}
 	}
-	return false
-}
 
-func detectRecoveryConditions(client *kubernetes.Clientset, pod *corev1.Pod) (bool, error) {
-	isUnschedulable := false
-	for _, condition := range pod.Status.Conditions {
-		if condition.Type == corev1.PodScheduled && condition.Reason == corev1.PodReasonUnschedulable {
-			isUnschedulable = true
-			break
+	if decision.Eviction {
+		if err := setDeferred(client, pod, ""); err != nil {
+			return err
 		}
+		return startEviction(client, options, pod, decision)
 	}
 
-	if isUnschedulable {
-		log.Printf("FailedScheduling detected for %s/%s.", pod.Namespace, pod.Name)
-		pvcDown, err := detectPVCDown(client, pod)
-		if err != nil {
-			return false, fmt.Errorf("failed to detect if pv for pod %s/%s is down: %v", pod.Namespace, pod.Name, err)
-		}
-		log.Printf("Detected PVC status for %s/%s: %v", pod.Namespace, pod.Name, pvcDown)
-		if pvcDown {
-			log.Printf("PVC for %s/%s is not available, assuming it is already deleted.", pod.Namespace, pod.Name)
-			return true, nil
+	entry := history.Entry{
+		Time:    time.Now(),
+		Pod:     pod.Name,
+		Node:    pod.Spec.NodeName,
+		Trigger: decision.Policy,
+		Reason:  decision.Reason,
+		Mode:    EvictionModeWipe,
+		Outcome: history.OutcomeSucceeded,
+	}
+	entry.PVCs, entry.PVs, err = volumeNames(client, pod)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+	status := pod.Annotations[RecoveryAnnotation]
+	if status == "" {
+		announce(options, pod, entry)
+		if err := setRecoveryStatus(client, pod, recoveryStarted); err != nil {
+			log.Printf("ERROR: %v", err)
 		}
-		nodeDown, err := detectNodeDown(client, pod)
-		if err != nil {
-			return false, fmt.Errorf("failed to detect if node for pod %s/%s is down: %v", pod.Namespace, pod.Name, err)
+	}
+	// Without the marker the new pod might join as a new node if it gets the same IP
+	if err = markReplacement(client, options, pod, decision.Reason); err == nil {
+		err = cleanStartPod(client, pod)
+	}
+	if err != nil {
+		// The failure is only recorded once the recovery is not retried anymore
+		if !options.FinalAttempt || status == recoveryFailed {
+			return fmt.Errorf("failed to recover pod %s/%s: %v", pod.Namespace, pod.Name, err)
 		}
-		if nodeDown {
-			log.Printf("Node is down for %s/%s.", pod.Namespace, pod.Name)
-			return true, nil
+		if err := setRecoveryStatus(client, pod, recoveryFailed); err != nil {
+			log.Printf("ERROR: %v", err)
 		}
+		entry.Outcome = history.OutcomeFailed
+		entry.Error = err.Error()
+		err = fmt.Errorf("failed to recover pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	} else {
+		options.Gate.Started(pod)
 	}
+	entry.Duration = time.Since(entry.Time).Round(time.Millisecond).String()
+	record(options, pod, entry)
+	return err
+}
 
-	return false, nil
+// announce notifies about the start of a recovery.
+func announce(options Options, pod *corev1.Pod, entry history.Entry) {
+	entry.Outcome = ""
+	entry.Duration = ""
+	options.Notifier.Notify(notify.NewEvent(notify.EventDecision, pod, entry))
 }
 
-func detectPVCDown(client *kubernetes.Clientset, pod *corev1.Pod) (bool, error) {
-	// we need to check if PVC is still deleted
-	for _, vol := range pod.Spec.Volumes {
-		if vol.PersistentVolumeClaim != nil {
-			pvc, err := client.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(vol.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
-			if errors.IsNotFound(err) {
-				return true, nil
-			}
-			if err != nil {
-				return false, fmt.Errorf("failed to retrieve pvc %s/%s: %v", pod.Namespace, vol.PersistentVolumeClaim.ClaimName, err)
-			}
-			log.Printf(" Volume Claim Status: %s", pvc.Status.Phase)
-			if pvc.Spec.VolumeName == "" {
-				log.Printf("Volume Name for PVC %s/%s has no PV attached", pvc.Namespace, pvc.Name)
-				if pvc.Status.Phase == corev1.ClaimPending {
-					log.Printf("PVC is still in phase Pending, it's not down")
-					return false, nil
-				}
-				return true, nil
-			}
-		}
+// record adds the outcome of a recovery to the history and notifies about it.
+func record(options Options, pod *corev1.Pod, entry history.Entry) {
+	if err := options.History.Record(pod, entry); err != nil {
+		log.Printf("ERROR: %v", err)
 	}
-	return false, nil
+	options.Notifier.Notify(notify.NewEvent(notify.EventOutcome, pod, entry))
 }
 
-func detectNodeDown(client *kubernetes.Clientset, pod *corev1.Pod) (bool, error) {
-	// we cannot check by node name here as the node will be  Nil here
-	// we need to check through PVC
-	for _, vol := range pod.Spec.Volumes {
-		if vol.PersistentVolumeClaim != nil {
-
-			pvc, err := client.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(vol.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
-			if err != nil {
-				return false, fmt.Errorf("failed to get pvc %s/%s: %v", pod.Namespace, vol.PersistentVolumeClaim.ClaimName, err)
-			}
-
-			pv, err := client.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
-			if err != nil {
-				return false, fmt.Errorf("failed to get PV '%s': %v", pvc.Spec.VolumeName, err)
-			}
-
-			for _, node := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
-				for _, expr := range node.MatchExpressions {
-					if expr.Key == "kubernetes.io/hostname" {
-						log.Printf("Found required hostname affinity for PV %s: %+v", pv.Name, expr)
-
-						if len(expr.Values) > 1 {
-							log.Printf("WARN: Required NodeAffinity for PV %s has more than one value for hostname: %v", pv.Name, expr.Values)
-						}
-
-						node, err := client.CoreV1().Nodes().Get(expr.Values[0], metav1.GetOptions{})
-						if err != nil {
-							if errors.IsNotFound(err) {
-								return true, nil
-							} else {
-								return false, fmt.Errorf("failed to get node %s: %v", expr.Values[0], err)
-							}
-						}
-						if node == nil {
-							return true, nil
-						}
-					}
-				}
-			}
-		}
+// setDeferred shows on the pod why its recovery is deferred, or removes the note if reason is empty.
+func setDeferred(client kubernetes.Interface, pod *corev1.Pod, reason string) error {
+	current, ok := pod.Annotations[DeferredAnnotation]
+	if current == reason && (ok || reason == "") {
+		return nil
+	}
+	var value interface{}
+	if reason != "" {
+		value = reason
+	}
+	patch, err := annotationPatch(DeferredAnnotation, value)
+	if err != nil {
+		return err
+	}
+	if _, err := client.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, patch); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to update deferred annotation of pod %s/%s: %v", pod.Namespace, pod.Name, err)
 	}
+	return nil
+}
 
-	return false, nil
+// setRecoveryStatus sets the status of the recovery of the pod, or removes it if status is empty.
+func setRecoveryStatus(client kubernetes.Interface, pod *corev1.Pod, status string) error {
+	if pod.Annotations[RecoveryAnnotation] == status {
+		return nil
+	}
+	var value interface{}
+	if status != "" {
+		value = status
+	}
+	patch, err := annotationPatch(RecoveryAnnotation, value)
+	if err != nil {
+		return err
+	}
+	if _, err := client.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, patch); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to update recovery annotation of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	return nil
 }
 
-func cleanStartPod(client *kubernetes.Clientset, pod *corev1.Pod) error {
+func cleanStartPod(client kubernetes.Interface, pod *corev1.Pod) error {
 	// Get all PVCs from the pod
 	pvcs, err := getPVCs(client, pod)
 	if err != nil {
@@ -196,7 +280,7 @@ func cleanStartPod(client *kubernetes.Clientset, pod *corev1.Pod) error {
 	return nil
 }
 
-func getPVCs(client *kubernetes.Clientset, pod *corev1.Pod) ([]*corev1.PersistentVolumeClaim, error) {
+func getPVCs(client kubernetes.Interface, pod *corev1.Pod) ([]*corev1.PersistentVolumeClaim, error) {
 	pvcs := make([]*corev1.PersistentVolumeClaim, 0, len(pod.Spec.Volumes))
 	for _, vol := range pod.Spec.Volumes {
 		if vol.PersistentVolumeClaim != nil {
@@ -215,7 +299,24 @@ func getPVCs(client *kubernetes.Clientset, pod *corev1.Pod) ([]*corev1.Persisten
 	return pvcs, nil
 }
 
-func detachPVCFromPV(client *kubernetes.Clientset, pvc *corev1.PersistentVolumeClaim) error {
+// volumeNames returns the names of the PVCs of the pod and of the PVs they are bound to.
+func volumeNames(client kubernetes.Interface, pod *corev1.Pod) ([]string, []string, error) {
+	pvcs, err := getPVCs(client, pod)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get PVCs from pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	pvcNames := make([]string, 0, len(pvcs))
+	pvNames := make([]string, 0, len(pvcs))
+	for _, pvc := range pvcs {
+		pvcNames = append(pvcNames, pvc.Name)
+		if pvc.Spec.VolumeName != "" {
+			pvNames = append(pvNames, pvc.Spec.VolumeName)
+		}
+	}
+	return pvcNames, pvNames, nil
+}
+
+func detachPVCFromPV(client kubernetes.Interface, pvc *corev1.PersistentVolumeClaim) error {
 	if pvc.Spec.VolumeName == "" {
 		log.Infof("Unable to detach PV from PVC %s/%s, volume name from PVC is already empty", pvc.Namespace, pvc.Name)
 		return nil
@@ -228,6 +329,12 @@ func detachPVCFromPV(client *kubernetes.Clientset, pvc *corev1.PersistentVolumeC
 
 	log.Printf("Detach PVC %s/%s from PV '%s'", pvc.Namespace, pvc.Name, pv.Name)
 	pv.Spec.ClaimRef = nil
+	// The PV still holds the data of the wiped node, remember it for the garbage collection
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	pv.Annotations[gc.WipedClaimAnnotation] = fmt.Sprintf("%s/%s", pvc.Namespace, pvc.Name)
+	pv.Annotations[gc.WipedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
 
 	_, err = client.CoreV1().PersistentVolumes().Update(pv)
 	if err != nil {
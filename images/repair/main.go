@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/client"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/credentials"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/keyspace"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/nodetool"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/repair"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/roles"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/schedule"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+func main() {
+	command := "repair"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	log.Printf("bootstrapping cassandra %s...", command)
+
+	namespace := os.Getenv("NAMESPACE")
+	instance := os.Getenv("INSTANCE_NAME")
+	if namespace == "" || instance == "" {
+		log.Fatalf("NAMESPACE and INSTANCE_NAME are required")
+	}
+
+	options, err := parseOptions()
+	if err != nil {
+		log.Fatalf("Invalid repair configuration: %v", err)
+	}
+
+	clientSet, err := client.GetKubeClient()
+	if err != nil {
+		log.Fatalf("failed to get kube client: %v", err)
+	}
+	config, err := client.GetKubeConfig()
+	if err != nil {
+		log.Fatalf("failed to get kube config: %v", err)
+	}
+
+	podSelector := fmt.Sprintf("app = %s, cassandra", instance)
+	owner := statefulSetOwner(clientSet, namespace, podSelector)
+	executor := nodetool.NewPodExecutor(config, clientSet)
+
+	switch command {
+	case "repair":
+		runRepair(clientSet, executor, namespace, instance, podSelector, owner, options)
+	case "schedule":
+		runScheduled(clientSet, executor, namespace, instance, podSelector, owner, options)
+	case "keyspaces":
+		runKeyspaces(clientSet, executor, namespace, instance, podSelector, owner, options, requiredEnv("KEYSPACES_CONFIGMAP"), mustRunID(clientSet, namespace))
+	case "roles":
+		runRoles(clientSet, executor, namespace, instance, podSelector, owner, options, requiredEnv("ROLES_CONFIGMAP"))
+	case "rotate-credentials":
+		runRotation(clientSet, executor, namespace, instance, podSelector, owner)
+	default:
+		log.Fatalf("unknown command '%s', expected 'repair', 'schedule', 'keyspaces', 'roles' or 'rotate-credentials'", command)
+	}
+}
+
+// runRepair repairs the token ranges of the instance, a restarted pod of the job resumes the repair.
+func runRepair(clientSet kubernetes.Interface, executor nodetool.Executor, namespace, instance, podSelector string, owner *metav1.OwnerReference, options repair.Options) {
+	stateConfigMap := os.Getenv("STATE_CONFIGMAP")
+	if stateConfigMap == "" {
+		stateConfigMap = fmt.Sprintf("%s-repair-state", instance)
+	}
+	store := state.NewStore(state.NewConfigMapStore(clientSet, namespace, stateConfigMap, owner))
+
+	orchestrator := repair.NewOrchestrator(clientSet, executor, namespace, podSelector, store, options)
+	if _, err := orchestrator.Run(mustRunID(clientSet, namespace)); err != nil {
+		log.Fatalf("Repair of instance %s/%s failed: %v", namespace, instance, err)
+	}
+}
+
+// requiredEnv returns the value of the environment variable, which the command requires.
+func requiredEnv(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		log.Fatalf("%s is required", name)
+	}
+	return value
+}
+
+// runScheduled runs a scheduled repair, which repairs a share of the current repair cycle.
+func runScheduled(clientSet kubernetes.Interface, executor nodetool.Executor, namespace, instance, podSelector string, owner *metav1.OwnerReference, options repair.Options) {
+	scheduleOptions, err := parseScheduleOptions()
+	if err != nil {
+		log.Fatalf("Invalid repair schedule: %v", err)
+	}
+
+	// The progress of the cycle and the status of the tables share the configmap
+	stateConfigMap := os.Getenv("STATE_CONFIGMAP")
+	if stateConfigMap == "" {
+		stateConfigMap = fmt.Sprintf("%s-repair-schedule", instance)
+	}
+	configMap := state.NewConfigMapStore(clientSet, namespace, stateConfigMap, owner)
+	store := state.NewStore(configMap)
+	orchestrator := repair.NewOrchestrator(clientSet, executor, namespace, podSelector, store, options)
+
+	scheduler := schedule.NewScheduler(orchestrator, executor, schedule.NewStore(configMap), scheduleOptions)
+	if err := scheduler.Run(); err != nil {
+		log.Fatalf("Scheduled repair of instance %s/%s failed: %v", namespace, instance, err)
+	}
+}
+
+// runKeyspaces reconciles the keyspaces declared in the configmap and repairs the keyspaces that got new replicas.
+func runKeyspaces(clientSet kubernetes.Interface, executor nodetool.Executor, namespace, instance, podSelector string, owner *metav1.OwnerReference, options repair.Options, name, runID string) {
+	cm, err := clientSet.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		log.Fatalf("failed to get keyspaces configmap %s/%s: %v", namespace, name, err)
+	}
+	config, err := keyspace.ParseConfig([]byte(cm.Data[keyspace.ConfigKey]))
+	if err != nil {
+		log.Fatalf("Invalid %s in configmap %s/%s: %v", keyspace.ConfigKey, namespace, name, err)
+	}
+	keyspaceOptions := keyspace.Options{Repair: os.Getenv("KEYSPACES_REPAIR") != "false"}
+	for _, ks := range strings.Split(os.Getenv("KEYSPACES_CONFIRM_RF_DECREASE"), ",") {
+		if ks = strings.TrimSpace(ks); ks != "" {
+			keyspaceOptions.Confirmed = append(keyspaceOptions.Confirmed, ks)
+		}
+	}
+
+	// The repair of the keyspaces is resumed by a restarted pod of the job
+	repairStore := state.NewStore(state.NewConfigMapStore(clientSet, namespace, fmt.Sprintf("%s-keyspaces-repair", instance), owner))
+	repairKeyspaces := func(keyspaces []string) error {
+		options.Keyspaces = keyspaces
+		_, err := repair.NewOrchestrator(clientSet, executor, namespace, podSelector, repairStore, options).Run(runID)
+		return err
+	}
+
+	orchestrator := repair.NewOrchestrator(clientSet, executor, namespace, podSelector, repairStore, options)
+	pod, err := orchestrator.Pod()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	store := keyspace.NewStore(state.NewConfigMapStore(clientSet, namespace, fmt.Sprintf("%s-keyspaces", instance), owner))
+	reconciler := keyspace.NewReconciler(executor, store, repairKeyspaces, keyspaceOptions)
+	if _, err := reconciler.Run(config, pod); err != nil {
+		log.Fatalf("Reconciling the keyspaces of instance %s/%s failed: %v", namespace, instance, err)
+	}
+}
+
+// runRoles reconciles the roles declared in the configmap.
+func runRoles(clientSet kubernetes.Interface, executor nodetool.InputExecutor, namespace, instance, podSelector string, owner *metav1.OwnerReference, options repair.Options, name string) {
+	cm, err := clientSet.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		log.Fatalf("failed to get roles configmap %s/%s: %v", namespace, name, err)
+	}
+	config, err := roles.ParseConfig([]byte(cm.Data[roles.ConfigKey]))
+	if err != nil {
+		log.Fatalf("Invalid %s in configmap %s/%s: %v", roles.ConfigKey, namespace, name, err)
+	}
+
+	// The role of the operator runs the statements, it must not be changed
+	protected := []string{}
+	if secretName := os.Getenv("AUTHENTICATION_SECRET_NAME"); secretName != "" {
+		secret, err := clientSet.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+		if err != nil {
+			log.Fatalf("failed to get authentication secret %s/%s: %v", namespace, secretName, err)
+		}
+		protected = append(protected, string(secret.Data["username"]))
+	}
+
+	pod, err := repair.NewOrchestrator(clientSet, executor, namespace, podSelector, nil, options).Pod()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	store := roles.NewStore(state.NewConfigMapStore(clientSet, namespace, fmt.Sprintf("%s-roles-status", instance), owner))
+	reconciler := roles.NewReconciler(executor, clientSet, namespace, store, protected)
+	if _, err := reconciler.Run(config, pod); err != nil {
+		log.Fatalf("Reconciling the roles of instance %s/%s failed: %v", namespace, instance, err)
+	}
+}
+
+// runRotation rotates the password of the role that the operator uses.
+func runRotation(clientSet kubernetes.Interface, executor nodetool.InputExecutor, namespace, instance, podSelector string, owner *metav1.OwnerReference) {
+	options := credentials.Options{
+		SecretName:    os.Getenv("AUTHENTICATION_SECRET_NAME"),
+		NewSecretName: os.Getenv("NEW_PASSWORD_SECRET_NAME"),
+		CacheValidity: 2 * time.Second,
+		Timeout:       5 * time.Minute,
+		Interval:      5 * time.Second,
+	}
+	if options.SecretName == "" {
+		log.Fatalf("AUTHENTICATION_SECRET_NAME is required to rotate the password")
+	}
+	if options.NewSecretName == "" {
+		log.Infof("No secret with a new password is set, nothing to rotate")
+		return
+	}
+	if v := os.Getenv("CREDENTIALS_VALIDITY_IN_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			log.Fatalf("CREDENTIALS_VALIDITY_IN_MS must be a non-negative integer: %s", v)
+		}
+		options.CacheValidity = time.Duration(ms) * time.Millisecond
+	}
+
+	store := credentials.NewStore(state.NewConfigMapStore(clientSet, namespace, fmt.Sprintf("%s-credentials-rotation", instance), owner))
+	rotator := credentials.NewRotator(clientSet, executor, namespace, podSelector, store, options)
+	if _, err := rotator.Run(); err != nil {
+		log.Fatalf("Rotating the password of instance %s/%s failed: %v", namespace, instance, err)
+	}
+}
+
+func parseScheduleOptions() (schedule.Options, error) {
+	options := schedule.Options{WarningPeriod: 48 * time.Hour}
+	var err error
+	if options.Schedule, err = cron.ParseStandard(os.Getenv("SCHEDULE")); err != nil {
+		return options, fmt.Errorf("SCHEDULE is not a valid cron expression: %v", err)
+	}
+	if v := os.Getenv("WARNING_PERIOD"); v != "" {
+		if options.WarningPeriod, err = time.ParseDuration(v); err != nil {
+			return options, fmt.Errorf("WARNING_PERIOD is not a duration: %v", err)
+		}
+	}
+	return options, nil
+}
+
+func parseOptions() (repair.Options, error) {
+	options := repair.DefaultOptions()
+	options.Pod = os.Getenv("REPAIR_POD")
+	for _, keyspace := range strings.Split(os.Getenv("KEYSPACES"), ",") {
+		if keyspace = strings.TrimSpace(keyspace); keyspace != "" {
+			options.Keyspaces = append(options.Keyspaces, keyspace)
+		}
+	}
+
+	var err error
+	if v := os.Getenv("PARALLELISM"); v != "" {
+		if options.Parallelism, err = strconv.Atoi(v); err != nil {
+			return options, fmt.Errorf("PARALLELISM is not a number: %v", err)
+		}
+	}
+	if v := os.Getenv("SEGMENTS_PER_RANGE"); v != "" {
+		if options.SegmentsPerRange, err = strconv.Atoi(v); err != nil {
+			return options, fmt.Errorf("SEGMENTS_PER_RANGE is not a number: %v", err)
+		}
+	}
+	if v := os.Getenv("INTENSITY"); v != "" {
+		if options.Intensity, err = strconv.ParseFloat(v, 64); err != nil {
+			return options, fmt.Errorf("INTENSITY is not a number: %v", err)
+		}
+	}
+	if v := os.Getenv("SEGMENT_RETRIES"); v != "" {
+		if options.Retries, err = strconv.Atoi(v); err != nil {
+			return options, fmt.Errorf("SEGMENT_RETRIES is not a number: %v", err)
+		}
+	}
+	return options, options.Validate()
+}
+
+// mustRunID returns the ID of the repair run, only repairs need it to resume an interrupted run.
+func mustRunID(client kubernetes.Interface, namespace string) string {
+	id, err := runID(client, namespace)
+	if err != nil {
+		log.Fatalf("failed to determine the repair run: %v", err)
+	}
+	return id
+}
+
+// runID identifies the repair run by the job that runs this pod, so a restarted pod of the same job resumes it.
+func runID(client kubernetes.Interface, namespace string) (string, error) {
+	if id := os.Getenv("RUN_ID"); id != "" {
+		return id, nil
+	}
+	podName := os.Getenv("POD_NAME")
+	if podName == "" {
+		return "", fmt.Errorf("POD_NAME or RUN_ID is required")
+	}
+	pod, err := client.CoreV1().Pods(namespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get pod %s/%s: %v", namespace, podName, err)
+	}
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "Job" {
+			return string(ref.UID), nil
+		}
+	}
+	log.Warnf("Pod %s/%s is not run by a job, the repair can not be resumed", namespace, podName)
+	return string(pod.UID), nil
+}
+
+// statefulSetOwner returns a reference to the StatefulSet of the Cassandra pods, or nil if there is none.
+func statefulSetOwner(client kubernetes.Interface, namespace, podSelector string) *metav1.OwnerReference {
+	pods, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: podSelector})
+	if err != nil {
+		log.Warnf("Failed to list Cassandra pods: %v", err)
+		return nil
+	}
+	for _, pod := range pods.Items {
+		for _, ref := range pod.OwnerReferences {
+			if ref.Kind == "StatefulSet" {
+				return &metav1.OwnerReference{APIVersion: ref.APIVersion, Kind: ref.Kind, Name: ref.Name, UID: ref.UID}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package credentials
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/nodetool"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+const (
+	// LoginScript runs cqlsh with the user name and password from the first two lines of stdin.
+	LoginScript = "/etc/cassandra/cqlsh-credentials.sh"
+	// RefreshScript replaces the credentials in the cqlshrc and the medusa config with the ones from stdin.
+	RefreshScript = "/etc/cassandra/refresh-credentials.sh"
+	// MedusaContainer is the name of the medusa container in the node pods, its config contains the credentials.
+	MedusaContainer = "medusa-backup"
+
+	// StatusKey contains the status of the rotation as JSON.
+	StatusKey = "status.json"
+	// ReportKey contains a human readable summary of the rotation.
+	ReportKey = "report"
+
+	loginQuery = "SELECT release_version FROM system.local"
+)
+
+// The phases of a rotation.
+const (
+	PhaseVerifying  = "Verifying"
+	PhaseCompleted  = "Completed"
+	PhaseRolledBack = "RolledBack"
+	PhaseFailed     = "Failed"
+)
+
+// Options configure a rotation.
+type Options struct {
+	// SecretName is the secret with the 'username' and 'password' of the operator.
+	SecretName string
+	// NewSecretName is the secret with the new 'password'.
+	NewSecretName string
+	// CacheValidity is how long nodes may keep using the old password from their credentials cache.
+	CacheValidity time.Duration
+	// Timeout is how long the new password may take to be accepted by all nodes after the cache validity.
+	Timeout time.Duration
+	// Interval between login attempts.
+	Interval time.Duration
+}
+
+// Status is the persisted state of the last rotation.
+type Status struct {
+	Phase    string `json:"phase"`
+	Username string `json:"username"`
+	// NewSecret is the version of the secret with the new password, a rolled back rotation is only retried once
+	// the secret changes.
+	NewSecret string      `json:"newSecret,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	UpdatedAt metav1.Time `json:"updatedAt"`
+}
+
+// Report returns a human readable summary of the status.
+func (s *Status) Report() string {
+	report := fmt.Sprintf("password rotation of role %s: %s at %s\n", s.Username, s.Phase, s.UpdatedAt.UTC().Format(time.RFC3339))
+	if s.Message != "" {
+		report += s.Message + "\n"
+	}
+	return report
+}
+
+// Rotator changes the password of the role that the operator uses. The role is altered with the old password, and
+// the secret is only updated after all nodes accept the new password.
+type Rotator struct {
+	client      kubernetes.Interface
+	executor    nodetool.InputExecutor
+	namespace   string
+	podSelector string
+	store       *Store
+	options     Options
+}
+
+func NewRotator(client kubernetes.Interface, executor nodetool.InputExecutor, namespace, podSelector string, store *Store, options Options) *Rotator {
+	return &Rotator{client: client, executor: executor, namespace: namespace, podSelector: podSelector, store: store, options: options}
+}
+
+// Run rotates the password. The password is rolled back if a node does not accept the new password. A run after a
+// failed or interrupted run continues it: the role is only altered if it does not accept the new password yet.
+func (r *Rotator) Run() (*Status, error) {
+	secret, err := r.client.CoreV1().Secrets(r.namespace).Get(r.options.SecretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get authentication secret %s: %v", r.options.SecretName, err)
+	}
+	username, oldPassword := string(secret.Data["username"]), string(secret.Data["password"])
+	if username == "" || oldPassword == "" {
+		return nil, fmt.Errorf("authentication secret %s needs a 'username' and a 'password'", r.options.SecretName)
+	}
+	newSecret, err := r.client.CoreV1().Secrets(r.namespace).Get(r.options.NewSecretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the secret %s with the new password: %v", r.options.NewSecretName, err)
+	}
+	newPassword := string(newSecret.Data["password"])
+	if newPassword == "" {
+		return nil, fmt.Errorf("secret %s needs the new 'password'", r.options.NewSecretName)
+	}
+
+	status := &Status{Username: username, NewSecret: fmt.Sprintf("%s@%s", newSecret.Name, newSecret.ResourceVersion)}
+	last, err := r.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if last.Phase == PhaseRolledBack && last.NewSecret == status.NewSecret {
+		// A retry of the job must not repeat the rotation
+		return last, fmt.Errorf("the rotation to the password in secret %s was rolled back at %s, update the secret to retry: %s",
+			r.options.NewSecretName, last.UpdatedAt.UTC().Format(time.RFC3339), last.Message)
+	}
+
+	pods, err := r.pods()
+	if err != nil {
+		return nil, err
+	}
+
+	if newPassword == oldPassword {
+		// The secret was updated by an earlier run, the consumers may not be refreshed yet
+		log.Infof("The authentication secret %s already contains the new password", r.options.SecretName)
+		if err := r.verify(pods, username, newPassword); err != nil {
+			return r.finish(status, PhaseFailed, err)
+		}
+		if err := r.refresh(pods, username, newPassword); err != nil {
+			return r.finish(status, PhaseFailed, err)
+		}
+		return r.finish(status, PhaseCompleted, nil)
+	}
+
+	if err := r.login(pods[0], username, newPassword); err == nil {
+		log.Infof("Role %s already accepts the new password, continuing an earlier rotation", username)
+	} else {
+		if err := r.login(pods[0], username, oldPassword); err != nil {
+			return r.finish(status, PhaseFailed, fmt.Errorf("role %s accepts neither the old nor the new password on pod %s: %v", username, pods[0].Name, err))
+		}
+		log.Infof("Changing the password of role %s", username)
+		if err := r.alter(pods[0], username, oldPassword, newPassword); err != nil {
+			return r.finish(status, PhaseFailed, fmt.Errorf("failed to change the password of role %s: %v", username, err))
+		}
+	}
+	status.Phase = PhaseVerifying
+	r.save(status)
+
+	log.Infof("Waiting %s for the credentials caches of the nodes to expire", r.options.CacheValidity)
+	time.Sleep(r.options.CacheValidity)
+	if err := r.verify(pods, username, newPassword); err != nil {
+		return r.rollback(status, pods, username, oldPassword, newPassword, err)
+	}
+
+	secret.Data["password"] = []byte(newPassword)
+	if _, err := r.client.CoreV1().Secrets(r.namespace).Update(secret); err != nil {
+		return r.rollback(status, pods, username, oldPassword, newPassword, fmt.Errorf("failed to update authentication secret %s: %v", r.options.SecretName, err))
+	}
+	log.Infof("Updated the password in the authentication secret %s", r.options.SecretName)
+
+	if err := r.refresh(pods, username, newPassword); err != nil {
+		// The consumers read the secret when they start, the mounted secret is updated by the kubelet
+		return r.finish(status, PhaseFailed, fmt.Errorf("the password was changed, but %v", err))
+	}
+	return r.finish(status, PhaseCompleted, nil)
+}
+
+// rollback restores the old password after the new one could not be verified.
+func (r *Rotator) rollback(status *Status, pods []*corev1.Pod, username, oldPassword, newPassword string, cause error) (*Status, error) {
+	log.Errorf("Rolling back the password of role %s: %v", username, cause)
+	if err := r.alter(pods[0], username, newPassword, oldPassword); err != nil {
+		return r.finish(status, PhaseFailed, fmt.Errorf("%v, and the rollback to the old password failed: %v", cause, err))
+	}
+	return r.finish(status, PhaseRolledBack, fmt.Errorf("%v, the old password was restored", cause))
+}
+
+func (r *Rotator) finish(status *Status, phase string, err error) (*Status, error) {
+	status.Phase = phase
+	status.Message = ""
+	if err != nil {
+		status.Message = err.Error()
+	}
+	r.save(status)
+	log.Infof("Credentials rotation:\n%s", status.Report())
+	return status, err
+}
+
+func (r *Rotator) save(status *Status) {
+	status.UpdatedAt = metav1.Now()
+	if err := r.store.Save(status); err != nil {
+		log.Errorf("%v", err)
+	}
+}
+
+// verify waits until all pods accept the password.
+func (r *Rotator) verify(pods []*corev1.Pod, username, password string) error {
+	deadline := time.Now().Add(r.options.Timeout)
+	for _, pod := range pods {
+		for {
+			err := r.login(pod, username, password)
+			if err == nil {
+				log.Infof("Pod %s accepts the password of role %s", pod.Name, username)
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("pod %s does not accept the new password of role %s: %v", pod.Name, username, err)
+			}
+			time.Sleep(r.options.Interval)
+		}
+	}
+	return nil
+}
+
+// refresh replaces the credentials in the cqlshrc and the medusa config of all pods.
+func (r *Rotator) refresh(pods []*corev1.Pod, username, password string) error {
+	failed := []string{}
+	for _, pod := range pods {
+		for _, container := range pod.Spec.Containers {
+			if container.Name != nodetool.Container && container.Name != MedusaContainer {
+				continue
+			}
+			if _, err := r.executor.ExecInput(pod, container.Name, []string{"/bin/bash", RefreshScript}, credentials(username, password)); err != nil {
+				log.Errorf("Failed to refresh the credentials in container %s of pod %s: %v", container.Name, pod.Name, err)
+				failed = append(failed, pod.Name+"/"+container.Name)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("the credentials of %s could not be refreshed, restart the pods", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (r *Rotator) login(pod *corev1.Pod, username, password string) error {
+	_, err := r.executor.ExecInput(pod, nodetool.Container, []string{"/bin/bash", LoginScript, "-e", loginQuery}, credentials(username, password))
+	return err
+}
+
+// alter changes the password of the role, logged in with the current password.
+func (r *Rotator) alter(pod *corev1.Pod, username, password, newPassword string) error {
+	statement := fmt.Sprintf("ALTER ROLE %s WITH PASSWORD = %s;\n", quote(username), stringLiteral(newPassword))
+	_, err := r.executor.ExecInput(pod, nodetool.Container, []string{"/bin/bash", LoginScript, "-f", "/dev/stdin"}, credentials(username, password)+statement)
+	return err
+}
+
+// pods returns the Cassandra pods sorted by name. All of them have to be ready to verify the new password.
+func (r *Rotator) pods() ([]*corev1.Pod, error) {
+	list, err := r.client.CoreV1().Pods(r.namespace).List(metav1.ListOptions{LabelSelector: r.podSelector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Cassandra pods: %v", err)
+	}
+	pods := []*corev1.Pod{}
+	for i := range list.Items {
+		pod := &list.Items[i]
+		if !isReady(pod) {
+			return nil, fmt.Errorf("pod %s is not ready, the password can only be rotated if all pods are ready", pod.Name)
+		}
+		pods = append(pods, pod)
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no Cassandra pods found with selector '%s'", r.podSelector)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+func isReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// credentials returns the input of the scripts, the user name and the password on separate lines.
+func credentials(username, password string) string {
+	return username + "\n" + password + "\n"
+}
+
+func stringLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// quote returns the quoted identifier, which keeps its case.
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Store keeps the status of the rotation in a configmap.
+type Store struct {
+	configMap *state.ConfigMapStore
+}
+
+// NewStore returns a store for the configmap.
+func NewStore(configMap *state.ConfigMapStore) *Store {
+	return &Store{configMap: configMap}
+}
+
+// Load returns the status of the last rotation, or an empty status.
+func (s *Store) Load() (*Status, error) {
+	status := &Status{}
+	if _, err := s.configMap.Load(StatusKey, status); err != nil {
+		return nil, fmt.Errorf("failed to get rotation status: %v", err)
+	}
+	return status, nil
+}
+
+// Save persists the status and its report.
+func (s *Store) Save(status *Status) error {
+	return s.configMap.Save(StatusKey, status, map[string]string{ReportKey: status.Report()})
+}
@@ -0,0 +1,164 @@
+package credentials
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+// fakeCassandra accepts the password of the role, except on the stale pods.
+type fakeCassandra struct {
+	password  string
+	stale     map[string]bool
+	altered   int
+	refreshed []string
+}
+
+func (c *fakeCassandra) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	return "", fmt.Errorf("unexpected command %v", command)
+}
+
+func (c *fakeCassandra) ExecInput(pod *corev1.Pod, container string, command []string, input string) (string, error) {
+	lines := strings.SplitN(input, "\n", 3)
+	if command[1] == RefreshScript {
+		c.refreshed = append(c.refreshed, fmt.Sprintf("%s/%s:%s", pod.Name, container, lines[1]))
+		return "", nil
+	}
+	if lines[0] != "cassandra" || lines[1] != c.password || (c.stale[pod.Name] && c.altered > 0 && lines[1] != "old") {
+		return "", fmt.Errorf("Provided username and/or password are incorrect")
+	}
+	if command[2] == "-f" {
+		statement := strings.TrimSpace(lines[2])
+		if !strings.HasPrefix(statement, `ALTER ROLE "cassandra" WITH PASSWORD = '`) {
+			return "", fmt.Errorf("unexpected statement %s", statement)
+		}
+		c.password = strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(statement, `ALTER ROLE "cassandra" WITH PASSWORD = '`), "';"), "''", "'")
+		c.altered++
+	}
+	return "", nil
+}
+
+func pod(name string, ready bool, containers ...string) *corev1.Pod {
+	p := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "cassandra", "cassandra": "cassandra"}},
+	}
+	for _, container := range containers {
+		p.Spec.Containers = append(p.Spec.Containers, corev1.Container{Name: container})
+	}
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	p.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}
+	return p
+}
+
+func secret(name string, data map[string]string) *corev1.Secret {
+	s := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}, Data: map[string][]byte{}}
+	for key, value := range data {
+		s.Data[key] = []byte(value)
+	}
+	return s
+}
+
+var options = Options{SecretName: "auth", NewSecretName: "auth-new", Timeout: 10 * time.Millisecond, Interval: time.Millisecond}
+
+func rotate(t *testing.T, cassandra *fakeCassandra, pods ...*corev1.Pod) (*Status, *fake.Clientset, error) {
+	client := fake.NewSimpleClientset(
+		secret("auth", map[string]string{"username": "cassandra", "password": "old"}),
+		secret("auth-new", map[string]string{"password": "it's new"}),
+		pod("cassandra-node-0", true, "cassandra", "medusa-backup"),
+		pod("cassandra-node-1", true, "cassandra", "prometheus-exporter"),
+	)
+	for _, p := range pods {
+		_, err := client.CoreV1().Pods("default").Create(p)
+		assert.NoError(t, err)
+	}
+	status, err := rerun(client, cassandra)
+	return status, client, err
+}
+
+// rerun runs the rotation again, like a new pod of the job.
+func rerun(client *fake.Clientset, cassandra *fakeCassandra) (*Status, error) {
+	store := NewStore(state.NewConfigMapStore(client, "default", "cassandra-credentials-rotation", nil))
+	return NewRotator(client, cassandra, "default", "app = cassandra, cassandra", store, options).Run()
+}
+
+func password(t *testing.T, client *fake.Clientset) string {
+	s, err := client.CoreV1().Secrets("default").Get("auth", metav1.GetOptions{})
+	assert.NoError(t, err)
+	return string(s.Data["password"])
+}
+
+func TestRun(t *testing.T) {
+	cassandra := &fakeCassandra{password: "old"}
+	status, client, err := rotate(t, cassandra)
+	assert.NoError(t, err)
+	assert.Equal(t, PhaseCompleted, status.Phase)
+	assert.Equal(t, "it's new", cassandra.password)
+	assert.Equal(t, "it's new", password(t, client))
+	assert.Equal(t, []string{
+		"cassandra-node-0/cassandra:it's new",
+		"cassandra-node-0/medusa-backup:it's new",
+		"cassandra-node-1/cassandra:it's new",
+	}, cassandra.refreshed)
+
+	cm, err := client.CoreV1().ConfigMaps("default").Get("cassandra-credentials-rotation", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, cm.Data[ReportKey], "password rotation of role cassandra: Completed")
+	assert.NotContains(t, cm.Data[StatusKey], "it's new")
+}
+
+func TestRun_continue(t *testing.T) {
+	// An earlier run changed the password, but did not update the secret
+	cassandra := &fakeCassandra{password: "it's new"}
+	status, client, err := rotate(t, cassandra)
+	assert.NoError(t, err)
+	assert.Equal(t, PhaseCompleted, status.Phase)
+	assert.Equal(t, 0, cassandra.altered)
+	assert.Equal(t, "it's new", password(t, client))
+}
+
+func TestRun_rollback(t *testing.T) {
+	cassandra := &fakeCassandra{password: "old", stale: map[string]bool{"cassandra-node-1": true}}
+	status, client, err := rotate(t, cassandra)
+	assert.EqualError(t, err, "pod cassandra-node-1 does not accept the new password of role cassandra: Provided username and/or password are incorrect, the old password was restored")
+	assert.Equal(t, PhaseRolledBack, status.Phase)
+	assert.Equal(t, 2, cassandra.altered)
+	assert.Equal(t, "old", cassandra.password)
+	assert.Equal(t, "old", password(t, client))
+	assert.Empty(t, cassandra.refreshed)
+
+	// A retry of the job does not rotate the password again
+	_, err = rerun(client, cassandra)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "the rotation to the password in secret auth-new was rolled back")
+	}
+	assert.Equal(t, 2, cassandra.altered)
+
+	// A new password in the secret is rotated
+	newSecret := secret("auth-new", map[string]string{"password": "newer"})
+	newSecret.ResourceVersion = "2"
+	_, err = client.CoreV1().Secrets("default").Update(newSecret)
+	assert.NoError(t, err)
+	cassandra.stale = nil
+	status, err = rerun(client, cassandra)
+	assert.NoError(t, err)
+	assert.Equal(t, PhaseCompleted, status.Phase)
+	assert.Equal(t, "newer", password(t, client))
+}
+
+func TestRun_notReady(t *testing.T) {
+	cassandra := &fakeCassandra{password: "old"}
+	_, _, err := rotate(t, cassandra, pod("cassandra-node-2", false, "cassandra"))
+	assert.EqualError(t, err, "pod cassandra-node-2 is not ready, the password can only be rotated if all pods are ready")
+	assert.Equal(t, 0, cassandra.altered)
+}
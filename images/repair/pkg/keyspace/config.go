@@ -0,0 +1,146 @@
+package keyspace
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/nodetool"
+)
+
+// ConfigKey is the key of the declared keyspaces in the configmap.
+const ConfigKey = "keyspaces.yaml"
+
+// Config declares the keyspaces of a Cassandra instance:
+//
+//	keyspaces:
+//	  - name: shop
+//	    replicationFactor: 3
+//	    replication:
+//	      dc2: 2
+//	    tableDefaults:
+//	      gc_grace_seconds: 86400
+//	      compaction:
+//	        class: LeveledCompactionStrategy
+type Config struct {
+	Keyspaces []Keyspace `json:"keyspaces"`
+}
+
+// Keyspace is a declared keyspace. Declared keyspaces use the NetworkTopologyStrategy.
+type Keyspace struct {
+	Name string `json:"name"`
+	// ReplicationFactor is the replication factor in all datacenters of the cluster that are not listed in
+	// Replication, including datacenters that are added later.
+	ReplicationFactor int `json:"replicationFactor,omitempty"`
+	// Replication is the replication factor by datacenter. A datacenter with 0 has no replicas.
+	Replication map[string]int `json:"replication,omitempty"`
+	// DurableWrites is true if not set.
+	DurableWrites *bool `json:"durableWrites,omitempty"`
+	// TableDefaults are options that all tables of the keyspace should have, e.g. gc_grace_seconds. Map options like
+	// compaction are given as maps, only the listed sub options are compared with the tables.
+	TableDefaults map[string]interface{} `json:"tableDefaults,omitempty"`
+}
+
+// tableOptions are the table options that can be declared, with true for map options.
+var tableOptions = map[string]bool{
+	"bloom_filter_fp_chance":      false,
+	"caching":                     true,
+	"comment":                     false,
+	"compaction":                  true,
+	"compression":                 true,
+	"crc_check_chance":            false,
+	"dclocal_read_repair_chance":  false,
+	"default_time_to_live":        false,
+	"gc_grace_seconds":            false,
+	"max_index_interval":          false,
+	"memtable_flush_period_in_ms": false,
+	"min_index_interval":          false,
+	"read_repair_chance":          false,
+	"speculative_retry":           false,
+}
+
+var namePat = regexp.MustCompile(`^[a-zA-Z0-9_]{1,48}$`)
+
+// ParseConfig parses and validates the declared keyspaces.
+func ParseConfig(data []byte) (Config, error) {
+	config := Config{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("invalid keyspaces: %v", err)
+	}
+	return config, config.Validate()
+}
+
+// Validate checks that the keyspaces can be created.
+func (c Config) Validate() error {
+	names := map[string]bool{}
+	for _, ks := range c.Keyspaces {
+		if !namePat.MatchString(ks.Name) {
+			return fmt.Errorf("invalid keyspace name '%s'", ks.Name)
+		}
+		if nodetool.IsLocalKeyspace(ks.Name) {
+			return fmt.Errorf("keyspace %s is not replicated and can not be declared", ks.Name)
+		}
+		if names[ks.Name] {
+			return fmt.Errorf("keyspace %s is declared twice", ks.Name)
+		}
+		names[ks.Name] = true
+
+		if ks.ReplicationFactor < 0 {
+			return fmt.Errorf("keyspace %s: replicationFactor must not be negative", ks.Name)
+		}
+		replicated := ks.ReplicationFactor > 0
+		for dc, rf := range ks.Replication {
+			if rf < 0 {
+				return fmt.Errorf("keyspace %s: replication factor of datacenter %s must not be negative", ks.Name, dc)
+			}
+			replicated = replicated || rf > 0
+		}
+		if !replicated {
+			return fmt.Errorf("keyspace %s has no replicas, set replicationFactor or replication", ks.Name)
+		}
+		for option, value := range ks.TableDefaults {
+			isMap, ok := tableOptions[option]
+			if !ok {
+				return fmt.Errorf("keyspace %s: unsupported table option '%s'", ks.Name, option)
+			}
+			if _, ok := value.(map[string]interface{}); ok != isMap {
+				return fmt.Errorf("keyspace %s: table option '%s' has an invalid value %v", ks.Name, option, value)
+			}
+		}
+	}
+	return nil
+}
+
+// replication returns the replication factors of the keyspace in the datacenters of the cluster. Datacenters without
+// replicas are omitted.
+func (ks Keyspace) replication(datacenters []string) map[string]int {
+	replication := map[string]int{}
+	for _, dc := range datacenters {
+		if ks.ReplicationFactor > 0 {
+			replication[dc] = ks.ReplicationFactor
+		}
+	}
+	for dc, rf := range ks.Replication {
+		if rf > 0 {
+			replication[dc] = rf
+		} else {
+			delete(replication, dc)
+		}
+	}
+	return replication
+}
+
+func (ks Keyspace) durableWrites() bool {
+	return ks.DurableWrites == nil || *ks.DurableWrites
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
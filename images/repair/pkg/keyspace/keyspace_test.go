@@ -0,0 +1,232 @@
+package keyspace
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+const (
+	fakeKeyspaces = `
+ [json]
+------------------------------------------------------------------------------------------------------------------------------
+ {"keyspace_name": "system_auth", "durable_writes": true, "replication": {"class": "org.apache.cassandra.locator.SimpleStrategy", "replication_factor": "1"}}
+                                      {"keyspace_name": "shop", "durable_writes": true, "replication": {"class": "org.apache.cassandra.locator.NetworkTopologyStrategy", "dc1": "2", "dc2": "1"}}
+
+(2 rows)
+`
+	fakeTables = `
+ [json]
+------------------------------------------------------------------------------------------------------------------------------
+ {"keyspace_name": "shop", "table_name": "orders", "gc_grace_seconds": 864000, "compaction": {"class": "org.apache.cassandra.db.compaction.SizeTieredCompactionStrategy", "max_threshold": "32", "min_threshold": "4"}}
+ {"keyspace_name": "shop", "table_name": "users", "gc_grace_seconds": 86400, "compaction": {"class": "org.apache.cassandra.db.compaction.LeveledCompactionStrategy"}}
+
+(2 rows)
+`
+	fakeLocal = `
+ [json]
+--------------------------
+ {"data_center": "dc1"}
+
+(1 rows)
+`
+	fakePeers = `
+ [json]
+--------------------------
+ {"data_center": "dc1"}
+ {"data_center": "dc1"}
+ {"data_center": "dc2"}
+ {"data_center": "dc2"}
+
+(4 rows)
+`
+)
+
+type fakeExecutor struct {
+	statements []string
+	// fail is a prefix of statements that fail
+	fail string
+}
+
+func (e *fakeExecutor) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	statement := command[2]
+	switch statement {
+	case keyspacesQuery:
+		return fakeKeyspaces, nil
+	case tablesQuery:
+		return fakeTables, nil
+	case localQuery:
+		return fakeLocal, nil
+	case peersQuery:
+		return fakePeers, nil
+	}
+	if e.fail != "" && strings.HasPrefix(statement, e.fail) {
+		return "", fmt.Errorf("failed")
+	}
+	e.statements = append(e.statements, statement)
+	return "", nil
+}
+
+func schema(t *testing.T) *Schema {
+	s, err := ReadSchema(&fakeExecutor{}, &corev1.Pod{})
+	assert.NoError(t, err)
+	return s
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+keyspaces:
+  - name: shop
+    replicationFactor: 3
+    replication:
+      dc2: 0
+    durableWrites: false
+    tableDefaults:
+      gc_grace_seconds: 86400
+      compaction:
+        class: LeveledCompactionStrategy
+`))
+	assert.NoError(t, err)
+	assert.Len(t, config.Keyspaces, 1)
+	assert.Equal(t, map[string]int{"dc1": 3}, config.Keyspaces[0].replication([]string{"dc1", "dc2"}))
+	assert.False(t, config.Keyspaces[0].durableWrites())
+
+	for _, invalid := range []string{
+		"keyspaces:\n  - name: shop-1\n    replicationFactor: 1\n",
+		"keyspaces:\n  - name: system\n    replicationFactor: 1\n",
+		"keyspaces:\n  - name: shop\n",
+		"keyspaces:\n  - name: shop\n    replication:\n      dc1: 0\n",
+		"keyspaces:\n  - name: shop\n    replicationFactor: 1\n  - name: shop\n    replicationFactor: 1\n",
+		"keyspaces:\n  - name: shop\n    replicationFactor: 1\n    tableDefaults:\n      id: 1\n",
+		"keyspaces:\n  - name: shop\n    replicationFactor: 1\n    tableDefaults:\n      compaction: LeveledCompactionStrategy\n",
+		"keyspaces:\n  - name: shop\n    replicas: 1\n",
+	} {
+		_, err := ParseConfig([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestReadSchema(t *testing.T) {
+	s := schema(t)
+	assert.Equal(t, map[string]int{"dc1": 3, "dc2": 2}, s.Datacenters)
+	assert.Len(t, s.Keyspaces, 2)
+	replicas, _ := s.Keyspaces["shop"].Replicas()
+	assert.Equal(t, map[string]int{"dc1": 2, "dc2": 1}, replicas)
+	replicas, simple := s.Keyspaces["system_auth"].Replicas()
+	assert.Nil(t, replicas)
+	assert.Equal(t, 1, simple)
+	assert.Len(t, s.Tables["shop"], 2)
+}
+
+func TestNewPlan(t *testing.T) {
+	config := Config{Keyspaces: []Keyspace{
+		{Name: "events", ReplicationFactor: 2},
+		{Name: "shop", ReplicationFactor: 3, Replication: map[string]int{"dc2": 1}, TableDefaults: map[string]interface{}{
+			"gc_grace_seconds": 86400.0,
+			"compaction":       map[string]interface{}{"class": "LeveledCompactionStrategy"},
+		}},
+		{Name: "system_auth", ReplicationFactor: 2},
+	}}
+	plan, err := NewPlan(config, schema(t), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Keyspace: "events", Statement: `CREATE KEYSPACE "events" WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': 2, 'dc2': 2} AND durable_writes = true`},
+		{Keyspace: "shop", Statement: `ALTER KEYSPACE "shop" WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': 3, 'dc2': 1} AND durable_writes = true`, Repair: true},
+		{Keyspace: "shop", Statement: `ALTER TABLE "shop"."orders" WITH compaction = {'class': 'LeveledCompactionStrategy'} AND gc_grace_seconds = 86400`},
+		{Keyspace: "system_auth", Statement: `ALTER KEYSPACE "system_auth" WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': 2, 'dc2': 2} AND durable_writes = true`, Repair: true},
+	}, plan.Changes)
+	assert.Empty(t, plan.Blocked)
+
+	// Nothing changes once the keyspaces have their declared state
+	config = Config{Keyspaces: []Keyspace{{Name: "shop", Replication: map[string]int{"dc1": 2, "dc2": 1}}}}
+	plan, err = NewPlan(config, schema(t), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, plan.Changes)
+}
+
+func TestNewPlan_lowered(t *testing.T) {
+	config := Config{Keyspaces: []Keyspace{{Name: "shop", Replication: map[string]int{"dc1": 3}}}}
+	plan, err := NewPlan(config, schema(t), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, plan.Changes)
+	assert.Equal(t, []Blocked{{Keyspace: "shop", Reason: "the replication factor would be lowered in dc2 from 1 to 0"}}, plan.Blocked)
+
+	plan, err = NewPlan(config, schema(t), []string{"shop"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Keyspace: "shop", Statement: `ALTER KEYSPACE "shop" WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': 3} AND durable_writes = true`, Repair: true},
+	}, plan.Changes)
+	assert.Empty(t, plan.Blocked)
+	assert.Equal(t, []string{"shop"}, plan.Lowered)
+}
+
+func TestNewPlan_invalid(t *testing.T) {
+	_, err := NewPlan(Config{Keyspaces: []Keyspace{{Name: "shop", Replication: map[string]int{"dc3": 1}}}}, schema(t), nil)
+	assert.EqualError(t, err, "keyspace shop: datacenter dc3 does not exist, the datacenters are dc1, dc2")
+	_, err = NewPlan(Config{Keyspaces: []Keyspace{{Name: "shop", ReplicationFactor: 3}}}, schema(t), nil)
+	assert.EqualError(t, err, "keyspace shop: replication factor 3 of datacenter dc2 is higher than its 2 nodes")
+}
+
+func TestRun(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := NewStore(state.NewConfigMapStore(client, "default", "cassandra-keyspaces", nil))
+	config := Config{Keyspaces: []Keyspace{
+		{Name: "events", ReplicationFactor: 1},
+		{Name: "shop", Replication: map[string]int{"dc1": 3, "dc2": 1}},
+	}}
+
+	// The repair fails, the keyspace is repaired by the next run
+	executor := &fakeExecutor{}
+	repaired := [][]string{}
+	repairErr := fmt.Errorf("repair failed")
+	repair := func(keyspaces []string) error {
+		repaired = append(repaired, keyspaces)
+		return repairErr
+	}
+	status, err := NewReconciler(executor, store, repair, Options{Repair: true}).Run(config, &corev1.Pod{})
+	assert.EqualError(t, err, "failed to repair keyspaces shop: repair failed")
+	assert.Len(t, executor.statements, 2)
+	assert.Equal(t, []string{"shop"}, status.PendingRepair)
+
+	repairErr = nil
+	config.Keyspaces = config.Keyspaces[1:2]
+	config.Keyspaces[0].Replication["dc1"] = 2
+	executor = &fakeExecutor{}
+	status, err = NewReconciler(executor, store, repair, Options{Repair: true}).Run(config, &corev1.Pod{})
+	assert.NoError(t, err)
+	assert.Empty(t, executor.statements)
+	assert.Empty(t, status.PendingRepair)
+	assert.Equal(t, [][]string{{"shop"}, {"shop"}}, repaired)
+
+	cm, err := client.CoreV1().ConfigMaps("default").Get("cassandra-keyspaces", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "All keyspaces have their declared replication and table defaults\n", cm.Data[ReportKey])
+}
+
+func TestRun_blocked(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := NewStore(state.NewConfigMapStore(client, "default", "cassandra-keyspaces", nil))
+	config := Config{Keyspaces: []Keyspace{{Name: "shop", ReplicationFactor: 1}}}
+	executor := &fakeExecutor{fail: "ALTER TABLE"}
+	repair := func(keyspaces []string) error {
+		assert.Fail(t, "no replicas are added")
+		return nil
+	}
+
+	status, err := NewReconciler(executor, store, repair, Options{Repair: true}).Run(config, &corev1.Pod{})
+	assert.EqualError(t, err, "1 keyspaces would lower their replication factor without confirmation")
+	assert.Empty(t, executor.statements)
+	assert.Contains(t, status.Report(), "blocked: keyspace shop, the replication factor would be lowered in dc1 from 2 to 1")
+
+	config.Keyspaces[0].TableDefaults = map[string]interface{}{"gc_grace_seconds": 3600.0}
+	_, err = NewReconciler(executor, store, repair, Options{Confirmed: []string{"shop"}}).Run(config, &corev1.Pod{})
+	assert.EqualError(t, err, "failed to change keyspace shop: failed")
+	assert.Len(t, executor.statements, 1)
+}
@@ -0,0 +1,225 @@
+package keyspace
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Change is a statement that brings a keyspace or table to its declared state.
+type Change struct {
+	Keyspace  string
+	Statement string
+	// Repair is true if the change adds replicas, which receive the existing data of the keyspace with a repair.
+	Repair bool
+}
+
+// Blocked is a declared keyspace that is not changed.
+type Blocked struct {
+	Keyspace string
+	Reason   string
+}
+
+// Plan contains the changes that bring the keyspaces to their declared state.
+type Plan struct {
+	Changes []Change
+	// Blocked are keyspaces whose replication factor would be lowered without confirmation.
+	Blocked []Blocked
+	// Lowered are keyspaces whose replication factor is lowered. The removed replicas keep their data until
+	// 'nodetool cleanup' runs on them.
+	Lowered []string
+}
+
+// NewPlan compares the declared keyspaces with the schema. The replication factor of the confirmed keyspaces may be
+// lowered.
+func NewPlan(config Config, schema *Schema, confirmed []string) (*Plan, error) {
+	datacenters := sortedKeys(schema.Datacenters)
+	plan := &Plan{}
+	for _, ks := range config.Keyspaces {
+		replication := ks.replication(datacenters)
+		for dc, rf := range replication {
+			nodes, ok := schema.Datacenters[dc]
+			if !ok {
+				return nil, fmt.Errorf("keyspace %s: datacenter %s does not exist, the datacenters are %s", ks.Name, dc, strings.Join(datacenters, ", "))
+			}
+			if rf > nodes {
+				return nil, fmt.Errorf("keyspace %s: replication factor %d of datacenter %s is higher than its %d nodes", ks.Name, rf, dc, nodes)
+			}
+		}
+
+		current, exists := schema.Keyspaces[ks.Name]
+		if !exists {
+			plan.Changes = append(plan.Changes, Change{
+				Keyspace:  ks.Name,
+				Statement: fmt.Sprintf("CREATE KEYSPACE %s WITH replication = %s AND durable_writes = %t", quote(ks.Name), replicationLiteral(replication), ks.durableWrites()),
+			})
+			continue
+		}
+
+		lowered, added := compare(current, replication)
+		switch {
+		case lowered != "" && !contains(confirmed, ks.Name):
+			plan.Blocked = append(plan.Blocked, Blocked{Keyspace: ks.Name, Reason: lowered})
+		case lowered != "" || added || current.DurableWrites != ks.durableWrites():
+			plan.Changes = append(plan.Changes, Change{
+				Keyspace:  ks.Name,
+				Statement: fmt.Sprintf("ALTER KEYSPACE %s WITH replication = %s AND durable_writes = %t", quote(ks.Name), replicationLiteral(replication), ks.durableWrites()),
+				Repair:    added,
+			})
+			if lowered != "" {
+				plan.Lowered = append(plan.Lowered, ks.Name)
+			}
+		}
+
+		plan.Changes = append(plan.Changes, tableChanges(ks, schema.Tables[ks.Name])...)
+	}
+	return plan, nil
+}
+
+// compare returns why the declared replication lowers the replication factor of the keyspace, or an empty string,
+// and true if it adds replicas.
+func compare(current CurrentKeyspace, replication map[string]int) (string, bool) {
+	replicas, simple := current.Replicas()
+	if replicas == nil {
+		// The replicas of the SimpleStrategy do not depend on the datacenters, all of them move
+		total := 0
+		for _, rf := range replication {
+			total += rf
+		}
+		if total < simple {
+			return fmt.Sprintf("the %s with %d replicas would be replaced by %d replicas", current.Strategy(), simple, total), true
+		}
+		return "", true
+	}
+
+	lowered := []string{}
+	added := false
+	for _, dc := range sortedKeys(union(replicas, replication)) {
+		if replication[dc] < replicas[dc] {
+			lowered = append(lowered, fmt.Sprintf("%s from %d to %d", dc, replicas[dc], replication[dc]))
+		}
+		if replication[dc] > replicas[dc] {
+			added = true
+		}
+	}
+	if len(lowered) > 0 {
+		return "the replication factor would be lowered in " + strings.Join(lowered, ", "), added
+	}
+	return "", added
+}
+
+// tableChanges returns the changes of the tables of the keyspace that do not have the declared table defaults.
+func tableChanges(ks Keyspace, tables map[string]map[string]interface{}) []Change {
+	options := make([]string, 0, len(ks.TableDefaults))
+	for option := range ks.TableDefaults {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changes := []Change{}
+	for _, name := range names {
+		set := []string{}
+		for _, option := range options {
+			declared := ks.TableDefaults[option]
+			if !optionEqual(declared, tables[name][option]) {
+				set = append(set, fmt.Sprintf("%s = %s", option, literal(declared)))
+			}
+		}
+		if len(set) > 0 {
+			changes = append(changes, Change{
+				Keyspace:  ks.Name,
+				Statement: fmt.Sprintf("ALTER TABLE %s.%s WITH %s", quote(ks.Name), quote(name), strings.Join(set, " AND ")),
+			})
+		}
+	}
+	return changes
+}
+
+// optionEqual returns true if the current value of a table option has the declared value. Only the declared sub
+// options of map options are compared, and a class matches the fully qualified class name.
+func optionEqual(declared, current interface{}) bool {
+	declaredMap, ok := declared.(map[string]interface{})
+	if !ok {
+		return strings.EqualFold(fmt.Sprint(declared), fmt.Sprint(current))
+	}
+	currentMap, ok := current.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for key, value := range declaredMap {
+		d, c := fmt.Sprint(value), fmt.Sprint(currentMap[key])
+		if key == "class" && strings.HasSuffix(c, "."+d) {
+			continue
+		}
+		if !strings.EqualFold(d, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// literal returns the CQL literal of an option value. Map values are strings.
+func literal(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return stringLiteral(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		entries := make([]string, 0, len(keys))
+		for _, key := range keys {
+			entries = append(entries, fmt.Sprintf("%s: %s", stringLiteral(key), stringLiteral(fmt.Sprint(v[key]))))
+		}
+		return "{" + strings.Join(entries, ", ") + "}"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func replicationLiteral(replication map[string]int) string {
+	entries := []string{fmt.Sprintf("'class': '%s'", networkTopologyStrategy)}
+	for _, dc := range sortedKeys(replication) {
+		entries = append(entries, fmt.Sprintf("%s: %d", stringLiteral(dc), replication[dc]))
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+func stringLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// quote returns the quoted identifier, which keeps its case.
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func union(a, b map[string]int) map[string]int {
+	u := map[string]int{}
+	for key := range a {
+		u[key] = 0
+	}
+	for key := range b {
+		u[key] = 0
+	}
+	return u
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
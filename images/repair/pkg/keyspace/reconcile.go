@@ -0,0 +1,169 @@
+package keyspace
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/nodetool"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+const (
+	// StatusKey contains the status of the reconciler as JSON.
+	StatusKey = "status.json"
+	// ReportKey contains a human readable summary of the last run.
+	ReportKey = "report"
+)
+
+// Options configure a reconciler run.
+type Options struct {
+	// Confirmed are the keyspaces whose replication factor may be lowered.
+	Confirmed []string
+	// Repair repairs the keyspaces with new replicas. Otherwise they are only recorded as pending.
+	Repair bool
+}
+
+// Repairer repairs all token ranges of the keyspaces.
+type Repairer func(keyspaces []string) error
+
+// Status is the persisted state of the reconciler across runs.
+type Status struct {
+	// PendingRepair are keyspaces that got new replicas and were not repaired yet, they are repaired by the next run.
+	PendingRepair []string `json:"pendingRepair,omitempty"`
+	// Applied are the statements of the last run.
+	Applied []string `json:"applied,omitempty"`
+	// Blocked are the keyspaces that the last run did not change, with the reason.
+	Blocked []Blocked `json:"blocked,omitempty"`
+	// Lowered are the keyspaces whose replication factor the last run lowered.
+	Lowered []string `json:"lowered,omitempty"`
+}
+
+// Report returns a human readable summary of the status.
+func (s *Status) Report() string {
+	b := &strings.Builder{}
+	if len(s.Applied) == 0 {
+		fmt.Fprintf(b, "All keyspaces have their declared replication and table defaults\n")
+	}
+	for _, statement := range s.Applied {
+		fmt.Fprintf(b, "applied: %s\n", statement)
+	}
+	for _, blocked := range s.Blocked {
+		fmt.Fprintf(b, "blocked: keyspace %s, %s; confirm it with KEYSPACES_CONFIRM_RF_DECREASE\n", blocked.Keyspace, blocked.Reason)
+	}
+	for _, keyspace := range s.Lowered {
+		fmt.Fprintf(b, "lowered: keyspace %s, run 'nodetool cleanup %s' on all nodes to remove the data of the old replicas\n", keyspace, keyspace)
+	}
+	if len(s.PendingRepair) > 0 {
+		fmt.Fprintf(b, "pending repair: %s\n", strings.Join(s.PendingRepair, ", "))
+	}
+	return b.String()
+}
+
+// Reconciler brings the keyspaces of a Cassandra instance to their declared replication and table defaults.
+type Reconciler struct {
+	executor nodetool.Executor
+	store    *Store
+	repair   Repairer
+	options  Options
+}
+
+func NewReconciler(executor nodetool.Executor, store *Store, repair Repairer, options Options) *Reconciler {
+	return &Reconciler{executor: executor, store: store, repair: repair, options: options}
+}
+
+// Run applies the changes with cqlsh in the pod and repairs the keyspaces with new replicas. It returns an error if
+// a keyspace is blocked or could not be changed or repaired.
+func (r *Reconciler) Run(config Config, pod *corev1.Pod) (*Status, error) {
+	status, err := r.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ReadSchema(r.executor, pod)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := NewPlan(config, schema, r.options.Confirmed)
+	if err != nil {
+		return nil, err
+	}
+
+	status.Applied, status.Blocked, status.Lowered = nil, plan.Blocked, plan.Lowered
+	var failed error
+	for _, change := range plan.Changes {
+		log.Infof("Keyspace %s: %s", change.Keyspace, change.Statement)
+		if _, err := nodetool.CQL(r.executor, pod, change.Statement); err != nil {
+			failed = fmt.Errorf("failed to change keyspace %s: %v", change.Keyspace, err)
+			break
+		}
+		status.Applied = append(status.Applied, change.Statement)
+		if change.Repair && !contains(status.PendingRepair, change.Keyspace) {
+			status.PendingRepair = append(status.PendingRepair, change.Keyspace)
+			sort.Strings(status.PendingRepair)
+		}
+		// The keyspaces that need a repair are kept if the run is interrupted
+		if err := r.store.Save(status); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+	for _, blocked := range plan.Blocked {
+		log.Errorf("Keyspace %s is not changed: %s", blocked.Keyspace, blocked.Reason)
+	}
+
+	if failed == nil && len(status.PendingRepair) > 0 {
+		if r.options.Repair {
+			log.Infof("Repairing the keyspaces with new replicas: %s", strings.Join(status.PendingRepair, ", "))
+			if err := r.repair(status.PendingRepair); err != nil {
+				failed = fmt.Errorf("failed to repair keyspaces %s: %v", strings.Join(status.PendingRepair, ", "), err)
+			} else {
+				status.PendingRepair = nil
+			}
+		} else {
+			log.Warnf("Keyspaces %s have new replicas and need a repair", strings.Join(status.PendingRepair, ", "))
+		}
+	}
+
+	if err := r.store.Save(status); err != nil {
+		log.Errorf("%v", err)
+	}
+	log.Infof("Keyspaces reconciled:\n%s", status.Report())
+	if failed != nil {
+		return status, failed
+	}
+	if len(plan.Blocked) > 0 {
+		return status, fmt.Errorf("%d keyspaces would lower their replication factor without confirmation", len(plan.Blocked))
+	}
+	return status, nil
+}
+
+// Store keeps the status of the reconciler in a configmap.
+type Store struct {
+	configMap *state.ConfigMapStore
+}
+
+// NewStore returns a store for the configmap.
+func NewStore(configMap *state.ConfigMapStore) *Store {
+	return &Store{configMap: configMap}
+}
+
+// Load returns the status of the last run, or an empty status.
+func (s *Store) Load() (*Status, error) {
+	status := &Status{}
+	_, err := s.configMap.Load(StatusKey, status)
+	if state.IsInvalid(err) {
+		log.Warnf("Ignoring invalid keyspace status: %v", err)
+		return &Status{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keyspace status: %v", err)
+	}
+	return status, nil
+}
+
+// Save persists the status and its report.
+func (s *Store) Save(status *Status) error {
+	return s.configMap.Save(StatusKey, status, map[string]string{ReportKey: status.Report()})
+}
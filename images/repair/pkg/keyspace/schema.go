@@ -0,0 +1,119 @@
+package keyspace
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/nodetool"
+)
+
+const (
+	keyspacesQuery = "SELECT JSON keyspace_name, durable_writes, replication FROM system_schema.keyspaces"
+	tablesQuery    = "SELECT JSON * FROM system_schema.tables"
+	localQuery     = "SELECT JSON data_center FROM system.local"
+	peersQuery     = "SELECT JSON data_center FROM system.peers"
+)
+
+// networkTopologyStrategy is the replication strategy of declared keyspaces.
+const networkTopologyStrategy = "NetworkTopologyStrategy"
+
+// Schema is the current state of the keyspaces of the cluster.
+type Schema struct {
+	Keyspaces map[string]CurrentKeyspace
+	// Tables are the options of the tables by keyspace and table name.
+	Tables map[string]map[string]map[string]interface{}
+	// Datacenters contains the number of nodes of every datacenter.
+	Datacenters map[string]int
+}
+
+// CurrentKeyspace is an existing keyspace.
+type CurrentKeyspace struct {
+	// Replication is the replication of the keyspace, the class of the strategy and its options.
+	Replication   map[string]string `json:"replication"`
+	DurableWrites bool              `json:"durable_writes"`
+}
+
+// Strategy returns the class name of the replication strategy without its package.
+func (ks CurrentKeyspace) Strategy() string {
+	class := ks.Replication["class"]
+	return class[strings.LastIndex(class, ".")+1:]
+}
+
+// Replicas returns the replication factor of every datacenter with the NetworkTopologyStrategy, or the total
+// replication factor with the SimpleStrategy.
+func (ks CurrentKeyspace) Replicas() (map[string]int, int) {
+	if ks.Strategy() != networkTopologyStrategy {
+		rf, _ := strconv.Atoi(ks.Replication["replication_factor"])
+		return nil, rf
+	}
+	replication := map[string]int{}
+	for key, value := range ks.Replication {
+		if rf, err := strconv.Atoi(value); err == nil && key != "class" && rf > 0 {
+			replication[key] = rf
+		}
+	}
+	return replication, 0
+}
+
+// ReadSchema reads the keyspaces, tables and datacenters from the Cassandra node in the pod.
+func ReadSchema(executor nodetool.Executor, pod *corev1.Pod) (*Schema, error) {
+	schema := &Schema{
+		Keyspaces:   map[string]CurrentKeyspace{},
+		Tables:      map[string]map[string]map[string]interface{}{},
+		Datacenters: map[string]int{},
+	}
+
+	out, err := nodetool.CQL(executor, pod, keyspacesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyspaces: %v", err)
+	}
+	rows, err := nodetool.ParseJSONRows(out)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		name, _ := row["keyspace_name"].(string)
+		data, _ := json.Marshal(row)
+		ks := CurrentKeyspace{}
+		if err := json.Unmarshal(data, &ks); err != nil {
+			return nil, fmt.Errorf("invalid replication of keyspace %s: %v", name, err)
+		}
+		schema.Keyspaces[name] = ks
+	}
+
+	out, err = nodetool.CQL(executor, pod, tablesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tables: %v", err)
+	}
+	if rows, err = nodetool.ParseJSONRows(out); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		keyspace, _ := row["keyspace_name"].(string)
+		table, _ := row["table_name"].(string)
+		if schema.Tables[keyspace] == nil {
+			schema.Tables[keyspace] = map[string]map[string]interface{}{}
+		}
+		schema.Tables[keyspace][table] = row
+	}
+
+	for _, query := range []string{localQuery, peersQuery} {
+		out, err := nodetool.CQL(executor, pod, query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read datacenters: %v", err)
+		}
+		if rows, err = nodetool.ParseJSONRows(out); err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if dc, ok := row["data_center"].(string); ok {
+				schema.Datacenters[dc]++
+			}
+		}
+	}
+	return schema, nil
+}
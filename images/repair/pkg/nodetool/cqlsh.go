@@ -0,0 +1,101 @@
+package nodetool
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// tablesQuery lists the tables of all keyspaces with their gc_grace_seconds.
+const tablesQuery = "SELECT keyspace_name, table_name, gc_grace_seconds FROM system_schema.tables"
+
+// Table is a table of a keyspace.
+type Table struct {
+	Keyspace string
+	Name     string
+	// GCGrace is the time after which tombstones of the table can be purged. A table has to be repaired within
+	// this time, otherwise deleted data can reappear.
+	GCGrace time.Duration
+}
+
+// FullName returns 'keyspace.table'.
+func (t Table) FullName() string {
+	return fmt.Sprintf("%s.%s", t.Keyspace, t.Name)
+}
+
+// CQL runs the statement with cqlsh in the Cassandra container of the pod. cqlsh uses the cqlshrc of the node,
+// which contains its credentials and TLS settings.
+func CQL(executor Executor, pod *corev1.Pod, statement string) (string, error) {
+	return executor.Exec(pod, Container, []string{"cqlsh", "-e", statement})
+}
+
+// CQLInput runs the statements with cqlsh in the Cassandra container of the pod. The statements are passed on stdin,
+// so that secrets like passwords in them do not show up in process lists and errors.
+func CQLInput(executor InputExecutor, pod *corev1.Pod, statements string) (string, error) {
+	return executor.ExecInput(pod, Container, []string{"cqlsh", "-f", "/dev/stdin"}, statements)
+}
+
+// ParseJSONRows returns the rows of the cqlsh output of a 'SELECT JSON' query.
+func ParseJSONRows(out string) ([]map[string]interface{}, error) {
+	rows := []map[string]interface{}{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		row := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			return nil, fmt.Errorf("invalid row '%s': %v", line, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ParseTables returns the tables from the cqlsh output of the tables query.
+func ParseTables(out string) ([]Table, error) {
+	tables := []Table{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) != 3 {
+			continue
+		}
+		keyspace, name, seconds := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]), strings.TrimSpace(fields[2])
+		if keyspace == "keyspace_name" {
+			// header
+			continue
+		}
+		s, err := strconv.Atoi(seconds)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gc_grace_seconds '%s' of table %s.%s: %v", seconds, keyspace, name, err)
+		}
+		tables = append(tables, Table{Keyspace: keyspace, Name: name, GCGrace: time.Duration(s) * time.Second})
+	}
+	return tables, nil
+}
+
+// Tables returns the tables of the keyspaces, as seen by the Cassandra node in the pod.
+func Tables(executor Executor, pod *corev1.Pod, keyspaces []string) ([]Table, error) {
+	out, err := CQL(executor, pod, tablesQuery)
+	if err != nil {
+		return nil, err
+	}
+	all, err := ParseTables(out)
+	if err != nil {
+		return nil, err
+	}
+	tables := []Table{}
+	for _, table := range all {
+		for _, keyspace := range keyspaces {
+			if table.Keyspace == keyspace {
+				tables = append(tables, table)
+				break
+			}
+		}
+	}
+	return tables, nil
+}
@@ -0,0 +1,138 @@
+package nodetool
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// Container is the name of the Cassandra container in the node pods.
+	Container = "cassandra"
+	// Script runs nodetool with the JMX credentials and TLS settings of the node.
+	Script = "/etc/cassandra/node-nodetool.sh"
+)
+
+// LocalKeyspaces use the LocalStrategy, they are not replicated and can not be repaired.
+var LocalKeyspaces = []string{"system", "system_schema"}
+
+// Executor runs commands in containers of a pod.
+type Executor interface {
+	Exec(pod *corev1.Pod, container string, command []string) (string, error)
+}
+
+// InputExecutor runs commands in containers of a pod with input on stdin. The input does not show up in the
+// command line of the process or in errors.
+type InputExecutor interface {
+	Executor
+	ExecInput(pod *corev1.Pod, container string, command []string, input string) (string, error)
+}
+
+type podExecutor struct {
+	config *rest.Config
+	client kubernetes.Interface
+}
+
+// NewPodExecutor returns an Executor that uses the pods/exec subresource.
+func NewPodExecutor(config *rest.Config, client kubernetes.Interface) InputExecutor {
+	return &podExecutor{config: config, client: client}
+}
+
+func (e *podExecutor) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	return e.exec(pod, container, command, nil)
+}
+
+func (e *podExecutor) ExecInput(pod *corev1.Pod, container string, command []string, input string) (string, error) {
+	return e.exec(pod, container, command, strings.NewReader(input))
+}
+
+func (e *podExecutor) exec(pod *corev1.Pod, container string, command []string, stdin io.Reader) (string, error) {
+	req := e.client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod.Name).
+		Namespace(pod.Namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(e.config, "POST", req.URL())
+	if err != nil {
+		return "", fmt.Errorf("failed to create executor for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = exec.Stream(remotecommand.StreamOptions{Stdin: stdin, Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		return stdout.String(), fmt.Errorf("command %v in pod %s/%s failed: %v: %s", command, pod.Namespace, pod.Name, err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// Run runs nodetool with the arguments in the Cassandra container of the pod.
+func Run(executor Executor, pod *corev1.Pod, args ...string) (string, error) {
+	return executor.Exec(pod, Container, append([]string{"/bin/bash", Script}, args...))
+}
+
+var keyspacePat = regexp.MustCompile(`^Keyspace\s*:\s*(\S+)\s*$`)
+
+// ParseKeyspaces returns the sorted keyspace names from the output of 'nodetool tablestats'.
+func ParseKeyspaces(tablestats string) []string {
+	keyspaces := []string{}
+	for _, line := range strings.Split(tablestats, "\n") {
+		if match := keyspacePat.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			keyspaces = append(keyspaces, match[1])
+		}
+	}
+	sort.Strings(keyspaces)
+	return keyspaces
+}
+
+// Keyspaces returns all keyspaces that can be repaired, as seen by the Cassandra node in the pod.
+func Keyspaces(executor Executor, pod *corev1.Pod) ([]string, error) {
+	out, err := Run(executor, pod, "tablestats")
+	if err != nil {
+		return nil, err
+	}
+	keyspaces := []string{}
+	for _, keyspace := range ParseKeyspaces(out) {
+		if !IsLocalKeyspace(keyspace) {
+			keyspaces = append(keyspaces, keyspace)
+		}
+	}
+	return keyspaces, nil
+}
+
+// IsLocalKeyspace returns true for keyspaces that are not replicated.
+func IsLocalKeyspace(keyspace string) bool {
+	for _, local := range LocalKeyspaces {
+		if keyspace == local {
+			return true
+		}
+	}
+	return false
+}
+
+// DescribeRing returns the output of 'nodetool describering' for the keyspace.
+func DescribeRing(executor Executor, pod *corev1.Pod, keyspace string) (string, error) {
+	return Run(executor, pod, "describering", keyspace)
+}
+
+// RepairRange repairs the token range (start, end] of the keyspace on all of its replicas. The pod coordinates
+// the repair.
+func RepairRange(executor Executor, pod *corev1.Pod, keyspace, start, end string) (string, error) {
+	return Run(executor, pod, "repair", "-full", "-st", start, "-et", end, keyspace)
+}
@@ -0,0 +1,53 @@
+package nodetool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyspaces(t *testing.T) {
+	out := `Total number of tables: 37
+----------------
+Keyspace : system_traces
+	Read Count: 0
+		Table: events
+----------------
+Keyspace : shop
+	Read Count: 12
+----------------
+Keyspace : system
+	Read Count: 45
+`
+	assert.Equal(t, []string{"shop", "system", "system_traces"}, ParseKeyspaces(out))
+	assert.Empty(t, ParseKeyspaces(""))
+}
+
+func TestIsLocalKeyspace(t *testing.T) {
+	assert.True(t, IsLocalKeyspace("system"))
+	assert.True(t, IsLocalKeyspace("system_schema"))
+	assert.False(t, IsLocalKeyspace("system_auth"))
+}
+
+func TestParseTables(t *testing.T) {
+	out := `
+ keyspace_name | table_name | gc_grace_seconds
+---------------+------------+------------------
+          shop |     orders |           864000
+          shop |      carts |             3600
+   system_auth |      roles |             7776000
+
+(3 rows)
+`
+	tables, err := ParseTables(out)
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{
+		{Keyspace: "shop", Name: "orders", GCGrace: 240 * time.Hour},
+		{Keyspace: "shop", Name: "carts", GCGrace: time.Hour},
+		{Keyspace: "system_auth", Name: "roles", GCGrace: 2160 * time.Hour},
+	}, tables)
+
+	_, err = ParseTables("shop | orders | ten days")
+	assert.Error(t, err)
+}
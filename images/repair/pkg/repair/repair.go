@@ -0,0 +1,404 @@
+package repair
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/nodetool"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/ring"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+// Options configure a repair run.
+type Options struct {
+	// Keyspaces to repair, all replicated keyspaces if empty.
+	Keyspaces []string
+	// Pod limits the repair to the ranges of the Cassandra node of the pod, which coordinates all repairs.
+	Pod string
+	// Parallelism is the maximum number of concurrent repairs coordinated by the nodes of a datacenter.
+	Parallelism int
+	// SegmentsPerRange splits every token range of the ring into this many subranges.
+	SegmentsPerRange int
+	// Intensity is the share of time the replicas of a range spend repairing. With 0.5, the replicas pause after a
+	// repair for as long as the repair took.
+	Intensity float64
+	// Retries is the number of times a failed subrange is repaired again.
+	Retries int
+}
+
+// DefaultOptions repair all keyspaces one subrange at a time per datacenter.
+func DefaultOptions() Options {
+	return Options{Parallelism: 1, SegmentsPerRange: 1, Intensity: 1, Retries: 2}
+}
+
+// Validate checks that the options are usable.
+func (o Options) Validate() error {
+	if o.Parallelism < 1 {
+		return fmt.Errorf("parallelism must be at least 1, got %d", o.Parallelism)
+	}
+	if o.SegmentsPerRange < 1 {
+		return fmt.Errorf("segments per range must be at least 1, got %d", o.SegmentsPerRange)
+	}
+	if o.Intensity <= 0 || o.Intensity > 1 {
+		return fmt.Errorf("intensity must be greater than 0 and at most 1, got %v", o.Intensity)
+	}
+	if o.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", o.Retries)
+	}
+	return nil
+}
+
+// Segment is a subrange of a keyspace that is repaired with a single 'nodetool repair'.
+type Segment struct {
+	Keyspace string
+	Range    ring.Range
+	Attempts int
+}
+
+func (s Segment) String() string {
+	return fmt.Sprintf("%s %s", s.Keyspace, s.Range)
+}
+
+// Orchestrator repairs all token ranges of a Cassandra instance in subranges.
+type Orchestrator struct {
+	client      kubernetes.Interface
+	executor    nodetool.Executor
+	namespace   string
+	podSelector string
+	store       *state.Store
+	options     Options
+}
+
+func NewOrchestrator(client kubernetes.Interface, executor nodetool.Executor, namespace, podSelector string, store *state.Store, options Options) *Orchestrator {
+	return &Orchestrator{
+		client:      client,
+		executor:    executor,
+		namespace:   namespace,
+		podSelector: podSelector,
+		store:       store,
+		options:     options,
+	}
+}
+
+// Run repairs all planned subranges that were not repaired by a previous attempt of the run. It returns an error if
+// a subrange could not be repaired.
+func (o *Orchestrator) Run(runID string) (*state.State, error) {
+	run, err := o.Prepare(runID)
+	if err != nil {
+		return nil, err
+	}
+	run.Repair(0)
+
+	st := run.State
+	st.Finish()
+	if err := o.store.Save(st); err != nil {
+		log.Errorf("%v", err)
+	}
+	log.Infof("Repair finished:\n%s", st.Report())
+	if failed := st.FailedRanges(); failed > 0 {
+		return st, fmt.Errorf("%d subranges could not be repaired", failed)
+	}
+	return st, nil
+}
+
+// Run is a planned repair run.
+type Run struct {
+	// State is the progress of the run.
+	State *state.State
+	// Segments are the subranges that still need to be repaired.
+	Segments []Segment
+
+	orchestrator *Orchestrator
+	pods         map[string]*corev1.Pod
+}
+
+// Prepare loads the state of the run and plans the subranges that were not repaired by a previous attempt.
+func (o *Orchestrator) Prepare(runID string) (*Run, error) {
+	pods, err := o.readyPods()
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no ready Cassandra pods found with selector '%s'", o.podSelector)
+	}
+
+	st, resumed, err := o.store.Load(runID)
+	if err != nil {
+		return nil, err
+	}
+	if resumed {
+		log.Infof("Resuming repair run %s started at %s", runID, st.StartedAt.UTC().Format(time.RFC3339))
+	} else {
+		log.Infof("Starting repair run %s", runID)
+	}
+
+	segments, err := o.plan(pods, st)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.store.Save(st); err != nil {
+		return nil, err
+	}
+	return &Run{State: st, Segments: segments, orchestrator: o, pods: pods}, nil
+}
+
+// Save persists the state of the run.
+func (r *Run) Save() error {
+	return r.orchestrator.store.Save(r.State)
+}
+
+// Pod returns the Cassandra pod that is asked for the keyspaces and the ring of the run.
+func (r *Run) Pod() (*corev1.Pod, error) {
+	return r.orchestrator.metadataPod(r.pods)
+}
+
+// Repair repairs at most limit of the planned subranges, or all of them if limit is 0. The progress is saved after
+// every repaired subrange, the run is not finished.
+func (r *Run) Repair(limit int) {
+	segments := r.Segments
+	if limit > 0 && limit < len(segments) {
+		segments = segments[:limit]
+	}
+	o := r.orchestrator
+	log.Infof("Repairing %d of %d subranges with parallelism %d per datacenter and intensity %v", len(segments), len(r.Segments), o.options.Parallelism, o.options.Intensity)
+	o.schedule(segments, r.pods, r.State)
+}
+
+// Pod returns the ready Cassandra pod that is asked for the keyspaces and the ring.
+func (o *Orchestrator) Pod() (*corev1.Pod, error) {
+	pods, err := o.readyPods()
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no ready Cassandra pods found with selector '%s'", o.podSelector)
+	}
+	return o.metadataPod(pods)
+}
+
+// readyPods returns the ready Cassandra pods by IP.
+func (o *Orchestrator) readyPods() (map[string]*corev1.Pod, error) {
+	list, err := o.client.CoreV1().Pods(o.namespace).List(metav1.ListOptions{LabelSelector: o.podSelector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Cassandra pods: %v", err)
+	}
+	pods := map[string]*corev1.Pod{}
+	for i := range list.Items {
+		pod := &list.Items[i]
+		if pod.Status.PodIP != "" && pod.DeletionTimestamp == nil && isReady(pod) {
+			pods[pod.Status.PodIP] = pod
+		}
+	}
+	return pods, nil
+}
+
+// plan returns the subranges of all keyspaces that still need to be repaired.
+func (o *Orchestrator) plan(pods map[string]*corev1.Pod, st *state.State) ([]Segment, error) {
+	coordinator, err := o.metadataPod(pods)
+	if err != nil {
+		return nil, err
+	}
+	keyspaces := o.options.Keyspaces
+	if len(keyspaces) == 0 {
+		keyspaces, err = nodetool.Keyspaces(o.executor, coordinator)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list keyspaces: %v", err)
+		}
+	}
+
+	segments := []Segment{}
+	for _, keyspace := range keyspaces {
+		out, err := nodetool.DescribeRing(o.executor, coordinator, keyspace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe the ring of keyspace %s: %v", keyspace, err)
+		}
+		ranges, err := ring.ParseDescribeRing(out)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the ring of keyspace %s: %v", keyspace, err)
+		}
+
+		planned, done := 0, 0
+		for _, r := range ranges {
+			if o.options.Pod != "" && !r.HasHost(coordinator.Status.PodIP) {
+				continue
+			}
+			for _, subrange := range ring.Split(r, o.options.SegmentsPerRange) {
+				planned++
+				if st.IsCompleted(keyspace, subrange.Key()) {
+					done++
+					continue
+				}
+				segments = append(segments, Segment{Keyspace: keyspace, Range: subrange})
+			}
+		}
+		st.Keyspace(keyspace).Ranges = planned
+		log.Infof("Keyspace %s: %d subranges planned, %d already repaired", keyspace, planned, done)
+	}
+	return segments, nil
+}
+
+// metadataPod returns the pod that is asked for the keyspaces and the ring.
+func (o *Orchestrator) metadataPod(pods map[string]*corev1.Pod) (*corev1.Pod, error) {
+	if o.options.Pod != "" {
+		for _, pod := range pods {
+			if pod.Name == o.options.Pod {
+				return pod, nil
+			}
+		}
+		return nil, fmt.Errorf("pod %s is not a ready Cassandra pod", o.options.Pod)
+	}
+	var first *corev1.Pod
+	for _, pod := range pods {
+		if first == nil || pod.Name < first.Name {
+			first = pod
+		}
+	}
+	return first, nil
+}
+
+type result struct {
+	segment     Segment
+	coordinator *corev1.Pod
+	datacenter  string
+	duration    time.Duration
+	err         error
+}
+
+// schedule repairs the segments. A segment is started when none of its replicas is repairing or pausing, and the
+// datacenter of its coordinator runs less repairs than the parallelism.
+func (o *Orchestrator) schedule(segments []Segment, pods map[string]*corev1.Pod, st *state.State) {
+	busy := map[string]bool{}
+	pausedUntil := map[string]time.Time{}
+	running := map[string]int{}
+	results := make(chan result)
+	active := 0
+
+	pending := segments
+	for len(pending) > 0 || active > 0 {
+		now := time.Now()
+		available := func(host string) bool {
+			return !busy[host] && !pausedUntil[host].After(now)
+		}
+
+		waiting := []Segment{}
+		for _, segment := range pending {
+			blocked := false
+			for _, host := range segment.Range.Hosts() {
+				if !available(host) {
+					blocked = true
+				}
+			}
+			coordinator, datacenter := o.coordinator(segment, pods, running)
+			if coordinator == nil {
+				if !blocked && active == 0 {
+					// No replica can coordinate, even though nothing is running
+					o.finish(st, result{segment: segment, err: fmt.Errorf("no ready replica to coordinate the repair")}, &waiting)
+					continue
+				}
+				blocked = true
+			}
+			if blocked {
+				waiting = append(waiting, segment)
+				continue
+			}
+
+			for _, host := range segment.Range.Hosts() {
+				busy[host] = true
+			}
+			running[datacenter]++
+			active++
+			go func(segment Segment, coordinator *corev1.Pod, datacenter string) {
+				start := time.Now()
+				log.Infof("Repairing %s on %s", segment, coordinator.Name)
+				_, err := nodetool.RepairRange(o.executor, coordinator, segment.Keyspace, fmt.Sprint(segment.Range.Start), fmt.Sprint(segment.Range.End))
+				results <- result{segment: segment, coordinator: coordinator, datacenter: datacenter, duration: time.Since(start), err: err}
+			}(segment, coordinator, datacenter)
+		}
+		pending = waiting
+
+		if active == 0 {
+			if len(pending) == 0 {
+				break
+			}
+			// All remaining segments wait for replicas to finish their pause
+			time.Sleep(time.Until(earliest(pausedUntil, now)))
+			continue
+		}
+
+		r := <-results
+		active--
+		running[r.datacenter]--
+		pause := time.Duration(float64(r.duration) * (1/o.options.Intensity - 1))
+		for _, host := range r.segment.Range.Hosts() {
+			busy[host] = false
+			pausedUntil[host] = time.Now().Add(pause)
+		}
+		o.finish(st, r, &pending)
+	}
+}
+
+// finish records the result of a segment, or adds it to the pending segments if it can be retried.
+func (o *Orchestrator) finish(st *state.State, r result, pending *[]Segment) {
+	segment := r.segment
+	segment.Attempts++
+	coordinator := ""
+	if r.coordinator != nil {
+		coordinator = r.coordinator.Name
+	}
+	if r.err == nil {
+		log.Infof("Repaired %s on %s in %v", segment, coordinator, r.duration.Round(time.Millisecond))
+		st.Succeeded(segment.Keyspace, segment.Range.Key(), r.duration)
+	} else if segment.Attempts <= o.options.Retries {
+		log.Warnf("Repair of %s on %s failed (attempt %d, will retry): %v", segment, coordinator, segment.Attempts, r.err)
+		*pending = append(*pending, segment)
+		return
+	} else {
+		log.Errorf("Repair of %s on %s failed after %d attempts: %v", segment, coordinator, segment.Attempts, r.err)
+		st.Failed(segment.Keyspace, segment.Range.Key(), state.Failure{Coordinator: coordinator, Attempts: segment.Attempts, Error: r.err.Error()}, r.duration)
+	}
+	if err := o.store.Save(st); err != nil {
+		log.Errorf("%v", err)
+	}
+}
+
+// coordinator returns a replica of the segment that can coordinate its repair, and its datacenter. The datacenter
+// of the coordinator must have capacity for another repair.
+func (o *Orchestrator) coordinator(segment Segment, pods map[string]*corev1.Pod, running map[string]int) (*corev1.Pod, string) {
+	for _, endpoint := range segment.Range.Endpoints {
+		pod, ok := pods[endpoint.Host]
+		if !ok || (o.options.Pod != "" && pod.Name != o.options.Pod) {
+			continue
+		}
+		if running[endpoint.Datacenter] < o.options.Parallelism {
+			return pod, endpoint.Datacenter
+		}
+	}
+	return nil, ""
+}
+
+func earliest(times map[string]time.Time, after time.Time) time.Time {
+	var min time.Time
+	for _, t := range times {
+		if t.After(after) && (min.IsZero() || t.Before(min)) {
+			min = t
+		}
+	}
+	if min.IsZero() {
+		return after
+	}
+	return min
+}
+
+func isReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package repair
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+// fakeRing is a ring of four nodes with two replicas per range. The ranges (100, 200] and (300, 400] have no
+// replica in common and can be repaired at the same time.
+const fakeRing = `TokenRange:
+	TokenRange(start_token:100, end_token:200, endpoints:[10.0.0.1, 10.0.0.2], rpc_endpoints:[], endpoint_details:[EndpointDetails(host:10.0.0.1, datacenter:dc1, rack:rack1), EndpointDetails(host:10.0.0.2, datacenter:dc1, rack:rack1)])
+	TokenRange(start_token:200, end_token:300, endpoints:[10.0.0.2, 10.0.0.3], rpc_endpoints:[], endpoint_details:[EndpointDetails(host:10.0.0.2, datacenter:dc1, rack:rack1), EndpointDetails(host:10.0.0.3, datacenter:dc1, rack:rack1)])
+	TokenRange(start_token:300, end_token:400, endpoints:[10.0.0.3, 10.0.0.4], rpc_endpoints:[], endpoint_details:[EndpointDetails(host:10.0.0.3, datacenter:dc1, rack:rack1), EndpointDetails(host:10.0.0.4, datacenter:dc1, rack:rack1)])
+	TokenRange(start_token:400, end_token:100, endpoints:[10.0.0.4, 10.0.0.1], rpc_endpoints:[], endpoint_details:[EndpointDetails(host:10.0.0.4, datacenter:dc1, rack:rack1), EndpointDetails(host:10.0.0.1, datacenter:dc1, rack:rack1)])
+`
+
+type fakeExecutor struct {
+	lock sync.Mutex
+	// failures is the number of times the repair of a range fails, by "keyspace start"
+	failures map[string]int
+	repairs  []string
+	running  int
+	// maxRunning is the highest number of concurrent repairs
+	maxRunning int
+}
+
+func (e *fakeExecutor) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	args := command[2:]
+	switch args[0] {
+	case "tablestats":
+		return "Keyspace : shop\nKeyspace : system\nKeyspace : system_schema\n", nil
+	case "describering":
+		return fakeRing, nil
+	case "repair":
+		// repair -full -st <start> -et <end> <keyspace>
+		key := fmt.Sprintf("%s %s", args[6], args[3])
+		e.lock.Lock()
+		e.running++
+		if e.running > e.maxRunning {
+			e.maxRunning = e.running
+		}
+		e.lock.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		e.running--
+		e.repairs = append(e.repairs, key)
+		if e.failures[key] > 0 {
+			e.failures[key]--
+			return "", fmt.Errorf("repair of %s failed", key)
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected command %s", strings.Join(command, " "))
+}
+
+func fakePods() []*corev1.Pod {
+	pods := []*corev1.Pod{}
+	for i := 1; i <= 4; i++ {
+		pods = append(pods, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("cassandra-node-%d", i-1),
+				Namespace: "default",
+				Labels:    map[string]string{"app": "cassandra", "cassandra": "cassandra"},
+			},
+			Status: corev1.PodStatus{
+				PodIP:      fmt.Sprintf("10.0.0.%d", i),
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+			},
+		})
+	}
+	return pods
+}
+
+func newTestOrchestrator(executor *fakeExecutor, options Options) (*Orchestrator, kubernetes.Interface) {
+	client := fake.NewSimpleClientset()
+	for _, pod := range fakePods() {
+		_, _ = client.CoreV1().Pods("default").Create(pod)
+	}
+	store := state.NewStore(state.NewConfigMapStore(client, "default", "cassandra-repair-state", nil))
+	return NewOrchestrator(client, executor, "default", "app = cassandra, cassandra", store, options), client
+}
+
+func TestRun(t *testing.T) {
+	executor := &fakeExecutor{}
+	options := DefaultOptions()
+	options.Parallelism = 4
+	orchestrator, _ := newTestOrchestrator(executor, options)
+
+	st, err := orchestrator.Run("run-1")
+	assert.NoError(t, err)
+	assert.Len(t, executor.repairs, 4)
+	assert.Equal(t, 2, executor.maxRunning, "only ranges without common replicas are repaired at the same time")
+	assert.Equal(t, []string{"shop"}, keyspaceNames(st))
+	assert.Equal(t, 4, st.Keyspaces["shop"].Ranges)
+	assert.Len(t, st.Keyspaces["shop"].Completed, 4)
+	assert.NotNil(t, st.FinishedAt)
+}
+
+func TestRun_parallelism(t *testing.T) {
+	executor := &fakeExecutor{}
+	options := DefaultOptions()
+	options.SegmentsPerRange = 2
+	orchestrator, _ := newTestOrchestrator(executor, options)
+
+	_, err := orchestrator.Run("run-1")
+	assert.NoError(t, err)
+	assert.Len(t, executor.repairs, 8)
+	assert.Equal(t, 1, executor.maxRunning)
+}
+
+func TestRun_singlePod(t *testing.T) {
+	executor := &fakeExecutor{}
+	options := DefaultOptions()
+	options.Pod = "cassandra-node-0"
+	options.Keyspaces = []string{"shop"}
+	orchestrator, _ := newTestOrchestrator(executor, options)
+
+	st, err := orchestrator.Run("run-1")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"shop 100", "shop 400"}, executor.repairs, "only the ranges of 10.0.0.1 are repaired")
+	assert.Equal(t, 2, st.Keyspaces["shop"].Ranges)
+}
+
+func TestRun_retries(t *testing.T) {
+	executor := &fakeExecutor{failures: map[string]int{"shop 200": 1, "shop 300": 5}}
+	options := DefaultOptions()
+	options.Retries = 1
+	orchestrator, client := newTestOrchestrator(executor, options)
+
+	st, err := orchestrator.Run("run-1")
+	assert.Error(t, err)
+	assert.Len(t, executor.repairs, 6)
+	assert.Len(t, st.Keyspaces["shop"].Completed, 3)
+	if assert.Contains(t, st.Keyspaces["shop"].Failed, "300:400") {
+		failure := st.Keyspaces["shop"].Failed["300:400"]
+		assert.Equal(t, 2, failure.Attempts)
+		assert.Contains(t, failure.Error, "repair of shop 300 failed")
+	}
+
+	cm, err := client.CoreV1().ConfigMaps("default").Get("cassandra-repair-state", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, cm.Data[state.ReportKey], "Keyspace shop: 3/4 ranges repaired, 1 failed")
+	assert.Contains(t, cm.Data[state.ReportKey], "range 300:400 failed after 2 attempts")
+}
+
+func TestRun_resume(t *testing.T) {
+	executor := &fakeExecutor{}
+	orchestrator, client := newTestOrchestrator(executor, DefaultOptions())
+
+	// A previous attempt of the run repaired two ranges before it was interrupted
+	previous := state.New("run-1")
+	previous.Succeeded("shop", "100:200", time.Second)
+	previous.Succeeded("shop", "300:400", time.Second)
+	assert.NoError(t, state.NewStore(state.NewConfigMapStore(client, "default", "cassandra-repair-state", nil)).Save(previous))
+
+	st, err := orchestrator.Run("run-1")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"shop 200", "shop 400"}, executor.repairs)
+	assert.Len(t, st.Keyspaces["shop"].Completed, 4)
+
+	// A new run repairs everything again
+	executor.repairs = nil
+	_, err = orchestrator.Run("run-2")
+	assert.NoError(t, err)
+	assert.Len(t, executor.repairs, 4)
+}
+
+func TestOptions_Validate(t *testing.T) {
+	assert.NoError(t, DefaultOptions().Validate())
+	for _, options := range []Options{
+		{Parallelism: 0, SegmentsPerRange: 1, Intensity: 1},
+		{Parallelism: 1, SegmentsPerRange: 0, Intensity: 1},
+		{Parallelism: 1, SegmentsPerRange: 1, Intensity: 0},
+		{Parallelism: 1, SegmentsPerRange: 1, Intensity: 1.5},
+		{Parallelism: 1, SegmentsPerRange: 1, Intensity: 1, Retries: -1},
+	} {
+		assert.Error(t, options.Validate(), "%+v", options)
+	}
+}
+
+func keyspaceNames(st *state.State) []string {
+	names := []string{}
+	for name := range st.Keyspaces {
+		names = append(names, name)
+	}
+	return names
+}
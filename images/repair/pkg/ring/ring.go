@@ -0,0 +1,132 @@
+package ring
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Endpoint is a replica of a token range.
+type Endpoint struct {
+	Host       string
+	Datacenter string
+	Rack       string
+}
+
+// Range is the token range (Start, End] and its replicas. The range wraps around the ring if Start >= End.
+type Range struct {
+	Start     int64
+	End       int64
+	Endpoints []Endpoint
+}
+
+// Key identifies the range.
+func (r Range) Key() string {
+	return fmt.Sprintf("%d:%d", r.Start, r.End)
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("(%d, %d]", r.Start, r.End)
+}
+
+// Hosts returns the addresses of the replicas.
+func (r Range) Hosts() []string {
+	hosts := make([]string, 0, len(r.Endpoints))
+	for _, e := range r.Endpoints {
+		hosts = append(hosts, e.Host)
+	}
+	return hosts
+}
+
+// HasHost returns true if the host is a replica of the range.
+func (r Range) HasHost(host string) bool {
+	for _, e := range r.Endpoints {
+		if e.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	rangePat    = regexp.MustCompile(`TokenRange\(start_token:(-?[0-9]+), end_token:(-?[0-9]+),`)
+	endpointPat = regexp.MustCompile(`EndpointDetails\(host:([^,]+), datacenter:([^,]+), rack:([^)]+)\)`)
+)
+
+// ParseDescribeRing returns the token ranges from the output of 'nodetool describering'. Only the Murmur3
+// partitioner is supported.
+func ParseDescribeRing(out string) ([]Range, error) {
+	ranges := []Range{}
+	for _, line := range strings.Split(out, "\n") {
+		match := rangePat.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		start, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start token '%s', only the Murmur3Partitioner is supported: %v", match[1], err)
+		}
+		end, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end token '%s', only the Murmur3Partitioner is supported: %v", match[2], err)
+		}
+		r := Range{Start: start, End: end}
+		for _, e := range endpointPat.FindAllStringSubmatch(line, -1) {
+			r.Endpoints = append(r.Endpoints, Endpoint{
+				Host:       strings.TrimSpace(e[1]),
+				Datacenter: strings.TrimSpace(e[2]),
+				Rack:       strings.TrimSpace(e[3]),
+			})
+		}
+		if len(r.Endpoints) == 0 {
+			return nil, fmt.Errorf("token range %s has no endpoint details", r)
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no token ranges found")
+	}
+	return ranges, nil
+}
+
+var ringSize = new(big.Int).Lsh(big.NewInt(1), 64)
+
+// Split divides the range into n subranges of about equal size with the same replicas.
+func Split(r Range, n int) []Range {
+	if n <= 1 {
+		return []Range{r}
+	}
+	start := big.NewInt(r.Start)
+	size := new(big.Int).Sub(big.NewInt(r.End), start)
+	if size.Sign() <= 0 {
+		// The range wraps around the ring
+		size.Add(size, ringSize)
+	}
+	if size.Cmp(big.NewInt(int64(n))) < 0 {
+		n = int(size.Int64())
+	}
+
+	subranges := make([]Range, 0, n)
+	previous := r.Start
+	for i := 1; i <= n; i++ {
+		end := r.End
+		if i < n {
+			offset := new(big.Int).Div(new(big.Int).Mul(size, big.NewInt(int64(i))), big.NewInt(int64(n)))
+			end = toToken(new(big.Int).Add(start, offset))
+		}
+		subranges = append(subranges, Range{Start: previous, End: end, Endpoints: r.Endpoints})
+		previous = end
+	}
+	return subranges
+}
+
+// toToken wraps the value into the signed 64 bit token space.
+func toToken(v *big.Int) int64 {
+	max := new(big.Int).Lsh(big.NewInt(1), 63)
+	if v.Cmp(max) >= 0 {
+		v.Sub(v, ringSize)
+	}
+	return v.Int64()
+}
@@ -0,0 +1,58 @@
+package ring
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const describeRing = `Schema Version:ea63e099-37c5-3d7b-9ace-32f4c833653d
+TokenRange: 
+	TokenRange(start_token:-9181834911036524046, end_token:-3074457345618258603, endpoints:[10.0.0.1, 10.0.0.2], rpc_endpoints:[10.0.0.1, 10.0.0.2], endpoint_details:[EndpointDetails(host:10.0.0.1, datacenter:dc1, rack:rack1), EndpointDetails(host:10.0.0.2, datacenter:dc2, rack:rack1)])
+	TokenRange(start_token:3074457345618258602, end_token:-9181834911036524046, endpoints:[10.0.0.3, 10.0.0.1], rpc_endpoints:[10.0.0.3, 10.0.0.1], endpoint_details:[EndpointDetails(host:10.0.0.3, datacenter:dc1, rack:rack2), EndpointDetails(host:10.0.0.1, datacenter:dc1, rack:rack1)])
+`
+
+func TestParseDescribeRing(t *testing.T) {
+	ranges, err := ParseDescribeRing(describeRing)
+	assert.NoError(t, err)
+	assert.Len(t, ranges, 2)
+	assert.Equal(t, int64(-9181834911036524046), ranges[0].Start)
+	assert.Equal(t, int64(-3074457345618258603), ranges[0].End)
+	assert.Equal(t, []Endpoint{{"10.0.0.1", "dc1", "rack1"}, {"10.0.0.2", "dc2", "rack1"}}, ranges[0].Endpoints)
+	assert.Equal(t, []string{"10.0.0.3", "10.0.0.1"}, ranges[1].Hosts())
+	assert.True(t, ranges[1].HasHost("10.0.0.3"))
+	assert.False(t, ranges[1].HasHost("10.0.0.2"))
+
+	_, err = ParseDescribeRing("Schema Version:ea63e099-37c5-3d7b-9ace-32f4c833653d\n")
+	assert.Error(t, err)
+	_, err = ParseDescribeRing("TokenRange(start_token:abc, end_token:def, endpoints:[])")
+	assert.Error(t, err)
+}
+
+func TestSplit(t *testing.T) {
+	r := Range{Start: 0, End: 100, Endpoints: []Endpoint{{Host: "10.0.0.1"}}}
+	subranges := Split(r, 3)
+	assert.Equal(t, []string{"0:33", "33:66", "66:100"}, keys(subranges))
+	assert.Equal(t, r.Endpoints, subranges[1].Endpoints)
+
+	assert.Equal(t, []Range{r}, Split(r, 1))
+	assert.Len(t, Split(Range{Start: 0, End: 2}, 5), 2, "a range is not split into empty subranges")
+}
+
+func TestSplit_wrapping(t *testing.T) {
+	r := Range{Start: math.MaxInt64 - 9, End: math.MinInt64 + 10}
+	subranges := Split(r, 2)
+	assert.Len(t, subranges, 2)
+	assert.Equal(t, r.Start, subranges[0].Start)
+	assert.Equal(t, int64(math.MinInt64), subranges[0].End)
+	assert.Equal(t, r.End, subranges[1].End)
+}
+
+func keys(ranges []Range) []string {
+	result := []string{}
+	for _, r := range ranges {
+		result = append(result, r.Key())
+	}
+	return result
+}
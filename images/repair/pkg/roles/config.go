@@ -0,0 +1,240 @@
+package roles
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigKey is the key of the declared roles in the configmap.
+const ConfigKey = "roles.yaml"
+
+// DefaultPasswordKey is the key of the password in a secret if none is given.
+const DefaultPasswordKey = "password"
+
+// Config declares the roles of a Cassandra instance:
+//
+//	roles:
+//	  - name: shop_app
+//	    login: true
+//	    passwordSecret:
+//	      name: shop-app-credentials
+//	    memberOf:
+//	      - shop_reader
+//	    grants:
+//	      - resource: KEYSPACE shop
+//	        permissions: [MODIFY]
+//	  - name: shop_reader
+//	    grants:
+//	      - resource: KEYSPACE shop
+//	        permissions: [SELECT]
+type Config struct {
+	Roles []Role `json:"roles"`
+}
+
+// Role is a declared role. The memberships and permissions of a declared role are managed completely: memberships and
+// permissions that are not declared are revoked.
+type Role struct {
+	Name      string `json:"name"`
+	Login     bool   `json:"login,omitempty"`
+	Superuser bool   `json:"superuser,omitempty"`
+	// PasswordSecret contains the password of the role, it is required for roles that can log in.
+	PasswordSecret *SecretKeyRef `json:"passwordSecret,omitempty"`
+	// MemberOf are the roles that are granted to the role.
+	MemberOf []string `json:"memberOf,omitempty"`
+	Grants   []Grant  `json:"grants,omitempty"`
+	// Adopt manages a role that existed before it was declared. Without it, a declared role that exists but was not
+	// created by the reconciler is rejected, so that removing its declaration can not drop it.
+	Adopt bool `json:"adopt,omitempty"`
+}
+
+// SecretKeyRef is a key of a secret in the namespace of the instance.
+type SecretKeyRef struct {
+	Name string `json:"name"`
+	// Key defaults to 'password'.
+	Key string `json:"key,omitempty"`
+}
+
+// Grant gives permissions on a resource.
+type Grant struct {
+	// Resource is 'ALL KEYSPACES', 'KEYSPACE <keyspace>', 'TABLE <keyspace>.<table>', 'ALL ROLES' or 'ROLE <role>'.
+	Resource string `json:"resource"`
+	// Permissions are CREATE, ALTER, DROP, SELECT, MODIFY, AUTHORIZE, DESCRIBE or ALL.
+	Permissions []string `json:"permissions"`
+}
+
+var (
+	rolePat     = regexp.MustCompile(`^[a-zA-Z0-9_.@-]{1,128}$`)
+	keyspacePat = regexp.MustCompile(`^[a-zA-Z0-9_]{1,48}$`)
+)
+
+// ParseConfig parses and validates the declared roles.
+func ParseConfig(data []byte) (Config, error) {
+	config := Config{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("invalid roles: %v", err)
+	}
+	return config, config.Validate()
+}
+
+// Validate checks that the roles can be created.
+func (c Config) Validate() error {
+	names := map[string]bool{}
+	for _, role := range c.Roles {
+		if !rolePat.MatchString(role.Name) {
+			return fmt.Errorf("invalid role name '%s'", role.Name)
+		}
+		if names[role.Name] {
+			return fmt.Errorf("role %s is declared twice", role.Name)
+		}
+		names[role.Name] = true
+
+		if role.Login && role.PasswordSecret == nil {
+			return fmt.Errorf("role %s can log in and needs a passwordSecret", role.Name)
+		}
+		if role.PasswordSecret != nil && role.PasswordSecret.Name == "" {
+			return fmt.Errorf("role %s: the name of the passwordSecret is missing", role.Name)
+		}
+		for _, parent := range role.MemberOf {
+			if parent == role.Name {
+				return fmt.Errorf("role %s can not be a member of itself", role.Name)
+			}
+			if !rolePat.MatchString(parent) {
+				return fmt.Errorf("role %s: invalid role name '%s' in memberOf", role.Name, parent)
+			}
+		}
+		for _, grant := range role.Grants {
+			if _, err := grant.parse(); err != nil {
+				return fmt.Errorf("role %s: %v", role.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resource is a resource that permissions are granted on.
+type resource struct {
+	// name is the name of the resource in system_auth.role_permissions, e.g. 'data/shop'.
+	name string
+	// cql is the resource in GRANT statements, e.g. 'KEYSPACE "shop"'.
+	cql string
+	// applicable are the permissions that the resource supports.
+	applicable []string
+}
+
+var (
+	dataPermissions   = []string{"ALTER", "AUTHORIZE", "CREATE", "DROP", "MODIFY", "SELECT"}
+	tablePermissions  = []string{"ALTER", "AUTHORIZE", "DROP", "MODIFY", "SELECT"}
+	rolesPermissions  = []string{"ALTER", "AUTHORIZE", "CREATE", "DESCRIBE", "DROP"}
+	rolePermissions   = []string{"ALTER", "AUTHORIZE", "DROP"}
+	resourceSeparator = regexp.MustCompile(`\s+`)
+)
+
+// parseResource parses a declared resource.
+func parseResource(declared string) (resource, error) {
+	fields := resourceSeparator.Split(strings.TrimSpace(declared), -1)
+	invalid := fmt.Errorf("invalid resource '%s', use 'ALL KEYSPACES', 'KEYSPACE <keyspace>', 'TABLE <keyspace>.<table>', 'ALL ROLES' or 'ROLE <role>'", declared)
+	if len(fields) != 2 {
+		return resource{}, invalid
+	}
+	kind, name := strings.ToUpper(fields[0]), fields[1]
+	switch {
+	case kind == "ALL" && strings.ToUpper(name) == "KEYSPACES":
+		return resource{name: "data", cql: "ALL KEYSPACES", applicable: dataPermissions}, nil
+	case kind == "ALL" && strings.ToUpper(name) == "ROLES":
+		return resource{name: "roles", cql: "ALL ROLES", applicable: rolesPermissions}, nil
+	case kind == "KEYSPACE" && keyspacePat.MatchString(name):
+		return resource{name: "data/" + name, cql: "KEYSPACE " + quote(name), applicable: dataPermissions}, nil
+	case kind == "TABLE":
+		parts := strings.Split(name, ".")
+		if len(parts) != 2 || !keyspacePat.MatchString(parts[0]) || !keyspacePat.MatchString(parts[1]) {
+			return resource{}, invalid
+		}
+		return resource{name: "data/" + parts[0] + "/" + parts[1], cql: "TABLE " + quote(parts[0]) + "." + quote(parts[1]), applicable: tablePermissions}, nil
+	case kind == "ROLE" && rolePat.MatchString(name):
+		return resource{name: "roles/" + name, cql: "ROLE " + quote(name), applicable: rolePermissions}, nil
+	}
+	return resource{}, invalid
+}
+
+// existingResource returns the resource of a name in system_auth.role_permissions. It returns false for resources
+// that can not be declared, like functions and MBeans.
+func existingResource(name string) (resource, bool) {
+	parts := strings.Split(name, "/")
+	switch {
+	case name == "data":
+		return resource{name: name, cql: "ALL KEYSPACES", applicable: dataPermissions}, true
+	case name == "roles":
+		return resource{name: name, cql: "ALL ROLES", applicable: rolesPermissions}, true
+	case parts[0] == "data" && len(parts) == 2:
+		return resource{name: name, cql: "KEYSPACE " + quote(parts[1]), applicable: dataPermissions}, true
+	case parts[0] == "data" && len(parts) == 3:
+		return resource{name: name, cql: "TABLE " + quote(parts[1]) + "." + quote(parts[2]), applicable: tablePermissions}, true
+	case parts[0] == "roles" && len(parts) == 2:
+		return resource{name: name, cql: "ROLE " + quote(parts[1]), applicable: rolePermissions}, true
+	}
+	return resource{}, false
+}
+
+// parse returns the resource of the grant, and an error if a permission does not apply to it.
+func (g Grant) parse() (resource, error) {
+	r, err := parseResource(g.Resource)
+	if err != nil {
+		return r, err
+	}
+	if len(g.Permissions) == 0 {
+		return r, fmt.Errorf("no permissions on %s", g.Resource)
+	}
+	for _, permission := range g.Permissions {
+		permission = strings.ToUpper(permission)
+		if permission != "ALL" && !contains(r.applicable, permission) {
+			return r, fmt.Errorf("permission '%s' does not apply to %s, use %s or ALL", permission, g.Resource, strings.Join(r.applicable, ", "))
+		}
+	}
+	return r, nil
+}
+
+// declaredPermissions returns the permissions of the role by resource name, and the resources by name.
+func (role Role) declaredPermissions() (map[string][]string, map[string]resource) {
+	permissions := map[string][]string{}
+	resources := map[string]resource{}
+	for _, grant := range role.Grants {
+		r, err := grant.parse()
+		if err != nil {
+			// the config is validated
+			continue
+		}
+		resources[r.name] = r
+		for _, permission := range grant.Permissions {
+			permission = strings.ToUpper(permission)
+			expanded := []string{permission}
+			if permission == "ALL" {
+				expanded = r.applicable
+			}
+			for _, p := range expanded {
+				if !contains(permissions[r.name], p) {
+					permissions[r.name] = append(permissions[r.name], p)
+				}
+			}
+		}
+		sort.Strings(permissions[r.name])
+	}
+	return permissions, resources
+}
+
+// quote returns the quoted identifier, which keeps its case.
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package roles
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/nodetool"
+)
+
+const (
+	rolesQuery       = "SELECT JSON role, can_login, is_superuser, member_of, salted_hash FROM system_auth.roles"
+	permissionsQuery = "SELECT JSON role, resource, permissions FROM system_auth.role_permissions"
+)
+
+// CurrentRole is an existing role.
+type CurrentRole struct {
+	Login     bool
+	Superuser bool
+	// SaltedHash is the bcrypt hash of the password.
+	SaltedHash string
+	MemberOf   []string
+	// Permissions are the permissions of the role by resource name, e.g. 'data/shop'.
+	Permissions map[string][]string
+}
+
+// ReadRoles reads the roles and their permissions from the Cassandra node in the pod.
+func ReadRoles(executor nodetool.Executor, pod *corev1.Pod) (map[string]*CurrentRole, error) {
+	out, err := nodetool.CQL(executor, pod, rolesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read roles: %v", err)
+	}
+	rows, err := nodetool.ParseJSONRows(out)
+	if err != nil {
+		return nil, err
+	}
+	roles := map[string]*CurrentRole{}
+	for _, row := range rows {
+		name, _ := row["role"].(string)
+		role := &CurrentRole{Permissions: map[string][]string{}}
+		role.Login, _ = row["can_login"].(bool)
+		role.Superuser, _ = row["is_superuser"].(bool)
+		role.SaltedHash, _ = row["salted_hash"].(string)
+		role.MemberOf = stringSet(row["member_of"])
+		roles[name] = role
+	}
+
+	out, err = nodetool.CQL(executor, pod, permissionsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read permissions: %v", err)
+	}
+	if rows, err = nodetool.ParseJSONRows(out); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		name, _ := row["role"].(string)
+		resourceName, _ := row["resource"].(string)
+		if role, ok := roles[name]; ok {
+			role.Permissions[resourceName] = stringSet(row["permissions"])
+		}
+	}
+	return roles, nil
+}
+
+// stringSet returns the sorted values of a JSON set.
+func stringSet(value interface{}) []string {
+	values, _ := value.([]interface{})
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			result = append(result, s)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
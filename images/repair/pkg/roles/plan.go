@@ -0,0 +1,188 @@
+package roles
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Change is a statement that brings a role to its declared state.
+type Change struct {
+	Role      string
+	Statement string
+	// Redacted is the statement without the password, it is used in logs and reports.
+	Redacted string
+	// Drop is true if the change drops a role that is no longer declared.
+	Drop bool
+	// Create is true if the change creates a declared role.
+	Create bool
+}
+
+// Plan contains the changes that bring the roles to their declared state, in the order they are applied: roles are
+// created before they are granted to other roles, and dropped last.
+type Plan struct {
+	Changes []Change
+}
+
+// NewPlan compares the declared roles with the existing roles. passwords contains the passwords of the declared roles
+// that have a password secret. The managed roles were created or adopted by earlier runs, the ones that are no longer
+// declared are dropped. Other roles that are not declared are not changed, existing roles can only be declared if they
+// are managed or adopted. The protected roles can not be declared.
+func NewPlan(config Config, current map[string]*CurrentRole, passwords map[string]string, managed, protected []string) (*Plan, error) {
+	declared := map[string]bool{}
+	for _, role := range config.Roles {
+		declared[role.Name] = true
+	}
+	for _, role := range config.Roles {
+		if contains(protected, role.Name) {
+			return nil, fmt.Errorf("role %s is used by the operator and can not be declared", role.Name)
+		}
+		if _, exists := current[role.Name]; exists && !role.Adopt && !contains(managed, role.Name) {
+			return nil, fmt.Errorf("role %s already exists and is not managed, set 'adopt: true' to manage it", role.Name)
+		}
+		for _, parent := range role.MemberOf {
+			if _, exists := current[parent]; !exists && !declared[parent] {
+				return nil, fmt.Errorf("role %s is a member of role %s, which does not exist", role.Name, parent)
+			}
+		}
+	}
+
+	plan := &Plan{}
+	for _, role := range config.Roles {
+		if change, ok := roleChange(role, current[role.Name], passwords[role.Name]); ok {
+			plan.Changes = append(plan.Changes, change)
+		}
+	}
+	for _, role := range config.Roles {
+		plan.Changes = append(plan.Changes, membershipChanges(role, current[role.Name])...)
+	}
+	for _, role := range config.Roles {
+		plan.Changes = append(plan.Changes, permissionChanges(role, current[role.Name])...)
+	}
+
+	dropped := []string{}
+	for _, name := range managed {
+		if _, exists := current[name]; exists && !declared[name] && !contains(protected, name) {
+			dropped = append(dropped, name)
+		}
+	}
+	sort.Strings(dropped)
+	for _, name := range dropped {
+		statement := fmt.Sprintf("DROP ROLE IF EXISTS %s", quote(name))
+		plan.Changes = append(plan.Changes, Change{Role: name, Statement: statement, Redacted: statement, Drop: true})
+	}
+	return plan, nil
+}
+
+// roleChange returns the change that creates or alters the role, and false if the role has its declared options.
+func roleChange(role Role, current *CurrentRole, password string) (Change, bool) {
+	options := []string{}
+	redacted := []string{}
+	option := func(option, value string, secret bool) {
+		options = append(options, fmt.Sprintf("%s = %s", option, value))
+		if secret {
+			value = "'*****'"
+		}
+		redacted = append(redacted, fmt.Sprintf("%s = %s", option, value))
+	}
+
+	if current == nil {
+		option("LOGIN", fmt.Sprint(role.Login), false)
+		option("SUPERUSER", fmt.Sprint(role.Superuser), false)
+		if role.PasswordSecret != nil {
+			option("PASSWORD", stringLiteral(password), true)
+		}
+		return Change{
+			Role:      role.Name,
+			Statement: "CREATE ROLE " + quote(role.Name) + " WITH " + strings.Join(options, " AND "),
+			Redacted:  "CREATE ROLE " + quote(role.Name) + " WITH " + strings.Join(redacted, " AND "),
+			Create:    true,
+		}, true
+	}
+
+	if current.Login != role.Login {
+		option("LOGIN", fmt.Sprint(role.Login), false)
+	}
+	if current.Superuser != role.Superuser {
+		option("SUPERUSER", fmt.Sprint(role.Superuser), false)
+	}
+	if role.PasswordSecret != nil && bcrypt.CompareHashAndPassword([]byte(current.SaltedHash), []byte(password)) != nil {
+		option("PASSWORD", stringLiteral(password), true)
+	}
+	if len(options) == 0 {
+		return Change{}, false
+	}
+	return Change{
+		Role:      role.Name,
+		Statement: "ALTER ROLE " + quote(role.Name) + " WITH " + strings.Join(options, " AND "),
+		Redacted:  "ALTER ROLE " + quote(role.Name) + " WITH " + strings.Join(redacted, " AND "),
+	}, true
+}
+
+// membershipChanges grants the declared memberships of the role and revokes the others.
+func membershipChanges(role Role, current *CurrentRole) []Change {
+	changes := []Change{}
+	existing := []string{}
+	if current != nil {
+		existing = current.MemberOf
+	}
+	parents := append([]string{}, role.MemberOf...)
+	sort.Strings(parents)
+	for _, parent := range parents {
+		if !contains(existing, parent) {
+			statement := fmt.Sprintf("GRANT %s TO %s", quote(parent), quote(role.Name))
+			changes = append(changes, Change{Role: role.Name, Statement: statement, Redacted: statement})
+		}
+	}
+	for _, parent := range existing {
+		if !contains(role.MemberOf, parent) {
+			statement := fmt.Sprintf("REVOKE %s FROM %s", quote(parent), quote(role.Name))
+			changes = append(changes, Change{Role: role.Name, Statement: statement, Redacted: statement})
+		}
+	}
+	return changes
+}
+
+// permissionChanges grants the declared permissions of the role and revokes the others. Permissions on resources that
+// can not be declared, like functions, are not changed.
+func permissionChanges(role Role, current *CurrentRole) []Change {
+	declared, resources := role.declaredPermissions()
+	existing := map[string][]string{}
+	if current != nil {
+		for name, permissions := range current.Permissions {
+			if r, ok := existingResource(name); ok {
+				existing[name] = permissions
+				resources[name] = r
+			}
+		}
+	}
+
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	changes := []Change{}
+	for _, name := range names {
+		r := resources[name]
+		for _, permission := range declared[name] {
+			if !contains(existing[name], permission) {
+				statement := fmt.Sprintf("GRANT %s ON %s TO %s", permission, r.cql, quote(role.Name))
+				changes = append(changes, Change{Role: role.Name, Statement: statement, Redacted: statement})
+			}
+		}
+		for _, permission := range existing[name] {
+			if !contains(declared[name], permission) {
+				statement := fmt.Sprintf("REVOKE %s ON %s FROM %s", permission, r.cql, quote(role.Name))
+				changes = append(changes, Change{Role: role.Name, Statement: statement, Redacted: statement})
+			}
+		}
+	}
+	return changes
+}
+
+func stringLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,197 @@
+package roles
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/nodetool"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+const (
+	// StatusKey contains the status of the reconciler as JSON.
+	StatusKey = "status.json"
+	// ReportKey contains a human readable summary of the last run.
+	ReportKey = "report"
+)
+
+// Status is the persisted state of the reconciler across runs.
+type Status struct {
+	// Managed are the declared roles that were created or adopted, they are dropped when they are no longer declared.
+	Managed []string `json:"managed,omitempty"`
+	// Applied are the statements of the last run, without passwords.
+	Applied []string `json:"applied,omitempty"`
+	// Dropped are the roles that the last run dropped.
+	Dropped []string `json:"dropped,omitempty"`
+}
+
+// Report returns a human readable summary of the status.
+func (s *Status) Report() string {
+	b := &strings.Builder{}
+	if len(s.Applied) == 0 {
+		fmt.Fprintf(b, "All roles have their declared options, memberships and permissions\n")
+	}
+	for _, statement := range s.Applied {
+		fmt.Fprintf(b, "applied: %s\n", statement)
+	}
+	if len(s.Dropped) > 0 {
+		fmt.Fprintf(b, "dropped: %s\n", strings.Join(s.Dropped, ", "))
+	}
+	fmt.Fprintf(b, "managed: %s\n", strings.Join(s.Managed, ", "))
+	return b.String()
+}
+
+// Reconciler brings the roles of a Cassandra instance to their declared state.
+type Reconciler struct {
+	executor  nodetool.InputExecutor
+	client    kubernetes.Interface
+	namespace string
+	store     *Store
+	// protected are roles that can not be declared, like the role of the operator.
+	protected []string
+}
+
+func NewReconciler(executor nodetool.InputExecutor, client kubernetes.Interface, namespace string, store *Store, protected []string) *Reconciler {
+	return &Reconciler{executor: executor, client: client, namespace: namespace, store: store, protected: protected}
+}
+
+// Run applies the changes with cqlsh in the pod. The passwords of the roles are read from their secrets.
+func (r *Reconciler) Run(config Config, pod *corev1.Pod) (*Status, error) {
+	status, err := r.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	passwords, err := r.passwords(config)
+	if err != nil {
+		return nil, err
+	}
+	current, err := ReadRoles(r.executor, pod)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := NewPlan(config, current, passwords, status.Managed, r.protected)
+	if err != nil {
+		return nil, err
+	}
+
+	// Declared roles are managed once they are created, adopted roles once all their changes are applied
+	remaining := map[string]int{}
+	for _, change := range plan.Changes {
+		remaining[change.Role]++
+	}
+	manage := func(name string, created bool) {
+		if (created || remaining[name] == 0) && config.declares(name) && !contains(status.Managed, name) {
+			status.Managed = append(status.Managed, name)
+			sort.Strings(status.Managed)
+		}
+	}
+	for _, role := range config.Roles {
+		manage(role.Name, false)
+	}
+	status.Applied, status.Dropped = nil, nil
+
+	var failed error
+	for _, change := range plan.Changes {
+		log.Infof("Role %s: %s", change.Role, change.Redacted)
+		if _, err := nodetool.CQLInput(r.executor, pod, change.Statement+";\n"); err != nil {
+			failed = fmt.Errorf("failed to change role %s: %v", change.Role, err)
+			break
+		}
+		status.Applied = append(status.Applied, change.Redacted)
+		remaining[change.Role]--
+		manage(change.Role, change.Create)
+		if change.Drop {
+			status.Dropped = append(status.Dropped, change.Role)
+			status.Managed = remove(status.Managed, change.Role)
+		}
+		if err := r.store.Save(status); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+	// Managed roles that were dropped by someone else are forgotten
+	for _, name := range status.Managed {
+		if _, exists := current[name]; !exists && !config.declares(name) {
+			status.Managed = remove(status.Managed, name)
+		}
+	}
+
+	if err := r.store.Save(status); err != nil {
+		log.Errorf("%v", err)
+	}
+	log.Infof("Roles reconciled:\n%s", status.Report())
+	return status, failed
+}
+
+// passwords returns the passwords of the declared roles from their secrets.
+func (r *Reconciler) passwords(config Config) (map[string]string, error) {
+	passwords := map[string]string{}
+	for _, role := range config.Roles {
+		if role.PasswordSecret == nil {
+			continue
+		}
+		key := role.PasswordSecret.Key
+		if key == "" {
+			key = DefaultPasswordKey
+		}
+		secret, err := r.client.CoreV1().Secrets(r.namespace).Get(role.PasswordSecret.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the password secret of role %s: %v", role.Name, err)
+		}
+		password, ok := secret.Data[key]
+		if !ok || len(password) == 0 {
+			return nil, fmt.Errorf("the password secret %s of role %s has no key '%s'", role.PasswordSecret.Name, role.Name, key)
+		}
+		passwords[role.Name] = string(password)
+	}
+	return passwords, nil
+}
+
+func (c Config) declares(name string) bool {
+	for _, role := range c.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(values []string, value string) []string {
+	result := []string{}
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Store keeps the status of the reconciler in a configmap.
+type Store struct {
+	configMap *state.ConfigMapStore
+}
+
+// NewStore returns a store for the configmap.
+func NewStore(configMap *state.ConfigMapStore) *Store {
+	return &Store{configMap: configMap}
+}
+
+// Load returns the status of the last run, or an empty status.
+func (s *Store) Load() (*Status, error) {
+	status := &Status{}
+	// The managed roles are needed to drop roles, an invalid status must not be ignored
+	if _, err := s.configMap.Load(StatusKey, status); err != nil {
+		return nil, fmt.Errorf("failed to get role status: %v", err)
+	}
+	return status, nil
+}
+
+// Save persists the status and its report.
+func (s *Store) Save(status *Status) error {
+	return s.configMap.Save(StatusKey, status, map[string]string{ReportKey: status.Report()})
+}
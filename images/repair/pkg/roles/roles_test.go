@@ -0,0 +1,235 @@
+package roles
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+const fakePermissions = `
+ [json]
+------------------------------------------------------------------------------------------------------------------------------
+ {"role": "shop_app", "resource": "data/shop", "permissions": ["MODIFY", "SELECT"]}
+ {"role": "shop_app", "resource": "functions/shop/f", "permissions": ["EXECUTE"]}
+ {"role": "legacy", "resource": "data", "permissions": ["SELECT"]}
+
+(3 rows)
+`
+
+type fakeExecutor struct {
+	roles      string
+	statements []string
+	// fail is a prefix of statements that fail
+	fail string
+}
+
+func (e *fakeExecutor) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	switch command[2] {
+	case rolesQuery:
+		return e.roles, nil
+	case permissionsQuery:
+		return fakePermissions, nil
+	}
+	return "", fmt.Errorf("unexpected command %v", command)
+}
+
+func (e *fakeExecutor) ExecInput(pod *corev1.Pod, container string, command []string, input string) (string, error) {
+	if e.fail != "" && strings.HasPrefix(input, e.fail) {
+		return "", fmt.Errorf("failed")
+	}
+	e.statements = append(e.statements, strings.TrimSuffix(input, ";\n"))
+	return "", nil
+}
+
+func fakeRoles(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NoError(t, err)
+	return fmt.Sprintf(`
+ [json]
+------------------------------------------------------------------------------------------------------------------------------
+ {"role": "cassandra", "can_login": true, "is_superuser": true, "member_of": null, "salted_hash": "%s"}
+ {"role": "shop_app", "can_login": true, "is_superuser": false, "member_of": ["legacy"], "salted_hash": "%s"}
+ {"role": "legacy", "can_login": false, "is_superuser": false, "member_of": null, "salted_hash": null}
+
+(3 rows)
+`, hash, hash)
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+roles:
+  - name: shop_app
+    login: true
+    passwordSecret:
+      name: shop-app-credentials
+    memberOf: [shop_reader]
+    grants:
+      - resource: keyspace shop
+        permissions: [modify]
+      - resource: TABLE shop.orders
+        permissions: [ALL]
+  - name: shop_reader
+    grants:
+      - resource: ALL KEYSPACES
+        permissions: [SELECT]
+`))
+	assert.NoError(t, err)
+	permissions, _ := config.Roles[0].declaredPermissions()
+	assert.Equal(t, map[string][]string{
+		"data/shop":        {"MODIFY"},
+		"data/shop/orders": {"ALTER", "AUTHORIZE", "DROP", "MODIFY", "SELECT"},
+	}, permissions)
+
+	for _, invalid := range []string{
+		"roles:\n  - name: \"shop app\"\n",
+		"roles:\n  - name: shop\n  - name: shop\n",
+		"roles:\n  - name: shop\n    login: true\n",
+		"roles:\n  - name: shop\n    memberOf: [shop]\n",
+		"roles:\n  - name: shop\n    grants:\n      - resource: FUNCTION f\n        permissions: [EXECUTE]\n",
+		"roles:\n  - name: shop\n    grants:\n      - resource: TABLE shop\n        permissions: [SELECT]\n",
+		"roles:\n  - name: shop\n    grants:\n      - resource: TABLE shop.orders\n        permissions: [CREATE]\n",
+		"roles:\n  - name: shop\n    grants:\n      - resource: KEYSPACE shop\n",
+		"roles:\n  - name: shop\n    password: secret\n",
+	} {
+		_, err := ParseConfig([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	executor := &fakeExecutor{roles: fakeRoles(t, "old")}
+	current, err := ReadRoles(executor, &corev1.Pod{})
+	assert.NoError(t, err)
+	assert.Len(t, current, 3)
+	assert.Equal(t, map[string][]string{"data/shop": {"MODIFY", "SELECT"}, "functions/shop/f": {"EXECUTE"}}, current["shop_app"].Permissions)
+
+	config := Config{Roles: []Role{
+		{Name: "shop_app", Adopt: true, Login: true, PasswordSecret: &SecretKeyRef{Name: "shop"}, MemberOf: []string{"shop_reader"}, Grants: []Grant{
+			{Resource: "KEYSPACE shop", Permissions: []string{"MODIFY"}},
+		}},
+		{Name: "shop_reader", Grants: []Grant{{Resource: "KEYSPACE shop", Permissions: []string{"SELECT"}}}},
+	}}
+	plan, err := NewPlan(config, current, map[string]string{"shop_app": "it's new"}, []string{"legacy"}, []string{"cassandra"})
+	assert.NoError(t, err)
+	statements := []string{}
+	redacted := []string{}
+	for _, change := range plan.Changes {
+		statements = append(statements, change.Statement)
+		redacted = append(redacted, change.Redacted)
+	}
+	assert.Equal(t, []string{
+		`ALTER ROLE "shop_app" WITH PASSWORD = 'it''s new'`,
+		`CREATE ROLE "shop_reader" WITH LOGIN = false AND SUPERUSER = false`,
+		`GRANT "shop_reader" TO "shop_app"`,
+		`REVOKE "legacy" FROM "shop_app"`,
+		`REVOKE SELECT ON KEYSPACE "shop" FROM "shop_app"`,
+		`GRANT SELECT ON KEYSPACE "shop" TO "shop_reader"`,
+		`DROP ROLE IF EXISTS "legacy"`,
+	}, statements)
+	assert.Equal(t, `ALTER ROLE "shop_app" WITH PASSWORD = '*****'`, redacted[0])
+	assert.True(t, plan.Changes[6].Drop)
+
+	// The password is only changed if it does not match the hash
+	plan, err = NewPlan(config, current, map[string]string{"shop_app": "old"}, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `CREATE ROLE "shop_reader" WITH LOGIN = false AND SUPERUSER = false`, plan.Changes[0].Statement)
+
+	_, err = NewPlan(Config{Roles: []Role{{Name: "cassandra"}}}, current, nil, nil, []string{"cassandra"})
+	assert.EqualError(t, err, "role cassandra is used by the operator and can not be declared")
+	_, err = NewPlan(Config{Roles: []Role{{Name: "shop", MemberOf: []string{"missing"}}}}, current, nil, nil, nil)
+	assert.EqualError(t, err, "role shop is a member of role missing, which does not exist")
+	_, err = NewPlan(Config{Roles: []Role{{Name: "legacy"}}}, current, nil, nil, nil)
+	assert.EqualError(t, err, "role legacy already exists and is not managed, set 'adopt: true' to manage it")
+	_, err = NewPlan(Config{Roles: []Role{{Name: "legacy"}}}, current, nil, []string{"legacy"}, nil)
+	assert.NoError(t, err)
+}
+
+func TestRun(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "default"},
+		Data:       map[string][]byte{"token": []byte("old")},
+	})
+	store := NewStore(state.NewConfigMapStore(client, "default", "cassandra-roles", nil))
+	config := Config{Roles: []Role{
+		{Name: "shop_app", Adopt: true, Login: true, PasswordSecret: &SecretKeyRef{Name: "shop", Key: "token"}, MemberOf: []string{"legacy"}, Grants: []Grant{
+			{Resource: "KEYSPACE shop", Permissions: []string{"MODIFY", "SELECT"}},
+		}},
+		{Name: "legacy", Adopt: true, Grants: []Grant{{Resource: "ALL KEYSPACES", Permissions: []string{"SELECT"}}}},
+	}}
+
+	executor := &fakeExecutor{roles: fakeRoles(t, "old")}
+	status, err := NewReconciler(executor, client, "default", store, nil).Run(config, &corev1.Pod{})
+	assert.NoError(t, err)
+	assert.Empty(t, executor.statements)
+	assert.Equal(t, []string{"legacy", "shop_app"}, status.Managed)
+
+	// A role that is no longer declared is dropped, an unmanaged role is not
+	config.Roles = config.Roles[:1]
+	config.Roles[0].MemberOf = nil
+	executor = &fakeExecutor{roles: fakeRoles(t, "old")}
+	status, err = NewReconciler(executor, client, "default", store, nil).Run(config, &corev1.Pod{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`REVOKE "legacy" FROM "shop_app"`, `DROP ROLE IF EXISTS "legacy"`}, executor.statements)
+	assert.Equal(t, []string{"shop_app"}, status.Managed)
+	assert.Equal(t, []string{"legacy"}, status.Dropped)
+
+	cm, err := client.CoreV1().ConfigMaps("default").Get("cassandra-roles", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "applied: REVOKE \"legacy\" FROM \"shop_app\"\napplied: DROP ROLE IF EXISTS \"legacy\"\ndropped: legacy\nmanaged: shop_app\n", cm.Data[ReportKey])
+
+	// The password is never part of the status
+	executor = &fakeExecutor{roles: fakeRoles(t, "older"), fail: "REVOKE"}
+	status, err = NewReconciler(executor, client, "default", store, nil).Run(config, &corev1.Pod{})
+	assert.EqualError(t, err, "failed to change role shop_app: failed")
+	assert.Equal(t, []string{`ALTER ROLE "shop_app" WITH PASSWORD = 'old'`}, executor.statements)
+	assert.Equal(t, []string{`ALTER ROLE "shop_app" WITH PASSWORD = '*****'`}, status.Applied)
+
+	config.Roles[0].PasswordSecret.Key = "password"
+	_, err = NewReconciler(executor, client, "default", store, nil).Run(config, &corev1.Pod{})
+	assert.EqualError(t, err, "the password secret shop of role shop_app has no key 'password'")
+}
+
+func TestRun_unmanaged(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := NewStore(state.NewConfigMapStore(client, "default", "cassandra-roles", nil))
+	config := Config{Roles: []Role{
+		{Name: "shop_reader", Grants: []Grant{{Resource: "KEYSPACE shop", Permissions: []string{"SELECT"}}}},
+	}}
+
+	// A role is only managed once it is created
+	executor := &fakeExecutor{roles: fakeRoles(t, "old"), fail: "CREATE"}
+	status, err := NewReconciler(executor, client, "default", store, nil).Run(config, &corev1.Pod{})
+	assert.EqualError(t, err, "failed to change role shop_reader: failed")
+	assert.Empty(t, status.Managed)
+
+	executor = &fakeExecutor{roles: fakeRoles(t, "old"), fail: "GRANT"}
+	status, err = NewReconciler(executor, client, "default", store, nil).Run(config, &corev1.Pod{})
+	assert.EqualError(t, err, "failed to change role shop_reader: failed")
+	assert.Equal(t, []string{`CREATE ROLE "shop_reader" WITH LOGIN = false AND SUPERUSER = false`}, executor.statements)
+	assert.Equal(t, []string{"shop_reader"}, status.Managed)
+
+	// An adopted role is only managed once all its changes are applied
+	config.Roles = append(config.Roles, Role{Name: "legacy", Adopt: true, Grants: []Grant{{Resource: "KEYSPACE shop", Permissions: []string{"SELECT"}}}})
+	status, err = NewReconciler(executor, client, "default", store, nil).Run(config, &corev1.Pod{})
+	assert.EqualError(t, err, "failed to change role shop_reader: failed")
+	assert.Equal(t, []string{"shop_reader"}, status.Managed)
+
+	// The roles that existed before and were never declared survive
+	config.Roles = config.Roles[:1]
+	executor = &fakeExecutor{roles: fakeRoles(t, "old")}
+	status, err = NewReconciler(executor, client, "default", store, nil).Run(config, &corev1.Pod{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"shop_reader"}, status.Managed)
+	for _, statement := range executor.statements {
+		assert.NotContains(t, statement, "DROP")
+	}
+
+}
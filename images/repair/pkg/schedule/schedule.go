@@ -0,0 +1,182 @@
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/nodetool"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/repair"
+)
+
+// defaultGCGrace is the gc_grace_seconds default of Cassandra, it is used for the cycle deadline if no table has
+// a gc grace period.
+const defaultGCGrace = 10 * 24 * time.Hour
+
+// Options configure the scheduled repairs.
+type Options struct {
+	// Schedule of the runs, used to spread the repairs of a cycle over the runs until its deadline.
+	Schedule cron.Schedule
+	// WarningPeriod is the time before the repair deadline of a table at which a warning is logged. A cycle is
+	// planned to complete before the warning period of its tables starts.
+	WarningPeriod time.Duration
+}
+
+// Scheduler runs one scheduled repair run. Every run repairs a share of the ring, so a repair cycle of the whole
+// ring is completed before the gc grace period of its tables passes.
+type Scheduler struct {
+	orchestrator *repair.Orchestrator
+	executor     nodetool.Executor
+	store        *Store
+	options      Options
+	now          func() time.Time
+}
+
+func NewScheduler(orchestrator *repair.Orchestrator, executor nodetool.Executor, store *Store, options Options) *Scheduler {
+	return &Scheduler{
+		orchestrator: orchestrator,
+		executor:     executor,
+		store:        store,
+		options:      options,
+		now:          time.Now,
+	}
+}
+
+// Run repairs the share of the current cycle for this run and records the repair of all tables when the cycle
+// completes. It returns an error if a subrange could not be repaired, the subrange is repaired again by the next
+// run.
+func (s *Scheduler) Run() error {
+	status, err := s.store.Load()
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	started := status.Cycle == nil
+	if started {
+		status.Cycle = &Cycle{ID: fmt.Sprintf("cycle-%s", now.UTC().Format("20060102T150405Z")), StartedAt: metav1.NewTime(now)}
+	}
+
+	run, err := s.orchestrator.Prepare(status.Cycle.ID)
+	if err != nil {
+		return err
+	}
+	pod, err := run.Pod()
+	if err != nil {
+		return err
+	}
+	keyspaces := make([]string, 0, len(run.State.Keyspaces))
+	for keyspace := range run.State.Keyspaces {
+		keyspaces = append(keyspaces, keyspace)
+	}
+	tables, err := nodetool.Tables(s.executor, pod, keyspaces)
+	if err != nil {
+		return fmt.Errorf("failed to list tables: %v", err)
+	}
+	status.updateTables(tables, now)
+	if started {
+		status.Cycle.Tables = make([]string, 0, len(tables))
+		for _, table := range tables {
+			status.Cycle.Tables = append(status.Cycle.Tables, table.FullName())
+		}
+		sort.Strings(status.Cycle.Tables)
+		status.Cycle.Deadline = metav1.NewTime(now.Add(s.cycleDuration(tables)))
+		log.Infof("Starting repair cycle %s of %d tables, deadline %s", status.Cycle.ID, len(tables), status.Cycle.Deadline.UTC().Format(time.RFC3339))
+	}
+
+	if remaining := len(run.Segments); remaining > 0 {
+		run.Repair(budget(remaining, s.options.Schedule, now, status.Cycle.Deadline.Time))
+	}
+
+	st := run.State
+	if st.Complete() {
+		log.Infof("Repair cycle %s completed", status.Cycle.ID)
+		st.Finish()
+		for _, name := range status.Cycle.Tables {
+			if table, ok := status.Tables[name]; ok {
+				lastRepair := status.Cycle.StartedAt
+				table.LastRepair = &lastRepair
+			}
+		}
+		status.Cycle = nil
+	}
+	if err := run.Save(); err != nil {
+		log.Errorf("%v", err)
+	}
+
+	s.warn(status)
+	if err := s.store.Save(status, status.Report(s.now(), s.options.WarningPeriod)); err != nil {
+		return err
+	}
+	if failed := st.FailedRanges(); failed > 0 {
+		return fmt.Errorf("%d subranges could not be repaired", failed)
+	}
+	return nil
+}
+
+// cycleDuration returns the time in which a cycle has to complete, so no table reaches its warning period. If the
+// gc grace period is shorter than twice the warning period, the cycle takes half the gc grace period.
+func (s *Scheduler) cycleDuration(tables []nodetool.Table) time.Duration {
+	gcGrace := time.Duration(0)
+	for _, table := range tables {
+		if table.GCGrace > 0 && (gcGrace == 0 || table.GCGrace < gcGrace) {
+			gcGrace = table.GCGrace
+		}
+	}
+	if gcGrace == 0 {
+		gcGrace = defaultGCGrace
+	}
+	if gcGrace < 2*s.options.WarningPeriod {
+		return gcGrace / 2
+	}
+	return gcGrace - s.options.WarningPeriod
+}
+
+// warn logs the tables that are close to or past their repair deadline.
+func (s *Scheduler) warn(status *Status) {
+	now := s.now()
+	for name, table := range status.Tables {
+		deadline, ok := table.Deadline()
+		if !ok {
+			continue
+		}
+		if now.After(deadline) {
+			log.Errorf("Table %s missed its repair deadline %s, deleted data may reappear", name, deadline.UTC().Format(time.RFC3339))
+		} else if deadline.Sub(now) < s.options.WarningPeriod {
+			log.Warnf("Table %s has to be repaired before %s", name, deadline.UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+// updateTables adds new tables, updates their gc grace period and removes dropped tables.
+func (s *Status) updateTables(tables []nodetool.Table, now time.Time) {
+	existing := map[string]bool{}
+	for _, table := range tables {
+		name := table.FullName()
+		existing[name] = true
+		t, ok := s.Tables[name]
+		if !ok {
+			t = &Table{FirstSeen: metav1.NewTime(now)}
+			s.Tables[name] = t
+		}
+		t.GCGraceSeconds = int64(table.GCGrace.Seconds())
+	}
+	for name := range s.Tables {
+		if !existing[name] {
+			delete(s.Tables, name)
+		}
+	}
+}
+
+// budget returns the number of subranges to repair in this run, so the remaining subranges are spread evenly over
+// this run and the scheduled runs before the deadline.
+func budget(remaining int, schedule cron.Schedule, now, deadline time.Time) int {
+	runs := 1
+	for next := schedule.Next(now); runs < remaining && next.Before(deadline); next = schedule.Next(next) {
+		runs++
+	}
+	return (remaining + runs - 1) / runs
+}
@@ -0,0 +1,173 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/repair"
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+const fakeRing = `TokenRange:
+	TokenRange(start_token:100, end_token:200, endpoints:[10.0.0.1, 10.0.0.2], rpc_endpoints:[], endpoint_details:[EndpointDetails(host:10.0.0.1, datacenter:dc1, rack:rack1), EndpointDetails(host:10.0.0.2, datacenter:dc1, rack:rack1)])
+	TokenRange(start_token:200, end_token:100, endpoints:[10.0.0.2, 10.0.0.1], rpc_endpoints:[], endpoint_details:[EndpointDetails(host:10.0.0.2, datacenter:dc1, rack:rack1), EndpointDetails(host:10.0.0.1, datacenter:dc1, rack:rack1)])
+`
+
+const fakeTables = `
+ keyspace_name | table_name | gc_grace_seconds
+---------------+------------+------------------
+          shop |     orders |           864000
+          shop |      carts |                0
+        system |      local |                0
+
+(3 rows)
+`
+
+type fakeExecutor struct {
+	repairs []string
+	fail    bool
+}
+
+func (e *fakeExecutor) Exec(pod *corev1.Pod, container string, command []string) (string, error) {
+	if command[0] == "cqlsh" {
+		return fakeTables, nil
+	}
+	args := command[2:]
+	switch args[0] {
+	case "tablestats":
+		return "Keyspace : shop\nKeyspace : system\n", nil
+	case "describering":
+		return fakeRing, nil
+	case "repair":
+		e.repairs = append(e.repairs, fmt.Sprintf("%s %s", args[6], args[3]))
+		if e.fail {
+			return "", fmt.Errorf("repair failed")
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected command %s", strings.Join(command, " "))
+}
+
+func newTestScheduler(executor *fakeExecutor, now *time.Time) (*Scheduler, *Store, *fake.Clientset) {
+	client := fake.NewSimpleClientset()
+	for i := 1; i <= 2; i++ {
+		_, _ = client.CoreV1().Pods("default").Create(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("cassandra-node-%d", i-1),
+				Namespace: "default",
+				Labels:    map[string]string{"app": "cassandra", "cassandra": "cassandra"},
+			},
+			Status: corev1.PodStatus{
+				PodIP:      fmt.Sprintf("10.0.0.%d", i),
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+			},
+		})
+	}
+	options := repair.DefaultOptions()
+	options.SegmentsPerRange = 2
+	options.Retries = 0
+	configMap := state.NewConfigMapStore(client, "default", "cassandra-repair-schedule", nil)
+	repairStore := state.NewStore(configMap)
+	orchestrator := repair.NewOrchestrator(client, executor, "default", "app = cassandra, cassandra", repairStore, options)
+
+	store := NewStore(configMap)
+	schedule, _ := cron.ParseStandard("0 3 * * *")
+	scheduler := NewScheduler(orchestrator, executor, store, Options{Schedule: schedule, WarningPeriod: 48 * time.Hour})
+	scheduler.now = func() time.Time { return *now }
+	return scheduler, store, client
+}
+
+func TestRun_cycle(t *testing.T) {
+	executor := &fakeExecutor{}
+	now := time.Date(2020, 6, 1, 3, 0, 0, 0, time.UTC)
+	scheduler, store, _ := newTestScheduler(executor, &now)
+
+	// 4 subranges are spread over the daily runs of the 8 day cycle
+	assert.NoError(t, scheduler.Run())
+	assert.Len(t, executor.repairs, 1)
+	status, err := store.Load()
+	assert.NoError(t, err)
+	if assert.NotNil(t, status.Cycle) {
+		assert.Equal(t, now.Add(8*24*time.Hour), status.Cycle.Deadline.Time.UTC())
+		assert.Equal(t, []string{"shop.carts", "shop.orders"}, status.Cycle.Tables)
+	}
+	assert.Nil(t, status.Tables["shop.orders"].LastRepair)
+	assert.NotContains(t, status.Tables, "system.local", "tables of local keyspaces are not repaired")
+
+	for i := 0; i < 3; i++ {
+		now = now.Add(24 * time.Hour)
+		assert.NoError(t, scheduler.Run())
+	}
+	assert.Len(t, executor.repairs, 4)
+	status, err = store.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, status.Cycle, "the cycle is completed")
+	if assert.NotNil(t, status.Tables["shop.orders"].LastRepair) {
+		assert.Equal(t, time.Date(2020, 6, 1, 3, 0, 0, 0, time.UTC), status.Tables["shop.orders"].LastRepair.Time.UTC())
+	}
+
+	// The next run starts a new cycle
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, scheduler.Run())
+	assert.Len(t, executor.repairs, 5)
+	status, err = store.Load()
+	assert.NoError(t, err)
+	assert.NotNil(t, status.Cycle)
+}
+
+func TestRun_failure(t *testing.T) {
+	executor := &fakeExecutor{fail: true}
+	now := time.Date(2020, 6, 1, 3, 0, 0, 0, time.UTC)
+	scheduler, store, _ := newTestScheduler(executor, &now)
+
+	assert.Error(t, scheduler.Run())
+	executor.fail = false
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, scheduler.Run())
+	assert.Equal(t, executor.repairs[0], executor.repairs[1], "the failed subrange is repaired by the next run")
+
+	status, err := store.Load()
+	assert.NoError(t, err)
+	assert.NotNil(t, status.Cycle)
+}
+
+func TestRun_deadlines(t *testing.T) {
+	executor := &fakeExecutor{}
+	now := time.Date(2020, 6, 1, 3, 0, 0, 0, time.UTC)
+	scheduler, store, client := newTestScheduler(executor, &now)
+	assert.NoError(t, scheduler.Run())
+
+	// The cycle missed its deadline, all remaining subranges are repaired
+	now = now.Add(9 * 24 * time.Hour)
+	assert.NoError(t, scheduler.Run())
+	assert.Len(t, executor.repairs, 4)
+	cm, err := client.CoreV1().ConfigMaps("default").Get("cassandra-repair-schedule", metav1.GetOptions{})
+	assert.NoError(t, err)
+	// The schedule status does not replace the repair state of the cycle
+	assert.Contains(t, cm.Data, state.StateKey)
+	assert.Contains(t, cm.Data, StatusKey)
+	assert.Contains(t, cm.Data[TablesKey], "shop.orders: last repair 2020-06-01T03:00:00Z, deadline 2020-06-11T03:00:00Z WARNING")
+	assert.Contains(t, cm.Data[TablesKey], "shop.carts: last repair 2020-06-01T03:00:00Z, no deadline")
+
+	now = now.Add(2 * 24 * time.Hour)
+	status, err := store.Load()
+	assert.NoError(t, err)
+	assert.Contains(t, status.Report(now, 48*time.Hour), "deadline 2020-06-11T03:00:00Z MISSED")
+}
+
+func TestBudget(t *testing.T) {
+	hourly, _ := cron.ParseStandard("0 * * * *")
+	now := time.Date(2020, 6, 1, 3, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 10, budget(100, hourly, now, now.Add(10*time.Hour)))
+	assert.Equal(t, 1, budget(5, hourly, now, now.Add(10*time.Hour)))
+	assert.Equal(t, 100, budget(100, hourly, now, now.Add(-time.Hour)), "everything is repaired after the deadline")
+}
@@ -0,0 +1,141 @@
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-repair/pkg/state"
+)
+
+const (
+	// StatusKey contains the status of the scheduled repairs as JSON.
+	StatusKey = "schedule.json"
+	// TablesKey contains a human readable overview of the repair deadlines of all tables.
+	TablesKey = "tables"
+)
+
+// Status is the persisted state of the scheduled repairs across runs.
+type Status struct {
+	// Cycle is the current repair of the whole ring. It is spread over the scheduled runs.
+	Cycle *Cycle `json:"cycle,omitempty"`
+	// Tables contains the repair status of every table, by 'keyspace.table'.
+	Tables map[string]*Table `json:"tables"`
+}
+
+// Cycle is a repair of all token ranges of the ring.
+type Cycle struct {
+	// ID is the run ID of the repair state of the cycle.
+	ID        string      `json:"id"`
+	StartedAt metav1.Time `json:"startedAt"`
+	// Deadline is the time until which the cycle should be completed.
+	Deadline metav1.Time `json:"deadline"`
+	// Tables are the tables that existed when the cycle started. They are repaired when the cycle completes.
+	Tables []string `json:"tables"`
+}
+
+// Table is the repair status of a table.
+type Table struct {
+	GCGraceSeconds int64 `json:"gcGraceSeconds"`
+	// FirstSeen is the time the table was found by a scheduled run. It replaces the last repair of tables that
+	// were never repaired.
+	FirstSeen metav1.Time `json:"firstSeen"`
+	// LastRepair is the start of the last cycle that repaired all token ranges of the table.
+	LastRepair *metav1.Time `json:"lastRepair,omitempty"`
+}
+
+// Deadline returns the time until which the table has to be repaired again, and false if the table has no
+// deadline because its tombstones are purged immediately.
+func (t *Table) Deadline() (time.Time, bool) {
+	if t.GCGraceSeconds <= 0 {
+		return time.Time{}, false
+	}
+	base := t.FirstSeen
+	if t.LastRepair != nil {
+		base = *t.LastRepair
+	}
+	return base.Add(time.Duration(t.GCGraceSeconds) * time.Second), true
+}
+
+// Report returns a human readable overview of the repair deadlines, the tables with the nearest deadline first.
+func (s *Status) Report(now time.Time, warningPeriod time.Duration) string {
+	names := make([]string, 0, len(s.Tables))
+	for name := range s.Tables {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		di, _ := s.Tables[names[i]].Deadline()
+		dj, _ := s.Tables[names[j]].Deadline()
+		if !di.Equal(dj) {
+			return di.Before(dj)
+		}
+		return names[i] < names[j]
+	})
+
+	b := &strings.Builder{}
+	if s.Cycle != nil {
+		fmt.Fprintf(b, "Repair cycle %s started at %s, deadline %s\n", s.Cycle.ID,
+			s.Cycle.StartedAt.UTC().Format(time.RFC3339), s.Cycle.Deadline.UTC().Format(time.RFC3339))
+	}
+	for _, name := range names {
+		table := s.Tables[name]
+		lastRepair := "never"
+		if table.LastRepair != nil {
+			lastRepair = table.LastRepair.UTC().Format(time.RFC3339)
+		}
+		deadline, ok := table.Deadline()
+		if !ok {
+			fmt.Fprintf(b, "%s: last repair %s, no deadline\n", name, lastRepair)
+			continue
+		}
+		fmt.Fprintf(b, "%s: last repair %s, deadline %s%s\n", name, lastRepair, deadline.UTC().Format(time.RFC3339), mark(deadline, now, warningPeriod))
+	}
+	return b.String()
+}
+
+func mark(deadline, now time.Time, warningPeriod time.Duration) string {
+	switch {
+	case now.After(deadline):
+		return " MISSED"
+	case deadline.Sub(now) < warningPeriod:
+		return " WARNING"
+	}
+	return ""
+}
+
+// Store keeps the status of the scheduled repairs in a configmap. It can share the configmap with the repair state
+// of the cycles.
+type Store struct {
+	configMap *state.ConfigMapStore
+}
+
+// NewStore returns a store for the configmap.
+func NewStore(configMap *state.ConfigMapStore) *Store {
+	return &Store{configMap: configMap}
+}
+
+// Load returns the persisted status, or an empty status if there is none.
+func (s *Store) Load() (*Status, error) {
+	status := &Status{}
+	_, err := s.configMap.Load(StatusKey, status)
+	if state.IsInvalid(err) {
+		log.Warnf("Ignoring invalid repair schedule status: %v", err)
+		return &Status{Tables: map[string]*Table{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repair schedule status: %v", err)
+	}
+	if status.Tables == nil {
+		status.Tables = map[string]*Table{}
+	}
+	return status, nil
+}
+
+// Save persists the status and the deadline report.
+func (s *Store) Save(status *Status, report string) error {
+	return s.configMap.Save(StatusKey, status, map[string]string{TablesKey: report})
+}
@@ -0,0 +1,107 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// ConfigMapStore keeps JSON documents and their reports in the keys of a configmap. Stores of different documents
+// can share the configmap, every save only replaces its own keys.
+type ConfigMapStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	// owner of the configmap, so it is removed together with the Cassandra instance
+	owner *metav1.OwnerReference
+}
+
+// NewConfigMapStore returns a store for the configmap.
+func NewConfigMapStore(client kubernetes.Interface, namespace, name string, owner *metav1.OwnerReference) *ConfigMapStore {
+	return &ConfigMapStore{client: client, namespace: namespace, name: name, owner: owner}
+}
+
+func (s *ConfigMapStore) String() string {
+	return fmt.Sprintf("%s/%s", s.namespace, s.name)
+}
+
+// Load decodes the document in the key into v. It returns false if the configmap or the key does not exist.
+func (s *ConfigMapStore) Load(key string, v interface{}) (bool, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get configmap %s: %v", s, err)
+	}
+	data, ok := cm.Data[key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		return false, &invalidError{fmt.Errorf("invalid %s in configmap %s: %v", key, s, err)}
+	}
+	return true, nil
+}
+
+type invalidError struct {
+	error
+}
+
+// IsInvalid returns true if Load failed because the document could not be decoded.
+func IsInvalid(err error) bool {
+	_, ok := err.(*invalidError)
+	return ok
+}
+
+// Save stores v as JSON in the key, and the reports in their keys.
+func (s *ConfigMapStore) Save(key string, v interface{}, reports map[string]string) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to serialize %s: %v", key, err)
+	}
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(s.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace},
+				Data:       map[string]string{},
+			}
+			if s.owner != nil {
+				cm.OwnerReferences = []metav1.OwnerReference{*s.owner}
+			}
+			setData(cm, key, string(data), reports)
+			_, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(cm)
+			if errors.IsAlreadyExists(err) {
+				// Created by another store in the meantime, retry with an update
+				return errors.NewConflict(corev1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		setData(cm, key, string(data), reports)
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Update(cm)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save %s in configmap %s: %v", key, s, err)
+	}
+	return nil
+}
+
+func setData(cm *corev1.ConfigMap, key, data string, reports map[string]string) {
+	cm.Data[key] = data
+	for k, v := range reports {
+		cm.Data[k] = v
+	}
+}
@@ -0,0 +1,40 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapStore(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	owner := &metav1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "cassandra-node", UID: "uid"}
+	store := NewConfigMapStore(client, "default", "cassandra-status", owner)
+
+	var value map[string]int
+	found, err := store.Load("a.json", &value)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// Documents in different keys share the configmap
+	assert.NoError(t, store.Save("a.json", map[string]int{"a": 1}, map[string]string{"a-report": "a is 1"}))
+	assert.NoError(t, NewConfigMapStore(client, "default", "cassandra-status", nil).Save("b.json", map[string]int{"b": 2}, nil))
+	found, err = store.Load("a.json", &value)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, map[string]int{"a": 1}, value)
+
+	cm, err := client.CoreV1().ConfigMaps("default").Get("cassandra-status", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a.json": `{"a":1}`, "a-report": "a is 1", "b.json": `{"b":2}`}, cm.Data)
+	assert.Equal(t, []metav1.OwnerReference{*owner}, cm.OwnerReferences)
+
+	cm.Data["a.json"] = "{invalid"
+	_, err = client.CoreV1().ConfigMaps("default").Update(cm)
+	assert.NoError(t, err)
+	_, err = store.Load("a.json", &value)
+	assert.True(t, IsInvalid(err))
+	assert.False(t, IsInvalid(nil))
+}
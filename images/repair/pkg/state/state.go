@@ -0,0 +1,193 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// StateKey contains the progress of the repair run as JSON.
+	StateKey = "state.json"
+	// ReportKey contains a human readable summary of the repair run.
+	ReportKey = "report"
+)
+
+// State is the persisted progress of a repair run.
+type State struct {
+	// RunID identifies the run, a job that is restarted with the same run ID resumes the run.
+	RunID      string       `json:"runID"`
+	StartedAt  metav1.Time  `json:"startedAt"`
+	UpdatedAt  metav1.Time  `json:"updatedAt"`
+	FinishedAt *metav1.Time `json:"finishedAt,omitempty"`
+	// Keyspaces contains the progress of every repaired keyspace.
+	Keyspaces map[string]*Keyspace `json:"keyspaces"`
+}
+
+// Keyspace is the progress of the repair of a keyspace.
+type Keyspace struct {
+	// Ranges is the number of planned subranges.
+	Ranges int `json:"ranges"`
+	// Completed are the keys of the repaired subranges.
+	Completed []string `json:"completed,omitempty"`
+	// Failed are the subranges that could not be repaired, by key.
+	Failed map[string]Failure `json:"failed,omitempty"`
+	// Seconds is the accumulated duration of all repairs of the keyspace.
+	Seconds float64 `json:"seconds"`
+}
+
+// Failure is the last error of a subrange that could not be repaired.
+type Failure struct {
+	Coordinator string `json:"coordinator"`
+	Attempts    int    `json:"attempts"`
+	Error       string `json:"error"`
+}
+
+// New returns the state of a new run.
+func New(runID string) *State {
+	now := metav1.Now()
+	return &State{RunID: runID, StartedAt: now, UpdatedAt: now, Keyspaces: map[string]*Keyspace{}}
+}
+
+// Keyspace returns the progress of the keyspace, and adds it if necessary.
+func (s *State) Keyspace(name string) *Keyspace {
+	if ks, ok := s.Keyspaces[name]; ok {
+		return ks
+	}
+	ks := &Keyspace{}
+	s.Keyspaces[name] = ks
+	return ks
+}
+
+// IsCompleted returns true if the subrange of the keyspace was repaired.
+func (s *State) IsCompleted(keyspace, key string) bool {
+	ks, ok := s.Keyspaces[keyspace]
+	if !ok {
+		return false
+	}
+	for _, completed := range ks.Completed {
+		if completed == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Succeeded records the successful repair of the subrange.
+func (s *State) Succeeded(keyspace, key string, duration time.Duration) {
+	ks := s.Keyspace(keyspace)
+	if !s.IsCompleted(keyspace, key) {
+		ks.Completed = append(ks.Completed, key)
+	}
+	delete(ks.Failed, key)
+	ks.Seconds += duration.Seconds()
+	s.UpdatedAt = metav1.Now()
+}
+
+// Failed records a failed repair of the subrange.
+func (s *State) Failed(keyspace, key string, failure Failure, duration time.Duration) {
+	ks := s.Keyspace(keyspace)
+	if ks.Failed == nil {
+		ks.Failed = map[string]Failure{}
+	}
+	ks.Failed[key] = failure
+	ks.Seconds += duration.Seconds()
+	s.UpdatedAt = metav1.Now()
+}
+
+// Finish marks the run as finished.
+func (s *State) Finish() {
+	now := metav1.Now()
+	s.FinishedAt = &now
+	s.UpdatedAt = now
+}
+
+// FailedRanges returns the number of subranges that could not be repaired.
+func (s *State) FailedRanges() int {
+	failed := 0
+	for _, ks := range s.Keyspaces {
+		failed += len(ks.Failed)
+	}
+	return failed
+}
+
+// Complete returns true if all planned subranges of all keyspaces were repaired.
+func (s *State) Complete() bool {
+	for _, ks := range s.Keyspaces {
+		if len(ks.Completed) < ks.Ranges {
+			return false
+		}
+	}
+	return true
+}
+
+// Report returns a human readable summary with the result of every keyspace and every failed subrange.
+func (s *State) Report() string {
+	names := make([]string, 0, len(s.Keyspaces))
+	for name := range s.Keyspaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Repair run %s started at %s", s.RunID, s.StartedAt.UTC().Format(time.RFC3339))
+	if s.FinishedAt != nil {
+		fmt.Fprintf(b, ", finished at %s", s.FinishedAt.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintln(b)
+	for _, name := range names {
+		ks := s.Keyspaces[name]
+		fmt.Fprintf(b, "Keyspace %s: %d/%d ranges repaired, %d failed, %v repair time\n",
+			name, len(ks.Completed), ks.Ranges, len(ks.Failed), (time.Duration(ks.Seconds) * time.Second).String())
+		keys := make([]string, 0, len(ks.Failed))
+		for key := range ks.Failed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			failure := ks.Failed[key]
+			fmt.Fprintf(b, "  range %s failed after %d attempts on %s: %s\n", key, failure.Attempts, failure.Coordinator, failure.Error)
+		}
+	}
+	return b.String()
+}
+
+// Store keeps the state of repair runs in a configmap.
+type Store struct {
+	configMap *ConfigMapStore
+}
+
+// NewStore returns a store for the configmap.
+func NewStore(configMap *ConfigMapStore) *Store {
+	return &Store{configMap: configMap}
+}
+
+// Load returns the state of the run. The state of a previous attempt of the same run is resumed, otherwise a new
+// state is returned.
+func (s *Store) Load(runID string) (*State, bool, error) {
+	state := &State{}
+	found, err := s.configMap.Load(StateKey, state)
+	if IsInvalid(err) {
+		log.Warnf("Ignoring invalid repair state: %v", err)
+		return New(runID), false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get repair state: %v", err)
+	}
+	if !found || state.RunID != runID || state.FinishedAt != nil {
+		return New(runID), false, nil
+	}
+	if state.Keyspaces == nil {
+		state.Keyspaces = map[string]*Keyspace{}
+	}
+	return state, true, nil
+}
+
+// Save persists the state and its report.
+func (s *Store) Save(state *State) error {
+	return s.configMap.Save(StateKey, state, map[string]string{ReportKey: state.Report()})
+}
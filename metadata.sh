@@ -50,9 +50,13 @@ export CASSANDRA_EXPORTER_DOCKER_IMAGE="criteord/cassandra_exporter"
 export CASSANDRA_EXPORTER_VERSION="2.3.4"
 
 # https://github.com/thelastpickle/cassandra-medusa/releases
-export MEDUSA_BACKUP_VERSION="0.6.0"
+export MEDUSA_BACKUP_VERSION="0.7.1"
 
 export RECOVERY_CONTROLLER_VERSION="0.0.2"
+
+export REPAIR_VERSION="0.0.1"
+
+export BACKUP_VERSION="0.0.1"
 ################################################################################
 ############################## Docker images ###################################
 ################################################################################
@@ -80,6 +84,16 @@ export RECOVERY_CONTROLLER_DOCKER_IMAGE_NAME="kudo-cassandra-recovery"
 export RECOVERY_CONTROLLER_DOCKER_IMAGE_TAG="${RECOVERY_CONTROLLER_VERSION}-${OPERATOR_VERSION}${POSSIBLE_SNAPSHOT_SUFFIX}${IMAGE_DISAMBIGUATION_SUFFIX:-}"
 export RECOVERY_CONTROLLER_DOCKER_IMAGE="${RECOVERY_CONTROLLER_DOCKER_IMAGE_NAMESPACE}/${RECOVERY_CONTROLLER_DOCKER_IMAGE_NAME}:${RECOVERY_CONTROLLER_DOCKER_IMAGE_TAG}"
 
+export REPAIR_DOCKER_IMAGE_NAMESPACE="mesosphere"
+export REPAIR_DOCKER_IMAGE_NAME="kudo-cassandra-repair"
+export REPAIR_DOCKER_IMAGE_TAG="${REPAIR_VERSION}-${OPERATOR_VERSION}${POSSIBLE_SNAPSHOT_SUFFIX}${IMAGE_DISAMBIGUATION_SUFFIX:-}"
+export REPAIR_DOCKER_IMAGE="${REPAIR_DOCKER_IMAGE_NAMESPACE}/${REPAIR_DOCKER_IMAGE_NAME}:${REPAIR_DOCKER_IMAGE_TAG}"
+
+export BACKUP_DOCKER_IMAGE_NAMESPACE="mesosphere"
+export BACKUP_DOCKER_IMAGE_NAME="kudo-cassandra-backup"
+export BACKUP_DOCKER_IMAGE_TAG="${BACKUP_VERSION}-${OPERATOR_VERSION}${POSSIBLE_SNAPSHOT_SUFFIX}${IMAGE_DISAMBIGUATION_SUFFIX:-}"
+export BACKUP_DOCKER_IMAGE="${BACKUP_DOCKER_IMAGE_NAMESPACE}/${BACKUP_DOCKER_IMAGE_NAME}:${BACKUP_DOCKER_IMAGE_TAG}"
+
 ################################################################################
 ################################# Testing ######################################
 ################################################################################
@@ -1,6 +1,7 @@
 package cassandra
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -40,32 +41,32 @@ func NewNodeTool(client client.Client, namespace, instance string, sslEnabled bo
 // Run Runs nodetool inside a new pod
 func (c *Executor) Run(arguments ...string) (string, string, error) {
 	podName := fmt.Sprintf("nodetool-%s", uuid.NewUUID())
-	defaultMode := int32(0755)
 	id := int64(999)
 	runAsNonRoot := true
 	args := "sleep 1000000;"
 	volumeMounts := []v1.VolumeMount{}
 	volumes := []v1.Volume{}
+	env := []v1.EnvVar{}
+
+	// The TLS artifacts are generated by the bootstrap binary of the node image
+	image, err := c.nodeImage()
+	if err != nil {
+		return "", "", err
+	}
 
 	if c.sslEnabled {
-		args = "/etc/tls/bin/generate-tls-artifacts.sh;" +
-			"/etc/cassandra/generate-nodetool-ssl-properties.sh &&" +
-			"cp /etc/cassandra/nodetool-ssl.properties /home/cassandra/.cassandra/nodetool-ssl.properties;" +
-			args
+		args = "/etc/cassandra-bootstrap/bootstrap tls-artifacts;" + args
+		env = []v1.EnvVar{
+			{
+				Name:  "USE_SSL",
+				Value: "true",
+			},
+		}
 		volumeMounts = []v1.VolumeMount{
 			{
 				Name:      "cassandra-tls",
 				MountPath: "/etc/tls/certs",
 			},
-			{
-				Name:      "generate-tls-artifacts",
-				MountPath: "/etc/tls/bin",
-			},
-			{
-				Name:      "generate-nodetool-ssl-properties",
-				MountPath: "/etc/cassandra/generate-nodetool-ssl-properties.sh",
-				SubPath:   "generate-nodetool-ssl-properties.sh",
-			},
 			{
 				Name:      "dot-cassandra",
 				MountPath: "/home/cassandra/.cassandra/",
@@ -85,28 +86,6 @@ func (c *Executor) Run(arguments ...string) (string, string, error) {
 					},
 				},
 			},
-			{
-				Name: "generate-tls-artifacts",
-				VolumeSource: v1.VolumeSource{
-					ConfigMap: &v1.ConfigMapVolumeSource{
-						LocalObjectReference: v1.LocalObjectReference{
-							Name: fmt.Sprintf("%s-generate-tls-artifacts-sh", c.instance),
-						},
-						DefaultMode: &defaultMode,
-					},
-				},
-			},
-			{
-				Name: "generate-nodetool-ssl-properties",
-				VolumeSource: v1.VolumeSource{
-					ConfigMap: &v1.ConfigMapVolumeSource{
-						LocalObjectReference: v1.LocalObjectReference{
-							Name: fmt.Sprintf("%s-generate-nodetool-ssl-properties", c.instance),
-						},
-						DefaultMode: &defaultMode,
-					},
-				},
-			},
 			{
 				Name: "dot-cassandra",
 				VolumeSource: v1.VolumeSource{
@@ -139,7 +118,7 @@ func (c *Executor) Run(arguments ...string) (string, string, error) {
 			Containers: []v1.Container{
 				{
 					Name:  "nodetool",
-					Image: "cassandra:3.11.6",
+					Image: image,
 					Command: []string{
 						"bash",
 						"-c",
@@ -147,6 +126,7 @@ func (c *Executor) Run(arguments ...string) (string, string, error) {
 					Args: []string{
 						args,
 					},
+					Env:          env,
 					VolumeMounts: volumeMounts,
 				},
 			},
@@ -176,7 +156,7 @@ func (c *Executor) Run(arguments ...string) (string, string, error) {
 		}
 	}
 
-	// The generate-tls-artifacts.sh takes time to execute in the container.
+	// Generating the TLS artifacts takes time in the container.
 	// Waiting for it to complete before exec-ing in the container
 	fmt.Printf("Waiting 10 secs for pod %s to initialize", pod.Name)
 	time.Sleep(10 * time.Second)
@@ -196,3 +176,21 @@ func (c *Executor) Run(arguments ...string) (string, string, error) {
 
 	return stdOut.String(), stdErr.String(), err
 }
+
+// nodeImage returns the image of the cassandra container of the instance pods
+func (c *Executor) nodeImage() (string, error) {
+	pods, err := c.client.Kubernetes.CoreV1().Pods(c.namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=%s", c.instance),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get the node image: %v", err)
+	}
+	for _, pod := range pods.Items {
+		for _, container := range pod.Spec.Containers {
+			if container.Name == "cassandra" {
+				return container.Image, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("failed to get the node image: no cassandra pod found for instance %s", c.instance)
+}
@@ -7,6 +7,7 @@ require (
 	github.com/google/uuid v1.1.1
 	github.com/kudobuilder/kudo v0.17.4
 	github.com/kudobuilder/test-tools v0.8.0
+	github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup v0.0.0
 	github.com/onsi/ginkgo v1.14.1
 	github.com/onsi/gomega v1.10.2
 	github.com/sirupsen/logrus v1.6.0
@@ -16,3 +17,5 @@ require (
 	k8s.io/api v0.19.3
 	k8s.io/apimachinery v0.19.3
 )
+
+replace github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup => ../images/backup
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
+)
+
+// DeleteFolder deletes all objects with the prefix from the backup storage. It uses the storage backends of the
+// backup image, so the test suites can clean up every storage that the operator supports.
+func DeleteFolder(config storage.Config, folderName string) error {
+	s, err := storage.New(config)
+	if err != nil {
+		return fmt.Errorf("failed to open backup storage: %v", err)
+	}
+	objects, err := s.List(folderName)
+	if err != nil {
+		return fmt.Errorf("failed to list bucket contents: %v", err)
+	}
+
+	fmt.Printf("Found %d items with prefix %s in bucket %s\n", len(objects), folderName, config.Bucket)
+
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = o.Key
+	}
+	if err := s.Delete(keys...); err != nil {
+		return fmt.Errorf("failed to delete bucket entries: %v", err)
+	}
+
+	fmt.Printf("Deleted %d items with prefix %s in bucket %s\n", len(keys), folderName, config.Bucket)
+
+	return nil
+}
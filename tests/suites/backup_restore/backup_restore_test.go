@@ -2,7 +2,9 @@ package external_service
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -15,8 +17,9 @@ import (
 	"github.com/kudobuilder/test-tools/pkg/kubernetes"
 	"github.com/kudobuilder/test-tools/pkg/kudo"
 	"github.com/kudobuilder/test-tools/pkg/tls"
-	"github.com/mesosphere/kudo-cassandra-operator/tests/aws"
+	backup "github.com/mesosphere/kudo-cassandra-operator/images/cassandra-backup/pkg/storage"
 	"github.com/mesosphere/kudo-cassandra-operator/tests/cassandra"
+	"github.com/mesosphere/kudo-cassandra-operator/tests/storage"
 	"github.com/mesosphere/kudo-cassandra-operator/tests/suites"
 	. "github.com/onsi/ginkgo"
 	"github.com/onsi/ginkgo/reporters"
@@ -28,6 +31,12 @@ import (
 // source ../scripts/export_maws.sh
 // ./run.sh backup_restore
 //
+// Another backup storage is selected with BACKUP_STORAGE_PROVIDER and BACKUP_STORAGE_BUCKET. An 's3_compatible'
+// storage also needs BACKUP_STORAGE_HOST and optionally BACKUP_STORAGE_PORT and BACKUP_STORAGE_SECURE, GCS and Azure
+// Blob need the credentials in the file BACKUP_STORAGE_CREDENTIALS_FILE. A 'local' storage needs no cloud access: it
+// needs a ReadWriteMany claim BACKUP_STORAGE_LOCAL_CLAIM in the test namespace, and the directory
+// BACKUP_STORAGE_LOCAL_PATH in which the test machine reaches the volume of the claim.
+//
 // Additionally, you can export LOCAL_CLUSTER=true to only use very limited resources
 //
 // When running these tests locall, it helps to pre-load the required images with kind load docker-image <image-name>
@@ -46,12 +55,14 @@ var (
 	Client    = client.Client{}
 	Operator  = kudo.Operator{}
 
-	BackupBucket    = "kudo-cassandra-backup-test"
+	BackupStorage   = backupStorageFromEnv()
 	BackupPrefix    = uuid.New().String()
 	BackupPrefixTls = uuid.New().String()
 	BackupName      = "first"
+	// BackupLocalClaim is the volume of a 'local' backup storage, the test machine reaches it in BasePath.
+	BackupLocalClaim = os.Getenv("BACKUP_STORAGE_LOCAL_CLAIM")
 
-	AwsSecretName string
+	StorageSecretName string
 
 	Secret     *kubernetes.Secret
 	TlsSecret  *kubernetes.Secret
@@ -94,7 +105,7 @@ var _ = BeforeSuite(func() {
 		fmt.Printf("Failed to create namespace: %v\n", err)
 	}
 
-	AwsSecretName = createAwsCredentials()
+	StorageSecretName = createStorageCredentials()
 })
 
 var _ = AfterSuite(func() {
@@ -107,7 +118,7 @@ var _ = AfterSuite(func() {
 
 	if Secret != nil {
 		if err := Secret.Delete(); err != nil {
-			fmt.Printf("Error while deleting AWS secret")
+			fmt.Printf("Error while deleting storage secret")
 		}
 	}
 	if TlsSecret != nil {
@@ -121,11 +132,11 @@ var _ = AfterSuite(func() {
 		}
 	}
 
-	if err := aws.DeleteFolderInS3(BackupBucket, BackupPrefix); err != nil {
-		fmt.Printf("Error while cleaning up S3 bucket for non-tls: %v\n", err)
+	if err := storage.DeleteFolder(BackupStorage, BackupPrefix); err != nil {
+		fmt.Printf("Error while cleaning up backup bucket for non-tls: %v\n", err)
 	}
-	if err := aws.DeleteFolderInS3(BackupBucket, BackupPrefixTls); err != nil {
-		fmt.Printf("Error while cleaning up S3 bucket for tls: %v\n", err)
+	if err := storage.DeleteFolder(BackupStorage, BackupPrefixTls); err != nil {
+		fmt.Printf("Error while cleaning up backup bucket for tls: %v\n", err)
 	}
 })
 
@@ -170,33 +181,94 @@ func createAuthSecret() string {
 	return secretName
 }
 
-func createAwsCredentials() string {
-	awsSecretName := "aws-credentials"
+// backupStorageFromEnv returns the backup storage of the tests, by default the S3 bucket kudo-cassandra-backup-test.
+func backupStorageFromEnv() backup.Config {
+	config := backup.Config{
+		Provider: getEnv("BACKUP_STORAGE_PROVIDER", "s3_us_west_oregon"),
+		Bucket:   getEnv("BACKUP_STORAGE_BUCKET", "kudo-cassandra-backup-test"),
+		Host:     os.Getenv("BACKUP_STORAGE_HOST"),
+		Port:     os.Getenv("BACKUP_STORAGE_PORT"),
+		Secure:   getEnv("BACKUP_STORAGE_SECURE", "true") == "true",
+		Region:   os.Getenv("BACKUP_STORAGE_REGION"),
+	}
+	if config.Provider == "local" {
+		// The backup jobs mount the claim and use a directory per bucket, see LOCAL_PATH in the operator templates
+		path := os.Getenv("BACKUP_STORAGE_LOCAL_PATH")
+		if path == "" || os.Getenv("BACKUP_STORAGE_LOCAL_CLAIM") == "" {
+			panic("BACKUP_STORAGE_LOCAL_PATH and BACKUP_STORAGE_LOCAL_CLAIM are required for the local backup storage")
+		}
+		config.BasePath = filepath.Join(path, config.Bucket)
+	}
+	if path := os.Getenv("BACKUP_STORAGE_CREDENTIALS_FILE"); path != "" {
+		credentials, err := ioutil.ReadFile(path)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to read backup storage credentials: %v", err))
+		}
+		config.Credentials = credentials
+	}
+	return config
+}
 
-	awsAccessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-	awsSecretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	awsSecurityToken := os.Getenv("AWS_SECURITY_TOKEN")
+func getEnv(name, defaultValue string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return defaultValue
+}
 
-	if awsAccessKey == "" || awsSecretKey == "" {
-		Fail("No AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY defined. These are required for backup to AWS S3")
+// setStorageParameters adds the endpoint of an S3 compatible backup storage, or the volume of a local backup storage,
+// to the parameters.
+func setStorageParameters(parameters map[string]string) {
+	if BackupStorage.Provider == "local" {
+		parameters["BACKUP_STORAGE_LOCAL_CLAIM"] = BackupLocalClaim
+		return
+	}
+	if BackupStorage.Provider != "s3_compatible" {
+		return
 	}
+	parameters["BACKUP_STORAGE_HOST"] = BackupStorage.Host
+	parameters["BACKUP_STORAGE_PORT"] = BackupStorage.Port
+	parameters["BACKUP_STORAGE_SECURE"] = strconv.FormatBool(BackupStorage.Secure)
+	parameters["BACKUP_STORAGE_REGION"] = BackupStorage.Region
+}
+
+func createStorageCredentials() string {
+	storageSecretName := "backup-storage-credentials"
 
-	awsCredentials := make(map[string]string, 2)
-	awsCredentials["access-key"] = awsAccessKey
-	awsCredentials["secret-key"] = awsSecretKey
-	if awsSecurityToken != "" {
-		awsCredentials["security-token"] = awsSecurityToken
+	storageCredentials := make(map[string]string, 3)
+	switch BackupStorage.Provider {
+	case "local":
+		// The local storage needs no credentials, the jobs ignore the missing keys
+	case "google_storage", "azure_blobs":
+		if len(BackupStorage.Credentials) == 0 {
+			Fail(fmt.Sprintf("No BACKUP_STORAGE_CREDENTIALS_FILE defined. It is required for backup to %s", BackupStorage.Provider))
+		}
+		storageCredentials["credentials.json"] = string(BackupStorage.Credentials)
+	default:
+		awsAccessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+		awsSecretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+		awsSecurityToken := os.Getenv("AWS_SECURITY_TOKEN")
+
+		if awsAccessKey == "" || awsSecretKey == "" {
+			Fail("No AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY defined. These are required for backup to S3")
+		}
+
+		storageCredentials["access-key"] = awsAccessKey
+		storageCredentials["secret-key"] = awsSecretKey
+		if awsSecurityToken != "" {
+			storageCredentials["security-token"] = awsSecurityToken
+		}
 	}
 
-	By("Creating a aws-credentials secret")
-	awsSecret, err := kubernetes.CreateSecret(awsSecretName).
+	By("Creating a backup-storage-credentials secret")
+	storageSecret, err := kubernetes.CreateSecret(storageSecretName).
 		WithNamespace(TestNamespace).
-		WithStringData(awsCredentials).Do(Client)
+		WithStringData(storageCredentials).Do(Client)
 
 	Expect(err).NotTo(HaveOccurred())
 
-	Secret = &awsSecret
-	return awsSecretName
+	Secret = &storageSecret
+	return storageSecretName
 }
 
 var _ = Describe("backup and restore", func() {
@@ -208,10 +280,11 @@ var _ = Describe("backup and restore", func() {
 			"NODE_COUNT":                             strconv.Itoa(NodeCount),
 			"JMX_LOCAL_ONLY":                         "true",
 			"BACKUP_RESTORE_ENABLED":                 "true",
-			"BACKUP_AWS_CREDENTIALS_SECRET":          AwsSecretName,
+			"BACKUP_STORAGE_CREDENTIALS_SECRET":      StorageSecretName,
 			"BACKUP_PREFIX":                          BackupPrefix,
 			"BACKUP_NAME":                            BackupName,
-			"BACKUP_AWS_S3_BUCKET_NAME":              BackupBucket,
+			"BACKUP_STORAGE_PROVIDER":                BackupStorage.Provider,
+			"BACKUP_STORAGE_BUCKET":                  BackupStorage.Bucket,
 			"POD_MANAGEMENT_POLICY":                  "OrderedReady",
 			"NODE_READINESS_PROBE_INITIAL_DELAY_S":   "30",
 			"NODE_READINESS_PROBE_PERIOD_S":          "10",
@@ -220,6 +293,7 @@ var _ = Describe("backup and restore", func() {
 			"NODE_LIVENESS_PROBE_FAILURE_THRESHOLD":  "6",
 		}
 		suites.SetSuitesParameters(parameters)
+		setStorageParameters(parameters)
 
 		By("Installing the operator from current directory")
 		Operator, err = kudo.InstallOperator(OperatorDirectory).
@@ -267,10 +341,11 @@ var _ = Describe("backup and restore", func() {
 			"NODE_COUNT":                             strconv.Itoa(NodeCount),
 			"JMX_LOCAL_ONLY":                         "true",
 			"BACKUP_RESTORE_ENABLED":                 "true",
-			"BACKUP_AWS_CREDENTIALS_SECRET":          AwsSecretName,
+			"BACKUP_STORAGE_CREDENTIALS_SECRET":      StorageSecretName,
 			"BACKUP_PREFIX":                          BackupPrefix,
 			"BACKUP_NAME":                            BackupName,
-			"BACKUP_AWS_S3_BUCKET_NAME":              BackupBucket,
+			"BACKUP_STORAGE_PROVIDER":                BackupStorage.Provider,
+			"BACKUP_STORAGE_BUCKET":                  BackupStorage.Bucket,
 			"RESTORE_FLAG":                           "true",
 			"RESTORE_OLD_NAMESPACE":                  TestNamespace,
 			"RESTORE_OLD_NAME":                       TestInstance,
@@ -282,6 +357,7 @@ var _ = Describe("backup and restore", func() {
 			"NODE_LIVENESS_PROBE_FAILURE_THRESHOLD":  "6",
 		}
 		suites.SetSuitesParameters(parameters)
+		setStorageParameters(parameters)
 
 		Operator, err = kudo.InstallOperator(OperatorDirectory).
 			WithNamespace(TestNamespace).
@@ -312,6 +388,7 @@ var _ = Describe("backup and restore", func() {
 			"NODE_READINESS_PROBE_INITIAL_DELAY_S": "10",
 		}
 		suites.SetSuitesParameters(parameters)
+		setStorageParameters(parameters)
 
 		err = Operator.Instance.UpdateParameters(parameters)
 
@@ -351,10 +428,11 @@ var _ = Describe("backup and restore", func() {
 			"JMX_LOCAL_ONLY":                         "false",
 			"TLS_SECRET_NAME":                        tlsSecretName,
 			"BACKUP_RESTORE_ENABLED":                 "true",
-			"BACKUP_AWS_CREDENTIALS_SECRET":          AwsSecretName,
+			"BACKUP_STORAGE_CREDENTIALS_SECRET":      StorageSecretName,
 			"BACKUP_PREFIX":                          BackupPrefixTls,
 			"BACKUP_NAME":                            BackupName,
-			"BACKUP_AWS_S3_BUCKET_NAME":              BackupBucket,
+			"BACKUP_STORAGE_PROVIDER":                BackupStorage.Provider,
+			"BACKUP_STORAGE_BUCKET":                  BackupStorage.Bucket,
 			"POD_MANAGEMENT_POLICY":                  "Parallel",
 			"NODE_READINESS_PROBE_INITIAL_DELAY_S":   "30",
 			"NODE_READINESS_PROBE_PERIOD_S":          "10",
@@ -363,6 +441,7 @@ var _ = Describe("backup and restore", func() {
 			"NODE_LIVENESS_PROBE_FAILURE_THRESHOLD":  "6",
 		}
 		suites.SetSuitesParameters(parameters)
+		setStorageParameters(parameters)
 
 		By("Installing the operator from current directory")
 		Operator, err = kudo.InstallOperator(OperatorDirectory).
@@ -413,10 +492,11 @@ var _ = Describe("backup and restore", func() {
 			"JMX_LOCAL_ONLY":                         "false",
 			"TLS_SECRET_NAME":                        tlsSecretName,
 			"BACKUP_RESTORE_ENABLED":                 "true",
-			"BACKUP_AWS_CREDENTIALS_SECRET":          AwsSecretName,
+			"BACKUP_STORAGE_CREDENTIALS_SECRET":      StorageSecretName,
 			"BACKUP_PREFIX":                          BackupPrefixTls,
 			"BACKUP_NAME":                            BackupName,
-			"BACKUP_AWS_S3_BUCKET_NAME":              BackupBucket,
+			"BACKUP_STORAGE_PROVIDER":                BackupStorage.Provider,
+			"BACKUP_STORAGE_BUCKET":                  BackupStorage.Bucket,
 			"RESTORE_FLAG":                           "true",
 			"RESTORE_OLD_NAMESPACE":                  TestNamespace,
 			"RESTORE_OLD_NAME":                       TestInstance,
@@ -428,6 +508,7 @@ var _ = Describe("backup and restore", func() {
 			"NODE_LIVENESS_PROBE_FAILURE_THRESHOLD":  "6",
 		}
 		suites.SetSuitesParameters(parameters)
+		setStorageParameters(parameters)
 
 		Operator, err = kudo.InstallOperator(OperatorDirectory).
 			WithNamespace(TestNamespace).